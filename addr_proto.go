@@ -1,5 +1,7 @@
 package proxyproto
 
+import "fmt"
+
 // AddressFamilyAndProtocol represents address family and transport protocol.
 type AddressFamilyAndProtocol byte
 
@@ -13,6 +15,57 @@ const (
 	UnixDatagram AddressFamilyAndProtocol = '\x32'
 )
 
+// supportedTransportProtocols are the address families and transport protocols
+// supported by this library.
+var supportedTransportProtocols = []AddressFamilyAndProtocol{
+	UNSPEC,
+	TCPv4,
+	UDPv4,
+	TCPv6,
+	UDPv6,
+	UnixStream,
+	UnixDatagram,
+}
+
+// SupportedTransportProtocols returns the address families and transport
+// protocols supported by this library, including UNSPEC. The returned slice is
+// a copy and may be modified.
+func SupportedTransportProtocols() []AddressFamilyAndProtocol {
+	return append([]AddressFamilyAndProtocol{}, supportedTransportProtocols...)
+}
+
+// IsSupported returns true if the address family and transport protocol is
+// supported by this library, see SupportedTransportProtocols, false otherwise.
+func (ap AddressFamilyAndProtocol) IsSupported() bool {
+	for _, supported := range supportedTransportProtocols {
+		if ap == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the name of the address family and protocol, e.g. "TCPv4".
+func (ap AddressFamilyAndProtocol) String() string {
+	switch ap {
+	case UNSPEC:
+		return "UNSPEC"
+	case TCPv4:
+		return "TCPv4"
+	case UDPv4:
+		return "UDPv4"
+	case TCPv6:
+		return "TCPv6"
+	case UDPv6:
+		return "UDPv6"
+	case UnixStream:
+		return "UnixStream"
+	case UnixDatagram:
+		return "UnixDatagram"
+	}
+	return fmt.Sprintf("AddressFamilyAndProtocol(%#02x)", byte(ap))
+}
+
 // IsIPv4 returns true if the address family is IPv4 (AF_INET4), false otherwise.
 func (ap AddressFamilyAndProtocol) IsIPv4() bool {
 	return ap&0xF0 == 0x10
@@ -91,3 +91,39 @@ func TestInvalidAddressFamilyAndProtocol(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestAddressFamilyAndProtocolString(t *testing.T) {
+	for ap, expected := range map[AddressFamilyAndProtocol]string{
+		UNSPEC:       "UNSPEC",
+		TCPv4:        "TCPv4",
+		UDPv4:        "UDPv4",
+		TCPv6:        "TCPv6",
+		UDPv6:        "UDPv6",
+		UnixStream:   "UnixStream",
+		UnixDatagram: "UnixDatagram",
+		0x15:         "AddressFamilyAndProtocol(0x15)",
+	} {
+		if s := ap.String(); s != expected {
+			t.Fatalf("expected %q, got %q", expected, s)
+		}
+	}
+}
+
+func TestAddressFamilyAndProtocolIsSupported(t *testing.T) {
+	for _, ap := range SupportedTransportProtocols() {
+		if !ap.IsSupported() {
+			t.Fatalf("expected %v to be supported", ap)
+		}
+	}
+	for _, ap := range []AddressFamilyAndProtocol{0x01, 0x10, 0x15, 0x41} {
+		if ap.IsSupported() {
+			t.Fatalf("expected %v to be unsupported", ap)
+		}
+	}
+
+	protocols := SupportedTransportProtocols()
+	protocols[0] = 0x15
+	if !UNSPEC.IsSupported() {
+		t.Fatalf("modifying SupportedTransportProtocols shouldn't change the supported protocols")
+	}
+}
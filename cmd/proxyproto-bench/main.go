@@ -0,0 +1,161 @@
+// Command proxyproto-bench load-tests PROXY protocol aware servers: it opens
+// connections to a target at a given rate, sends a header on each one,
+// optionally followed by a payload, and reports how connections fared.
+//
+//	proxyproto-bench -target 127.0.0.1:8080 -rate 500 -duration 30s -version 2 -tlv-size 64
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	proxyproto "github.com/pires/go-proxyproto"
+)
+
+type result struct {
+	latency time.Duration
+	err     error
+}
+
+func main() {
+	target := flag.String("target", "", "address of the server to load-test")
+	rate := flag.Int("rate", 100, "connections opened per second")
+	duration := flag.Duration("duration", 10*time.Second, "how long to open connections for")
+	version := flag.Int("version", 2, "version of the headers, 1 or 2")
+	tlvSize := flag.Int("tlv-size", 0, "size in bytes of a random PP2_TYPE_UNIQUE_ID TLV added to v2 headers, 0 for none")
+	padTo := flag.Int("pad-to", 0, "pad v2 headers to this total length with a NOOP TLV, 0 for none")
+	payload := flag.String("payload", "", "payload sent after the header")
+	readResponse := flag.Bool("read", false, "wait for the server to send data before closing connections")
+	timeout := flag.Duration("timeout", 5*time.Second, "timeout of each connection")
+	flag.Parse()
+
+	if *target == "" || *rate <= 0 {
+		fmt.Fprintln(os.Stderr, "proxyproto-bench: -target and a positive -rate are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *version != 1 && *version != 2 {
+		log.Fatalf("proxyproto-bench: invalid version %d", *version)
+	}
+
+	var mu sync.Mutex
+	var results []result
+	var wg sync.WaitGroup
+
+	ticker := time.NewTicker(time.Second / time.Duration(*rate))
+	defer ticker.Stop()
+	start := time.Now()
+	for i := 0; time.Since(start) < *duration; i++ {
+		<-ticker.C
+
+		header, err := newHeader(byte(*version), i, *tlvSize, *padTo)
+		if err != nil {
+			log.Fatalf("proxyproto-bench: %v", err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := run(*target, header, []byte(*payload), *readResponse, *timeout)
+			mu.Lock()
+			results = append(results, r)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	report(os.Stdout, results, time.Since(start))
+}
+
+// newHeader returns the header of the i-th connection, each one having a
+// distinct source address.
+func newHeader(version byte, i, tlvSize, padTo int) (*proxyproto.Header, error) {
+	header := proxyproto.HeaderProxyFromAddrs(version,
+		&net.TCPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 1024 + i%64512},
+		&net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 443},
+	)
+	if version != 2 {
+		return header, nil
+	}
+
+	if tlvSize > 0 {
+		value := make([]byte, tlvSize)
+		rand.Read(value)
+		if err := header.SetTLVs([]proxyproto.TLV{{Type: proxyproto.PP2_TYPE_UNIQUE_ID, Value: value}}); err != nil {
+			return nil, err
+		}
+	}
+	if padTo > 0 {
+		if err := header.PadTo(padTo); err != nil {
+			return nil, err
+		}
+	}
+	return header, nil
+}
+
+// run opens a connection, sends the header and payload, and optionally waits
+// for a response.
+func run(target string, header *proxyproto.Header, payload []byte, readResponse bool, timeout time.Duration) result {
+	start := time.Now()
+
+	conn, err := net.DialTimeout("tcp", target, timeout)
+	if err != nil {
+		return result{err: err}
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(start.Add(timeout)); err != nil {
+		return result{err: err}
+	}
+	if _, err := header.WriteTo(conn); err != nil {
+		return result{err: err}
+	}
+	if len(payload) > 0 {
+		if _, err := conn.Write(payload); err != nil {
+			return result{err: err}
+		}
+	}
+	if readResponse {
+		if _, err := conn.Read(make([]byte, 1)); err != nil && err != io.EOF {
+			return result{err: err}
+		}
+	}
+
+	return result{latency: time.Since(start)}
+}
+
+func report(w io.Writer, results []result, elapsed time.Duration) {
+	var latencies []time.Duration
+	errs := make(map[string]int)
+	for _, r := range results {
+		if r.err != nil {
+			errs[r.err.Error()]++
+			continue
+		}
+		latencies = append(latencies, r.latency)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	fmt.Fprintf(w, "connections: %d in %s (%.1f/s)\n", len(results), elapsed.Round(time.Millisecond), float64(len(results))/elapsed.Seconds())
+	fmt.Fprintf(w, "succeeded:   %d\n", len(latencies))
+	fmt.Fprintf(w, "failed:      %d\n", len(results)-len(latencies))
+	for err, n := range errs {
+		fmt.Fprintf(w, "  %d x %s\n", n, err)
+	}
+	if len(latencies) > 0 {
+		fmt.Fprintf(w, "latency:     p50 %s, p90 %s, p99 %s, max %s\n",
+			percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), latencies[len(latencies)-1])
+	}
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	return sorted[(len(sorted)-1)*p/100]
+}
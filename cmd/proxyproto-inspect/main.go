@@ -0,0 +1,167 @@
+// Command proxyproto-inspect decodes a PROXY protocol header and prints an
+// annotated description of it: version, command, address family, addresses
+// and every TLV, with the names of known vendor TLVs.
+//
+// The header is read from stdin by default, from a file with -file, or from a
+// hex string or hex dump with -hex, e.g. the output of xxd, hexdump -C or
+// tcpdump -X, see proxyproto.DecodeHexDump:
+//
+//	proxyproto-inspect -hex '0d0a0d0a000d0a515549540a2011000c...'
+//	proxyproto-inspect -hex "$(xxd header.bin)"
+//	printf 'PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n' | proxyproto-inspect
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	proxyproto "github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/tlvparse"
+)
+
+var tlvNames = map[proxyproto.PP2Type]string{
+	proxyproto.PP2_TYPE_ALPN:           "ALPN",
+	proxyproto.PP2_TYPE_AUTHORITY:      "AUTHORITY",
+	proxyproto.PP2_TYPE_CRC32C:         "CRC32C",
+	proxyproto.PP2_TYPE_NOOP:           "NOOP",
+	proxyproto.PP2_TYPE_UNIQUE_ID:      "UNIQUE_ID",
+	proxyproto.PP2_TYPE_SSL:            "SSL",
+	proxyproto.PP2_SUBTYPE_SSL_VERSION: "SSL_VERSION",
+	proxyproto.PP2_SUBTYPE_SSL_CN:      "SSL_CN",
+	proxyproto.PP2_SUBTYPE_SSL_CIPHER:  "SSL_CIPHER",
+	proxyproto.PP2_SUBTYPE_SSL_SIG_ALG: "SSL_SIG_ALG",
+	proxyproto.PP2_SUBTYPE_SSL_KEY_ALG: "SSL_KEY_ALG",
+	proxyproto.PP2_TYPE_NETNS:          "NETNS",
+	tlvparse.PP2_TYPE_GCP:              "GCP",
+	tlvparse.PP2_TYPE_AWS:              "AWS",
+	tlvparse.PP2_TYPE_AZURE:            "AZURE",
+}
+
+func main() {
+	hexInput := flag.String("hex", "", "header as a hex string or hex dump, e.g. from xxd, hexdump -C or tcpdump -X")
+	file := flag.String("file", "", "file to read the header from, instead of stdin")
+	flag.Parse()
+
+	if *hexInput != "" {
+		header, err := proxyproto.DecodeHexDump(*hexInput)
+		if err != nil {
+			log.Fatalf("proxyproto-inspect: %v", err)
+		}
+		// Dumps may include bytes before and after the header, only its
+		// own length is known.
+		buf, err := header.Format()
+		if err != nil {
+			log.Fatalf("proxyproto-inspect: %v", err)
+		}
+		inspect(os.Stdout, header, len(buf), -1)
+		return
+	}
+
+	b, err := readInput(*file)
+	if err != nil {
+		log.Fatalf("proxyproto-inspect: %v", err)
+	}
+
+	header, n, err := proxyproto.Parse(b)
+	if err != nil {
+		log.Fatalf("proxyproto-inspect: %v", err)
+	}
+
+	inspect(os.Stdout, header, n, len(b)-n)
+}
+
+func readInput(file string) ([]byte, error) {
+	if file != "" {
+		return os.ReadFile(file)
+	}
+	return io.ReadAll(os.Stdin)
+}
+
+// inspect prints the description of header, payloadLen being negative if the
+// number of bytes following the header is unknown.
+func inspect(w io.Writer, header *proxyproto.Header, headerLen, payloadLen int) {
+	fmt.Fprintf(w, "version:      %d\n", header.Version)
+	if payloadLen < 0 {
+		fmt.Fprintf(w, "length:       %d bytes\n", headerLen)
+	} else {
+		fmt.Fprintf(w, "length:       %d bytes, followed by %d bytes of payload\n", headerLen, payloadLen)
+	}
+	fmt.Fprintf(w, "command:      %s (%#02x)\n", header.Command, byte(header.Command))
+	fmt.Fprintf(w, "transport:    %s (%#02x)\n", header.TransportProtocol, byte(header.TransportProtocol))
+	if header.SourceAddr != nil {
+		fmt.Fprintf(w, "source:       %s\n", header.SourceAddr)
+	}
+	if header.DestinationAddr != nil {
+		fmt.Fprintf(w, "destination:  %s\n", header.DestinationAddr)
+	}
+	if header.Version != 2 {
+		return
+	}
+
+	if _, ok := header.TLV(proxyproto.PP2_TYPE_CRC32C); ok {
+		if err := proxyproto.RequireCRC32c(header); err != nil {
+			fmt.Fprintf(w, "checksum:     %v\n", err)
+		} else {
+			fmt.Fprintln(w, "checksum:     valid")
+		}
+	}
+
+	fmt.Fprintln(w, "TLVs:")
+	if err := header.IterateTLVs(func(tlv proxyproto.TLV) bool {
+		fmt.Fprintf(w, "  %#02x %s, %d bytes: %s\n", byte(tlv.Type), name(tlvNames[tlv.Type]), len(tlv.Value), describeTLV(tlv))
+		return true
+	}); err != nil {
+		fmt.Fprintf(w, "  %v\n", err)
+	}
+
+	// Vendors share the custom TLV types, warn about ambiguous values.
+	if tlvs, err := header.TLVs(); err == nil {
+		for _, collision := range tlvparse.DiagnoseTLVCollisions(tlvs) {
+			fmt.Fprintf(w, "warning:      %s\n", collision)
+		}
+	}
+}
+
+func name(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// describeTLV returns a human-readable description of the TLV's value.
+func describeTLV(tlv proxyproto.TLV) string {
+	switch tlv.Type {
+	case proxyproto.PP2_TYPE_ALPN, proxyproto.PP2_TYPE_AUTHORITY, proxyproto.PP2_TYPE_NETNS:
+		return fmt.Sprintf("%q", tlv.Value)
+	case proxyproto.PP2_TYPE_NOOP:
+		return "padding"
+	case proxyproto.PP2_TYPE_SSL:
+		ssl, err := tlvparse.SSL(tlv)
+		if err != nil {
+			return fmt.Sprintf("%v: %x", err, tlv.Value)
+		}
+		s := fmt.Sprintf("client SSL %t, cert conn %t, cert sess %t, verify %d", ssl.ClientSSL(), ssl.ClientCertConn(), ssl.ClientCertSess(), ssl.Verify)
+		for _, sub := range ssl.TLV {
+			s += fmt.Sprintf(", %s %q", name(tlvNames[sub.Type]), sub.Value)
+		}
+		return s
+	case tlvparse.PP2_TYPE_AWS:
+		if id, err := tlvparse.AWSVPCEndpointID(tlv); err == nil {
+			return "VPC endpoint ID " + id
+		}
+	case tlvparse.PP2_TYPE_AZURE:
+		if id, ok := tlvparse.FindAzurePrivateEndpointLinkID([]proxyproto.TLV{tlv}); ok {
+			return fmt.Sprintf("private endpoint link ID %d", id)
+		}
+	case tlvparse.PP2_TYPE_GCP:
+		if id, ok := tlvparse.ExtractPSCConnectionID([]proxyproto.TLV{tlv}); ok {
+			return fmt.Sprintf("PSC connection ID %d", id)
+		}
+	}
+	return hex.EncodeToString(tlv.Value)
+}
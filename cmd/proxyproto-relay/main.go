@@ -0,0 +1,176 @@
+// Command proxyproto-relay relays TCP connections from a listen address to a
+// backend, adding, stripping or passing through PROXY protocol headers.
+//
+// Usage:
+//
+//	proxyproto-relay -listen :8080 -backend 127.0.0.1:9090 -mode add -version 2
+//
+// Modes:
+//
+//	add       clients don't send headers, a header is sent to the backend
+//	strip     clients send headers, which aren't forwarded to the backend
+//	pass      clients send headers, which are forwarded to the backend as is
+//	verbatim  like pass, but the exact bytes received are forwarded instead of
+//	          formatting the parsed headers again
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	proxyproto "github.com/pires/go-proxyproto"
+)
+
+func main() {
+	listenAddr := flag.String("listen", "127.0.0.1:8080", "address to listen on")
+	backendAddr := flag.String("backend", "", "address of the backend to relay to")
+	mode := flag.String("mode", "pass", "add, strip, pass or verbatim")
+	version := flag.Int("version", 2, "version of the headers sent in add mode, 1 or 2")
+	policy := flag.String("policy", "use", "policy applied to clients' headers in strip, pass and verbatim modes: use, require, ignore or reject")
+	headerTimeout := flag.Duration("header-timeout", proxyproto.DefaultReadHeaderTimeout, "how long to wait for clients' headers")
+	dialTimeout := flag.Duration("dial-timeout", 5*time.Second, "how long to wait for connections to the backend")
+	flag.Parse()
+
+	if *backendAddr == "" {
+		fmt.Fprintln(os.Stderr, "proxyproto-relay: -backend is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *version != 1 && *version != 2 {
+		log.Fatalf("proxyproto-relay: invalid version %d", *version)
+	}
+	clientPolicy, err := parsePolicy(*policy)
+	if err != nil {
+		log.Fatalf("proxyproto-relay: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		log.Fatalf("proxyproto-relay: %v", err)
+	}
+
+	switch *mode {
+	case "add":
+	case "strip", "pass", "verbatim":
+		ln = &proxyproto.Listener{
+			Listener:          ln,
+			ReadHeaderTimeout: *headerTimeout,
+			RecordHeader:      *mode == "verbatim",
+			Policy: func(net.Addr) (proxyproto.Policy, error) {
+				return clientPolicy, nil
+			},
+		}
+	default:
+		log.Fatalf("proxyproto-relay: invalid mode %q", *mode)
+	}
+	defer ln.Close()
+
+	log.Printf("relaying %s to %s in %s mode", ln.Addr(), *backendAddr, *mode)
+	for {
+		conn, err := ln.Accept()
+		var acceptErr *proxyproto.AcceptError
+		if errors.As(err, &acceptErr) && acceptErr.Temporary() {
+			log.Printf("proxyproto-relay: %v", err)
+			continue
+		} else if err != nil {
+			log.Fatalf("proxyproto-relay: %v", err)
+		}
+
+		go func() {
+			if err := relay(conn, *backendAddr, *mode, byte(*version), *dialTimeout); err != nil {
+				log.Printf("%s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func parsePolicy(name string) (proxyproto.Policy, error) {
+	switch strings.ToLower(name) {
+	case "use":
+		return proxyproto.USE, nil
+	case "require":
+		return proxyproto.REQUIRE, nil
+	case "ignore":
+		return proxyproto.IGNORE, nil
+	case "reject":
+		return proxyproto.REJECT, nil
+	default:
+		return 0, fmt.Errorf("invalid policy %q", name)
+	}
+}
+
+// relay dials the backend, sends it the header required by mode, and copies
+// data in both directions until both sides are done.
+func relay(conn net.Conn, backendAddr, mode string, version byte, dialTimeout time.Duration) error {
+	defer conn.Close()
+
+	var header *proxyproto.Header
+	switch mode {
+	case "add":
+		header = proxyproto.HeaderProxyFromAddrs(version, conn.RemoteAddr(), conn.LocalAddr())
+	case "pass", "verbatim":
+		// Reading the header may fail, e.g. if it's required but missing.
+		pc := conn.(*proxyproto.Conn)
+		if err := pc.HeaderError(); err != nil {
+			return err
+		}
+		if mode == "pass" {
+			header = pc.ProxyHeader()
+		}
+	}
+
+	backend, err := net.DialTimeout("tcp", backendAddr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	if header != nil {
+		if _, err := header.WriteTo(backend); err != nil {
+			return err
+		}
+	}
+	if mode == "verbatim" {
+		if _, err := conn.(*proxyproto.Conn).WriteRawHeaderTo(backend); err != nil {
+			return err
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		pipe(backend, conn)
+	}()
+	go func() {
+		defer wg.Done()
+		pipe(conn, backend)
+	}()
+	wg.Wait()
+
+	return nil
+}
+
+// pipe copies src to dst, then closes the write side of dst so that the peer
+// sees EOF while the other direction keeps going.
+func pipe(dst, src net.Conn) {
+	_, _ = io.Copy(dst, src)
+
+	if tc, ok := dst.(interface{ CloseWrite() error }); ok {
+		_ = tc.CloseWrite()
+	} else if pc, ok := dst.(*proxyproto.Conn); ok {
+		if tcpConn, ok := pc.TCPConn(); ok {
+			_ = tcpConn.CloseWrite()
+		}
+	} else {
+		_ = dst.Close()
+	}
+}
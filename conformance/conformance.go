@@ -0,0 +1,358 @@
+// Package conformance provides canonical proxy protocol wire fixtures, valid
+// and invalid, along with the results expected from parsing them, including a
+// header captured from a real load balancer and synthetic examples of vendor
+// TLVs. They allow checking other
+// implementations, or integrations of this one, against the spec:
+// https://www.haproxy.org/download/2.3/doc/proxy-protocol.txt
+package conformance
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// Vector is a wire fixture along with the result expected from parsing it.
+type Vector struct {
+	Name string
+	// Wire is the fixture, as read from a connection. It may be followed by
+	// payload bytes, which must be left unread by the parser.
+	Wire []byte
+	// Header is the header expected from parsing Wire, nil if parsing must
+	// fail.
+	Header *proxyproto.Header
+	// TLVTypes are the types of the TLVs expected in Header, in order.
+	TLVTypes []proxyproto.PP2Type
+	// Err is the error expected from parsing Wire, nil if parsing must
+	// succeed.
+	Err error
+}
+
+// Check returns an error describing how the result of parsing the vector's
+// wire fixture differs from the expected one, or nil if it matches.
+func (v Vector) Check(header *proxyproto.Header, err error) error {
+	if v.Err != nil {
+		if !errors.Is(err, v.Err) {
+			return fmt.Errorf("conformance: %s: expected error %q, got %v", v.Name, v.Err, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("conformance: %s: unexpected error %q", v.Name, err)
+	}
+	if !header.EqualsTo(v.Header) {
+		return fmt.Errorf("conformance: %s: expected header %+v, got %+v", v.Name, v.Header, header)
+	}
+	tlvs, err := header.TLVs()
+	if err != nil {
+		return fmt.Errorf("conformance: %s: unexpected error splitting TLVs %q", v.Name, err)
+	}
+	if len(tlvs) != len(v.TLVTypes) {
+		return fmt.Errorf("conformance: %s: expected %d TLVs, got %d", v.Name, len(v.TLVTypes), len(tlvs))
+	}
+	for i, t := range v.TLVTypes {
+		if tlvs[i].Type != t {
+			return fmt.Errorf("conformance: %s: expected TLV %d of type %#x, got %#x", v.Name, i, t, tlvs[i].Type)
+		}
+	}
+	return nil
+}
+
+// Vectors returns all the vectors, valid ones first.
+func Vectors() []Vector {
+	return append(append([]Vector{}, Valid...), Invalid...)
+}
+
+// Valid are the vectors that must be parsed successfully.
+var Valid = []Vector{
+	{
+		Name:   "v1 TCP4",
+		Wire:   []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nGET / HTTP/1.1\r\n"),
+		Header: proxyHeader(1, proxyproto.TCPv4, tcpAddr("192.168.0.1", 56324), tcpAddr("192.168.0.11", 443)),
+	},
+	{
+		Name:   "v1 TCP6",
+		Wire:   []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"),
+		Header: proxyHeader(1, proxyproto.TCPv6, tcpAddr("2001:db8::1", 56324), tcpAddr("2001:db8::2", 443)),
+	},
+	{
+		Name:   "v1 UNKNOWN",
+		Wire:   []byte("PROXY UNKNOWN\r\n"),
+		Header: localHeader(1),
+	},
+	{
+		Name:   "v1 UNKNOWN with ignored addresses",
+		Wire:   []byte("PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n"),
+		Header: localHeader(1),
+	},
+	{
+		Name:   "v2 LOCAL",
+		Wire:   v2(0x20, 0x00, nil),
+		Header: localHeader(2),
+	},
+	{
+		Name:   "v2 TCP over IPv4",
+		Wire:   v2(0x21, 0x11, ipv4Payload("10.0.0.1", "10.0.0.2", 1000, 2000)),
+		Header: proxyHeader(2, proxyproto.TCPv4, tcpAddr("10.0.0.1", 1000), tcpAddr("10.0.0.2", 2000)),
+	},
+	{
+		Name:   "v2 UDP over IPv4",
+		Wire:   v2(0x21, 0x12, ipv4Payload("10.0.0.1", "10.0.0.2", 1000, 2000)),
+		Header: proxyHeader(2, proxyproto.UDPv4, udpAddr("10.0.0.1", 1000), udpAddr("10.0.0.2", 2000)),
+	},
+	{
+		Name:   "v2 TCP over IPv6",
+		Wire:   v2(0x21, 0x21, ipv6Payload("2001:db8::1", "2001:db8::2", 1000, 2000)),
+		Header: proxyHeader(2, proxyproto.TCPv6, tcpAddr("2001:db8::1", 1000), tcpAddr("2001:db8::2", 2000)),
+	},
+	{
+		Name: "v2 unix stream",
+		Wire: v2(0x21, 0x31, append(unixName("/var/run/src.sock"), unixName("/var/run/dst.sock")...)),
+		Header: proxyHeader(2, proxyproto.UnixStream,
+			&net.UnixAddr{Net: "unix", Name: "/var/run/src.sock"},
+			&net.UnixAddr{Net: "unix", Name: "/var/run/dst.sock"},
+		),
+	},
+	{
+		Name:     "v2 LOCAL with TLVs",
+		Wire:     v2(0x20, 0x00, tlv(proxyproto.PP2_TYPE_NOOP, make([]byte, 5))),
+		Header:   withTLVs(localHeader(2), tlv(proxyproto.PP2_TYPE_NOOP, make([]byte, 5))),
+		TLVTypes: []proxyproto.PP2Type{proxyproto.PP2_TYPE_NOOP},
+	},
+	{
+		Name: "v2 with authority and unique ID",
+		Wire: v2(0x21, 0x11, append(ipv4Payload("10.0.0.1", "10.0.0.2", 1000, 2000),
+			append(tlv(proxyproto.PP2_TYPE_AUTHORITY, []byte("example.org")), tlv(proxyproto.PP2_TYPE_UNIQUE_ID, []byte("id"))...)...)),
+		Header: withTLVs(proxyHeader(2, proxyproto.TCPv4, tcpAddr("10.0.0.1", 1000), tcpAddr("10.0.0.2", 2000)),
+			append(tlv(proxyproto.PP2_TYPE_AUTHORITY, []byte("example.org")), tlv(proxyproto.PP2_TYPE_UNIQUE_ID, []byte("id"))...)),
+		TLVTypes: []proxyproto.PP2Type{proxyproto.PP2_TYPE_AUTHORITY, proxyproto.PP2_TYPE_UNIQUE_ID},
+	},
+	{
+		// https://github.com/aws/elastic-load-balancing-tools/blob/c8eee30ab991ab4c57dc37d1c58f09f67bd534aa/proprot/tst/com/amazonaws/proprot/Compatibility_AwsNetworkLoadBalancerTest.java#L41..L67
+		Name:     "AWS NLB VPC endpoint",
+		Wire:     awsVPCE,
+		Header:   withTLVs(proxyHeader(2, proxyproto.TCPv4, tcpAddr("172.31.7.113", 51442), tcpAddr("172.31.10.31", 80)), awsVPCE[28:]),
+		TLVTypes: []proxyproto.PP2Type{proxyproto.PP2_TYPE_CRC32C, 0xEA, proxyproto.PP2_TYPE_NOOP},
+	},
+	{
+		Name:     "v2 TCP over IPv6 with CRC32c",
+		Wire:     crc32cV2,
+		Header:   withTLVs(proxyHeader(2, proxyproto.TCPv6, tcpAddr("2001:db8::1", 1000), tcpAddr("2001:db8::2", 2000)), crc32cV2[52:]),
+		TLVTypes: []proxyproto.PP2Type{proxyproto.PP2_TYPE_CRC32C},
+	},
+	{
+		Name:     "v2 with ALPN and SSL",
+		Wire:     v2(0x21, 0x11, append(ipv4Payload("10.0.0.1", "10.0.0.2", 1000, 443), sslTLVs...)),
+		Header:   withTLVs(proxyHeader(2, proxyproto.TCPv4, tcpAddr("10.0.0.1", 1000), tcpAddr("10.0.0.2", 443)), sslTLVs),
+		TLVTypes: []proxyproto.PP2Type{proxyproto.PP2_TYPE_ALPN, proxyproto.PP2_TYPE_SSL},
+	},
+	{
+		// Synthetic GCP Private Service Connect header, with a PSC
+		// connection ID TLV.
+		Name:     "GCP Private Service Connect",
+		Wire:     v2(0x21, 0x11, append(ipv4Payload("10.0.0.6", "10.0.0.7", 50000, 80), gcpPSCConnectionID...)),
+		Header:   withTLVs(proxyHeader(2, proxyproto.TCPv4, tcpAddr("10.0.0.6", 50000), tcpAddr("10.0.0.7", 80)), gcpPSCConnectionID),
+		TLVTypes: []proxyproto.PP2Type{0xE0},
+	},
+	{
+		// Synthetic Azure private link service header, with a private
+		// endpoint LINKID TLV.
+		Name:     "Azure private link",
+		Wire:     v2(0x21, 0x11, append(ipv4Payload("10.0.0.4", "10.0.0.5", 50000, 443), azureLinkID...)),
+		Header:   withTLVs(proxyHeader(2, proxyproto.TCPv4, tcpAddr("10.0.0.4", 50000), tcpAddr("10.0.0.5", 443)), azureLinkID),
+		TLVTypes: []proxyproto.PP2Type{0xEE},
+	},
+}
+
+// Invalid are the vectors that must be rejected.
+var Invalid = []Vector{
+	{
+		Name: "no signature",
+		Wire: []byte("GET / HTTP/1.1\r\n"),
+		Err:  proxyproto.ErrNoProxyProtocol,
+	},
+	{
+		Name: "v1 LF only",
+		Wire: []byte("PROXY \n"),
+		Err:  proxyproto.ErrLineMustEndWithCrlf,
+	},
+	{
+		Name: "v1 unknown protocol",
+		Wire: []byte("PROXY SOMETHING\r\n"),
+		Err:  proxyproto.ErrCantReadAddressFamilyAndProtocol,
+	},
+	{
+		Name: "v1 TCP4 with IPv6 addresses",
+		Wire: []byte("PROXY TCP4 2001:db8::1 2001:db8::2 1000 2000\r\n"),
+		Err:  proxyproto.ErrInvalidAddress,
+	},
+	{
+		Name: "v1 invalid port",
+		Wire: []byte("PROXY TCP4 10.0.0.1 10.0.0.2 65536 2000\r\n"),
+		Err:  proxyproto.ErrInvalidPortNumber,
+	},
+	{
+		Name: "v1 too long",
+		Wire: []byte("PROXY UNKNOWN ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535 \r\n"),
+		Err:  proxyproto.ErrVersion1HeaderTooLong,
+	},
+	{
+		Name: "v2 invalid version",
+		Wire: v2(0x11, 0x11, ipv4Payload("10.0.0.1", "10.0.0.2", 1000, 2000)),
+		Err:  proxyproto.ErrUnsupportedProtocolVersionAndCommand,
+	},
+	{
+		Name: "v2 PROXY with UNSPEC",
+		Wire: v2(0x21, 0x00, nil),
+		Err:  proxyproto.ErrUnsupportedAddressFamilyAndProtocol,
+	},
+	{
+		Name: "v2 length too short for IPv6",
+		Wire: v2(0x21, 0x21, ipv4Payload("10.0.0.1", "10.0.0.2", 1000, 2000)),
+		Err:  proxyproto.ErrInvalidLength,
+	},
+	{
+		Name: "v2 truncated payload",
+		Wire: v2(0x21, 0x11, ipv4Payload("10.0.0.1", "10.0.0.2", 1000, 2000))[:20],
+		Err:  proxyproto.ErrInvalidLength,
+	},
+}
+
+var awsVPCE = []byte{
+	0x0d, 0x0a, 0x0d, 0x0a, /* Start of Sig */
+	0x00, 0x0d, 0x0a, 0x51,
+	0x55, 0x49, 0x54, 0x0a, /* End of Sig */
+	0x21, 0x11, 0x00, 0x54, /* ver_cmd, fam and len */
+	0xac, 0x1f, 0x07, 0x71, /* Caller src ip */
+	0xac, 0x1f, 0x0a, 0x1f, /* Endpoint dst ip */
+	0xc8, 0xf2, 0x00, 0x50, /* Proxy src port & dst port */
+	0x03, 0x00, 0x04, 0xe8, /* CRC TLV start */
+	0xd6, 0x89, 0x2d, 0xea, /* CRC TLV cont, VPCE id TLV start */
+	0x00, 0x17, 0x01, 0x76,
+	0x70, 0x63, 0x65, 0x2d,
+	0x30, 0x38, 0x64, 0x32,
+	0x62, 0x66, 0x31, 0x35,
+	0x66, 0x61, 0x63, 0x35,
+	0x30, 0x30, 0x31, 0x63,
+	0x39, 0x04, 0x00, 0x24, /* VPCE id TLV end, NOOP TLV start*/
+	0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, /* NOOP TLV end */
+}
+
+// crc32cV2 is a version 2 header over IPv6 carrying a valid PP2_TYPE_CRC32C
+// TLV.
+var crc32cV2 = withCRC32c(v2(0x21, 0x21, append(ipv6Payload("2001:db8::1", "2001:db8::2", 1000, 2000),
+	tlv(proxyproto.PP2_TYPE_CRC32C, make([]byte, 4))...)))
+
+// sslTLVs are a PP2_TYPE_ALPN TLV and a PP2_TYPE_SSL TLV for a client which
+// sent a verified certificate over TLSv1.3.
+var sslTLVs = append(tlv(proxyproto.PP2_TYPE_ALPN, []byte("h2")), tlv(proxyproto.PP2_TYPE_SSL, append(
+	[]byte{0x07, 0x00, 0x00, 0x00, 0x00}, // client flags and verify result
+	append(tlv(proxyproto.PP2_SUBTYPE_SSL_VERSION, []byte("TLSv1.3")), tlv(proxyproto.PP2_SUBTYPE_SSL_CN, []byte("example.org"))...)...,
+))...)
+
+// gcpPSCConnectionID is a PP2_TYPE_GCP TLV holding the big-endian PSC
+// connection ID 0x0102030405060708.
+var gcpPSCConnectionID = tlv(0xE0, []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08})
+
+// azureLinkID is a PP2_TYPE_AZURE TLV of subtype PP2_SUBTYPE_AZURE_PRIVATEENDPOINT_LINKID,
+// holding the little-endian link ID 0x12345678.
+var azureLinkID = tlv(0xEE, []byte{0x01, 0x78, 0x56, 0x34, 0x12})
+
+func proxyHeader(version byte, transport proxyproto.AddressFamilyAndProtocol, sourceAddr, destAddr net.Addr) *proxyproto.Header {
+	return &proxyproto.Header{
+		Version:           version,
+		Command:           proxyproto.PROXY,
+		TransportProtocol: transport,
+		SourceAddr:        sourceAddr,
+		DestinationAddr:   destAddr,
+	}
+}
+
+func localHeader(version byte) *proxyproto.Header {
+	return &proxyproto.Header{
+		Version:           version,
+		Command:           proxyproto.LOCAL,
+		TransportProtocol: proxyproto.UNSPEC,
+	}
+}
+
+// withTLVs sets the raw TLVs of header. Unlike SplitTLVs, it keeps the
+// content of no-op padding so that the TLVs are rendered back identically.
+func withTLVs(header *proxyproto.Header, raw []byte) *proxyproto.Header {
+	var tlvs []proxyproto.TLV
+	for i := 0; i < len(raw); {
+		n := int(binary.BigEndian.Uint16(raw[i+1:]))
+		tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.PP2Type(raw[i]), Value: raw[i+3 : i+3+n]})
+		i += 3 + n
+	}
+	if err := header.SetTLVs(tlvs); err != nil {
+		panic(err)
+	}
+	return header
+}
+
+func tcpAddr(ip string, port int) *net.TCPAddr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+func udpAddr(ip string, port int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+// v2 renders a version 2 header from its 13th and 14th bytes and payload.
+func v2(verCmd, famProto byte, payload []byte) []byte {
+	b := append([]byte{}, proxyproto.SIGV2...)
+	b = append(b, verCmd, famProto, 0, 0)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(payload)))
+	return append(b, payload...)
+}
+
+func ipv4Payload(sourceIP, destIP string, sourcePort, destPort uint16) []byte {
+	b := append(net.ParseIP(sourceIP).To4(), net.ParseIP(destIP).To4()...)
+	return ports(b, sourcePort, destPort)
+}
+
+func ipv6Payload(sourceIP, destIP string, sourcePort, destPort uint16) []byte {
+	b := append(net.ParseIP(sourceIP).To16(), net.ParseIP(destIP).To16()...)
+	return ports(b, sourcePort, destPort)
+}
+
+func ports(b []byte, sourcePort, destPort uint16) []byte {
+	var p [4]byte
+	binary.BigEndian.PutUint16(p[:2], sourcePort)
+	binary.BigEndian.PutUint16(p[2:], destPort)
+	return append(b, p[:]...)
+}
+
+func unixName(name string) []byte {
+	b := make([]byte, 108)
+	copy(b, name)
+	return b
+}
+
+// withCRC32c fills the zeroed value of the PP2_TYPE_CRC32C TLV ending b, a
+// version 2 header, with the header's checksum.
+func withCRC32c(b []byte) []byte {
+	binary.BigEndian.PutUint32(b[len(b)-4:], crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli)))
+	return b
+}
+
+func tlv(t proxyproto.PP2Type, value []byte) []byte {
+	raw, err := proxyproto.JoinTLVs([]proxyproto.TLV{{Type: t, Value: value}})
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
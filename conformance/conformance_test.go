@@ -0,0 +1,55 @@
+package conformance
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+)
+
+func TestVectors(t *testing.T) {
+	for _, v := range Vectors() {
+		t.Run(v.Name, func(t *testing.T) {
+			header, err := proxyproto.Read(bufio.NewReader(bytes.NewReader(v.Wire)))
+			if err := v.Check(header, err); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// lossyVectors are the valid vectors whose header isn't rendered back
+// identically, as the addresses of v1 UNKNOWN headers are ignored.
+var lossyVectors = map[string]bool{
+	"v1 UNKNOWN with ignored addresses": true,
+}
+
+func TestVectorsRoundTrip(t *testing.T) {
+	for _, v := range Valid {
+		if lossyVectors[v.Name] {
+			continue
+		}
+		t.Run(v.Name, func(t *testing.T) {
+			header, n, err := proxyproto.Parse(v.Wire)
+			if err := v.Check(header, err); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := header.TLV(proxyproto.PP2_TYPE_CRC32C); ok {
+				if err := proxyproto.RequireCRC32c(header); err != nil {
+					t.Fatalf("err: %v", err)
+				}
+			}
+
+			// Emitting the parsed header must reproduce the fixture byte for
+			// byte, including padding and vendor TLVs.
+			formatted, err := header.Format()
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if !bytes.Equal(formatted, v.Wire[:n]) {
+				t.Fatalf("expected round trip to %x, got %x", v.Wire[:n], formatted)
+			}
+		})
+	}
+}
@@ -0,0 +1,344 @@
+// Package core implements the byte-level parsing of proxy protocol headers,
+// versions 1 and 2, and of their Type-Length-Value vectors, as per
+// specification: https://www.haproxy.org/download/2.3/doc/proxy-protocol.txt
+//
+// Unlike the proxyproto package it's used by, it doesn't depend on the net
+// package: addresses are returned as netip.Addr values or raw bytes. This
+// allows reusing the parser in embedded, WASM or packet-processing contexts.
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"strconv"
+)
+
+var (
+	ErrVersion1HeaderTooLong                = errors.New("proxyproto: version 1 header must be 107 bytes or less")
+	ErrLineMustEndWithCrlf                  = errors.New("proxyproto: version 1 header is invalid, must end with \\r\\n")
+	ErrCantReadProtocolVersionAndCommand    = errors.New("proxyproto: can't read proxy protocol version and command")
+	ErrCantReadAddressFamilyAndProtocol     = errors.New("proxyproto: can't read address family or protocol")
+	ErrCantReadLength                       = errors.New("proxyproto: can't read length")
+	ErrNoProxyProtocol                      = errors.New("proxyproto: proxy protocol signature not present")
+	ErrUnsupportedProtocolVersionAndCommand = errors.New("proxyproto: unsupported proxy protocol version and command")
+	ErrUnsupportedAddressFamilyAndProtocol  = errors.New("proxyproto: unsupported address family and protocol")
+	ErrInvalidLength                        = errors.New("proxyproto: invalid length")
+	ErrInvalidAddress                       = errors.New("proxyproto: invalid address")
+	ErrInvalidPortNumber                    = errors.New("proxyproto: invalid port number")
+	ErrTruncatedTLV                         = errors.New("proxyproto: truncated TLV")
+)
+
+const (
+	// Commands, see section 2.2 of the spec. Version 1 headers use PROXY,
+	// or LOCAL for UNKNOWN connections.
+	CommandLocal byte = 0x20
+	CommandProxy byte = 0x21
+
+	// Address families and transport protocols, see section 2.2 of the spec.
+	// Version 1 headers use UNSPEC for UNKNOWN connections.
+	UNSPEC       byte = 0x00
+	TCPv4        byte = 0x11
+	UDPv4        byte = 0x12
+	TCPv6        byte = 0x21
+	UDPv6        byte = 0x22
+	UnixStream   byte = 0x31
+	UnixDatagram byte = 0x32
+
+	// V1MaxLen is the maximum length of a version 1 header.
+	V1MaxLen = 107
+	// V2PreambleLen is the length of the fixed-size part of a version 2
+	// header, which holds the length of the rest of the header.
+	V2PreambleLen = 16
+
+	familyInet  = 0x10
+	familyInet6 = 0x20
+	familyUnix  = 0x30
+	unixNameLen = 108
+)
+
+var (
+	sigV1 = []byte("PROXY")
+	sigV2 = []byte{'\x0D', '\x0A', '\x0D', '\x0A', '\x00', '\x0D', '\x0A', '\x51', '\x55', '\x49', '\x54', '\x0A'}
+)
+
+// Header is a parsed proxy protocol header. Its byte slices point into the
+// parsed bytes.
+type Header struct {
+	Version           byte
+	Command           byte
+	TransportProtocol byte
+	// SourceIP and DestinationIP are set for the IPv4 and IPv6 families.
+	SourceIP      netip.Addr
+	DestinationIP netip.Addr
+	// SourcePort and DestinationPort are set for the IPv4 and IPv6 families.
+	SourcePort      uint16
+	DestinationPort uint16
+	// SourceUnix and DestinationUnix are the paths of the UNIX family,
+	// without NUL padding.
+	SourceUnix      []byte
+	DestinationUnix []byte
+	// TLVs is the raw Type-Length-Value vector of version 2 headers, see
+	// IterateTLVs.
+	TLVs []byte
+}
+
+// ParseV1 parses a version 1 header from line, which must hold the whole
+// header including its final CRLF.
+func ParseV1(line []byte) (Header, error) {
+	var h Header
+	if len(line) > V1MaxLen {
+		return h, ErrVersion1HeaderTooLong
+	}
+	if !bytes.HasPrefix(line, sigV1) {
+		return h, ErrNoProxyProtocol
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' || line[len(line)-1] != '\n' {
+		return h, ErrLineMustEndWithCrlf
+	}
+
+	// Split on each space, keeping empty tokens, and keep the first 6 ones.
+	var tokens [6][]byte
+	var n int
+	for rest := line[:len(line)-2]; ; n++ {
+		i := bytes.IndexByte(rest, ' ')
+		if n < len(tokens) {
+			if i < 0 {
+				tokens[n] = rest
+			} else {
+				tokens[n] = rest[:i]
+			}
+		}
+		if i < 0 {
+			n++
+			break
+		}
+		rest = rest[i+1:]
+	}
+
+	// Expect at least 2 tokens: "PROXY" and the transport protocol.
+	if n < 2 {
+		return h, ErrCantReadAddressFamilyAndProtocol
+	}
+
+	h.Version = 1
+	h.Command = CommandProxy
+	switch string(tokens[1]) {
+	case "TCP4":
+		h.TransportProtocol = TCPv4
+	case "TCP6":
+		h.TransportProtocol = TCPv6
+	case "UNKNOWN":
+		// UNSPEC doesn't exist in v1 but fits UNKNOWN, which ignores the
+		// rest of the line.
+		h.Command = CommandLocal
+		h.TransportProtocol = UNSPEC
+		return h, nil
+	default:
+		return h, ErrCantReadAddressFamilyAndProtocol
+	}
+
+	// Expect 6 tokens when UNKNOWN is not present.
+	if n < 6 {
+		return h, ErrCantReadAddressFamilyAndProtocol
+	}
+
+	var err error
+	if h.SourceIP, err = parseV1IPAddress(h.TransportProtocol, tokens[2]); err != nil {
+		return h, err
+	}
+	if h.DestinationIP, err = parseV1IPAddress(h.TransportProtocol, tokens[3]); err != nil {
+		return h, err
+	}
+	if h.SourcePort, err = parseV1PortNumber(tokens[4]); err != nil {
+		return h, err
+	}
+	if h.DestinationPort, err = parseV1PortNumber(tokens[5]); err != nil {
+		return h, err
+	}
+	return h, nil
+}
+
+func parseV1IPAddress(protocol byte, b []byte) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(string(b))
+	if err != nil {
+		return netip.Addr{}, ErrInvalidAddress
+	}
+
+	switch protocol {
+	case TCPv4:
+		if addr.Is4() {
+			return addr, nil
+		}
+	case TCPv6:
+		if addr.Is6() || addr.Is4In6() {
+			return addr, nil
+		}
+	}
+
+	return netip.Addr{}, ErrInvalidAddress
+}
+
+func parseV1PortNumber(b []byte) (uint16, error) {
+	port, err := strconv.Atoi(string(b))
+	if err != nil || port < 0 || port > 65535 {
+		return 0, ErrInvalidPortNumber
+	}
+	return uint16(port), nil
+}
+
+// ParseV2 parses a version 2 header from the beginning of b, and returns it
+// along with its length.
+func ParseV2(b []byte) (Header, int, error) {
+	h, length, err := ParseV2Preamble(b)
+	if err != nil {
+		return h, 0, err
+	}
+	if len(b) < V2PreambleLen+length {
+		return h, 0, ErrInvalidLength
+	}
+	if err := h.ParseV2Payload(b[V2PreambleLen : V2PreambleLen+length]); err != nil {
+		return h, 0, err
+	}
+	return h, V2PreambleLen + length, nil
+}
+
+// ParseV2Preamble parses the fixed-size part of a version 2 header from the
+// beginning of b, i.e. its first V2PreambleLen bytes, and returns it along
+// with the length of the rest of the header, to be parsed by ParseV2Payload.
+// This allows parsing headers from streams without reading past them. If b is
+// too short, the error describes the first missing field.
+func ParseV2Preamble(b []byte) (Header, int, error) {
+	var h Header
+	if !bytes.HasPrefix(b, sigV2) {
+		if len(b) < len(sigV2) {
+			return h, 0, ErrCantReadProtocolVersionAndCommand
+		}
+		return h, 0, ErrNoProxyProtocol
+	}
+
+	h.Version = 2
+
+	// Read the 13th byte, protocol version and command
+	if len(b) < 13 {
+		return h, 0, ErrCantReadProtocolVersionAndCommand
+	}
+	h.Command = b[12]
+	if h.Command != CommandLocal && h.Command != CommandProxy {
+		return h, 0, ErrUnsupportedProtocolVersionAndCommand
+	}
+
+	// Read the 14th byte, address family and protocol
+	if len(b) < 14 {
+		return h, 0, ErrCantReadAddressFamilyAndProtocol
+	}
+	h.TransportProtocol = b[13]
+	// UNSPEC is only supported when LOCAL is set.
+	if h.TransportProtocol == UNSPEC && h.Command != CommandLocal {
+		return h, 0, ErrUnsupportedAddressFamilyAndProtocol
+	}
+
+	if len(b) < V2PreambleLen {
+		return h, 0, ErrCantReadLength
+	}
+	length := int(binary.BigEndian.Uint16(b[14:16]))
+	if length < addressesLen(h.TransportProtocol) {
+		return h, 0, ErrInvalidLength
+	}
+	// Addresses can only be read for the supported address families and
+	// protocols, which PROXY requires. LOCAL ignores them anyway.
+	if h.Command == CommandProxy && !supportedTransport(h.TransportProtocol) {
+		return h, 0, ErrUnsupportedAddressFamilyAndProtocol
+	}
+
+	return h, length, nil
+}
+
+// ParseV2Payload parses the addresses and TLVs following the preamble of a
+// version 2 header parsed by ParseV2Preamble. payload must be exactly as long
+// as the length returned by ParseV2Preamble.
+func (h *Header) ParseV2Payload(payload []byte) error {
+	n := addressesLen(h.TransportProtocol)
+	if n < 0 || len(payload) < n {
+		return ErrInvalidLength
+	}
+
+	switch h.TransportProtocol & 0xF0 {
+	case familyInet:
+		var src, dst [4]byte
+		copy(src[:], payload[0:4])
+		copy(dst[:], payload[4:8])
+		h.SourceIP = netip.AddrFrom4(src)
+		h.DestinationIP = netip.AddrFrom4(dst)
+		h.SourcePort = binary.BigEndian.Uint16(payload[8:10])
+		h.DestinationPort = binary.BigEndian.Uint16(payload[10:12])
+	case familyInet6:
+		var src, dst [16]byte
+		copy(src[:], payload[0:16])
+		copy(dst[:], payload[16:32])
+		h.SourceIP = netip.AddrFrom16(src)
+		h.DestinationIP = netip.AddrFrom16(dst)
+		h.SourcePort = binary.BigEndian.Uint16(payload[32:34])
+		h.DestinationPort = binary.BigEndian.Uint16(payload[34:36])
+	case familyUnix:
+		h.SourceUnix = trimNUL(payload[:unixNameLen])
+		h.DestinationUnix = trimNUL(payload[unixNameLen : 2*unixNameLen])
+	}
+
+	h.TLVs = payload[n:]
+	return nil
+}
+
+// addressesLen returns the length of the addresses of the transport
+// protocol, or -1 if it's unknown.
+func addressesLen(transport byte) int {
+	switch transport & 0xF0 {
+	case familyInet:
+		return 12
+	case familyInet6:
+		return 36
+	case familyUnix:
+		return 2 * unixNameLen
+	}
+	if transport&0xF0 == 0x00 || transport&0x0F == 0x00 {
+		return 0
+	}
+	return -1
+}
+
+func supportedTransport(transport byte) bool {
+	switch transport {
+	case TCPv4, UDPv4, TCPv6, UDPv6, UnixStream, UnixDatagram:
+		return true
+	}
+	return false
+}
+
+func trimNUL(b []byte) []byte {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return b[:i]
+	}
+	return b
+}
+
+// IterateTLVs calls fn for each record of the raw Type-Length-Value vector, in
+// order, until fn returns false. Values point into raw. ErrTruncatedTLV is
+// returned if the vector is malformed, after calling fn for the valid records
+// before.
+func IterateTLVs(raw []byte, fn func(t byte, value []byte) bool) error {
+	for i := 0; i < len(raw); {
+		if len(raw)-i <= 2 {
+			return ErrTruncatedTLV
+		}
+		tlvLen := int(binary.BigEndian.Uint16(raw[i+1 : i+3]))
+		if i+3+tlvLen > len(raw) {
+			return ErrTruncatedTLV
+		}
+		if !fn(raw[i], raw[i+3:i+3+tlvLen:i+3+tlvLen]) {
+			return nil
+		}
+		i += 3 + tlvLen
+	}
+	return nil
+}
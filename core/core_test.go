@@ -0,0 +1,233 @@
+package core
+
+import (
+	"bytes"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestParseV1(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		header Header
+		err    error
+	}{
+		{
+			name: "TCP4",
+			line: "PROXY TCP4 192.168.1.1 192.168.1.2 1000 2000\r\n",
+			header: Header{
+				Version:           1,
+				Command:           CommandProxy,
+				TransportProtocol: TCPv4,
+				SourceIP:          netip.MustParseAddr("192.168.1.1"),
+				DestinationIP:     netip.MustParseAddr("192.168.1.2"),
+				SourcePort:        1000,
+				DestinationPort:   2000,
+			},
+		},
+		{
+			name: "TCP6",
+			line: "PROXY TCP6 ::1 ::ffff:10.0.0.1 65535 0\r\n",
+			header: Header{
+				Version:           1,
+				Command:           CommandProxy,
+				TransportProtocol: TCPv6,
+				SourceIP:          netip.MustParseAddr("::1"),
+				DestinationIP:     netip.MustParseAddr("::ffff:10.0.0.1"),
+				SourcePort:        65535,
+			},
+		},
+		{
+			name:   "UNKNOWN",
+			line:   "PROXY UNKNOWN whatever\r\n",
+			header: Header{Version: 1, Command: CommandLocal, TransportProtocol: UNSPEC},
+		},
+		{name: "no signature", line: "GET / HTTP/1.1\r\n", err: ErrNoProxyProtocol},
+		{name: "no CR", line: "PROXY TCP4 192.168.1.1 192.168.1.2 1000 2000\n", err: ErrLineMustEndWithCrlf},
+		{name: "too long", line: "PROXY UNKNOWN " + strings.Repeat("f", 100) + "\r\n", err: ErrVersion1HeaderTooLong},
+		{name: "no protocol", line: "PROXY\r\n", err: ErrCantReadAddressFamilyAndProtocol},
+		{name: "bad protocol", line: "PROXY UDP4 192.168.1.1 192.168.1.2 1000 2000\r\n", err: ErrCantReadAddressFamilyAndProtocol},
+		{name: "missing port", line: "PROXY TCP4 192.168.1.1 192.168.1.2 1000\r\n", err: ErrCantReadAddressFamilyAndProtocol},
+		{name: "IPv6 in TCP4", line: "PROXY TCP4 ::1 192.168.1.2 1000 2000\r\n", err: ErrInvalidAddress},
+		{name: "double space", line: "PROXY TCP4  192.168.1.1 192.168.1.2 1000 2000\r\n", err: ErrInvalidAddress},
+		{name: "bad port", line: "PROXY TCP4 192.168.1.1 192.168.1.2 1000 65536\r\n", err: ErrInvalidPortNumber},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := ParseV1([]byte(tt.line))
+			if err != tt.err {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if err == nil && !equal(header, tt.header) {
+				t.Fatalf("expected %+v, got %+v", tt.header, header)
+			}
+		})
+	}
+}
+
+func TestParseV2(t *testing.T) {
+	unixPath := func(s string) []byte {
+		b := make([]byte, unixNameLen)
+		copy(b, s)
+		return b
+	}
+	v2 := func(cmd, transport byte, length int, payload ...[]byte) []byte {
+		b := append(append([]byte{}, sigV2...), cmd, transport, byte(length>>8), byte(length))
+		for _, p := range payload {
+			b = append(b, p...)
+		}
+		return b
+	}
+	tlvs := []byte{0x01, 0x00, 0x02, 'h', '2'}
+
+	tests := []struct {
+		name   string
+		wire   []byte
+		header Header
+		n      int
+		err    error
+	}{
+		{
+			name:   "LOCAL",
+			wire:   v2(CommandLocal, UNSPEC, 0),
+			header: Header{Version: 2, Command: CommandLocal, TransportProtocol: UNSPEC, TLVs: []byte{}},
+			n:      16,
+		},
+		{
+			name: "TCP4 with TLVs and trailing data",
+			wire: v2(CommandProxy, TCPv4, 12+len(tlvs), []byte{10, 0, 0, 1, 10, 0, 0, 2, 0x03, 0xE8, 0x07, 0xD0}, tlvs, []byte("GET")),
+			header: Header{
+				Version:           2,
+				Command:           CommandProxy,
+				TransportProtocol: TCPv4,
+				SourceIP:          netip.MustParseAddr("10.0.0.1"),
+				DestinationIP:     netip.MustParseAddr("10.0.0.2"),
+				SourcePort:        1000,
+				DestinationPort:   2000,
+				TLVs:              tlvs,
+			},
+			n: 16 + 12 + len(tlvs),
+		},
+		{
+			name: "UDP6",
+			wire: v2(CommandProxy, UDPv6, 36, netip.MustParseAddr("::1").AsSlice(), netip.MustParseAddr("::2").AsSlice(), []byte{0, 1, 0, 2}),
+			header: Header{
+				Version:           2,
+				Command:           CommandProxy,
+				TransportProtocol: UDPv6,
+				SourceIP:          netip.MustParseAddr("::1"),
+				DestinationIP:     netip.MustParseAddr("::2"),
+				SourcePort:        1,
+				DestinationPort:   2,
+				TLVs:              []byte{},
+			},
+			n: 16 + 36,
+		},
+		{
+			name: "unix stream",
+			wire: v2(CommandProxy, UnixStream, 216, unixPath("/tmp/src.sock"), unixPath("/tmp/dst.sock")),
+			header: Header{
+				Version:           2,
+				Command:           CommandProxy,
+				TransportProtocol: UnixStream,
+				SourceUnix:        []byte("/tmp/src.sock"),
+				DestinationUnix:   []byte("/tmp/dst.sock"),
+				TLVs:              []byte{},
+			},
+			n: 16 + 216,
+		},
+		{name: "no signature", wire: []byte("GET / HTTP/1.1\r\nHost: x\r\n"), err: ErrNoProxyProtocol},
+		{name: "short signature", wire: sigV2[:4], err: ErrCantReadProtocolVersionAndCommand},
+		{name: "bad command", wire: v2(0x22, TCPv4, 12), err: ErrUnsupportedProtocolVersionAndCommand},
+		{name: "no family", wire: v2(CommandProxy, TCPv4, 12)[:13], err: ErrCantReadAddressFamilyAndProtocol},
+		{name: "PROXY UNSPEC", wire: v2(CommandProxy, UNSPEC, 0), err: ErrUnsupportedAddressFamilyAndProtocol},
+		{name: "no length", wire: v2(CommandProxy, TCPv4, 12)[:15], err: ErrCantReadLength},
+		{name: "length too small", wire: v2(CommandProxy, TCPv4, 11), err: ErrInvalidLength},
+		{name: "unsupported protocol", wire: v2(CommandProxy, 0x15, 12), err: ErrUnsupportedAddressFamilyAndProtocol},
+		{name: "truncated payload", wire: v2(CommandProxy, TCPv4, 12, []byte{10, 0, 0, 1}), err: ErrInvalidLength},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, n, err := ParseV2(tt.wire)
+			if err != tt.err {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if err != nil {
+				return
+			}
+			if n != tt.n {
+				t.Fatalf("expected length %d, got %d", tt.n, n)
+			}
+			if !equal(header, tt.header) {
+				t.Fatalf("expected %+v, got %+v", tt.header, header)
+			}
+		})
+	}
+}
+
+func TestIterateTLVs(t *testing.T) {
+	raw := []byte{0x01, 0x00, 0x02, 'h', '2', 0x04, 0x00, 0x00, 0x02, 0x00, 0x01, 'a'}
+
+	var types []byte
+	err := IterateTLVs(raw, func(typ byte, value []byte) bool {
+		types = append(types, typ)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(types, []byte{0x01, 0x04, 0x02}) {
+		t.Fatalf("unexpected types %v", types)
+	}
+
+	types = types[:0]
+	err = IterateTLVs(raw, func(typ byte, value []byte) bool {
+		types = append(types, typ)
+		return false
+	})
+	if err != nil || len(types) != 1 {
+		t.Fatalf("expected iteration to stop after 1 TLV, got %v, %v", types, err)
+	}
+
+	types = types[:0]
+	err = IterateTLVs(raw[:len(raw)-1], func(typ byte, value []byte) bool {
+		types = append(types, typ)
+		return true
+	})
+	if err != ErrTruncatedTLV {
+		t.Fatalf("expected %v, got %v", ErrTruncatedTLV, err)
+	}
+	if len(types) != 2 {
+		t.Fatalf("expected the 2 valid TLVs before the truncated one, got %v", types)
+	}
+}
+
+func TestNoNetDependency(t *testing.T) {
+	out, err := exec.Command("go", "list", "-deps", ".").Output()
+	if err != nil {
+		t.Skipf("can't list dependencies: %v", err)
+	}
+	for _, dep := range strings.Fields(string(out)) {
+		if dep == "net" {
+			t.Fatal("core must not depend on the net package")
+		}
+	}
+}
+
+func equal(a, b Header) bool {
+	return a.Version == b.Version &&
+		a.Command == b.Command &&
+		a.TransportProtocol == b.TransportProtocol &&
+		a.SourceIP == b.SourceIP &&
+		a.DestinationIP == b.DestinationIP &&
+		a.SourcePort == b.SourcePort &&
+		a.DestinationPort == b.DestinationPort &&
+		bytes.Equal(a.SourceUnix, b.SourceUnix) &&
+		bytes.Equal(a.DestinationUnix, b.DestinationUnix) &&
+		bytes.Equal(a.TLVs, b.TLVs)
+}
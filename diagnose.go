@@ -0,0 +1,85 @@
+package proxyproto
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// diagnoseLen is the number of first bytes kept by NoProxyProtocolError.
+const diagnoseLen = 16
+
+// NoProxyProtocolError describes the first bytes of a connection which
+// doesn't start with a proxy protocol header, in order to make
+// misconfigurations, e.g. a client sending HTTP to a port requiring the
+// protocol, debuggable from logs. It wraps ErrNoProxyProtocol. See
+// DiagnoseNoProxyProtocol and Conn.NoProxyProtocolError.
+type NoProxyProtocolError struct {
+	// Peeked are the first bytes of the connection, at most 16.
+	Peeked []byte
+	// Protocol is what the first bytes resemble: "TLS", "HTTP", "SSH",
+	// "incomplete PROXY header", "text", "binary", or "no data".
+	Protocol string
+}
+
+// DiagnoseNoProxyProtocol returns a NoProxyProtocolError describing the first
+// bytes of a connection, e.g. as returned by bufio.Reader.Peek, which don't
+// start with a proxy protocol header. At most 16 bytes are kept.
+func DiagnoseNoProxyProtocol(peeked []byte) *NoProxyProtocolError {
+	if len(peeked) > diagnoseLen {
+		peeked = peeked[:diagnoseLen]
+	}
+	return &NoProxyProtocolError{
+		Peeked:   append([]byte(nil), peeked...),
+		Protocol: resembledProtocol(peeked),
+	}
+}
+
+func (e *NoProxyProtocolError) Error() string {
+	if len(e.Peeked) == 0 {
+		return ErrNoProxyProtocol.Error() + ", got no data"
+	}
+	return fmt.Sprintf("%s, got %q resembling %s", ErrNoProxyProtocol, e.Peeked, e.Protocol)
+}
+
+// Unwrap returns ErrNoProxyProtocol.
+func (e *NoProxyProtocolError) Unwrap() error {
+	return ErrNoProxyProtocol
+}
+
+// httpMethods are the request methods recognized by resembledProtocol,
+// followed by a space, and the HTTP/2 connection preface.
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("HEAD "), []byte("POST "), []byte("PUT "),
+	[]byte("DELETE "), []byte("CONNECT "), []byte("OPTIONS "), []byte("TRACE "),
+	[]byte("PATCH "), []byte("PRI * HTTP/2"),
+}
+
+// resembledProtocol returns what b resembles, see NoProxyProtocolError.
+func resembledProtocol(b []byte) string {
+	switch {
+	case len(b) == 0:
+		return "no data"
+	case len(b) >= 2 && b[0] == tlsRecordTypeHandshake && b[1] == tlsRecordMajorVersion:
+		return "TLS"
+	case bytes.HasPrefix(b, []byte("SSH-")):
+		return "SSH"
+	case isSignaturePrefix(b, SIGV1) || isSignaturePrefix(b, SIGV2):
+		return "incomplete PROXY header"
+	}
+	for _, method := range httpMethods {
+		if isSignaturePrefix(b, method) || bytes.HasPrefix(b, method) {
+			return "HTTP"
+		}
+	}
+	for _, c := range b {
+		if (c < 0x20 || c > 0x7e) && c != '\r' && c != '\n' && c != '\t' {
+			return "binary"
+		}
+	}
+	return "text"
+}
+
+// isSignaturePrefix returns whether b is a strict prefix of sig.
+func isSignaturePrefix(b, sig []byte) bool {
+	return len(b) < len(sig) && bytes.HasPrefix(sig, b)
+}
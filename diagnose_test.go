@@ -0,0 +1,103 @@
+package proxyproto
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiagnoseNoProxyProtocol(t *testing.T) {
+	var cases = []struct {
+		name     string
+		peeked   []byte
+		expected string
+	}{
+		{"no data", nil, "no data"},
+		{"TLS", []byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x01}, "TLS"},
+		{"HTTP", []byte("GET / HTTP/1.1\r\nHost: example.org\r\n"), "HTTP"},
+		{"HTTP/2", []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"), "HTTP"},
+		{"short HTTP", []byte("GE"), "HTTP"},
+		{"SSH", []byte("SSH-2.0-OpenSSH_9.0\r\n"), "SSH"},
+		{"incomplete v1", []byte("PRO"), "incomplete PROXY header"},
+		{"incomplete v2", SIGV2[:8], "incomplete PROXY header"},
+		{"text", []byte("ping"), "text"},
+		{"binary", []byte{0x00, 0xff, 0x10}, "binary"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := DiagnoseNoProxyProtocol(tc.peeked)
+			if err.Protocol != tc.expected {
+				t.Fatalf("Expected %q, got %q", tc.expected, err.Protocol)
+			}
+			if len(err.Peeked) > 16 {
+				t.Fatalf("Expected at most 16 bytes, got %d", len(err.Peeked))
+			}
+			if !errors.Is(err, ErrNoProxyProtocol) {
+				t.Fatalf("Expected error %v to wrap %v", err, ErrNoProxyProtocol)
+			}
+			if !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Expected error %q to mention %q", err, tc.expected)
+			}
+		})
+	}
+}
+
+func TestConnNoProxyProtocolError(t *testing.T) {
+	var cases = []struct {
+		name     string
+		data     string
+		expected string
+	}{
+		{"HTTP", "GET / HTTP/1.1\r\nHost: example.org\r\n\r\n", "HTTP"},
+		{"header", "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping", ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			go func() {
+				_, _ = client.Write([]byte(tc.data))
+			}()
+
+			conn := NewConn(server, WithPolicy(REQUIRE))
+			err := conn.NoProxyProtocolError()
+			if tc.expected == "" {
+				if err != nil {
+					t.Fatalf("Unexpected error %v", err)
+				}
+				return
+			}
+			if err == nil || err.Protocol != tc.expected || string(err.Peeked) != tc.data[:16] {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if conn.HeaderError() != ErrNoProxyProtocol {
+				t.Fatalf("Expected error %v, got %v", ErrNoProxyProtocol, conn.HeaderError())
+			}
+		})
+	}
+}
+
+func TestConnNoProxyProtocolErrorTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// A slow proxy sends the beginning of a header only.
+	go func() {
+		_, _ = client.Write(SIGV2[:4])
+	}()
+
+	conn := NewConn(server, WithPolicy(REQUIRE), SetReadHeaderTimeout(50*time.Millisecond))
+	if err := conn.HeaderError(); err != ErrReadHeaderTimeout {
+		t.Fatalf("Expected error %v, got %v", ErrReadHeaderTimeout, err)
+	}
+	if err := conn.NoProxyProtocolError(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package proxyproto
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ErrHeaderAlreadyWritten is returned when writing a header on a ClientConn
+// which already has one, e.g. because a connection pool reused it.
+var ErrHeaderAlreadyWritten = errors.New("proxyproto: PROXY header already written on connection")
+
+// Dialer dials connections and writes a proxy protocol header on each of
+// them before returning it as a *ClientConn.
+type Dialer struct {
+	// Dialer dials the underlying connections. If nil, the zero value of
+	// net.Dialer is used.
+	Dialer *net.Dialer
+	// Header is written on each dialed connection. If nil, a header is
+	// derived from the connection addresses with HeaderProxyFromAddrs.
+	Header *Header
+	// HeaderFunc, if not nil, returns the header to write on each dialed
+	// connection instead of Header, so that each one can carry a different
+	// header, e.g. with the address of the client it's dialed for, taken
+	// from ctx, or with extra TLVs. It's passed the arguments of DialContext
+	// and the dialed connection. Header is used if it returns a nil header,
+	// and the connection is closed if it returns an error.
+	HeaderFunc func(ctx context.Context, network, address string, conn net.Conn) (*Header, error)
+	// Local makes the dialer write a v2 LOCAL header, as load balancers do
+	// for health checks, instead of Header.
+	Local bool
+}
+
+// ClientConn is a client-side connection on which a proxy protocol header can
+// be written at most once: writing a second header, with WriteHeader or
+// Header.WriteTo, fails with ErrHeaderAlreadyWritten instead of corrupting the
+// stream. Connections returned by Dialer are ClientConns.
+type ClientConn struct {
+	net.Conn
+
+	headerWritten uint32 // atomic
+}
+
+// NewClientConn returns a ClientConn wrapping conn, on which no header has
+// been written yet.
+func NewClientConn(conn net.Conn) *ClientConn {
+	return &ClientConn{Conn: conn}
+}
+
+// WriteHeader writes the header on the connection, or returns
+// ErrHeaderAlreadyWritten if one already was.
+func (c *ClientConn) WriteHeader(header *Header) error {
+	_, err := header.WriteTo(c)
+	return err
+}
+
+// HeaderWritten returns whether a header was written on the connection, even
+// partially.
+func (c *ClientConn) HeaderWritten() bool {
+	return atomic.LoadUint32(&c.headerWritten) == 1
+}
+
+func (c *ClientConn) writeHeader(buf []byte) (int64, error) {
+	if !atomic.CompareAndSwapUint32(&c.headerWritten, 0, 1) {
+		return 0, ErrHeaderAlreadyWritten
+	}
+	n, err := c.Conn.Write(buf)
+	return int64(n), err
+}
+
+// Dial connects to the address on the named network and writes the header,
+// see net.Dial.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address on the named network using the
+// provided context and writes the header, see net.Dialer.DialContext.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	header := d.Header
+	if d.HeaderFunc != nil && !d.Local {
+		h, err := d.HeaderFunc(ctx, network, address, conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if h != nil {
+			header = h
+		}
+	}
+	switch {
+	case d.Local:
+		header = NewLocalHeader()
+	case header == nil:
+		header = HeaderProxyFromAddrs(0, conn.LocalAddr(), conn.RemoteAddr())
+	}
+
+	// Honor the context's deadline while writing the header, as the dial did.
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetWriteDeadline(deadline); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+
+	clientConn := NewClientConn(conn)
+	if err := clientConn.WriteHeader(header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return clientConn, nil
+}
@@ -0,0 +1,202 @@
+package proxyproto
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestDialerWritesHeader(t *testing.T) {
+	var cases = []struct {
+		name     string
+		dialer   func(addr net.Addr) *Dialer
+		expected func(conn net.Conn) *Header
+	}{
+		{
+			name:   "local",
+			dialer: func(net.Addr) *Dialer { return &Dialer{Local: true} },
+			expected: func(net.Conn) *Header {
+				return NewLocalHeader()
+			},
+		},
+		{
+			name:   "from connection addresses",
+			dialer: func(net.Addr) *Dialer { return &Dialer{} },
+			expected: func(conn net.Conn) *Header {
+				return HeaderProxyFromAddrs(2, conn.RemoteAddr(), conn.LocalAddr())
+			},
+		},
+		{
+			name: "header callback",
+			dialer: func(addr net.Addr) *Dialer {
+				return &Dialer{
+					Header: NewLocalHeader(),
+					HeaderFunc: func(ctx context.Context, network, address string, conn net.Conn) (*Header, error) {
+						if address != addr.String() {
+							return nil, fmt.Errorf("unexpected address %s", address)
+						}
+						header := HeaderProxyFromAddrs(2, conn.LocalAddr(), conn.LocalAddr())
+						return header, header.SetTLVs([]TLV{{Type: PP2_TYPE_AUTHORITY, Value: []byte("example.org")}})
+					},
+				}
+			},
+			expected: func(conn net.Conn) *Header {
+				header := HeaderProxyFromAddrs(2, conn.RemoteAddr(), conn.RemoteAddr())
+				_ = header.SetTLVs([]TLV{{Type: PP2_TYPE_AUTHORITY, Value: []byte("example.org")}})
+				return header
+			},
+		},
+		{
+			name: "header callback falling back to header",
+			dialer: func(addr net.Addr) *Dialer {
+				return &Dialer{
+					Header: HeaderProxyFromAddrs(1, addr, addr),
+					HeaderFunc: func(context.Context, string, string, net.Conn) (*Header, error) {
+						return nil, nil
+					},
+				}
+			},
+			expected: func(conn net.Conn) *Header {
+				return HeaderProxyFromAddrs(1, conn.LocalAddr(), conn.LocalAddr())
+			},
+		},
+		{
+			name: "explicit header",
+			dialer: func(addr net.Addr) *Dialer {
+				return &Dialer{Header: HeaderProxyFromAddrs(1, addr, addr)}
+			},
+			expected: func(conn net.Conn) *Header {
+				return HeaderProxyFromAddrs(1, conn.LocalAddr(), conn.LocalAddr())
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			defer l.Close()
+
+			cliResult := make(chan error)
+			go func() {
+				conn, err := tc.dialer(l.Addr()).Dial("tcp", l.Addr().String())
+				if err != nil {
+					cliResult <- err
+					return
+				}
+				defer conn.Close()
+
+				close(cliResult)
+			}()
+
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			defer conn.Close()
+
+			header, err := Read(bufio.NewReader(conn))
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if expected := tc.expected(conn); !header.EqualsTo(expected) {
+				t.Fatalf("Expected header %#v, got %#v", expected, header)
+			}
+
+			err = <-cliResult
+			if err != nil {
+				t.Fatalf("client error: %v", err)
+			}
+		})
+	}
+}
+
+func TestDialerHeaderCallbackError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	callbackErr := errors.New("no client")
+	dialer := &Dialer{
+		HeaderFunc: func(context.Context, string, string, net.Conn) (*Header, error) {
+			return nil, callbackErr
+		},
+	}
+	if _, err := dialer.Dial("tcp", l.Addr().String()); err != callbackErr {
+		t.Fatalf("expected %v, got %v", callbackErr, err)
+	}
+}
+
+func TestClientConnWritesHeaderOnce(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	cliResult := make(chan error)
+	go func() {
+		conn, err := (&Dialer{}).Dial("tcp", l.Addr().String())
+		if err != nil {
+			cliResult <- err
+			return
+		}
+		defer conn.Close()
+
+		clientConn, ok := conn.(*ClientConn)
+		if !ok {
+			cliResult <- fmt.Errorf("expected a *ClientConn, got %T", conn)
+			return
+		}
+		if !clientConn.HeaderWritten() {
+			cliResult <- fmt.Errorf("expected header to be written")
+			return
+		}
+		if err := clientConn.WriteHeader(NewLocalHeader()); err != ErrHeaderAlreadyWritten {
+			cliResult <- fmt.Errorf("expected %v, got %v", ErrHeaderAlreadyWritten, err)
+			return
+		}
+		if _, err := NewLocalHeader().WriteTo(conn); err != ErrHeaderAlreadyWritten {
+			cliResult <- fmt.Errorf("expected %v, got %v", ErrHeaderAlreadyWritten, err)
+			return
+		}
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			cliResult <- err
+			return
+		}
+
+		close(cliResult)
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	if _, err := Read(reader); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	err = <-cliResult
+	if err != nil {
+		t.Fatalf("client error: %v", err)
+	}
+
+	recv := make([]byte, 4)
+	if _, err := io.ReadFull(reader, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != "ping" {
+		t.Fatalf("expected ping after the header, got %q", recv)
+	}
+}
@@ -0,0 +1,273 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// dumpLineBytes is the maximum number of bytes printed per line by DumpBytes.
+const dumpLineBytes = 16
+
+// ErrInvalidHexDump is returned by DecodeHexDump when the dump contains no
+// hex bytes.
+var ErrInvalidHexDump = errors.New("proxyproto: invalid hex dump")
+
+// DumpHeader renders the header and returns an annotated hex dump of its wire
+// format, see DumpBytes.
+func DumpHeader(h *Header) (string, error) {
+	buf, err := h.Format()
+	if err != nil {
+		return "", err
+	}
+	return DumpBytes(buf), nil
+}
+
+// DumpBytes returns a human-readable hex dump of b, each line starting with
+// the offset of its bytes and ending with the header field they belong to.
+// Bytes following the header, or that can't be decoded, are dumped without
+// annotation. It never fails, so that it can be used from error paths to dump
+// malformed headers.
+func DumpBytes(b []byte) string {
+	d := &dumper{b: b}
+	switch {
+	case bytes.HasPrefix(b, SIGV2):
+		d.dumpVersion2()
+	case bytes.HasPrefix(b, SIGV1):
+		d.dumpVersion1()
+	}
+	d.field(len(b)-d.off, "")
+	return d.sb.String()
+}
+
+// DecodeHexDump decodes the bytes of a hex dump and reads the header they
+// start with. It accepts plain hex, with or without spaces between bytes, as
+// well as the output of xxd, hexdump -C, tcpdump -X, encoding/hex.Dump and
+// DumpBytes: offsets and ASCII or annotation columns are ignored, and so are
+// lines without hex bytes. If the bytes don't start with a header, e.g. when
+// they include the IP and TCP headers of a packet, the header is read from
+// the first signature found in them.
+func DecodeHexDump(dump string) (*Header, error) {
+	b, err := decodeHexDump(dump)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, SIGV2) && !bytes.HasPrefix(b, SIGV1) {
+		start := bytes.Index(b, SIGV2)
+		if i := bytes.Index(b, SIGV1); i >= 0 && (start < 0 || i < start) {
+			start = i
+		}
+		if start > 0 {
+			b = b[start:]
+		}
+	}
+	return Read(bufio.NewReader(bytes.NewReader(b)))
+}
+
+// decodeHexDump returns the bytes of a hex dump, see DecodeHexDump.
+func decodeHexDump(dump string) ([]byte, error) {
+	var b []byte
+	for _, line := range strings.Split(dump, "\n") {
+		line = strings.TrimSpace(line)
+		// hexdump -C and encoding/hex.Dump delimit the ASCII column.
+		if i := strings.IndexByte(line, '|'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(fields[0], ":"):
+			// xxd and tcpdump -X end offsets with a colon, and separate
+			// the ASCII column by at least two spaces.
+			rest := strings.TrimSpace(line[len(fields[0]):])
+			if i := strings.Index(rest, "  "); i >= 0 {
+				rest = rest[:i]
+			}
+			fields = strings.Fields(rest)
+		case len(fields) > 1 && strings.HasPrefix(line[len(fields[0]):], "  "):
+			// hexdump -C, encoding/hex.Dump and DumpBytes separate
+			// offsets by two spaces.
+			fields = fields[1:]
+		}
+		for _, field := range fields {
+			decoded, err := hex.DecodeString(field)
+			if err != nil {
+				break
+			}
+			b = append(b, decoded...)
+		}
+	}
+	if len(b) == 0 {
+		return nil, ErrInvalidHexDump
+	}
+	return b, nil
+}
+
+type dumper struct {
+	b   []byte
+	off int
+	sb  strings.Builder
+}
+
+// field dumps the next n bytes, or less if b is too short, annotated with
+// desc. It returns false if b was too short.
+func (d *dumper) field(n int, desc string) bool {
+	ok := d.off+n <= len(d.b)
+	if !ok {
+		n = len(d.b) - d.off
+		if desc != "" {
+			desc += " (truncated)"
+		}
+	}
+	for n > 0 {
+		l := n
+		if l > dumpLineBytes {
+			l = dumpLineBytes
+		}
+		hex := fmt.Sprintf("% x", d.b[d.off:d.off+l])
+		line := fmt.Sprintf("%04x  %-*s  %s", d.off, dumpLineBytes*3-1, hex, desc)
+		d.sb.WriteString(strings.TrimRight(line, " "))
+		d.sb.WriteByte('\n')
+		d.off += l
+		n -= l
+		desc = ""
+	}
+	return ok
+}
+
+func (d *dumper) dumpVersion1() {
+	end := bytes.IndexByte(d.b, '\n')
+	if end < 0 || end >= V1MaxLen {
+		d.field(len(d.b), "version 1 header without LF")
+		return
+	}
+	d.field(end+1, fmt.Sprintf("version 1 header %q", d.b[:end+1]))
+}
+
+func (d *dumper) dumpVersion2() {
+	d.field(len(SIGV2), "version 2 signature")
+	if d.off >= len(d.b) {
+		return
+	}
+	cmd := ProtocolVersionAndCommand(d.b[d.off])
+	cmdName := "unknown command"
+	switch {
+	case cmd.IsLocal():
+		cmdName = "command LOCAL"
+	case cmd.IsProxy():
+		cmdName = "command PROXY"
+	}
+	d.field(1, fmt.Sprintf("version %d, %s", cmd>>4, cmdName))
+
+	if d.off >= len(d.b) {
+		return
+	}
+	fam := AddressFamilyAndProtocol(d.b[d.off])
+	d.field(1, "family and protocol "+dumpTransport(fam))
+
+	if d.off+2 > len(d.b) {
+		d.field(2, "length")
+		return
+	}
+	length := int(binary.BigEndian.Uint16(d.b[d.off:]))
+	d.field(2, fmt.Sprintf("length %d", length))
+
+	end := d.off + length
+	if end > len(d.b) {
+		end = len(d.b)
+	}
+	payload := &dumper{b: d.b[:end], off: d.off}
+	payload.dumpAddresses(fam)
+	payload.dumpTLVs()
+	d.sb.WriteString(payload.sb.String())
+	d.off = payload.off
+}
+
+func (d *dumper) dumpAddresses(fam AddressFamilyAndProtocol) {
+	var ipLen int
+	switch {
+	case fam.IsUnspec():
+		return
+	case fam.IsIPv4():
+		ipLen = net.IPv4len
+	case fam.IsIPv6():
+		ipLen = net.IPv6len
+	case fam.IsUnix():
+		for _, desc := range []string{"source", "destination"} {
+			name := "address"
+			if d.off+108 <= len(d.b) {
+				name = fmt.Sprintf("address %q", parseUnixName(d.b[d.off:d.off+108]))
+			}
+			if !d.field(108, desc+" "+name) {
+				return
+			}
+		}
+		return
+	default:
+		return
+	}
+
+	for _, desc := range []string{"source", "destination"} {
+		if d.off+ipLen > len(d.b) {
+			d.field(ipLen, desc+" address")
+			return
+		}
+		d.field(ipLen, fmt.Sprintf("%s address %s", desc, net.IP(d.b[d.off:d.off+ipLen])))
+	}
+	for _, desc := range []string{"source", "destination"} {
+		if d.off+2 > len(d.b) {
+			d.field(2, desc+" port")
+			return
+		}
+		d.field(2, fmt.Sprintf("%s port %d", desc, binary.BigEndian.Uint16(d.b[d.off:])))
+	}
+}
+
+func (d *dumper) dumpTLVs() {
+	for d.off < len(d.b) {
+		if d.off+3 > len(d.b) {
+			d.field(3, "TLV")
+			return
+		}
+		t := PP2Type(d.b[d.off])
+		n := int(binary.BigEndian.Uint16(d.b[d.off+1:]))
+		d.field(3, fmt.Sprintf("TLV type %#02x, length %d", byte(t), n))
+		if !d.field(n, "TLV value") {
+			return
+		}
+	}
+}
+
+func dumpTransport(fam AddressFamilyAndProtocol) string {
+	var family, protocol string
+	switch {
+	case fam&0xF0 == 0x00:
+		family = "UNSPEC"
+	case fam.IsIPv4():
+		family = "INET"
+	case fam.IsIPv6():
+		family = "INET6"
+	case fam.IsUnix():
+		family = "UNIX"
+	default:
+		family = "unknown"
+	}
+	switch {
+	case fam&0x0F == 0x00:
+		protocol = "UNSPEC"
+	case fam.IsStream():
+		protocol = "STREAM"
+	case fam.IsDatagram():
+		protocol = "DGRAM"
+	default:
+		protocol = "unknown"
+	}
+	return family + " " + protocol
+}
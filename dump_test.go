@@ -0,0 +1,156 @@
+package proxyproto
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDumpHeader(t *testing.T) {
+	header := HeaderProxyFromAddrs(2, v4addr, v4addr)
+	if err := header.SetTLVs([]TLV{{Type: PP2_TYPE_AUTHORITY, Value: []byte("example.org")}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	dump, err := DumpHeader(header)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := `0000  0d 0a 0d 0a 00 0d 0a 51 55 49 54 0a              version 2 signature
+000c  21                                               version 2, command PROXY
+000d  11                                               family and protocol INET STREAM
+000e  00 1a                                            length 26
+0010  7f 00 00 01                                      source address 127.0.0.1
+0014  7f 00 00 01                                      destination address 127.0.0.1
+0018  ff fd                                            source port 65533
+001a  ff fd                                            destination port 65533
+001c  02 00 0b                                         TLV type 0x02, length 11
+001f  65 78 61 6d 70 6c 65 2e 6f 72 67                 TLV value
+`
+	if dump != expected {
+		t.Fatalf("Expected dump\n%s\ngot\n%s", expected, dump)
+	}
+
+	if _, err := DumpHeader(&Header{Version: 3}); err != ErrUnknownProxyProtocolVersion {
+		t.Fatalf("Expected error %v, got %v", ErrUnknownProxyProtocolVersion, err)
+	}
+}
+
+func TestDumpBytes(t *testing.T) {
+	var cases = []struct {
+		name     string
+		b        []byte
+		contains []string
+	}{
+		{
+			name:     "v1 with payload",
+			b:        []byte(fixtureTCP4V1),
+			contains: []string{`version 1 header "PROXY TCP4 127.0.0.1 127.0.0.1 65533 65533\r\n"`, "47 45 54 20 2f"},
+		},
+		{
+			name:     "v2 truncated addresses",
+			b:        append(append(SIGV2, byte(PROXY), byte(TCPv6)), fixtureIPv6V2[:20]...),
+			contains: []string{"length 36", "source address ::1", "destination address (truncated)"},
+		},
+		{
+			name:     "v2 truncated TLV",
+			b:        append(append(SIGV2, byte(LOCAL), byte(UNSPEC)), 0x00, 0x05, byte(PP2_TYPE_NOOP), 0x00, 0x04, 0x00),
+			contains: []string{"command LOCAL", "family and protocol UNSPEC UNSPEC", "TLV type 0x04, length 4", "TLV value (truncated)"},
+		},
+		{
+			name:     "no header",
+			b:        []byte("GET / HTTP/1.1"),
+			contains: []string{"0000  47 45 54"},
+		},
+		{
+			name:     "long payload wraps",
+			b:        make([]byte, 40),
+			contains: []string{"0010  00", "0020  00"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dump := DumpBytes(tc.b)
+			for _, s := range tc.contains {
+				if !strings.Contains(dump, s) {
+					t.Fatalf("Expected dump to contain %q, got\n%s", s, dump)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeHexDump(t *testing.T) {
+	header := HeaderProxyFromAddrs(2, v4addr, v4addr)
+	if err := header.SetTLVs([]TLV{{Type: PP2_TYPE_AUTHORITY, Value: []byte("example.org")}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	raw, err := header.Format()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var cases = []struct {
+		name string
+		dump string
+	}{
+		{"plain", hex.EncodeToString(raw)},
+		{"spaced", fmt.Sprintf("% x", raw)},
+		{"DumpBytes", DumpBytes(append(raw, "GET /"...))},
+		{"encoding/hex.Dump", hex.Dump(raw)},
+		{
+			name: "xxd",
+			dump: `00000000: 0d0a 0d0a 000d 0a51 5549 540a 2111 001a  .......QUIT.!...
+00000010: 7f00 0001 7f00 0001 fffd fffd 0200 0b65  ...............e
+00000020: 7861 6d70 6c65 2e6f 7267 4745 5420 2f20  xample.orgGET /
+`,
+		},
+		{
+			name: "tcpdump",
+			dump: `12:00:00.000000 IP 127.0.0.1.65533 > 127.0.0.1.80: Flags [P.], length 42
+	0x0000:  4500 005e 0000 4000 4006 3c98 7f00 0001  E..^..@.@.<.....
+	0x0010:  7f00 0001 fffd 0050 0000 0001 0000 0001  .......P........
+	0x0020:  5018 ffff fe52 0000 0d0a 0d0a 000d 0a51  P....R.........Q
+	0x0030:  5549 540a 2111 001a 7f00 0001 7f00 0001  UIT.!...........
+	0x0040:  fffd fffd 0200 0b65 7861 6d70 6c65 2e6f  .......example.o
+	0x0050:  7267                                     rg
+`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			decoded, err := DecodeHexDump(tc.dump)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if !decoded.EqualsTo(header) {
+				t.Fatalf("Expected header %#v, got %#v", header, decoded)
+			}
+			if authority, _ := decoded.TLVs(); len(authority) != 1 || string(authority[0].Value) != "example.org" {
+				t.Fatalf("Unexpected TLVs %v", authority)
+			}
+		})
+	}
+
+	v1 := `00000000: 5052 4f58 5920 5443 5034 2031 3237 2e30  PROXY TCP4 127.0
+00000010: 2e30 2e31 2031 3237 2e30 2e30 2e31 2036  .0.1 127.0.0.1 6
+00000020: 3535 3333 2036 3535 3333 0d0a            5533 65533..
+`
+	decoded, err := DecodeHexDump(v1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !decoded.EqualsTo(HeaderProxyFromAddrs(1, v4addr, v4addr)) {
+		t.Fatalf("Unexpected header %#v", decoded)
+	}
+
+	if _, err := DecodeHexDump("no hex here"); err != ErrInvalidHexDump {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidHexDump, err)
+	}
+	if _, err := DecodeHexDump("47 45 54 20 2f"); err != ErrNoProxyProtocol {
+		t.Fatalf("Expected error %v, got %v", ErrNoProxyProtocol, err)
+	}
+}
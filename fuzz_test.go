@@ -0,0 +1,115 @@
+package proxyproto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func addParseSeeds(f *testing.F) {
+	for _, tt := range validParseAndWriteV1Tests {
+		if buf, err := tt.expectedHeader.Format(); err == nil {
+			f.Add(buf)
+		}
+	}
+	for _, tt := range validParseAndWriteV2Tests {
+		if buf, err := tt.expectedHeader.Format(); err == nil {
+			f.Add(buf)
+		}
+	}
+	f.Add([]byte(fixtureTCP4V1))
+	f.Add([]byte(fixtureUnknownWithAddresses))
+	f.Add(append(append(SIGV2, byte(PROXY), byte(TCPv4)), fixtureIPv4V2TLV...))
+	f.Add(append(append(SIGV2, byte(LOCAL), byte(UNSPEC)), fixtureUnspecTLV...))
+}
+
+func FuzzParse(f *testing.F) {
+	addParseSeeds(f)
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		header, n, err := Parse(b)
+		if err != nil {
+			return
+		}
+		if n <= 0 || n > len(b) {
+			t.Fatalf("Invalid header length %d for %d bytes", n, len(b))
+		}
+
+		// Parsing the header alone must give the same header back.
+		again, m, err := Parse(b[:n])
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if m != n || !again.EqualsTo(header) {
+			t.Fatalf("Expected header %+v of %d bytes, got %+v of %d bytes", header, n, again, m)
+		}
+
+		// Rendering must not panic, and whatever it renders must be parsed
+		// back to an equivalent header.
+		buf, err := header.Format()
+		if err != nil {
+			return
+		}
+		if l, err := header.Len(); err != nil || l != len(buf) {
+			t.Fatalf("Expected length %d, got %d, %v", len(buf), l, err)
+		}
+		if _, _, err := Parse(buf); err != nil {
+			t.Fatalf("Can't parse rendered header %q: %v", buf, err)
+		}
+	})
+}
+
+func FuzzTLVs(f *testing.F) {
+	f.Add(fixtureTLV)
+	f.Add([]byte{byte(PP2_TYPE_AUTHORITY), 0x00, 0x03, 'a', 'b', 'c', byte(PP2_TYPE_NOOP), 0x00, 0x00})
+	f.Add([]byte{byte(PP2_TYPE_SSL), 0x00})
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		header := &Header{Version: 2, rawTLVs: raw}
+
+		tlvs, err := SplitTLVs(raw)
+		var n int
+		iterErr := header.IterateTLVs(func(TLV) bool {
+			n++
+			return true
+		})
+		if (err == nil) != (iterErr == nil) {
+			t.Fatalf("SplitTLVs error %v doesn't match IterateTLVs error %v", err, iterErr)
+		}
+		if err != nil {
+			return
+		}
+		if n != len(tlvs) {
+			t.Fatalf("Expected %d TLVs, iterated over %d", len(tlvs), n)
+		}
+
+		for _, tlv := range tlvs {
+			if _, ok := header.TLV(tlv.Type); !ok {
+				t.Fatalf("Expected to find TLV %#x", tlv.Type)
+			}
+		}
+
+		joined, err := JoinTLVs(tlvs)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		split, err := SplitTLVs(joined)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(split) != len(tlvs) {
+			t.Fatalf("Expected %d TLVs once joined, got %d", len(tlvs), len(split))
+		}
+		if !bytes.Equal(header.TLVValue(PP2_TYPE_AUTHORITY), tlvValue(tlvs, PP2_TYPE_AUTHORITY)) {
+			t.Fatalf("TLVValue doesn't match SplitTLVs")
+		}
+	})
+}
+
+func tlvValue(tlvs []TLV, t PP2Type) []byte {
+	for _, tlv := range tlvs {
+		if tlv.Type == t {
+			return tlv.Value
+		}
+	}
+	return nil
+}
@@ -6,9 +6,14 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net"
+	"sync/atomic"
 	"time"
+
+	"github.com/pires/go-proxyproto/core"
 )
 
 var (
@@ -17,21 +22,22 @@ var (
 	SIGV2 = []byte{'\x0D', '\x0A', '\x0D', '\x0A', '\x00', '\x0D', '\x0A', '\x51', '\x55', '\x49', '\x54', '\x0A'}
 
 	ErrCantReadVersion1Header               = errors.New("proxyproto: can't read version 1 header")
-	ErrVersion1HeaderTooLong                = errors.New("proxyproto: version 1 header must be 107 bytes or less")
-	ErrLineMustEndWithCrlf                  = errors.New("proxyproto: version 1 header is invalid, must end with \\r\\n")
-	ErrCantReadProtocolVersionAndCommand    = errors.New("proxyproto: can't read proxy protocol version and command")
-	ErrCantReadAddressFamilyAndProtocol     = errors.New("proxyproto: can't read address family or protocol")
-	ErrCantReadLength                       = errors.New("proxyproto: can't read length")
+	ErrVersion1HeaderTooLong                = core.ErrVersion1HeaderTooLong
+	ErrLineMustEndWithCrlf                  = core.ErrLineMustEndWithCrlf
+	ErrCantReadProtocolVersionAndCommand    = core.ErrCantReadProtocolVersionAndCommand
+	ErrCantReadAddressFamilyAndProtocol     = core.ErrCantReadAddressFamilyAndProtocol
+	ErrCantReadLength                       = core.ErrCantReadLength
 	ErrCantResolveSourceUnixAddress         = errors.New("proxyproto: can't resolve source Unix address")
 	ErrCantResolveDestinationUnixAddress    = errors.New("proxyproto: can't resolve destination Unix address")
-	ErrNoProxyProtocol                      = errors.New("proxyproto: proxy protocol signature not present")
+	ErrNoProxyProtocol                      = core.ErrNoProxyProtocol
 	ErrUnknownProxyProtocolVersion          = errors.New("proxyproto: unknown proxy protocol version")
-	ErrUnsupportedProtocolVersionAndCommand = errors.New("proxyproto: unsupported proxy protocol version and command")
-	ErrUnsupportedAddressFamilyAndProtocol  = errors.New("proxyproto: unsupported address family and protocol")
-	ErrInvalidLength                        = errors.New("proxyproto: invalid length")
-	ErrInvalidAddress                       = errors.New("proxyproto: invalid address")
-	ErrInvalidPortNumber                    = errors.New("proxyproto: invalid port number")
+	ErrUnsupportedProtocolVersionAndCommand = core.ErrUnsupportedProtocolVersionAndCommand
+	ErrUnsupportedAddressFamilyAndProtocol  = core.ErrUnsupportedAddressFamilyAndProtocol
+	ErrInvalidLength                        = core.ErrInvalidLength
+	ErrInvalidAddress                       = core.ErrInvalidAddress
+	ErrInvalidPortNumber                    = core.ErrInvalidPortNumber
 	ErrSuperfluousProxyHeader               = errors.New("proxyproto: upstream connection sent PROXY header but isn't allowed to send one")
+	ErrUnsupportedV1Transport               = errors.New("proxyproto: transport protocol can't be represented in version 1")
 )
 
 // Header is the placeholder for proxy protocol header.
@@ -42,6 +48,7 @@ type Header struct {
 	SourceAddr        net.Addr
 	DestinationAddr   net.Addr
 	rawTLVs           []byte
+	tlvs              atomic.Value // []TLV split from rawTLVs, see TLVs
 }
 
 // HeaderProxyFromAddrs creates a new PROXY header from a source and a
@@ -97,6 +104,27 @@ func HeaderProxyFromAddrs(version byte, sourceAddr, destAddr net.Addr) *Header {
 	return h
 }
 
+// HeaderProxyFromConns creates a new PROXY header for a relay, from the
+// connection accepted from the client (downstream) and the one dialed to the
+// backend (upstream): the source address is the client's address, i.e. the
+// remote address of downstream, and the destination address is the local
+// address of upstream. If version is zero, the latest protocol version is
+// used, see HeaderProxyFromAddrs.
+func HeaderProxyFromConns(version byte, downstream, upstream net.Conn) *Header {
+	return HeaderProxyFromAddrs(version, downstream.RemoteAddr(), upstream.LocalAddr())
+}
+
+// NewLocalHeader creates a new v2 LOCAL header, as sent by load balancers on
+// their own connections, e.g. health checks. Receivers must use the real
+// connection addresses for such connections.
+func NewLocalHeader() *Header {
+	return &Header{
+		Version:           2,
+		Command:           LOCAL,
+		TransportProtocol: UNSPEC,
+	}
+}
+
 func (header *Header) TCPAddrs() (sourceAddr, destAddr *net.TCPAddr, ok bool) {
 	if !header.TransportProtocol.IsStream() {
 		return nil, nil, false
@@ -144,6 +172,118 @@ func (header *Header) Ports() (sourcePort, destPort int, ok bool) {
 	}
 }
 
+// Clone returns a deep copy of the header, including its addresses and TLVs,
+// which can be modified without affecting the original one.
+func (header *Header) Clone() *Header {
+	if header == nil {
+		return nil
+	}
+	clone := *header
+	clone.tlvs = atomic.Value{}
+	clone.SourceAddr = cloneAddr(header.SourceAddr)
+	clone.DestinationAddr = cloneAddr(header.DestinationAddr)
+	if header.rawTLVs != nil {
+		clone.rawTLVs = append([]byte{}, header.rawTLVs...)
+	}
+	return &clone
+}
+
+// ToV2 returns a version 2 copy of a version 1 header, e.g. for relays
+// normalizing headers from mixed fleets of proxies, which can then carry TLVs.
+// The addresses and transport protocol are preserved and the command is set
+// to PROXY, except for UNKNOWN headers which carry no address and become
+// LOCAL ones, like the parser reports them. Version 2 headers are cloned, and
+// ErrUnknownProxyProtocolVersion is returned for other versions.
+func (header *Header) ToV2() (*Header, error) {
+	switch header.Version {
+	case 1:
+	case 2:
+		return header.Clone(), nil
+	default:
+		return nil, ErrUnknownProxyProtocolVersion
+	}
+
+	v2 := &Header{
+		Version:           2,
+		Command:           PROXY,
+		TransportProtocol: header.TransportProtocol,
+		SourceAddr:        cloneAddr(header.SourceAddr),
+		DestinationAddr:   cloneAddr(header.DestinationAddr),
+	}
+	if header.TransportProtocol == UNSPEC {
+		v2.Command = LOCAL
+		v2.SourceAddr, v2.DestinationAddr = nil, nil
+	}
+	return v2, nil
+}
+
+// ToV1 returns a version 1 copy of a version 2 header, e.g. for relays
+// forwarding to legacy backends only supporting version 1, along with the
+// TLVs it can't carry, so that operators know exactly what is dropped. TCP
+// over IPv4 and IPv6 headers keep their addresses, while LOCAL and UNSPEC
+// ones become UNKNOWN headers. Other transport protocols, e.g. UDP or UNIX
+// sockets, can't be represented and ErrUnsupportedV1Transport is returned:
+// an UNKNOWN header can be sent instead, making the backend use the
+// connection addresses. Version 1 headers are cloned, and
+// ErrUnknownProxyProtocolVersion is returned for other versions.
+func (header *Header) ToV1() (*Header, []TLV, error) {
+	switch header.Version {
+	case 1:
+		return header.Clone(), nil, nil
+	case 2:
+	default:
+		return nil, nil, ErrUnknownProxyProtocolVersion
+	}
+
+	tlvs, err := header.TLVs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	v1 := &Header{
+		Version:           1,
+		Command:           LOCAL,
+		TransportProtocol: UNSPEC,
+	}
+	if header.Command.IsLocal() || header.TransportProtocol == UNSPEC {
+		return v1, tlvs, nil
+	}
+	switch header.TransportProtocol {
+	case TCPv4, TCPv6:
+	default:
+		return nil, nil, ErrUnsupportedV1Transport
+	}
+	sourceAddr, destAddr, ok := header.TCPAddrs()
+	if !ok {
+		return nil, nil, ErrInvalidAddress
+	}
+	v1.Command = PROXY
+	v1.TransportProtocol = header.TransportProtocol
+	v1.SourceAddr = cloneAddr(sourceAddr)
+	v1.DestinationAddr = cloneAddr(destAddr)
+	return v1, tlvs, nil
+}
+
+// cloneAddr returns a deep copy of the addresses used by headers, other
+// addresses are returned as is.
+func cloneAddr(addr net.Addr) net.Addr {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		clone := *addr
+		clone.IP = append(net.IP{}, addr.IP...)
+		return &clone
+	case *net.UDPAddr:
+		clone := *addr
+		clone.IP = append(net.IP{}, addr.IP...)
+		return &clone
+	case *net.UnixAddr:
+		clone := *addr
+		return &clone
+	default:
+		return addr
+	}
+}
+
 // EqualTo returns true if headers are equivalent, false otherwise.
 // Deprecated: use EqualsTo instead. This method will eventually be removed.
 func (header *Header) EqualTo(otherHeader *Header) bool {
@@ -171,12 +311,17 @@ func (header *Header) EqualsTo(otherHeader *Header) bool {
 }
 
 // WriteTo renders a proxy protocol header in a format and writes it to an io.Writer.
+// When w is a *ClientConn, ErrHeaderAlreadyWritten is returned if a header was
+// already written on it.
 func (header *Header) WriteTo(w io.Writer) (int64, error) {
 	buf, err := header.Format()
 	if err != nil {
 		return 0, err
 	}
 
+	if conn, ok := w.(*ClientConn); ok {
+		return conn.writeHeader(buf)
+	}
 	return bytes.NewBuffer(buf).WriteTo(w)
 }
 
@@ -192,9 +337,133 @@ func (header *Header) Format() ([]byte, error) {
 	}
 }
 
+// FormatOption customizes how a header is rendered by FormatWith.
+type FormatOption func(*formatOptions)
+
+type formatOptions struct {
+	v1UnknownFallback bool
+}
+
+// WithV1UnknownFallback makes version 1 headers whose addresses can't be
+// rendered as TCP4 or TCP6, e.g. mismatched address families, render as
+// "PROXY UNKNOWN\r\n" as allowed by the spec, instead of failing with
+// ErrInvalidAddress. Receivers then use the real connection addresses.
+func WithV1UnknownFallback() FormatOption {
+	return func(o *formatOptions) {
+		o.v1UnknownFallback = true
+	}
+}
+
+// FormatWith renders a proxy protocol header like Format, customized by the
+// given options.
+func (header *Header) FormatWith(opts ...FormatOption) ([]byte, error) {
+	var o formatOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	buf, err := header.Format()
+	if err == ErrInvalidAddress && header.Version == 1 && o.v1UnknownFallback {
+		return []byte("PROXY UNKNOWN" + crlf), nil
+	}
+	return buf, err
+}
+
+// Len returns the length of the header on the wire, without rendering it. It
+// returns the same error as Format if the header can't be rendered.
+func (header *Header) Len() (int, error) {
+	switch header.Version {
+	case 1:
+		return header.lenVersion1()
+	case 2:
+		return header.lenVersion2()
+	default:
+		return 0, ErrUnknownProxyProtocolVersion
+	}
+}
+
 // TLVs returns the TLVs stored into this header, if they exist.  TLVs are optional for v2 of the protocol.
+// The TLVs are split once and cached, each call returning a new copy of them,
+// values included, which the caller may modify.
 func (header *Header) TLVs() ([]TLV, error) {
-	return SplitTLVs(header.rawTLVs)
+	tlvs, ok := header.tlvs.Load().([]TLV)
+	if !ok {
+		var err error
+		tlvs, err = SplitTLVs(header.rawTLVs)
+		if err != nil {
+			return nil, err
+		}
+		header.tlvs.Store(tlvs)
+	}
+	if tlvs == nil {
+		return nil, nil
+	}
+
+	// Copy the values into a single buffer, each with its capacity capped
+	// so that appending to one doesn't overwrite the next.
+	size := 0
+	for _, tlv := range tlvs {
+		size += len(tlv.Value)
+	}
+	buf := make([]byte, 0, size)
+	copied := make([]TLV, len(tlvs))
+	for i, tlv := range tlvs {
+		copied[i].Type = tlv.Type
+		if tlv.Value != nil {
+			start := len(buf)
+			buf = append(buf, tlv.Value...)
+			copied[i].Value = buf[start:len(buf):len(buf)]
+		}
+	}
+	return copied, nil
+}
+
+// TLV returns the first TLV of the given type stored into this header. It
+// scans the raw TLVs without splitting them all, and reports false if there's
+// no such TLV or if the TLVs are malformed before it.
+func (header *Header) TLV(t PP2Type) (TLV, bool) {
+	var found TLV
+	var ok bool
+	_ = header.IterateTLVs(func(tlv TLV) bool {
+		if tlv.Type != t {
+			return true
+		}
+		found, ok = TLV{Type: t}, true
+		// Ignore no-op padding, as SplitTLVs does
+		if t != PP2_TYPE_NOOP {
+			found.Value = append([]byte{}, tlv.Value...)
+		}
+		return false
+	})
+	return found, ok
+}
+
+// IterateTLVs calls fn for each TLV stored into this header, in order, until
+// fn returns false. TLVs are decoded one at a time, without allocating: their
+// values, including no-op padding, point into the header's buffer and must be
+// copied to be retained or modified. ErrTruncatedTLV is returned if the TLVs
+// are malformed, after calling fn for the valid ones before.
+func (header *Header) IterateTLVs(fn func(TLV) bool) error {
+	return core.IterateTLVs(header.rawTLVs, func(t byte, value []byte) bool {
+		return fn(TLV{Type: PP2Type(t), Value: value})
+	})
+}
+
+// TLVValue returns the value of the first TLV of the given type stored into
+// this header, or nil if there's no such TLV, see TLV.
+func (header *Header) TLVValue(t PP2Type) []byte {
+	tlv, _ := header.TLV(t)
+	return tlv.Value
+}
+
+// RawTLVs returns a copy of the raw TLV vector stored into this header, as
+// read or formatted, or nil if there's none. It allows forwarding or hashing
+// the TLVs verbatim, without decoding and encoding them again.
+func (header *Header) RawTLVs() []byte {
+	if len(header.rawTLVs) == 0 {
+		return nil
+	}
+	return append([]byte(nil), header.rawTLVs...)
 }
 
 // SetTLVs sets the TLVs stored in this header. This method replaces any
@@ -205,6 +474,72 @@ func (header *Header) SetTLVs(tlvs []TLV) error {
 		return err
 	}
 	header.rawTLVs = raw
+	header.tlvs = atomic.Value{}
+	return nil
+}
+
+// AppendTLVs appends TLVs to the ones stored in this header, keeping them,
+// e.g. for a relay to add its own TLVs to the ones of the upstream proxy. An
+// error is returned, leaving the header untouched, if the TLVs can't be
+// joined or if the header would be too long to be formatted.
+func (header *Header) AppendTLVs(tlvs ...TLV) error {
+	raw, err := JoinTLVs(tlvs)
+	if err != nil {
+		return err
+	}
+	if len(raw) == 0 {
+		return nil
+	}
+	if int(addressesLenVersion2(header.TransportProtocol))+len(header.rawTLVs)+len(raw) > math.MaxUint16 {
+		return errUint16Overflow
+	}
+	// Copy the TLVs rather than appending in place, as their buffer may be
+	// shared, e.g. with a clone.
+	rawTLVs := make([]byte, 0, len(header.rawTLVs)+len(raw))
+	header.rawTLVs = append(append(rawTLVs, header.rawTLVs...), raw...)
+	header.tlvs = atomic.Value{}
+	return nil
+}
+
+// PadTo appends a PP2_TYPE_NOOP TLV to this header so that its formatted
+// length is exactly totalLen bytes, as some load balancers do to emit headers
+// of a constant size. Only version 2 headers can be padded. An error is
+// returned if the header is already longer than totalLen, or if it's shorter
+// by less than the 3 bytes a TLV takes at least.
+func (header *Header) PadTo(totalLen int) error {
+	if header.Version != 2 {
+		return ErrUnknownProxyProtocolVersion
+	}
+
+	buf, err := header.Format()
+	if err != nil {
+		return err
+	}
+
+	padLen := totalLen - len(buf)
+	if padLen == 0 {
+		return nil
+	}
+	if padLen < 3 {
+		return fmt.Errorf("proxyproto: cannot pad header of %d bytes to %d bytes", len(buf), totalLen)
+	}
+	// The length field covers everything past the first 16 bytes.
+	if totalLen-16 > math.MaxUint16 {
+		return errUint16Overflow
+	}
+
+	noop, err := JoinTLVs([]TLV{{
+		Type:  PP2_TYPE_NOOP,
+		Value: make([]byte, padLen-3),
+	}})
+	if err != nil {
+		return err
+	}
+	// Copy the TLVs rather than appending in place, see AppendTLVs.
+	rawTLVs := make([]byte, 0, len(header.rawTLVs)+len(noop))
+	header.rawTLVs = append(append(rawTLVs, header.rawTLVs...), noop...)
+	header.tlvs = atomic.Value{}
+
 	return nil
 }
 
@@ -218,44 +553,166 @@ func (header *Header) SetTLVs(tlvs []TLV) error {
 // the remaining header, assume the reader buffer to be in a corrupt state.
 // Also, this operation will block until enough bytes are available for peeking.
 func Read(reader *bufio.Reader) (*Header, error) {
+	return ReadWith(reader)
+}
+
+// V1MaxLen is the maximum length of a version 1 header per spec, including
+// its final CRLF. Longer lines are rejected with ErrVersion1HeaderTooLong.
+const V1MaxLen = core.V1MaxLen
+
+// ReadOption customizes how a header is read by ReadWith.
+type ReadOption func(*readOptions)
+
+type readOptions struct {
+	v1MaxLen int
+}
+
+// WithV1MaxLen lowers the maximum length of version 1 headers, including
+// their final CRLF, to n. Longer lines are rejected with
+// ErrVersion1HeaderTooLong as soon as n bytes have been read without finding
+// the end of the line. It is ignored if n is zero or negative, or greater
+// than V1MaxLen.
+func WithV1MaxLen(n int) ReadOption {
+	return func(o *readOptions) {
+		if n > 0 && n < V1MaxLen {
+			o.v1MaxLen = n
+		}
+	}
+}
+
+// ReadWith reads a header like Read, customized by the given options.
+func ReadWith(reader *bufio.Reader, opts ...ReadOption) (*Header, error) {
+	header := new(Header)
+	if err := ReadIntoWith(reader, header, opts...); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// Parse reads a header from the beginning of b, and returns it along with its
+// length, i.e. the offset in b at which the payload starts. Allocations are
+// bounded by the length of the header, whatever the length of the payload. It
+// returns ErrNoProxyProtocol if b doesn't start with a header, including when
+// b is too short to hold a whole signature, and another error if the header is
+// incomplete.
+func Parse(b []byte) (*Header, int, error) {
+	r := bytes.NewReader(b)
+	reader := bufio.NewReaderSize(r, readBufferSize)
+	header, err := Read(reader)
+	if err != nil {
+		return nil, 0, err
+	}
+	return header, len(b) - r.Len() - reader.Buffered(), nil
+}
+
+// ReadInto is like Read, but fills the given header instead of allocating a
+// new one. The header's buffers, i.e. its addresses and TLVs, are reused when
+// possible, which allows pooling headers: neither the header nor anything
+// obtained from it must be in use anymore. If an error is returned, the
+// header is left in an unspecified state.
+func ReadInto(reader *bufio.Reader, header *Header) error {
+	return ReadIntoWith(reader, header)
+}
+
+// ReadIntoWith is like ReadInto, customized by the given options.
+func ReadIntoWith(reader *bufio.Reader, header *Header, opts ...ReadOption) error {
+	o := readOptions{v1MaxLen: V1MaxLen}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	header.reset()
+
 	// In order to improve speed for small non-PROXYed packets, take a peek at the first byte alone.
 	b1, err := reader.Peek(1)
 	if err != nil {
 		if err == io.EOF {
-			return nil, ErrNoProxyProtocol
+			return ErrNoProxyProtocol
 		}
-		return nil, err
+		return err
 	}
 
 	if bytes.Equal(b1[:1], SIGV1[:1]) || bytes.Equal(b1[:1], SIGV2[:1]) {
 		signature, err := reader.Peek(5)
 		if err != nil {
 			if err == io.EOF {
-				return nil, ErrNoProxyProtocol
+				return ErrNoProxyProtocol
 			}
-			return nil, err
+			return err
 		}
 		if bytes.Equal(signature[:5], SIGV1) {
-			return parseVersion1(reader)
+			return header.finishRead(parseVersion1(reader, header, o.v1MaxLen))
 		}
 
 		signature, err = reader.Peek(12)
 		if err != nil {
 			if err == io.EOF {
-				return nil, ErrNoProxyProtocol
+				return ErrNoProxyProtocol
 			}
-			return nil, err
+			return err
 		}
 		if bytes.Equal(signature[:12], SIGV2) {
-			return parseVersion2(reader)
+			return header.finishRead(parseVersion2(reader, header))
 		}
 	}
 
-	return nil, ErrNoProxyProtocol
+	return ErrNoProxyProtocol
+}
+
+// reset clears the header, keeping its buffers for reuse.
+func (header *Header) reset() {
+	*header = Header{
+		SourceAddr:      header.SourceAddr,
+		DestinationAddr: header.DestinationAddr,
+		rawTLVs:         header.rawTLVs[:0],
+	}
+}
+
+// finishRead drops the addresses kept by reset if the parsed header has none.
+func (header *Header) finishRead(err error) error {
+	if err == nil && header.TransportProtocol.IsUnspec() {
+		header.SourceAddr = nil
+		header.DestinationAddr = nil
+	}
+	return err
 }
 
-// ReadTimeout acts as Read but takes a timeout. If that timeout is reached, it's assumed
-// there's no proxy protocol header.
+// SniffVersion identifies the proxy protocol version from the first bytes of
+// a connection without consuming them, e.g. as returned by bufio.Reader.Peek.
+// At most 12 bytes are inspected.
+//
+// The returned version is 1 or 2 when the bytes match the corresponding
+// signature, and 0 when they don't carry a PROXY header. ok is false when
+// peek is too short to tell, in which case the caller should peek further
+// before deciding.
+func SniffVersion(peek []byte) (version int, ok bool) {
+	if len(peek) > len(SIGV2) {
+		peek = peek[:len(SIGV2)]
+	}
+
+	switch {
+	case len(peek) >= len(SIGV1) && bytes.Equal(peek[:len(SIGV1)], SIGV1):
+		return 1, true
+	case len(peek) == len(SIGV2) && bytes.Equal(peek, SIGV2):
+		return 2, true
+	case bytes.HasPrefix(SIGV1, peek) || bytes.HasPrefix(SIGV2, peek):
+		// Could still be either signature, need more bytes.
+		return 0, false
+	}
+
+	return 0, true
+}
+
+// ReadTimeout acts as Read but takes a timeout. If that timeout is reached,
+// ErrReadHeaderTimeout is returned.
+//
+// Since a bufio.Reader can't be interrupted, the header is read in a separate
+// goroutine which stays blocked until the underlying reader returns, even after
+// the timeout is reached.
+//
+// Deprecated: the goroutine reading the header leaks until the underlying
+// reader returns. Use ReadTimeoutConn, which relies on the connection's read
+// deadline instead.
 func ReadTimeout(reader *bufio.Reader, timeout time.Duration) (*Header, error) {
 	type header struct {
 		h *Header
@@ -275,6 +732,72 @@ func ReadTimeout(reader *bufio.Reader, timeout time.Duration) (*Header, error) {
 		timer.Stop()
 		return result.h, result.e
 	case <-timer.C:
-		return nil, ErrNoProxyProtocol
+		return nil, ErrReadHeaderTimeout
 	}
 }
+
+// ReadTimeoutConn acts as Read, reader reading from conn, but takes a timeout,
+// applied by setting a read deadline on conn. If that timeout is reached,
+// ErrReadHeaderTimeout is returned.
+//
+// As net.Conn has no way to retrieve its read deadline, the read deadline of
+// conn is restored before returning if conn exposes it with a ReadDeadline
+// method, like *Conn, in which case it's also kept if it's earlier than the
+// timeout, and cleared otherwise.
+func ReadTimeoutConn(conn net.Conn, reader *bufio.Reader, timeout time.Duration) (*Header, error) {
+	var previous time.Time
+	if d, ok := conn.(interface{ ReadDeadline() time.Time }); ok {
+		previous = d.ReadDeadline()
+	}
+	deadline := time.Now().Add(timeout)
+	if !previous.IsZero() && previous.Before(deadline) {
+		deadline = previous
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	header, err := Read(reader)
+
+	if err := conn.SetReadDeadline(previous); err != nil {
+		return nil, err
+	}
+	if isTimeout(err) {
+		return nil, ErrReadHeaderTimeout
+	}
+
+	return header, err
+}
+
+// readError is returned when reading a header fails because of the
+// underlying reader. It wraps err, the usual error, and implements net.Error
+// like cause, so that e.g. timeouts are classified as such.
+type readError struct {
+	err   error
+	cause error
+}
+
+func (e *readError) Error() string { return e.err.Error() + ": " + e.cause.Error() }
+func (e *readError) Unwrap() error { return e.err }
+func (e *readError) Timeout() bool { return isTimeout(e.cause) }
+
+func (e *readError) Temporary() bool {
+	var netErr net.Error
+	return errors.As(e.cause, &netErr) && netErr.Temporary()
+}
+
+// withReadCause returns err, or a *readError wrapping it if cause, the error
+// of the underlying reader, is a net.Error.
+func withReadCause(err, cause error) error {
+	var netErr net.Error
+	if !errors.As(cause, &netErr) {
+		return err
+	}
+	return &readError{err: err, cause: cause}
+}
+
+// isTimeout returns whether err is a net.Error reporting a timeout.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
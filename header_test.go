@@ -4,8 +4,10 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"math"
 	"net"
 	"reflect"
+	"runtime"
 	"testing"
 	"time"
 )
@@ -56,9 +58,12 @@ func TestReadTimeoutV1Invalid(t *testing.T) {
 	reader := bufio.NewReader(&b)
 	_, err := ReadTimeout(reader, 50*time.Millisecond)
 	if err == nil {
-		t.Fatalf("expected error %s", ErrNoProxyProtocol)
-	} else if err != ErrNoProxyProtocol {
-		t.Fatalf("expected %s, actual %s", ErrNoProxyProtocol, err)
+		t.Fatalf("expected error %s", ErrReadHeaderTimeout)
+	} else if err != ErrReadHeaderTimeout {
+		t.Fatalf("expected %s, actual %s", ErrReadHeaderTimeout, err)
+	}
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("expected a net.Error timeout, actual %#v", err)
 	}
 }
 
@@ -74,6 +79,70 @@ func TestReadTimeoutPropagatesReadError(t *testing.T) {
 	}
 }
 
+func TestReadTimeoutConn(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// Nothing is ever written, the deadline must be reached.
+	_, err := ReadTimeoutConn(server, bufio.NewReader(server), 50*time.Millisecond)
+	if err != ErrReadHeaderTimeout {
+		t.Fatalf("expected %s, actual %s", ErrReadHeaderTimeout, err)
+	}
+
+	// The deadline, already reached, must have been cleared.
+	go func() {
+		_, _ = client.Write([]byte("PROXY TCP4 127.0.0.1 127.0.0.1 65533 65533\r\nping"))
+	}()
+	header, err := Read(bufio.NewReader(server))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if header.Version != 1 || header.SourceAddr.String() != "127.0.0.1:65533" {
+		t.Fatalf("unexpected header %+v", header)
+	}
+}
+
+func TestReadTimeoutConnRestoresDeadline(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// The connection exposes its read deadline, which must be restored.
+	conn := NewConn(server, WithPolicy(SKIP))
+	deadline := time.Now().Add(time.Hour)
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		_, _ = client.Write([]byte("PROXY TCP4 127.0.0.1 127.0.0.1 65533 65533\r\n"))
+	}()
+	if _, err := ReadTimeoutConn(conn, bufio.NewReader(conn), 5*time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !conn.ReadDeadline().Equal(deadline) {
+		t.Fatalf("expected the deadline %v to be restored, got %v", deadline, conn.ReadDeadline())
+	}
+
+	// An earlier deadline is kept.
+	if err := conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := ReadTimeoutConn(conn, bufio.NewReader(conn), time.Hour)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != ErrReadHeaderTimeout {
+			t.Fatalf("expected %s, actual %v", ErrReadHeaderTimeout, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the earlier deadline to be kept")
+	}
+}
+
 func TestEqualsTo(t *testing.T) {
 	var headersEqual = []struct {
 		this, that *Header
@@ -394,6 +463,155 @@ func TestSetTLVs(t *testing.T) {
 	}
 }
 
+func TestTLVsCache(t *testing.T) {
+	header := HeaderProxyFromAddrs(2, v4addr, v4addr)
+	if err := header.SetTLVs([]TLV{{Type: PP2_TYPE_AUTHORITY, Value: []byte("example.org")}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	tlvs, err := header.TLVs()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tlvs[0].Type = PP2_TYPE_NOOP
+	tlvs[0].Value[0] = 'X'
+	tlvs[0].Value = append(tlvs[0].Value, ".com"...)
+
+	tlvs, err = header.TLVs()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(tlvs) != 1 || tlvs[0].Type != PP2_TYPE_AUTHORITY || string(tlvs[0].Value) != "example.org" {
+		t.Fatalf("Expected cached TLVs to be untouched, got %+v", tlvs)
+	}
+	if value := header.TLVValue(PP2_TYPE_AUTHORITY); string(value) != "example.org" {
+		t.Fatalf("Expected the header to be untouched, got %q", value)
+	}
+
+	if err := header.SetTLVs([]TLV{{Type: PP2_TYPE_NETNS, Value: []byte("ns")}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tlvs, err = header.TLVs()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(tlvs) != 1 || tlvs[0].Type != PP2_TYPE_NETNS {
+		t.Fatalf("Expected SetTLVs to invalidate cached TLVs, got %+v", tlvs)
+	}
+
+	if err := header.PadTo(128); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tlvs, err = header.TLVs()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(tlvs) != 2 || tlvs[1].Type != PP2_TYPE_NOOP {
+		t.Fatalf("Expected PadTo to invalidate cached TLVs, got %+v", tlvs)
+	}
+}
+
+func TestTLVLookup(t *testing.T) {
+	header := HeaderProxyFromAddrs(2, v4addr, v4addr)
+	if err := header.SetTLVs([]TLV{
+		{Type: PP2_TYPE_NOOP, Value: []byte{0, 0}},
+		{Type: PP2_TYPE_AUTHORITY, Value: []byte("example.org")},
+		{Type: PP2_TYPE_UNIQUE_ID, Value: []byte("first")},
+		{Type: PP2_TYPE_UNIQUE_ID, Value: []byte("second")},
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if tlv, ok := header.TLV(PP2_TYPE_AUTHORITY); !ok || string(tlv.Value) != "example.org" {
+		t.Fatalf("Expected authority TLV, got %+v, %t", tlv, ok)
+	}
+	if value := header.TLVValue(PP2_TYPE_UNIQUE_ID); string(value) != "first" {
+		t.Fatalf("Expected first unique ID, got %q", value)
+	}
+	if tlv, ok := header.TLV(PP2_TYPE_NOOP); !ok || tlv.Value != nil {
+		t.Fatalf("Expected NOOP TLV without value, got %+v, %t", tlv, ok)
+	}
+	if tlv, ok := header.TLV(PP2_TYPE_NETNS); ok {
+		t.Fatalf("Expected no NETNS TLV, got %+v", tlv)
+	}
+	if value := header.TLVValue(PP2_TYPE_NETNS); value != nil {
+		t.Fatalf("Expected no NETNS value, got %q", value)
+	}
+
+	// Truncated TLVs
+	header.rawTLVs = header.rawTLVs[:len(header.rawTLVs)-1]
+	if tlv, ok := header.TLV(PP2_TYPE_AUTHORITY); !ok || string(tlv.Value) != "example.org" {
+		t.Fatalf("Expected authority TLV before the truncated one, got %+v, %t", tlv, ok)
+	}
+	if value := header.TLVValue(PP2_TYPE_UNIQUE_ID); string(value) != "first" {
+		t.Fatalf("Expected first unique ID, got %q", value)
+	}
+	header.rawTLVs = header.rawTLVs[:2]
+	if _, ok := header.TLV(PP2_TYPE_NOOP); ok {
+		t.Fatalf("Expected no TLV in truncated TLVs")
+	}
+}
+
+func TestIterateTLVs(t *testing.T) {
+	header := HeaderProxyFromAddrs(2, v4addr, v4addr)
+	expected := []TLV{
+		{Type: PP2_TYPE_AUTHORITY, Value: []byte("example.org")},
+		{Type: PP2_TYPE_NOOP, Value: []byte{0, 0}},
+		{Type: PP2_TYPE_UNIQUE_ID, Value: []byte("id")},
+	}
+	if err := header.SetTLVs(expected); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var tlvs []TLV
+	if err := header.IterateTLVs(func(tlv TLV) bool {
+		tlvs = append(tlvs, tlv)
+		return true
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(tlvs) != len(expected) {
+		t.Fatalf("Expected %d TLVs, got %d", len(expected), len(tlvs))
+	}
+	for i := range expected {
+		if tlvs[i].Type != expected[i].Type || !bytes.Equal(tlvs[i].Value, expected[i].Value) {
+			t.Fatalf("Expected TLV %+v, got %+v", expected[i], tlvs[i])
+		}
+	}
+
+	// Stop early
+	var calls int
+	if err := header.IterateTLVs(func(tlv TLV) bool {
+		calls++
+		return false
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("Expected 1 call, got %d", calls)
+	}
+
+	// Truncated TLVs
+	header.rawTLVs = header.rawTLVs[:len(header.rawTLVs)-1]
+	calls = 0
+	if err := header.IterateTLVs(func(tlv TLV) bool {
+		calls++
+		return true
+	}); err != ErrTruncatedTLV {
+		t.Fatalf("Expected error %v, got %v", ErrTruncatedTLV, err)
+	}
+	if calls != 2 {
+		t.Fatalf("Expected 2 calls before the truncated TLV, got %d", calls)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = header.IterateTLVs(func(tlv TLV) bool { return true })
+	})
+	if allocs != 0 {
+		t.Fatalf("Expected no allocation, got %v", allocs)
+	}
+}
+
 func TestWriteTo(t *testing.T) {
 	var buf bytes.Buffer
 
@@ -532,10 +750,252 @@ func TestFormatInvalid(t *testing.T) {
 			} else if err != test.err {
 				t.Errorf("Header.Format() = %q, want %q", err, test.err)
 			}
+			if _, err := test.header.Len(); err != test.err {
+				t.Errorf("Header.Len() = %v, want %q", err, test.err)
+			}
 		})
 	}
 }
 
+func TestFormatWithV1UnknownFallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   *Header
+		expected string
+		err      error
+	}{
+		{
+			name:     "TCPv4",
+			header:   HeaderProxyFromAddrs(1, v4addr, v4addr),
+			expected: "PROXY TCP4 127.0.0.1 127.0.0.1 65533 65533\r\n",
+		},
+		{
+			name: "mismatched families",
+			header: &Header{
+				Version:           1,
+				Command:           PROXY,
+				TransportProtocol: TCPv4,
+				SourceAddr:        v6addr,
+				DestinationAddr:   v4addr,
+			},
+			expected: "PROXY UNKNOWN\r\n",
+		},
+		{
+			name:     "unix",
+			header:   HeaderProxyFromAddrs(1, unixStreamAddr, unixStreamAddr),
+			expected: "PROXY UNKNOWN\r\n",
+		},
+		{
+			name: "v2 is left untouched",
+			header: &Header{
+				Version:           2,
+				Command:           PROXY,
+				TransportProtocol: TCPv4,
+				SourceAddr:        v6addr,
+				DestinationAddr:   v4addr,
+			},
+			err: ErrInvalidAddress,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf, err := test.header.FormatWith(WithV1UnknownFallback())
+			if err != test.err {
+				t.Fatalf("Expected error %v, got %v", test.err, err)
+			}
+			if err == nil && string(buf) != test.expected {
+				t.Fatalf("Expected %q, got %q", test.expected, buf)
+			}
+		})
+	}
+}
+
+func TestLen(t *testing.T) {
+	var headers []*Header
+	for _, tt := range validParseAndWriteV1Tests {
+		if !tt.skipWrite {
+			headers = append(headers, tt.expectedHeader)
+		}
+	}
+	for _, tt := range validParseAndWriteV2Tests {
+		headers = append(headers, tt.expectedHeader)
+	}
+	withTLVs := HeaderProxyFromAddrs(2, v4addr, v4addr)
+	if err := withTLVs.SetTLVs([]TLV{{Type: PP2_TYPE_NOOP, Value: make([]byte, 42)}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	headers = append(headers, withTLVs)
+
+	for _, header := range headers {
+		buf, err := header.Format()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		n, err := header.Len()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if n != len(buf) {
+			t.Fatalf("Expected length %d, got %d for header %+v", len(buf), n, header)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	header := HeaderProxyFromAddrs(2,
+		&net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000},
+		&net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000},
+	)
+	if err := header.SetTLVs([]TLV{{Type: PP2_TYPE_AUTHORITY, Value: []byte("example.org")}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	clone := header.Clone()
+	if !clone.EqualsTo(header) {
+		t.Fatalf("Expected clone %+v to equal %+v", clone, header)
+	}
+
+	clone.SourceAddr.(*net.TCPAddr).IP[len(net.IPv6zero)-1] = 42
+	clone.DestinationAddr.(*net.TCPAddr).Port = 4242
+	clone.rawTLVs[len(clone.rawTLVs)-1] = 'x'
+	if clone.EqualsTo(header) {
+		t.Fatalf("Expected modifying the clone to leave the original header untouched")
+	}
+	if header.SourceAddr.String() != "10.1.1.1:1000" || header.DestinationAddr.String() != "20.2.2.2:2000" {
+		t.Fatalf("Expected original addresses to be untouched, got %v and %v", header.SourceAddr, header.DestinationAddr)
+	}
+	tlvs, err := header.TLVs()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(tlvs[0].Value) != "example.org" {
+		t.Fatalf("Expected original TLVs to be untouched, got %q", tlvs[0].Value)
+	}
+
+	if (*Header)(nil).Clone() != nil {
+		t.Fatalf("Expected nil clone of a nil header")
+	}
+}
+
+func TestToV2(t *testing.T) {
+	var cases = []struct {
+		name     string
+		v1       string
+		expected *Header
+	}{
+		{"TCP4", "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n", HeaderProxyFromAddrs(2,
+			&net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000},
+			&net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000})},
+		{"TCP6", "PROXY TCP6 ::1 ::2 1000 2000\r\n", HeaderProxyFromAddrs(2,
+			&net.TCPAddr{IP: net.ParseIP("::1"), Port: 1000},
+			&net.TCPAddr{IP: net.ParseIP("::2"), Port: 2000})},
+		{"UNKNOWN", "PROXY UNKNOWN\r\n", NewLocalHeader()},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			header, err := Read(bufio.NewReader(bytes.NewReader([]byte(tc.v1))))
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			v2, err := header.ToV2()
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if !v2.EqualsTo(tc.expected) {
+				t.Fatalf("Expected header %#v, got %#v", tc.expected, v2)
+			}
+			if header.Version != 1 {
+				t.Fatalf("Expected the original header to be untouched, got version %d", header.Version)
+			}
+			if err := v2.AppendTLVs(TLV{Type: PP2_TYPE_AUTHORITY, Value: []byte("example.org")}); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if _, err := v2.Format(); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		})
+	}
+
+	header := HeaderProxyFromAddrs(2, v4addr, v4addr)
+	if v2, err := header.ToV2(); err != nil || v2 == header || !v2.EqualsTo(header) {
+		t.Fatalf("Expected a clone of the v2 header, got %#v with error %v", v2, err)
+	}
+	if _, err := (&Header{Version: 3}).ToV2(); err != ErrUnknownProxyProtocolVersion {
+		t.Fatalf("Expected error %v, got %v", ErrUnknownProxyProtocolVersion, err)
+	}
+}
+
+func TestToV1(t *testing.T) {
+	tlvs := []TLV{
+		{Type: PP2_TYPE_AUTHORITY, Value: []byte("example.org")},
+		{Type: PP2Type(0xee), Value: []byte{0, 0}},
+	}
+	withTLVs := func(header *Header) *Header {
+		if err := header.SetTLVs(tlvs); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return header
+	}
+	local := withTLVs(NewLocalHeader())
+	unix := withTLVs(HeaderProxyFromAddrs(2,
+		&net.UnixAddr{Net: "unix", Name: "src"},
+		&net.UnixAddr{Net: "unix", Name: "dst"}))
+
+	var cases = []struct {
+		name        string
+		header      *Header
+		expected    string
+		expectedErr error
+	}{
+		{"TCP4", withTLVs(HeaderProxyFromAddrs(2,
+			&net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000},
+			&net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000})), "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n", nil},
+		{"TCP6", withTLVs(HeaderProxyFromAddrs(2,
+			&net.TCPAddr{IP: net.ParseIP("::1"), Port: 1000},
+			&net.TCPAddr{IP: net.ParseIP("::2"), Port: 2000})), "PROXY TCP6 ::1 ::2 1000 2000\r\n", nil},
+		{"LOCAL", local, "PROXY UNKNOWN\r\n", nil},
+		{"UNIX", unix, "", ErrUnsupportedV1Transport},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			v1, dropped, err := tc.header.ToV1()
+			if err != tc.expectedErr {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(dropped, tlvs) {
+				t.Fatalf("Expected dropped TLVs %v, got %v", tlvs, dropped)
+			}
+			buf, err := v1.Format()
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if string(buf) != tc.expected {
+				t.Fatalf("Expected %q, got %q", tc.expected, buf)
+			}
+			if tc.header.Version != 2 {
+				t.Fatalf("Expected the original header to be untouched, got version %d", tc.header.Version)
+			}
+		})
+	}
+
+	header := HeaderProxyFromAddrs(1, v4addr, v4addr)
+	if v1, dropped, err := header.ToV1(); err != nil || v1 == header || !v1.EqualsTo(header) || dropped != nil {
+		t.Fatalf("Expected a clone of the v1 header, got %#v dropping %v with error %v", v1, dropped, err)
+	}
+	if v1, dropped, err := HeaderProxyFromAddrs(2, v4addr, v4addr).ToV1(); err != nil || len(dropped) != 0 || v1.Version != 1 {
+		t.Fatalf("Expected nothing to be dropped, got %#v dropping %v with error %v", v1, dropped, err)
+	}
+	if _, _, err := (&Header{Version: 3}).ToV1(); err != ErrUnknownProxyProtocolVersion {
+		t.Fatalf("Expected error %v, got %v", ErrUnknownProxyProtocolVersion, err)
+	}
+}
+
 func TestHeaderProxyFromAddrs(t *testing.T) {
 	unspec := &Header{
 		Version:           2,
@@ -789,3 +1249,367 @@ func TestHeaderProxyFromAddrs(t *testing.T) {
 		})
 	}
 }
+
+type addrConn struct {
+	net.Conn // nil; crash on any unexpected use
+	local    net.Addr
+	remote   net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr  { return c.local }
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestHeaderProxyFromConns(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000}
+	proxyFront := &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000}
+	proxyBack := &net.TCPAddr{IP: net.ParseIP("30.3.3.3"), Port: 3000}
+	backend := &net.TCPAddr{IP: net.ParseIP("40.4.4.4"), Port: 4000}
+
+	downstream := addrConn{local: proxyFront, remote: client}
+	upstream := addrConn{local: proxyBack, remote: backend}
+
+	h := HeaderProxyFromConns(1, downstream, upstream)
+	expected := &Header{
+		Version:           1,
+		Command:           PROXY,
+		TransportProtocol: TCPv4,
+		SourceAddr:        client,
+		DestinationAddr:   proxyBack,
+	}
+	if !h.EqualsTo(expected) {
+		t.Fatalf("expected %+v, actual %+v", expected, h)
+	}
+}
+
+func TestParse(t *testing.T) {
+	header, n, err := Parse([]byte(fixtureTCP4V1))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if payload := fixtureTCP4V1[n:]; payload != "GET /" {
+		t.Fatalf("Expected payload %q, got %q", "GET /", payload)
+	}
+	if header.Version != 1 || header.TransportProtocol != TCPv4 {
+		t.Fatalf("Unexpected header %+v", header)
+	}
+
+	buf := append(append(SIGV2, byte(PROXY), byte(TCPv4)), fixtureIPv4V2TLV...)
+	if _, n, err = Parse(buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != len(buf) {
+		t.Fatalf("Expected header length %d, got %d", len(buf), n)
+	}
+
+	if _, _, err := Parse(buf[:len(buf)-1]); err != ErrInvalidLength {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidLength, err)
+	}
+	for _, b := range [][]byte{nil, []byte("PRO"), SIGV2[:8]} {
+		if _, _, err := Parse(b); err != ErrNoProxyProtocol {
+			t.Fatalf("Expected error %v for %q, got %v", ErrNoProxyProtocol, b, err)
+		}
+	}
+}
+
+func TestParseLargePayload(t *testing.T) {
+	header := "PROXY TCP4 " + IPv4AddressesAndPorts + crlf
+	buf := append([]byte(header), make([]byte, 1<<20)...)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, n, err := Parse(buf)
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != len(header) {
+		t.Fatalf("Expected header length %d, got %d", len(header), n)
+	}
+	// The payload mustn't be copied.
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64<<10 {
+		t.Fatalf("Expected parsing not to depend on the payload, allocated %d bytes", allocated)
+	}
+}
+
+func TestReadInto(t *testing.T) {
+	withTLVs := HeaderProxyFromAddrs(2, v4addr, v4addr)
+	if err := withTLVs.SetTLVs([]TLV{{Type: PP2_TYPE_AUTHORITY, Value: []byte("example.org")}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	headers := []*Header{
+		withTLVs,
+		HeaderProxyFromAddrs(2, v6addr, v6addr),
+		HeaderProxyFromAddrs(1, v4addr, v4addr),
+		HeaderProxyFromAddrs(2, v4UDPAddr, v4UDPAddr),
+		NewLocalHeader(),
+		{Version: 1, Command: LOCAL, TransportProtocol: UNSPEC},
+		HeaderProxyFromAddrs(2, unixStreamAddr, unixStreamAddr),
+		HeaderProxyFromAddrs(2, v4addr, v4addr),
+	}
+
+	header := new(Header)
+	for _, expected := range headers {
+		buf, err := expected.Format()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := ReadInto(newBufioReader(buf), header); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !header.EqualsTo(expected) {
+			t.Fatalf("Expected header %+v, got %+v", expected, header)
+		}
+		if expected.TransportProtocol == UNSPEC && (header.SourceAddr != nil || header.DestinationAddr != nil) {
+			t.Fatalf("Expected no addresses, got %v and %v", header.SourceAddr, header.DestinationAddr)
+		}
+		// TLVs cached by the previous header must not leak
+		tlvs, err := header.TLVs()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		expectedTLVs, _ := expected.TLVs()
+		if len(tlvs) != len(expectedTLVs) {
+			t.Fatalf("Expected TLVs %+v, got %+v", expectedTLVs, tlvs)
+		}
+	}
+
+	// Reading a header of the same kind reuses the addresses
+	sourceAddr := header.SourceAddr
+	buf, err := HeaderProxyFromAddrs(2, v4addr, v4addr).Format()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ReadInto(newBufioReader(buf), header); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if header.SourceAddr != sourceAddr {
+		t.Fatalf("Expected source address to be reused")
+	}
+
+	if err := ReadInto(newBufioReader([]byte("GET / HTTP/1.1")), header); err != ErrNoProxyProtocol {
+		t.Fatalf("Expected error %v, got %v", ErrNoProxyProtocol, err)
+	}
+}
+
+func TestSniffVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		peek    []byte
+		version int
+		ok      bool
+	}{
+		{name: "empty", peek: nil, version: 0, ok: false},
+		{name: "v1 partial", peek: []byte("PRO"), version: 0, ok: false},
+		{name: "v1", peek: []byte("PROXY"), version: 1, ok: true},
+		{name: "v1 full line", peek: []byte("PROXY TCP4 127.0.0.1 127.0.0.1 1 2\r\n"), version: 1, ok: true},
+		{name: "v2 partial", peek: SIGV2[:6], version: 0, ok: false},
+		{name: "v2", peek: SIGV2, version: 2, ok: true},
+		{name: "v2 with payload", peek: append(append([]byte{}, SIGV2...), 0x21, 0x11), version: 2, ok: true},
+		{name: "http", peek: []byte("GET / HTTP/1.1"), version: 0, ok: true},
+		{name: "almost v1", peek: []byte("PROXi"), version: 0, ok: true},
+		{name: "almost v2", peek: append(append([]byte{}, SIGV2[:11]...), 0x00), version: 0, ok: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, ok := SniffVersion(tt.peek)
+			if version != tt.version || ok != tt.ok {
+				t.Fatalf("expected (%d, %t), actual (%d, %t)", tt.version, tt.ok, version, ok)
+			}
+		})
+	}
+}
+
+func TestPadTo(t *testing.T) {
+	header := &Header{
+		Version:           2,
+		Command:           PROXY,
+		TransportProtocol: TCPv4,
+		SourceAddr:        v4addr,
+		DestinationAddr:   v4addr,
+	}
+	if err := header.SetTLVs([]TLV{{Type: PP2_TYPE_AUTHORITY, Value: []byte("example.org")}}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	// 16 bytes of fixed header, 12 bytes of addresses and 14 bytes of TLV.
+	if err := header.PadTo(42); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := header.PadTo(41); err == nil {
+		t.Fatal("expected error padding to a shorter length")
+	}
+	if err := header.PadTo(44); err == nil {
+		t.Fatal("expected error padding by less than a TLV")
+	}
+
+	if err := header.PadTo(100); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	buf, err := header.Format()
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(buf) != 100 {
+		t.Fatalf("expected header of 100 bytes, actual %d", len(buf))
+	}
+
+	parsed, err := Read(bufio.NewReader(bytes.NewReader(buf)))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	tlvs, err := parsed.TLVs()
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(tlvs) != 2 || tlvs[0].Type != PP2_TYPE_AUTHORITY || tlvs[1].Type != PP2_TYPE_NOOP {
+		t.Fatalf("unexpected TLVs %v", tlvs)
+	}
+
+	if err := header.PadTo(1 << 17); err == nil {
+		t.Fatal("expected error padding beyond the maximum length")
+	}
+	if err := (&Header{Version: 1}).PadTo(100); err != ErrUnknownProxyProtocolVersion {
+		t.Fatalf("expected %s, actual %v", ErrUnknownProxyProtocolVersion, err)
+	}
+}
+
+func TestPadToParsed(t *testing.T) {
+	buf := append(append(SIGV2, byte(PROXY), byte(TCPv4)), fixtureIPv4V2TLV...)
+	header, err := Read(bufio.NewReader(bytes.NewReader(buf)))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	// The TLVs of parsed headers have spare capacity in their buffer, which
+	// may be shared and mustn't be written to.
+	backing := header.rawTLVs[:cap(header.rawTLVs)]
+	before := append([]byte{}, backing...)
+	if err := header.PadTo(len(buf) + 4); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if !bytes.Equal(backing, before) {
+		t.Fatalf("expected the TLVs buffer to be left untouched, got %x instead of %x", backing, before)
+	}
+}
+
+func TestPadToUnix(t *testing.T) {
+	header := &Header{
+		Version:           2,
+		Command:           PROXY,
+		TransportProtocol: UnixStream,
+		SourceAddr:        unixStreamAddr,
+		DestinationAddr:   unixStreamAddr,
+	}
+	if err := header.PadTo(16 + 216 + 10); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	buf, err := header.Format()
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	parsed, err := Read(bufio.NewReader(bytes.NewReader(buf)))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if !parsed.EqualsTo(header) {
+		t.Fatalf("expected %+v, actual %+v", header, parsed)
+	}
+}
+
+func TestRawTLVs(t *testing.T) {
+	header := HeaderProxyFromAddrs(2, v4addr, v4addr)
+	if raw := header.RawTLVs(); raw != nil {
+		t.Fatalf("Expected no TLVs, got %v", raw)
+	}
+
+	tlvs := []TLV{
+		{Type: PP2_TYPE_AUTHORITY, Value: []byte("example.org")},
+		{Type: PP2_TYPE_UNIQUE_ID, Value: []byte("id")},
+	}
+	if err := header.SetTLVs(tlvs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected, err := JoinTLVs(tlvs)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Parse the formatted header for the TLVs to be the ones read.
+	b, err := header.Format()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	parsed, _, err := Parse(b)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	raw := parsed.RawTLVs()
+	if !bytes.Equal(raw, expected) {
+		t.Fatalf("Expected raw TLVs %v, got %v", expected, raw)
+	}
+
+	// The TLVs are copied.
+	raw[0] = byte(PP2_TYPE_NOOP)
+	if tlv, ok := parsed.TLV(PP2_TYPE_AUTHORITY); !ok || string(tlv.Value) != "example.org" {
+		t.Fatalf("Expected the header's TLVs to be left untouched, got %+v", tlv)
+	}
+}
+
+func TestAppendTLVs(t *testing.T) {
+	header := HeaderProxyFromAddrs(2, v4addr, v4addr)
+	upstream := []TLV{
+		{Type: PP2_TYPE_AUTHORITY, Value: []byte("example.org")},
+		{Type: PP2_TYPE_UNIQUE_ID, Value: []byte("id")},
+	}
+	if err := header.SetTLVs(upstream); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	clone := header.Clone()
+	// Fill the TLVs cache, which must be invalidated.
+	if _, err := header.TLVs(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	hop := TLV{Type: PP2_TYPE_NETNS, Value: []byte("ns")}
+	if err := header.AppendTLVs(hop); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tlvs, err := header.TLVs()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := append(append([]TLV{}, upstream...), hop)
+	if len(tlvs) != len(expected) {
+		t.Fatalf("Expected %d TLVs, got %d", len(expected), len(tlvs))
+	}
+	for i := range expected {
+		if tlvs[i].Type != expected[i].Type || !bytes.Equal(tlvs[i].Value, expected[i].Value) {
+			t.Fatalf("Expected TLV %+v, got %+v", expected[i], tlvs[i])
+		}
+	}
+	if cloneTLVs, err := clone.TLVs(); err != nil || len(cloneTLVs) != len(upstream) {
+		t.Fatalf("Expected the clone's TLVs to be left untouched, got %v, %v", cloneTLVs, err)
+	}
+	if _, err := header.Format(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The header must remain formattable.
+	before := header.RawTLVs()
+	large := TLV{Type: PP2_TYPE_NOOP, Value: make([]byte, math.MaxUint16-len(before)-int(lengthV4)-3+1)}
+	if err := header.AppendTLVs(large); err != errUint16Overflow {
+		t.Fatalf("Expected error %v, got %v", errUint16Overflow, err)
+	}
+	if !bytes.Equal(header.RawTLVs(), before) {
+		t.Fatalf("Expected the TLVs to be left untouched on error")
+	}
+	large.Value = large.Value[1:]
+	if err := header.AppendTLVs(large); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := header.Format(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
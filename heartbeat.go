@@ -0,0 +1,112 @@
+package proxyproto
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultHeartbeatInterval is the interval between heartbeats, if
+// Heartbeat.Interval is not positive.
+const DefaultHeartbeatInterval = 30 * time.Second
+
+// Heartbeat keeps long-lived client connections alive while they are idle,
+// e.g. in a Pool, by periodically sending a keep-alive message on them.
+//
+// The message is sent by Ping, e.g. the application's own ping. Alternatively,
+// v2 LOCAL headers can be sent with SendLocalHeaders, which only receivers
+// reading a header before each message accept on connections which already
+// carried a header. Receivers reading a single header per connection, such as
+// Listener and most servers, would take them for application data. If
+// neither is set, no heartbeat is sent.
+type Heartbeat struct {
+	// Interval is the time between heartbeats. If zero or negative,
+	// DefaultHeartbeatInterval is used. It also bounds each heartbeat, as a
+	// deadline is set on the connection for Ping to complete.
+	Interval time.Duration
+	// Ping sends a heartbeat on conn, e.g. an application level ping, and
+	// reads its reply if any.
+	Ping func(conn *ClientConn) error
+	// SendLocalHeaders, if Ping is nil, makes heartbeats v2 LOCAL headers
+	// sent with conn.WriteHeartbeat. The receiver must accept them, see
+	// Heartbeat.
+	SendLocalHeaders bool
+}
+
+// WriteHeartbeat writes a v2 LOCAL header on the connection, unlike
+// WriteHeader even if a header was already written. Receivers reading a
+// single header per connection take it for application data, see Heartbeat.
+func (c *ClientConn) WriteHeartbeat() error {
+	_, err := c.Conn.Write(localHeartbeat)
+	return err
+}
+
+var localHeartbeat, _ = NewLocalHeader().Format()
+
+func (h *Heartbeat) interval() time.Duration {
+	if h.Interval <= 0 {
+		return DefaultHeartbeatInterval
+	}
+	return h.Interval
+}
+
+func (h *Heartbeat) ping(conn *ClientConn) error {
+	if err := conn.SetDeadline(time.Now().Add(h.interval())); err != nil {
+		return err
+	}
+	var err error
+	if h.Ping != nil {
+		err = h.Ping(conn)
+	} else {
+		err = conn.WriteHeartbeat()
+	}
+	if err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// Start sends heartbeats on conn every Interval until the returned function
+// is called, which waits for a heartbeat in progress to complete. The
+// connection mustn't be used otherwise in the meantime. When a heartbeat
+// fails, the connection is closed, no more heartbeats are sent and the
+// returned function returns the error.
+func (h *Heartbeat) Start(conn *ClientConn) (stop func() error) {
+	return h.start(conn, nil)
+}
+
+// start acts as Start, calling onError, if not nil, when a heartbeat fails.
+func (h *Heartbeat) start(conn *ClientConn, onError func(error)) func() error {
+	if h.Ping == nil && !h.SendLocalHeaders {
+		return func() error { return nil }
+	}
+
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	var err error
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(h.interval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+			}
+			if err = h.ping(conn); err != nil {
+				conn.Close()
+				if onError != nil {
+					onError(err)
+				}
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() error {
+		once.Do(func() { close(stopCh) })
+		<-done
+		return err
+	}
+}
@@ -0,0 +1,130 @@
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	headers := make(chan *Header)
+	go func() {
+		defer close(headers)
+		reader := bufio.NewReader(server)
+		for {
+			header, err := Read(reader)
+			if err != nil {
+				return
+			}
+			headers <- header
+		}
+	}()
+
+	conn := NewClientConn(client)
+	heartbeat := &Heartbeat{Interval: 10 * time.Millisecond, SendLocalHeaders: true}
+	stop := heartbeat.Start(conn)
+	for i := 0; i < 2; i++ {
+		select {
+		case header := <-headers:
+			if !header.EqualsTo(NewLocalHeader()) {
+				t.Fatalf("expected a LOCAL header, got %#v", header)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for heartbeat")
+		}
+	}
+	if err := stop(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := stop(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Heartbeats don't count as the header of the connection.
+	if conn.HeaderWritten() {
+		t.Fatal("expected no header to be written")
+	}
+}
+
+func TestHeartbeatPingError(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	errPing := errors.New("ping failed")
+	pings := 0
+	pinged := make(chan struct{}, 1)
+	conn := NewClientConn(client)
+	heartbeat := &Heartbeat{
+		Interval: time.Millisecond,
+		Ping: func(c *ClientConn) error {
+			if c != conn {
+				t.Errorf("expected the heartbeat's connection")
+			}
+			pings++
+			select {
+			case pinged <- struct{}{}:
+			default:
+			}
+			return errPing
+		},
+	}
+	stop := heartbeat.Start(conn)
+	select {
+	case <-pinged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for heartbeat")
+	}
+	if err := stop(); err != errPing {
+		t.Fatalf("expected error %v, got %v", errPing, err)
+	}
+	if pings != 1 {
+		t.Fatalf("expected heartbeats to stop after the failing one, got %d", pings)
+	}
+
+	// The connection was closed.
+	if _, err := conn.Write([]byte("ping")); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+}
+
+func TestHeartbeatInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		heartbeat := &Heartbeat{Interval: interval}
+		if heartbeat.interval() != DefaultHeartbeatInterval {
+			t.Fatalf("expected interval %v for %v, got %v", DefaultHeartbeatInterval, interval, heartbeat.interval())
+		}
+	}
+
+	// Starting heartbeats with a negative interval mustn't panic.
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	stop := (&Heartbeat{Interval: -time.Second, SendLocalHeaders: true}).Start(NewClientConn(client))
+	if err := stop(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestHeartbeatNoPing(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// LOCAL headers must be opted in to.
+	stop := (&Heartbeat{Interval: time.Millisecond}).Start(NewClientConn(client))
+	defer stop()
+	if err := server.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var ne net.Error
+	if _, err := server.Read(make([]byte, 1)); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("expected no heartbeat, got %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+// Package expvar publishes the counters of PROXY protocol listeners with the
+// standard expvar package, and thus on /debug/vars, without any dependency.
+//
+// It's a separate package because importing expvar registers its handler on
+// http.DefaultServeMux.
+package expvar
+
+import (
+	"errors"
+	"expvar"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// ErrAlreadyPublished is returned by Publish if a variable with the same name
+// is already published.
+var ErrAlreadyPublished = errors.New("proxyproto: expvar variable already published")
+
+// Publish publishes the counters of the listener, see Listener.Stats, as an
+// expvar variable named prefix, e.g. "proxyproto" or "proxyproto.public" to
+// tell several listeners apart. The variable is a map computed on each
+// read:
+//
+//	{"open": 1, "accepted": 2, "rejected": 0, "headers_v1": 0, "headers_v2": 2}
+//
+// As expvar variables can't be unpublished, Publish should be called once per
+// prefix, e.g. when the listener is created.
+func Publish(prefix string, ln *proxyproto.Listener) error {
+	if expvar.Get(prefix) != nil {
+		return ErrAlreadyPublished
+	}
+	expvar.Publish(prefix, Func(ln))
+	return nil
+}
+
+// Func returns an expvar variable computing the counters of the listener,
+// like the one published by Publish, e.g. to publish it in an expvar.Map.
+func Func(ln *proxyproto.Listener) expvar.Func {
+	return func() interface{} {
+		stats := ln.Stats()
+		return map[string]interface{}{
+			"open":       stats.Open,
+			"accepted":   stats.Accepted,
+			"rejected":   stats.Rejected,
+			"headers_v1": stats.HeadersV1,
+			"headers_v2": stats.HeadersV2,
+		}
+	}
+}
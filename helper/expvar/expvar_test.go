@@ -0,0 +1,60 @@
+package expvar
+
+import (
+	"encoding/json"
+	"expvar"
+	"net"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+)
+
+func TestPublish(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &proxyproto.Listener{Listener: ln}
+	defer pl.Close()
+
+	if err := Publish("proxyproto.test", pl); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := Publish("proxyproto.test", pl); err != ErrAlreadyPublished {
+		t.Fatalf("expected %v, got %v", ErrAlreadyPublished, err)
+	}
+
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"))
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	recv := make([]byte, 4)
+	if _, err := conn.Read(recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	v := expvar.Get("proxyproto.test")
+	if v == nil {
+		t.Fatalf("expected the variable to be published")
+	}
+	var stats map[string]int
+	if err := json.Unmarshal([]byte(v.String()), &stats); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := map[string]int{"open": 1, "accepted": 1, "rejected": 0, "headers_v1": 1, "headers_v2": 0}
+	for key, value := range expected {
+		if stats[key] != value {
+			t.Fatalf("expected %d for %q, got %d", value, key, stats[key])
+		}
+	}
+}
@@ -2,7 +2,9 @@
 package http2
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -11,11 +13,16 @@ import (
 	"time"
 
 	"github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/tlvparse"
 	"golang.org/x/net/http2"
 )
 
 const listenerRetryBaseDelay = 5 * time.Millisecond
 
+// supportedProtos are the TLS ALPN protocols served, see
+// https://www.iana.org/assignments/tls-extensiontype-values/tls-extensiontype-values.xhtml#alpn-protocol-ids
+var supportedProtos = []string{http2.NextProtoTLS, "h2c", "http/1.0", "http/1.1"}
+
 // Server is an HTTP server accepting both regular and proxied, both HTTP/1 and
 // HTTP/2 connections.
 //
@@ -24,33 +31,156 @@ const listenerRetryBaseDelay = 5 * time.Millisecond
 // TLS-terminating proxy in front of the server must be configured to accept
 // the "h2" TLS ALPN protocol.
 //
+// The contexts of requests hold the PROXY header and the TLS ALPN protocol of
+// their connection, see ProxyHeaderFromContext and ProtocolFromContext.
+//
 // The server is closed when the http.Server is.
 type Server struct {
 	h1         *http.Server  // regular HTTP/1 server
 	h2         *http2.Server // HTTP/2 server
 	h2Err      error         // HTTP/2 server setup error, if any
 	h1Listener h1Listener    // pipe listener for the HTTP/1 server
+	conns      chan struct{} // connection slots, nil if unlimited
+	queueSize  int           // size of the HTTP/1 connection queue
+	queue      QueuePolicy   // overflow policy of the HTTP/1 connection queue
+	done       chan struct{} // closed when the server is
+	h1Protos   sync.Map      // negotiated protocols of HTTP/1 connections, by net.Conn
+
+	connContext func(context.Context, net.Conn) context.Context // user-provided http.Server.ConnContext
 
 	// The following fields are protected by the mutex
 	mu        sync.Mutex
 	closed    bool
 	listeners map[net.Listener]struct{}
+	handlers  map[string]ConnHandler
+}
+
+// contextKey is a value for use with context.WithValue. It's used as a pointer
+// so it fits in an interface{} without allocation.
+type contextKey struct {
+	name string
+}
+
+func (k *contextKey) String() string { return "proxyproto/helper/http2 context value " + k.name }
+
+var (
+	// ProxyHeaderContextKey is a context key. It can be used in HTTP
+	// handlers with Context.Value to access the *proxyproto.Header of the
+	// connection the request came on, if any.
+	ProxyHeaderContextKey = &contextKey{"proxy-header"}
+	// ProtocolContextKey is a context key. It can be used in HTTP handlers
+	// with Context.Value to access the TLS ALPN protocol negotiated for the
+	// connection the request came on, as a string, empty if none was.
+	ProtocolContextKey = &contextKey{"protocol"}
+)
+
+// ProxyHeaderFromContext returns the PROXY header of the connection a request
+// came on, or nil if it had none.
+func ProxyHeaderFromContext(ctx context.Context) *proxyproto.Header {
+	proxyHeader, _ := ctx.Value(ProxyHeaderContextKey).(*proxyproto.Header)
+	return proxyHeader
+}
+
+// ProtocolFromContext returns the TLS ALPN protocol negotiated for the
+// connection a request came on, empty if none was.
+func ProtocolFromContext(ctx context.Context) string {
+	proto, _ := ctx.Value(ProtocolContextKey).(string)
+	return proto
+}
+
+// ConnHandler serves a connection whose TLS ALPN protocol it has been
+// registered for with Server.HandleProto. It's responsible for closing the
+// connection.
+type ConnHandler func(conn net.Conn) error
+
+// Option configures a Server, see NewServer.
+type Option func(*Server)
+
+// WithMaxConns limits the number of connections served concurrently to n.
+// When the limit is reached, the server stops accepting connections until one
+// is closed. HTTP/1 connections are released when closed or hijacked, others
+// when their HTTP/2 or ConnHandler serving returns. Zero or a negative n
+// means no limit, the default.
+func WithMaxConns(n int) Option {
+	return func(srv *Server) {
+		if n <= 0 {
+			srv.conns = nil
+			return
+		}
+		srv.conns = make(chan struct{}, n)
+	}
+}
+
+// WithH1Queue sets the size of the queue of HTTP/1 connections handed over to
+// the http.Server, which accepts them one at a time, and what happens when
+// it's full: by default, 64 connections are queued and serving the next one
+// blocks. Dropped and rejected connections are closed and logged. A size of
+// zero or less keeps the default.
+func WithH1Queue(size int, policy QueuePolicy) Option {
+	return func(srv *Server) {
+		if size > 0 {
+			srv.queueSize = size
+		}
+		srv.queue = policy
+	}
+}
+
+// WithIdleTimeout closes connections after waiting for the next request for d,
+// overriding the IdleTimeout of both the HTTP/1 and the HTTP/2 servers.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(srv *Server) {
+		srv.h1.IdleTimeout = d
+		srv.h2.IdleTimeout = d
+	}
+}
+
+// WithMaxConcurrentStreams limits the number of concurrent streams each HTTP/2
+// client may open, overriding the MaxConcurrentStreams of the HTTP/2 server.
+func WithMaxConcurrentStreams(n uint32) Option {
+	return func(srv *Server) {
+		srv.h2.MaxConcurrentStreams = n
+	}
 }
 
 // NewServer creates a new HTTP server.
 //
-// A nil h2 is equivalent to a zero http2.Server.
-func NewServer(h1 *http.Server, h2 *http2.Server) *Server {
+// A nil h2 is equivalent to a zero http2.Server. Options may modify both h1
+// and h2.
+func NewServer(h1 *http.Server, h2 *http2.Server, opts ...Option) *Server {
 	if h2 == nil {
 		h2 = new(http2.Server)
 	}
 	srv := &Server{
 		h1:        h1,
 		h2:        h2,
-		h2Err:     http2.ConfigureServer(h1, h2),
+		queueSize: defaultQueueSize,
+		done:      make(chan struct{}),
 		listeners: make(map[net.Listener]struct{}),
 	}
-	srv.h1Listener = h1Listener{newPipeListener(), srv}
+	for _, opt := range opts {
+		opt(srv)
+	}
+	srv.h2Err = http2.ConfigureServer(h1, h2)
+	if srv.conns != nil {
+		// HTTP/1 connections are handed over to the HTTP/1 server, which
+		// tells when it's done with them.
+		connState := h1.ConnState
+		h1.ConnState = func(conn net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				srv.releaseConn()
+			}
+			if connState != nil {
+				connState(conn, state)
+			}
+		}
+	}
+	srv.connContext = h1.ConnContext
+	h1.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+		proto, _ := srv.h1Protos.LoadAndDelete(conn)
+		s, _ := proto.(string)
+		return srv.withConn(ctx, conn, s)
+	}
+	srv.h1Listener = h1Listener{newPipeListener(srv.queueSize, srv.queue, srv.dropConn), srv}
 	go func() {
 		// proxyListener.Accept never fails
 		_ = h1.Serve(srv.h1Listener)
@@ -58,6 +188,47 @@ func NewServer(h1 *http.Server, h2 *http2.Server) *Server {
 	return srv
 }
 
+// HandleProto registers the handler for connections negotiating the TLS ALPN
+// protocol proto, e.g. "acme-tls/1" or "imap", either directly via a tls.Conn,
+// either indirectly via the PROXY protocol. This turns the server into a
+// general connection router: handlers take precedence over the built-in
+// HTTP/1 and HTTP/2 ones, and a nil handler unregisters the protocol.
+func (srv *Server) HandleProto(proto string, handler ConnHandler) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if handler == nil {
+		delete(srv.handlers, proto)
+		return
+	}
+	if srv.handlers == nil {
+		srv.handlers = make(map[string]ConnHandler)
+	}
+	srv.handlers[proto] = handler
+}
+
+// protos returns the TLS ALPN protocols served.
+func (srv *Server) protos() []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if len(srv.handlers) == 0 {
+		return supportedProtos
+	}
+	protos := append([]string{}, supportedProtos...)
+	for proto := range srv.handlers {
+		protos = append(protos, proto)
+	}
+	return protos
+}
+
+// handler returns the handler registered for the TLS ALPN protocol, if any.
+func (srv *Server) handler(proto string) ConnHandler {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.handlers[proto]
+}
+
 func (srv *Server) errorLog() *log.Logger {
 	if srv.h1.ErrorLog != nil {
 		return srv.h1.ErrorLog
@@ -92,7 +263,20 @@ func (srv *Server) Serve(ln net.Listener) error {
 	// This mirrors what the net/http package does.
 	var delay time.Duration
 	for {
+		if !srv.acquireConn() {
+			return http.ErrServerClosed
+		}
 		conn, err := ln.Accept()
+		if err != nil {
+			srv.releaseConn()
+		}
+		// Connections rejected by a proxyproto.Listener don't affect the
+		// next ones, no need to wait.
+		var acceptErr *proxyproto.AcceptError
+		if errors.As(err, &acceptErr) && acceptErr.RemoteAddr != nil && acceptErr.Temporary() {
+			srv.errorLog().Printf("listener %q: %v", ln.Addr(), err)
+			continue
+		}
 		if ne, ok := err.(net.Error); ok && ne.Timeout() {
 			if delay == 0 {
 				delay = listenerRetryBaseDelay
@@ -104,6 +288,7 @@ func (srv *Server) Serve(ln net.Listener) error {
 			}
 			srv.errorLog().Printf("listener %q: accept error (retrying in %v): %v", ln.Addr(), delay, err)
 			time.Sleep(delay)
+			continue
 		} else if err != nil {
 			return fmt.Errorf("failed to accept connection: %w", err)
 		}
@@ -118,6 +303,28 @@ func (srv *Server) Serve(ln net.Listener) error {
 	}
 }
 
+// acquireConn waits for a connection slot, and returns false if the server is
+// closed meanwhile.
+func (srv *Server) acquireConn() bool {
+	if srv.conns == nil {
+		return true
+	}
+	select {
+	case srv.conns <- struct{}{}:
+		return true
+	case <-srv.done:
+		return false
+	}
+}
+
+func (srv *Server) releaseConn() {
+	if srv.conns != nil {
+		<-srv.conns
+	}
+}
+
+// serveConn serves the connection, and releases its slot unless it's handed
+// over to the HTTP/1 server.
 func (srv *Server) serveConn(conn net.Conn) error {
 	var proto string
 	switch conn := conn.(type) {
@@ -127,37 +334,81 @@ func (srv *Server) serveConn(conn net.Conn) error {
 		if proxyHeader := conn.ProxyHeader(); proxyHeader != nil {
 			tlvs, err := proxyHeader.TLVs()
 			if err != nil {
+				srv.releaseConn()
 				conn.Close()
 				return err
 			}
-			for _, tlv := range tlvs {
-				if tlv.Type == proxyproto.PP2_TYPE_ALPN {
-					proto = string(tlv.Value)
-					break
-				}
+			proto, err = tlvparse.NegotiateALPN(tlvs, srv.protos())
+			if err != nil {
+				srv.releaseConn()
+				conn.Close()
+				return err
 			}
 		}
 	}
 
-	// See https://www.iana.org/assignments/tls-extensiontype-values/tls-extensiontype-values.xhtml#alpn-protocol-ids
+	if handler := srv.handler(proto); handler != nil {
+		defer srv.releaseConn()
+		return handler(conn)
+	}
+
 	switch proto {
 	case http2.NextProtoTLS, "h2c":
+		defer srv.releaseConn()
 		defer conn.Close()
-		opts := http2.ServeConnOpts{Handler: srv.h1.Handler}
+		ctx := srv.withConn(context.Background(), conn, proto)
+		opts := http2.ServeConnOpts{Context: ctx, Handler: srv.h1.Handler}
 		srv.h2.ServeConn(conn, &opts)
 		return nil
 	case "", "http/1.0", "http/1.1":
-		return srv.h1Listener.ServeConn(conn)
+		srv.h1Protos.Store(conn, proto)
+		err := srv.h1Listener.ServeConn(conn)
+		if err != nil {
+			srv.h1Protos.Delete(conn)
+			srv.releaseConn()
+			conn.Close()
+		}
+		return err
 	default:
+		srv.releaseConn()
 		conn.Close()
 		return fmt.Errorf("unsupported protocol %q", proto)
 	}
 }
 
+// dropConn closes an HTTP/1 connection dropped from the queue before the
+// HTTP/1 server accepted it, and releases its slot.
+func (srv *Server) dropConn(conn net.Conn) {
+	srv.h1Protos.Delete(conn)
+	srv.releaseConn()
+	conn.Close()
+	select {
+	case <-srv.done:
+	default:
+		srv.errorLog().Printf("dropped queued HTTP/1 connection from %v", conn.RemoteAddr())
+	}
+}
+
+// withConn returns a copy of ctx holding the PROXY header and the negotiated
+// protocol of conn, and calls the user-provided ConnContext, if any.
+func (srv *Server) withConn(ctx context.Context, conn net.Conn, proto string) context.Context {
+	if proxyHeader, ok := proxyproto.HeaderFromConn(conn); ok {
+		ctx = context.WithValue(ctx, ProxyHeaderContextKey, proxyHeader)
+	}
+	ctx = context.WithValue(ctx, ProtocolContextKey, proto)
+	if srv.connContext != nil {
+		ctx = srv.connContext(ctx, conn)
+	}
+	return ctx
+}
+
 func (srv *Server) closeListeners() error {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 
+	if !srv.closed {
+		close(srv.done)
+	}
 	srv.closed = true
 
 	var err error
@@ -177,7 +428,8 @@ type h1Listener struct {
 }
 
 func (ln h1Listener) Close() error {
-	// pipeListener.Close never fails
+	err := ln.srv.closeListeners()
+	// The queued connections are dropped once the server is closed.
 	_ = ln.pipeListener.Close()
-	return ln.srv.closeListeners()
+	return err
 }
@@ -1,11 +1,15 @@
 package http2_test
 
 import (
+	"bufio"
+	"context"
 	"errors"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/pires/go-proxyproto"
 	h2proxy "github.com/pires/go-proxyproto/helper/http2"
@@ -112,3 +116,238 @@ func newTestServer(t *testing.T) (addr string, server *http.Server) {
 
 	return ln.Addr().String(), server
 }
+
+func TestServer_HandleProto(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	h2Server := h2proxy.NewServer(server, nil)
+	h2Server.HandleProto("imap", func(conn net.Conn) error {
+		defer conn.Close()
+		_, err := conn.Write([]byte("* OK IMAP4rev1 ready\r\n"))
+		return err
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- h2Server.Serve(&proxyproto.Listener{Listener: ln})
+	}()
+	defer func() {
+		server.Close()
+		if err := <-done; err != nil && !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("failed to serve: %v", err)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	proxyHeader := proxyproto.Header{
+		Version:           2,
+		Command:           proxyproto.LOCAL,
+		TransportProtocol: proxyproto.UNSPEC,
+	}
+	if err := proxyHeader.SetTLVs([]proxyproto.TLV{{
+		Type:  proxyproto.PP2_TYPE_ALPN,
+		Value: []byte("imap"),
+	}}); err != nil {
+		t.Fatalf("failed to set TLVs: %v", err)
+	}
+	if _, err := proxyHeader.WriteTo(conn); err != nil {
+		t.Fatalf("failed to write PROXY header: %v", err)
+	}
+
+	greeting, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("failed to read greeting: %v", err)
+	}
+	if string(greeting) != "* OK IMAP4rev1 ready\r\n" {
+		t.Fatalf("unexpected greeting %q", greeting)
+	}
+}
+
+func TestServer_WithMaxConns(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	h2Server := h2proxy.NewServer(server, nil, h2proxy.WithMaxConns(1), h2proxy.WithMaxConcurrentStreams(10))
+	done := make(chan error, 1)
+	go func() {
+		done <- h2Server.Serve(ln)
+	}()
+	defer func() {
+		server.Close()
+		if err := <-done; err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, http.ErrServerClosed) {
+			t.Fatalf("failed to serve: %v", err)
+		}
+	}()
+
+	get := func(conn net.Conn) error {
+		if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+			return err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer first.Close()
+	if err := get(first); err != nil {
+		t.Fatalf("failed to perform HTTP request: %v", err)
+	}
+
+	// The first connection is kept alive, so the second one must wait.
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer second.Close()
+	if err := second.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatalf("failed to set deadline: %v", err)
+	}
+	var ne net.Error
+	if err := get(second); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("expected the second connection to wait, got %v", err)
+	}
+
+	first.Close()
+	if err := second.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("failed to set deadline: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(second), nil)
+	if err != nil {
+		t.Fatalf("expected the second connection to be served once the first is closed: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestServer_WithMaxConnsUnlimited(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		ln, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+		h2Server := h2proxy.NewServer(server, nil, h2proxy.WithMaxConns(n))
+		done := make(chan error, 1)
+		go func() {
+			done <- h2Server.Serve(ln)
+		}()
+
+		resp, err := (&http.Client{Timeout: 5 * time.Second}).Get("http://" + ln.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to perform HTTP request with WithMaxConns(%d): %v", n, err)
+		}
+		resp.Body.Close()
+
+		server.Close()
+		if err := <-done; err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, http.ErrServerClosed) {
+			t.Fatalf("failed to serve: %v", err)
+		}
+	}
+}
+
+func TestServer_ConnContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	type result struct {
+		source string
+		proto  string
+		user   interface{}
+	}
+	results := make(chan result, 1)
+	type userKey struct{}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var res result
+			if proxyHeader := h2proxy.ProxyHeaderFromContext(r.Context()); proxyHeader != nil {
+				res.source = proxyHeader.SourceAddr.String()
+			}
+			res.proto = h2proxy.ProtocolFromContext(r.Context())
+			res.user = r.Context().Value(userKey{})
+			results <- res
+		}),
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, userKey{}, "user")
+		},
+	}
+	h2Server := h2proxy.NewServer(server, nil)
+	done := make(chan error, 1)
+	go func() {
+		done <- h2Server.Serve(&proxyproto.Listener{Listener: ln})
+	}()
+	defer func() {
+		server.Close()
+		if err := <-done; err != nil && !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("failed to serve: %v", err)
+		}
+	}()
+
+	for _, proto := range []string{"", "http/1.1", "h2"} {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer conn.Close()
+
+		proxyHeader := proxyproto.HeaderProxyFromAddrs(2,
+			&net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000},
+			&net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000})
+		if proto != "" {
+			if err := proxyHeader.SetTLVs([]proxyproto.TLV{{Type: proxyproto.PP2_TYPE_ALPN, Value: []byte(proto)}}); err != nil {
+				t.Fatalf("failed to set TLVs: %v", err)
+			}
+		}
+		if _, err := proxyHeader.WriteTo(conn); err != nil {
+			t.Fatalf("failed to write PROXY header: %v", err)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String(), nil)
+		if err != nil {
+			t.Fatalf("failed to create HTTP request: %v", err)
+		}
+		var resp *http.Response
+		if proto == "h2" {
+			h2Conn, err := new(http2.Transport).NewClientConn(conn)
+			if err != nil {
+				t.Fatalf("failed to create HTTP connection: %v", err)
+			}
+			resp, err = h2Conn.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("failed to perform HTTP request: %v", err)
+			}
+		} else {
+			if err := req.Write(conn); err != nil {
+				t.Fatalf("failed to write HTTP request: %v", err)
+			}
+			resp, err = http.ReadResponse(bufio.NewReader(conn), req)
+			if err != nil {
+				t.Fatalf("failed to read HTTP response: %v", err)
+			}
+		}
+		resp.Body.Close()
+
+		res := <-results
+		if res.source != "10.1.1.1:1000" || res.proto != proto || res.user != "user" {
+			t.Fatalf("%q: unexpected request context values %+v", proto, res)
+		}
+	}
+}
@@ -1,55 +1,138 @@
 package http2
 
 import (
+	"errors"
 	"net"
 	"sync"
 )
 
+// ErrQueueFull is returned when serving an HTTP/1 connection which can't be
+// queued with the QueueRejectNewest policy, see WithH1Queue.
+var ErrQueueFull = errors.New("proxyproto: HTTP/1 connection queue full")
+
+// defaultQueueSize is the default size of the queue of HTTP/1 connections.
+const defaultQueueSize = 64
+
+// QueuePolicy defines what happens to HTTP/1 connections handed over to the
+// http.Server when its queue is full, see WithH1Queue.
+type QueuePolicy int
+
+const (
+	// QueueBlock waits for room in the queue, which in turn stops the
+	// server from accepting connections.
+	QueueBlock QueuePolicy = iota
+	// QueueDropOldest closes the connection queued for the longest time to
+	// make room for the new one.
+	QueueDropOldest
+	// QueueRejectNewest closes the new connection.
+	QueueRejectNewest
+)
+
 // pipeListener is a hack to workaround the lack of http.Server.ServeConn.
 // See: https://github.com/golang/go/issues/36673
 type pipeListener struct {
 	ch     chan net.Conn
-	closed bool
-	mu     sync.Mutex
+	policy QueuePolicy
+	onDrop func(net.Conn) // called with connections dropped from the queue
+	done   chan struct{}  // closed by Close
+	once   sync.Once
 }
 
-func newPipeListener() *pipeListener {
+func newPipeListener(size int, policy QueuePolicy, onDrop func(net.Conn)) *pipeListener {
 	return &pipeListener{
-		ch: make(chan net.Conn, 64),
+		ch:     make(chan net.Conn, size),
+		policy: policy,
+		onDrop: onDrop,
+		done:   make(chan struct{}),
 	}
 }
 
 func (ln *pipeListener) Accept() (net.Conn, error) {
-	conn, ok := <-ln.ch
-	if !ok {
+	select {
+	case conn := <-ln.ch:
+		return conn, nil
+	case <-ln.done:
 		return nil, net.ErrClosed
 	}
-	return conn, nil
 }
 
+// Close closes the listener, dropping the queued connections.
 func (ln *pipeListener) Close() error {
-	ln.mu.Lock()
-	defer ln.mu.Unlock()
+	err := net.ErrClosed
+	ln.once.Do(func() {
+		close(ln.done)
+		err = nil
+	})
+	if err == nil {
+		ln.drain()
+	}
+	return err
+}
 
-	if ln.closed {
-		return net.ErrClosed
+// drain drops the queued connections.
+func (ln *pipeListener) drain() {
+	for {
+		select {
+		case conn := <-ln.ch:
+			ln.drop(conn)
+		default:
+			return
+		}
+	}
+}
+
+func (ln *pipeListener) drop(conn net.Conn) {
+	if ln.onDrop != nil {
+		ln.onDrop(conn)
 	}
-	ln.closed = true
-	close(ln.ch)
-	return nil
 }
 
 // ServeConn enqueues a new connection. The connection will be returned in the
-// next Accept call.
+// next Accept call. When the queue is full, the policy applies.
 func (ln *pipeListener) ServeConn(conn net.Conn) error {
-	ln.mu.Lock()
-	defer ln.mu.Unlock()
+	for {
+		select {
+		case <-ln.done:
+			return net.ErrClosed
+		default:
+		}
+
+		select {
+		case ln.ch <- conn:
+			ln.drainIfClosed()
+			return nil
+		default:
+		}
+
+		switch ln.policy {
+		case QueueRejectNewest:
+			return ErrQueueFull
+		case QueueDropOldest:
+			select {
+			case old := <-ln.ch:
+				ln.drop(old)
+			default:
+			}
+		default:
+			select {
+			case ln.ch <- conn:
+				ln.drainIfClosed()
+				return nil
+			case <-ln.done:
+				return net.ErrClosed
+			}
+		}
+	}
+}
 
-	if ln.closed {
-		return net.ErrClosed
+// drainIfClosed drops the queued connections if the listener is closed, in
+// case Close drained the queue before a connection was queued.
+func (ln *pipeListener) drainIfClosed() {
+	select {
+	case <-ln.done:
+		ln.drain()
+	default:
 	}
-	ln.ch <- conn
-	return nil
 }
 
 func (ln *pipeListener) Addr() net.Addr {
@@ -0,0 +1,110 @@
+package http2
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPipeListenerQueuePolicy(t *testing.T) {
+	var cases = []struct {
+		name        string
+		policy      QueuePolicy
+		expectedErr error
+		accepted    int // index of the connection accepted first
+		dropped     []int
+	}{
+		{"drop oldest", QueueDropOldest, nil, 1, []int{0}},
+		{"reject newest", QueueRejectNewest, ErrQueueFull, 0, nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var conns [2]net.Conn
+			for i := range conns {
+				server, client := net.Pipe()
+				defer server.Close()
+				defer client.Close()
+				conns[i] = server
+			}
+
+			var dropped []net.Conn
+			ln := newPipeListener(1, tc.policy, func(conn net.Conn) {
+				dropped = append(dropped, conn)
+			})
+			defer ln.Close()
+
+			if err := ln.ServeConn(conns[0]); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if err := ln.ServeConn(conns[1]); err != tc.expectedErr {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+			if len(dropped) != len(tc.dropped) {
+				t.Fatalf("Expected %d dropped connections, got %d", len(tc.dropped), len(dropped))
+			}
+			for i, j := range tc.dropped {
+				if dropped[i] != conns[j] {
+					t.Fatalf("Expected connection %d to be dropped", j)
+				}
+			}
+
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if conn != conns[tc.accepted] {
+				t.Fatalf("Expected connection %d to be accepted", tc.accepted)
+			}
+		})
+	}
+}
+
+func TestPipeListenerBlock(t *testing.T) {
+	first, client := net.Pipe()
+	defer first.Close()
+	defer client.Close()
+	second, client := net.Pipe()
+	defer second.Close()
+	defer client.Close()
+
+	var dropped []net.Conn
+	ln := newPipeListener(1, QueueBlock, func(conn net.Conn) {
+		dropped = append(dropped, conn)
+	})
+	if err := ln.ServeConn(first); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- ln.ServeConn(second)
+	}()
+	select {
+	case err := <-served:
+		t.Fatalf("Expected serving to block, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if conn, err := ln.Accept(); err != nil || conn != first {
+		t.Fatalf("Expected the first connection, got %v with error %v", conn, err)
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Closing the listener drops the queued connections.
+	if err := ln.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(dropped) != 1 || dropped[0] != second {
+		t.Fatalf("Expected the second connection to be dropped, got %v", dropped)
+	}
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Expected error %v, got %v", net.ErrClosed, err)
+	}
+	if err := ln.ServeConn(first); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Expected error %v, got %v", net.ErrClosed, err)
+	}
+}
@@ -0,0 +1,18 @@
+module github.com/pires/go-proxyproto/helper/otel
+
+go 1.18
+
+require (
+	github.com/pires/go-proxyproto v0.0.0-00010101000000-000000000000
+	go.opentelemetry.io/otel v1.11.1
+	go.opentelemetry.io/otel/sdk v1.11.1
+	go.opentelemetry.io/otel/trace v1.11.1
+)
+
+require (
+	github.com/go-logr/logr v1.2.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+)
+
+replace github.com/pires/go-proxyproto => ../..
@@ -0,0 +1,168 @@
+// Package otel provides OpenTelemetry tracing of the header processing of
+// PROXY protocol listeners, on top of their hooks.
+//
+// It's a separate module, so that users of github.com/pires/go-proxyproto
+// don't depend on the OpenTelemetry libraries.
+package otel
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.com/pires/go-proxyproto/helper/otel"
+	spanName            = "proxyproto.header"
+)
+
+// Attribute keys of the spans.
+const (
+	PolicyKey      = attribute.Key("proxyproto.policy")
+	VersionKey     = attribute.Key("proxyproto.version")
+	CommandKey     = attribute.Key("proxyproto.command")
+	TransportKey   = attribute.Key("proxyproto.transport")
+	SourceAddrKey  = attribute.Key("proxyproto.source.addr")
+	SourcePortKey  = attribute.Key("proxyproto.source.port")
+	TLVTypesKey    = attribute.Key("proxyproto.tlv.types")
+	PeerAddrKey    = attribute.Key("net.sock.peer.addr")
+	PeerPortKey    = attribute.Key("net.sock.peer.port")
+	HostAddrKey    = attribute.Key("net.sock.host.addr")
+	HostPortKey    = attribute.Key("net.sock.host.port")
+	HeaderFoundKey = attribute.Key("proxyproto.header.found")
+)
+
+// Tracer traces the header processing of the listeners it instruments, see
+// Instrument, with a span per connection which wasn't skipped. The spans
+// start when the header processing starts, end when it's done, and record:
+//
+//   - the policy applied, the address of the upstream and the local address
+//     of the underlying connection;
+//   - whether a header was found and, if so, its version, command, transport
+//     protocol, source address and TLV types;
+//   - the processing error, if any, which sets the span status to Error.
+type Tracer struct {
+	tracer  trace.Tracer
+	context func(net.Conn) context.Context
+}
+
+// Option configures a Tracer.
+type Option func(*Tracer)
+
+// WithTracerProvider sets the provider of the tracer creating the spans. The
+// global provider is used by default.
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(t *Tracer) {
+		t.tracer = provider.Tracer(instrumentationName)
+	}
+}
+
+// WithContext sets the function returning the context of the spans of
+// connections, e.g. to make them children of a span of the connection
+// establishment. context.Background is used by default.
+func WithContext(fn func(conn net.Conn) context.Context) Option {
+	return func(t *Tracer) {
+		t.context = fn
+	}
+}
+
+// NewTracer creates a new tracer.
+func NewTracer(opts ...Option) *Tracer {
+	t := &Tracer{}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if t.tracer == nil {
+		t.tracer = otel.GetTracerProvider().Tracer(instrumentationName)
+	}
+	return t
+}
+
+// Hooks returns listener hooks tracing header processing.
+func (t *Tracer) Hooks() proxyproto.ListenerHooks {
+	return proxyproto.ListenerHooks{
+		HeaderReadStarted: t.headerReadStarted,
+	}
+}
+
+// Instrument sets the HeaderReadStarted hook of the listener to trace header
+// processing, replacing any previous one. It must be called before the
+// listener accepts connections.
+func (t *Tracer) Instrument(ln *proxyproto.Listener) {
+	ln.Hooks.HeaderReadStarted = t.Hooks().HeaderReadStarted
+}
+
+func (t *Tracer) headerReadStarted(conn net.Conn, policy proxyproto.Policy) func(*proxyproto.Header, time.Duration, error) {
+	ctx := context.Background()
+	if t.context != nil {
+		ctx = t.context(conn)
+	}
+
+	attrs := []attribute.KeyValue{PolicyKey.String(policy.String())}
+	attrs = appendAddr(attrs, PeerAddrKey, PeerPortKey, conn.RemoteAddr())
+	attrs = appendAddr(attrs, HostAddrKey, HostPortKey, conn.LocalAddr())
+	_, span := t.tracer.Start(ctx, spanName,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...))
+
+	return func(header *proxyproto.Header, duration time.Duration, err error) {
+		span.SetAttributes(headerAttributes(header)...)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// headerAttributes returns the attributes describing the header.
+func headerAttributes(header *proxyproto.Header) []attribute.KeyValue {
+	if header == nil {
+		return []attribute.KeyValue{HeaderFoundKey.Bool(false)}
+	}
+	attrs := []attribute.KeyValue{
+		HeaderFoundKey.Bool(true),
+		VersionKey.Int(int(header.Version)),
+		CommandKey.String(header.Command.String()),
+		TransportKey.String(header.TransportProtocol.String()),
+	}
+	attrs = appendAddr(attrs, SourceAddrKey, SourcePortKey, header.SourceAddr)
+
+	var types []int
+	_ = header.IterateTLVs(func(tlv proxyproto.TLV) bool {
+		types = append(types, int(tlv.Type))
+		return true
+	})
+	if len(types) > 0 {
+		attrs = append(attrs, TLVTypesKey.IntSlice(types))
+	}
+	return attrs
+}
+
+// appendAddr appends the attributes of the address and port of addr, if any.
+func appendAddr(attrs []attribute.KeyValue, addrKey, portKey attribute.Key, addr net.Addr) []attribute.KeyValue {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return append(attrs, addrKey.String(addr.IP.String()), portKey.Int(addr.Port))
+	case *net.UDPAddr:
+		return append(attrs, addrKey.String(addr.IP.String()), portKey.Int(addr.Port))
+	case nil:
+		return attrs
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return append(attrs, addrKey.String(addr.String()))
+	}
+	attrs = append(attrs, addrKey.String(host))
+	if p, err := strconv.Atoi(port); err == nil {
+		attrs = append(attrs, portKey.Int(p))
+	}
+	return attrs
+}
@@ -0,0 +1,150 @@
+package otel
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTestTracer() (*Tracer, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	return NewTracer(WithTracerProvider(provider)), recorder
+}
+
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, attr := range span.Attributes() {
+		attrs[attr.Key] = attr.Value
+	}
+	return attrs
+}
+
+func TestTracer(t *testing.T) {
+	tracer, recorder := newTestTracer()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &proxyproto.Listener{Listener: ln}
+	tracer.Instrument(pl)
+	defer pl.Close()
+
+	header := &proxyproto.Header{
+		Version:           2,
+		Command:           proxyproto.PROXY,
+		TransportProtocol: proxyproto.TCPv4,
+		SourceAddr:        &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000},
+		DestinationAddr:   &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000},
+	}
+	if err := header.SetTLVs([]proxyproto.TLV{{Type: proxyproto.PP2_TYPE_AUTHORITY, Value: []byte("example.org")}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = header.WriteTo(conn)
+		_, _ = conn.Write([]byte("ping"))
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	recv := make([]byte, 4)
+	if _, err := conn.Read(recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	if spans[0].Name() != spanName {
+		t.Fatalf("expected span %q, got %q", spanName, spans[0].Name())
+	}
+	if spans[0].Status().Code != codes.Unset {
+		t.Fatalf("expected unset status, got %v", spans[0].Status())
+	}
+	attrs := spanAttributes(spans[0])
+	for key, expected := range map[attribute.Key]attribute.Value{
+		PolicyKey:      attribute.StringValue("USE"),
+		PeerAddrKey:    attribute.StringValue("127.0.0.1"),
+		HeaderFoundKey: attribute.BoolValue(true),
+		VersionKey:     attribute.IntValue(2),
+		CommandKey:     attribute.StringValue(proxyproto.PROXY.String()),
+		TransportKey:   attribute.StringValue(proxyproto.TCPv4.String()),
+		SourceAddrKey:  attribute.StringValue("10.1.1.1"),
+		SourcePortKey:  attribute.IntValue(1000),
+		TLVTypesKey:    attribute.IntSliceValue([]int{int(proxyproto.PP2_TYPE_AUTHORITY)}),
+	} {
+		if attrs[key].Emit() != expected.Emit() {
+			t.Fatalf("expected %v for %s, got %v", expected.Emit(), key, attrs[key].Emit())
+		}
+	}
+}
+
+func TestTracerError(t *testing.T) {
+	tracer, recorder := newTestTracer()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &proxyproto.Listener{
+		Listener: ln,
+		Policy: func(upstream net.Addr) (proxyproto.Policy, error) {
+			return proxyproto.REQUIRE, nil
+		},
+	}
+	tracer.Instrument(pl)
+	defer pl.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("ping"))
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	recv := make([]byte, 4)
+	if _, err := conn.Read(recv); err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	if spans[0].Status().Code != codes.Error {
+		t.Fatalf("expected error status, got %v", spans[0].Status())
+	}
+	attrs := spanAttributes(spans[0])
+	if attrs[PolicyKey].AsString() != "REQUIRE" {
+		t.Fatalf("expected the REQUIRE policy, got %v", attrs[PolicyKey].Emit())
+	}
+	if attrs[HeaderFoundKey].AsBool() {
+		t.Fatalf("expected no header")
+	}
+	if len(spans[0].Events()) != 1 {
+		t.Fatalf("expected the error to be recorded, got %d events", len(spans[0].Events()))
+	}
+}
@@ -0,0 +1,168 @@
+// Package prometheus provides a Prometheus collector exporting metrics of
+// PROXY protocol listeners, on top of their hooks.
+//
+// It's a separate module, so that users of github.com/pires/go-proxyproto
+// don't depend on the Prometheus client library.
+package prometheus
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "proxyproto"
+
+// Collector is a prometheus.Collector exporting the following metrics of the
+// listeners it instruments, see Instrument:
+//
+//   - proxyproto_policy_decisions_total, the connections accepted from the
+//     underlying listeners by policy: "use", "ignore", "reject", "require",
+//     "skip", or "error" if the policy callback failed.
+//   - proxyproto_connections_total, the connections whose header has been
+//     processed by header version: "1", "2", or "none" if there was none or
+//     it wasn't used.
+//   - proxyproto_header_errors_total, the header processing errors by kind:
+//     "missing", "superfluous", "malformed", "too_large", "timeout" or
+//     "other", e.g. for validation errors.
+//   - proxyproto_header_read_duration_seconds, a histogram of how long
+//     reading headers took.
+//
+// Multiple listeners can be instrumented by the same collector. Use
+// prometheus.WrapRegistererWith to register several collectors told apart by
+// labels.
+type Collector struct {
+	policies    *prometheus.CounterVec
+	connections *prometheus.CounterVec
+	errors      *prometheus.CounterVec
+	duration    prometheus.Histogram
+}
+
+// NewCollector creates a new collector.
+func NewCollector() *Collector {
+	return &Collector{
+		policies: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "policy_decisions_total",
+			Help:      "Connections accepted from the underlying listener, by policy.",
+		}, []string{"policy"}),
+		connections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connections_total",
+			Help:      "Connections whose PROXY header has been processed, by header version.",
+		}, []string{"version"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "header_errors_total",
+			Help:      "PROXY header processing errors, by kind.",
+		}, []string{"kind"}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "header_read_duration_seconds",
+			Help:      "How long reading PROXY headers took.",
+			Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5, 10},
+		}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.policies.Describe(ch)
+	c.connections.Describe(ch)
+	c.errors.Describe(ch)
+	c.duration.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.policies.Collect(ch)
+	c.connections.Collect(ch)
+	c.errors.Collect(ch)
+	c.duration.Collect(ch)
+}
+
+// Hooks returns listener hooks updating the metrics of the collector.
+func (c *Collector) Hooks() proxyproto.ListenerHooks {
+	return proxyproto.ListenerHooks{
+		PolicyDecided: c.policyDecided,
+		HeaderRead:    c.headerRead,
+	}
+}
+
+// Instrument sets the PolicyDecided and HeaderRead hooks of the listener to
+// update the metrics of the collector, replacing any previous ones. It must be
+// called before the listener accepts connections.
+func (c *Collector) Instrument(ln *proxyproto.Listener) {
+	hooks := c.Hooks()
+	ln.Hooks.PolicyDecided = hooks.PolicyDecided
+	ln.Hooks.HeaderRead = hooks.HeaderRead
+}
+
+func (c *Collector) policyDecided(upstream net.Addr, policy proxyproto.Policy, err error) {
+	c.policies.WithLabelValues(policyLabel(policy, err)).Inc()
+}
+
+func (c *Collector) headerRead(header *proxyproto.Header, duration time.Duration, err error) {
+	c.duration.Observe(duration.Seconds())
+	if err != nil {
+		c.errors.WithLabelValues(errorLabel(err)).Inc()
+		return
+	}
+	version := "none"
+	if header != nil {
+		version = strconv.Itoa(int(header.Version))
+	}
+	c.connections.WithLabelValues(version).Inc()
+}
+
+func policyLabel(policy proxyproto.Policy, err error) string {
+	if err != nil {
+		return "error"
+	}
+	return strings.ToLower(policy.String())
+}
+
+// malformedErrors are the errors of malformed headers.
+var malformedErrors = []error{
+	proxyproto.ErrCantReadVersion1Header,
+	proxyproto.ErrVersion1HeaderTooLong,
+	proxyproto.ErrLineMustEndWithCrlf,
+	proxyproto.ErrCantReadProtocolVersionAndCommand,
+	proxyproto.ErrCantReadAddressFamilyAndProtocol,
+	proxyproto.ErrCantReadLength,
+	proxyproto.ErrCantResolveSourceUnixAddress,
+	proxyproto.ErrCantResolveDestinationUnixAddress,
+	proxyproto.ErrUnsupportedProtocolVersionAndCommand,
+	proxyproto.ErrUnsupportedAddressFamilyAndProtocol,
+	proxyproto.ErrInvalidLength,
+	proxyproto.ErrInvalidAddress,
+	proxyproto.ErrInvalidPortNumber,
+}
+
+// errorLabel classifies header processing errors, keeping the number of
+// label values bounded.
+func errorLabel(err error) string {
+	switch {
+	case errors.Is(err, proxyproto.ErrNoProxyProtocol):
+		return "missing"
+	case errors.Is(err, proxyproto.ErrSuperfluousProxyHeader):
+		return "superfluous"
+	case errors.Is(err, proxyproto.ErrHeaderTooLarge):
+		return "too_large"
+	}
+	for _, malformed := range malformedErrors {
+		if errors.Is(err, malformed) {
+			return "malformed"
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return "other"
+}
@@ -0,0 +1,92 @@
+package prometheus
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	c := NewCollector()
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(c); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &proxyproto.Listener{Listener: ln}
+	c.Instrument(pl)
+	defer pl.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"))
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	recv := make([]byte, 4)
+	if _, err := conn.Read(recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if v := testutil.ToFloat64(c.policies.WithLabelValues("use")); v != 1 {
+		t.Fatalf("expected 1 connection with the USE policy, got %v", v)
+	}
+	if v := testutil.ToFloat64(c.connections.WithLabelValues("1")); v != 1 {
+		t.Fatalf("expected 1 connection with a v1 header, got %v", v)
+	}
+	if n := testutil.CollectAndCount(c, "proxyproto_header_read_duration_seconds"); n != 1 {
+		t.Fatalf("expected the header read duration histogram, got %d metrics", n)
+	}
+	if _, err := registry.Gather(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestCollectorHooks(t *testing.T) {
+	c := NewCollector()
+	hooks := c.Hooks()
+
+	hooks.PolicyDecided(nil, proxyproto.REQUIRE, nil)
+	hooks.PolicyDecided(nil, proxyproto.USE, fmt.Errorf("failure"))
+	hooks.HeaderRead(&proxyproto.Header{Version: 2}, time.Millisecond, nil)
+	hooks.HeaderRead(nil, time.Millisecond, nil)
+	hooks.HeaderRead(nil, time.Millisecond, proxyproto.ErrNoProxyProtocol)
+	hooks.HeaderRead(nil, time.Millisecond, proxyproto.ErrInvalidLength)
+	hooks.HeaderRead(nil, time.Millisecond, fmt.Errorf("validation failed"))
+	hooks.HeaderRead(nil, time.Millisecond, proxyproto.ErrReadHeaderTimeout)
+
+	for _, tc := range []struct {
+		counter  prometheus.Counter
+		expected float64
+	}{
+		{c.policies.WithLabelValues("require"), 1},
+		{c.policies.WithLabelValues("error"), 1},
+		{c.connections.WithLabelValues("2"), 1},
+		{c.connections.WithLabelValues("none"), 1},
+		{c.errors.WithLabelValues("missing"), 1},
+		{c.errors.WithLabelValues("malformed"), 1},
+		{c.errors.WithLabelValues("other"), 1},
+		{c.errors.WithLabelValues("timeout"), 1},
+	} {
+		if v := testutil.ToFloat64(tc.counter); v != tc.expected {
+			t.Fatalf("expected %v, got %v for %v", tc.expected, v, tc.counter.Desc())
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Package reverseproxy provides helpers to chain an httputil.ReverseProxy to
+// PROXY protocol upstreams, preserving the identity of the clients.
+package reverseproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+
+	"github.com/pires/go-proxyproto"
+)
+
+type headerContextKey struct{}
+
+// NewSingleHostReverseProxy returns a reverse proxy routing requests to
+// target like httputil.NewSingleHostReverseProxy does, and sending a PROXY
+// header of the given version on each upstream connection, see Configure.
+func NewSingleHostReverseProxy(target *url.URL, version byte) *httputil.ReverseProxy {
+	rp := httputil.NewSingleHostReverseProxy(target)
+	Configure(rp, version)
+	return rp
+}
+
+// Configure makes the reverse proxy send a PROXY header of the given version
+// on each upstream connection, derived from the inbound request with
+// HeaderFromRequest. The reverse proxy Rewrite is wrapped if set, its
+// Director otherwise, and its Transport replaced by a copy of it, or of
+// http.DefaultTransport if it isn't an *http.Transport.
+//
+// As each upstream connection is bound to the client of the request it's
+// dialed for, keep-alives are disabled on the transport. Dialing with
+// Transport.DialTLSContext isn't supported, TLS upstreams must rely on
+// Transport.DialContext and Transport.TLSClientConfig instead.
+func Configure(rp *httputil.ReverseProxy, version byte) {
+	transport, ok := rp.Transport.(*http.Transport)
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport)
+	}
+	transport = transport.Clone()
+	transport.DisableKeepAlives = true
+	transport.DialTLSContext = nil
+
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		header, ok := ctx.Value(headerContextKey{}).(*proxyproto.Header)
+		if !ok {
+			header = proxyproto.HeaderProxyFromAddrs(version, nil, nil)
+		}
+		if _, err := header.WriteTo(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	rp.Transport = transport
+
+	if configureRewrite(rp, version) {
+		return
+	}
+	director := rp.Director
+	rp.Director = func(req *http.Request) {
+		header := HeaderFromRequest(req, version)
+		if director != nil {
+			director(req)
+		}
+		*req = *req.WithContext(context.WithValue(req.Context(), headerContextKey{}, header))
+	}
+}
+
+// HeaderFromRequest returns a header of the given version describing the
+// connection the request came on, from the client address in
+// http.Request.RemoteAddr to the server address stored in the request context
+// under http.LocalAddrContextKey. When the request came on a proxied
+// connection, e.g. accepted by a proxyproto.Listener, these are the addresses
+// of the original connection. A LOCAL header is returned if either address is
+// unknown.
+func HeaderFromRequest(req *http.Request, version byte) *proxyproto.Header {
+	var sourceAddr, destAddr net.Addr
+	if addrPort, err := netip.ParseAddrPort(req.RemoteAddr); err == nil {
+		sourceAddr = net.TCPAddrFromAddrPort(addrPort)
+	}
+	if localAddr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		destAddr = localAddr
+	}
+	return proxyproto.HeaderProxyFromAddrs(version, sourceAddr, destAddr)
+}
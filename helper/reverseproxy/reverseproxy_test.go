@@ -0,0 +1,93 @@
+package reverseproxy_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/helper/reverseproxy"
+)
+
+func TestNewSingleHostReverseProxy(t *testing.T) {
+	// The upstream requires a PROXY header and echoes the client address.
+	upstreamLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	upstream := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.RemoteAddr)
+	})}
+	go upstream.Serve(&proxyproto.Listener{
+		Listener: upstreamLn,
+		Policy: func(net.Addr) (proxyproto.Policy, error) {
+			return proxyproto.REQUIRE, nil
+		},
+	})
+	defer upstream.Close()
+
+	target, err := url.Parse("http://" + upstreamLn.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	frontendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	frontend := &http.Server{Handler: reverseproxy.NewSingleHostReverseProxy(target, 2)}
+	go frontend.Serve(frontendLn)
+	defer frontend.Close()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", frontendLn.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		client := &http.Client{Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return conn, nil
+			},
+		}}
+
+		resp, err := client.Get("http://" + frontendLn.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to perform HTTP request: %v", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", resp.StatusCode, body)
+		}
+		if string(body) != conn.LocalAddr().String() {
+			t.Fatalf("expected upstream to see client %s, got %s", conn.LocalAddr(), body)
+		}
+		conn.Close()
+	}
+}
+
+func TestHeaderFromRequest(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if header := reverseproxy.HeaderFromRequest(req, 2); header.Command != proxyproto.LOCAL {
+		t.Fatalf("expected a LOCAL header without addresses, got %+v", header)
+	}
+
+	req.RemoteAddr = "[2001:db8::1]:1000"
+	ctx := context.WithValue(req.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443})
+	header := reverseproxy.HeaderFromRequest(req.WithContext(ctx), 1)
+	if header.Version != 1 || header.Command != proxyproto.PROXY || header.TransportProtocol != proxyproto.TCPv6 {
+		t.Fatalf("unexpected header %+v", header)
+	}
+	if header.SourceAddr.String() != "[2001:db8::1]:1000" || header.DestinationAddr.String() != "[2001:db8::2]:443" {
+		t.Fatalf("unexpected addresses %v and %v", header.SourceAddr, header.DestinationAddr)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build go1.20
+
+package reverseproxy
+
+import (
+	"context"
+	"net/http/httputil"
+)
+
+// configureRewrite wraps the reverse proxy Rewrite like Configure wraps its
+// Director, and returns false if it isn't set.
+func configureRewrite(rp *httputil.ReverseProxy, version byte) bool {
+	rewrite := rp.Rewrite
+	if rewrite == nil {
+		return false
+	}
+	rp.Rewrite = func(pr *httputil.ProxyRequest) {
+		header := HeaderFromRequest(pr.In, version)
+		rewrite(pr)
+		pr.Out = pr.Out.WithContext(context.WithValue(pr.Out.Context(), headerContextKey{}, header))
+	}
+	return true
+}
@@ -0,0 +1,10 @@
+//go:build !go1.20
+
+package reverseproxy
+
+import "net/http/httputil"
+
+// configureRewrite returns false, as ReverseProxy.Rewrite requires Go 1.20.
+func configureRewrite(rp *httputil.ReverseProxy, version byte) bool {
+	return false
+}
@@ -0,0 +1,82 @@
+//go:build go1.20
+
+package reverseproxy_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/helper/reverseproxy"
+)
+
+func TestConfigureRewrite(t *testing.T) {
+	// The upstream requires a PROXY header and echoes the client address.
+	upstreamLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	upstream := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.RemoteAddr)
+	})}
+	go upstream.Serve(&proxyproto.Listener{
+		Listener: upstreamLn,
+		Policy: func(net.Addr) (proxyproto.Policy, error) {
+			return proxyproto.REQUIRE, nil
+		},
+	})
+	defer upstream.Close()
+
+	target, err := url.Parse("http://" + upstreamLn.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+		},
+	}
+	reverseproxy.Configure(rp, 2)
+	if rp.Director != nil {
+		t.Fatal("expected no Director to be set along with Rewrite")
+	}
+
+	frontendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	frontend := &http.Server{Handler: rp}
+	go frontend.Serve(frontendLn)
+	defer frontend.Close()
+
+	conn, err := net.Dial("tcp", frontendLn.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return conn, nil
+		},
+	}}
+
+	resp, err := client.Get("http://" + frontendLn.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to perform HTTP request: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", resp.StatusCode, body)
+	}
+	if string(body) != conn.LocalAddr().String() {
+		t.Fatalf("expected upstream to see client %s, got %s", conn.LocalAddr(), body)
+	}
+}
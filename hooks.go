@@ -0,0 +1,50 @@
+package proxyproto
+
+import (
+	"net"
+	"time"
+)
+
+// ListenerHooks are called by a Listener on connection events, e.g. to export
+// metrics, see Listener.Hooks. Nil hooks are skipped. They're called
+// synchronously, possibly concurrently, and must not block.
+type ListenerHooks struct {
+	// PolicyDecided is called for each connection accepted from the
+	// underlying listener, with the policy decided for it, USE if the
+	// listener has no policy callback, or the error the callback returned.
+	PolicyDecided func(upstream net.Addr, policy Policy, err error)
+	// HeaderRead is called once the header of a connection which wasn't
+	// skipped has been processed, with the header, nil if there was none or
+	// it wasn't used, how long reading it took, and the processing error,
+	// e.g. ErrNoProxyProtocol with REQUIRE, if any.
+	HeaderRead func(header *Header, duration time.Duration, err error)
+	// HeaderReadStarted is called when processing the header of a
+	// connection which wasn't skipped starts, with the underlying connection
+	// and the policy applied. The returned function, if not nil, is called
+	// once processing is done, with the same arguments as HeaderRead. It
+	// allows e.g. tracing header processing.
+	HeaderReadStarted func(conn net.Conn, policy Policy) func(header *Header, duration time.Duration, err error)
+	// ConnectionClosed is called once a connection which wasn't skipped is
+	// closed, with information about it, e.g. to write access logs. Setting
+	// it makes connections count the bytes read and written.
+	ConnectionClosed func(info ConnInfo)
+}
+
+func (h ListenerHooks) policyDecided(upstream net.Addr, policy Policy, err error) {
+	if h.PolicyDecided != nil {
+		h.PolicyDecided(upstream, policy, err)
+	}
+}
+
+func (h ListenerHooks) headerRead(header *Header, duration time.Duration, err error) {
+	if h.HeaderRead != nil {
+		h.HeaderRead(header, duration, err)
+	}
+}
+
+func (h ListenerHooks) headerReadStarted(conn net.Conn, policy Policy) func(*Header, time.Duration, error) {
+	if h.HeaderReadStarted != nil {
+		return h.HeaderReadStarted(conn, policy)
+	}
+	return nil
+}
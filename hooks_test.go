@@ -0,0 +1,182 @@
+package proxyproto
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestListenerHooks(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var (
+		mu       sync.Mutex
+		policies []Policy
+		headers  []*Header
+		errs     []error
+		started  []Policy
+		done     []*Header
+	)
+	headerRead := make(chan struct{}, 1)
+	pl := &Listener{
+		Listener: l,
+		ConnPolicy: func(ConnPolicyOptions) (Policy, error) {
+			return REQUIRE, nil
+		},
+		Hooks: ListenerHooks{
+			PolicyDecided: func(upstream net.Addr, policy Policy, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				policies = append(policies, policy)
+			},
+			HeaderReadStarted: func(conn net.Conn, policy Policy) func(*Header, time.Duration, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				started = append(started, policy)
+				return func(header *Header, duration time.Duration, err error) {
+					mu.Lock()
+					defer mu.Unlock()
+					done = append(done, header)
+				}
+			},
+			HeaderRead: func(header *Header, duration time.Duration, err error) {
+				mu.Lock()
+				headers = append(headers, header)
+				errs = append(errs, err)
+				mu.Unlock()
+				headerRead <- struct{}{}
+			},
+		},
+	}
+
+	cliResult := make(chan error)
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			cliResult <- err
+			return
+		}
+		defer conn.Close()
+
+		if _, err := conn.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping")); err != nil {
+			cliResult <- err
+			return
+		}
+
+		close(cliResult)
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	recv := make([]byte, 4)
+	if _, err := conn.Read(recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	<-headerRead
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(policies) != 1 || policies[0] != REQUIRE {
+		t.Fatalf("Expected policy %v, got %v", REQUIRE, policies)
+	}
+	if len(headers) != 1 || headers[0] == nil || headers[0].Version != 1 || errs[0] != nil {
+		t.Fatalf("Unexpected headers %v with errors %v", headers, errs)
+	}
+	if len(started) != 1 || started[0] != REQUIRE || len(done) != 1 || done[0] != headers[0] {
+		t.Fatalf("Unexpected header processing started with %v and done with %v", started, done)
+	}
+
+	err = <-cliResult
+	if err != nil {
+		t.Fatalf("client error: %v", err)
+	}
+}
+
+func TestListenerConnectionClosedHook(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	closed := make(chan ConnInfo, 1)
+	pl := &Listener{
+		Listener: l,
+		Hooks: ListenerHooks{
+			ConnectionClosed: func(info ConnInfo) {
+				closed <- info
+			},
+		},
+	}
+
+	cliResult := make(chan error)
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			cliResult <- err
+			return
+		}
+		defer conn.Close()
+
+		if _, err := conn.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping")); err != nil {
+			cliResult <- err
+			return
+		}
+		recv := make([]byte, 6)
+		if _, err := io.ReadFull(conn, recv); err != nil {
+			cliResult <- err
+			return
+		}
+
+		close(cliResult)
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	recv := make([]byte, 4)
+	if _, err := io.ReadFull(conn, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := conn.Write([]byte("pong!!")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err = <-cliResult
+	if err != nil {
+		t.Fatalf("client error: %v", err)
+	}
+	conn.Close()
+	conn.Close()
+
+	info := <-closed
+	if info.Header == nil || info.Header.Version != 1 || info.HeaderErr != nil {
+		t.Fatalf("Unexpected header %v with error %v", info.Header, info.HeaderErr)
+	}
+	if info.RemoteAddr.String() != "10.1.1.1:1000" || info.LocalAddr.String() != "20.2.2.2:2000" {
+		t.Fatalf("Unexpected claimed addresses %v and %v", info.RemoteAddr, info.LocalAddr)
+	}
+	if info.SocketLocalAddr.String() != l.Addr().String() {
+		t.Fatalf("Expected socket local address %v, got %v", l.Addr(), info.SocketLocalAddr)
+	}
+	if info.BytesIn != 4 || info.BytesOut != 6 {
+		t.Fatalf("Expected 4 bytes in and 6 bytes out, got %d and %d", info.BytesIn, info.BytesOut)
+	}
+	if info.HeaderSize != 40 || info.Policy != USE || info.Duration <= 0 {
+		t.Fatalf("Unexpected connection info %+v", info)
+	}
+	select {
+	case info := <-closed:
+		t.Fatalf("Unexpected second call with %+v", info)
+	default:
+	}
+}
@@ -0,0 +1,58 @@
+package proxyproto
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrOriginalDstUnsupported is returned by OriginalDestination on platforms
+// other than Linux.
+var ErrOriginalDstUnsupported = errors.New("proxyproto: original destination is only available on Linux")
+
+// OriginalDestination returns the destination a TCP connection was addressed
+// to before being redirected to this host by netfilter, e.g. with an iptables
+// REDIRECT or DNAT rule, read with getsockopt(SO_ORIGINAL_DST). Connections
+// intercepted with TPROXY don't need it: their local address is already the
+// original destination.
+//
+// conn must be a *net.TCPConn, or wrap one like *Conn does. ErrNotTCPConn is
+// returned otherwise, and ErrOriginalDstUnsupported on platforms other than
+// Linux.
+func OriginalDestination(conn net.Conn) (*net.TCPAddr, error) {
+	if c, ok := conn.(*Conn); ok {
+		conn = c.Raw()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, ErrNotTCPConn
+	}
+	localAddr, ok := tcpConn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, ErrNotTCPConn
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		addr, sockErr = originalDestination(int(fd), localAddr.IP.To4() == nil)
+	}); err != nil {
+		return nil, err
+	}
+	return addr, sockErr
+}
+
+// HeaderFromOriginalDestination returns a header of the given version for a
+// redirected TCP connection, from its remote address to its original
+// destination, see OriginalDestination. This allows transparent interceptors
+// to forward the true destination upstream.
+func HeaderFromOriginalDestination(version byte, conn net.Conn) (*Header, error) {
+	destAddr, err := OriginalDestination(conn)
+	if err != nil {
+		return nil, err
+	}
+	return HeaderProxyFromAddrs(version, conn.RemoteAddr(), destAddr), nil
+}
@@ -0,0 +1,45 @@
+//go:build linux
+
+package proxyproto
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h, which is also
+// IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h.
+const soOriginalDst = 80
+
+func originalDestination(fd int, ipv6 bool) (*net.TCPAddr, error) {
+	if ipv6 {
+		// The sockaddr_in6 returned fits in the IPv6MTUInfo structure.
+		info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.IPPROTO_IPV6, soOriginalDst)
+		if err != nil {
+			return nil, err
+		}
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		return &net.TCPAddr{
+			IP:   append(net.IP(nil), info.Addr.Addr[:]...),
+			Port: int(binary.BigEndian.Uint16(port[:])),
+		}, nil
+	}
+
+	// The sockaddr_in returned fits in the IPv6Mreq structure.
+	mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.IPPROTO_IP, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSockaddrInet4(mreq.Multiaddr), nil
+}
+
+// decodeSockaddrInet4 decodes a struct sockaddr_in: its family in host byte
+// order, its port and its address in network byte order.
+func decodeSockaddrInet4(b [16]byte) *net.TCPAddr {
+	return &net.TCPAddr{
+		IP:   net.IPv4(b[4], b[5], b[6], b[7]).To4(),
+		Port: int(binary.BigEndian.Uint16(b[2:4])),
+	}
+}
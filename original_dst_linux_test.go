@@ -0,0 +1,11 @@
+package proxyproto
+
+import "testing"
+
+func TestDecodeSockaddrInet4(t *testing.T) {
+	// AF_INET, port 8080, 10.0.0.1
+	b := [16]byte{0x02, 0x00, 0x1f, 0x90, 10, 0, 0, 1}
+	if addr := decodeSockaddrInet4(b); addr.String() != "10.0.0.1:8080" {
+		t.Fatalf("expected 10.0.0.1:8080, got %s", addr)
+	}
+}
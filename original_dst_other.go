@@ -0,0 +1,9 @@
+//go:build !linux
+
+package proxyproto
+
+import "net"
+
+func originalDestination(fd int, ipv6 bool) (*net.TCPAddr, error) {
+	return nil, ErrOriginalDstUnsupported
+}
@@ -0,0 +1,49 @@
+package proxyproto
+
+import (
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestOriginalDestination(t *testing.T) {
+	pipeConn, _ := net.Pipe()
+	defer pipeConn.Close()
+	if _, err := OriginalDestination(pipeConn); err != ErrNotTCPConn {
+		t.Fatalf("expected %v, got %v", ErrNotTCPConn, err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	cliConn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer cliConn.Close()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// Without connection tracking, there's no original destination. With
+	// it, the connection wasn't redirected so it's the local address.
+	header, err := HeaderFromOriginalDestination(2, NewConn(conn))
+	if runtime.GOOS != "linux" {
+		if err != ErrOriginalDstUnsupported {
+			t.Fatalf("expected %v, got %v", ErrOriginalDstUnsupported, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Skipf("no original destination: %v", err)
+	}
+	if expected := HeaderProxyFromAddrs(2, conn.RemoteAddr(), conn.LocalAddr()); !header.EqualsTo(expected) {
+		t.Fatalf("expected header %#v, got %#v", expected, header)
+	}
+}
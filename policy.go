@@ -1,9 +1,14 @@
 package proxyproto
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // PolicyFunc can be used to decide whether to trust the PROXY info from
@@ -23,10 +28,34 @@ type PolicyFunc func(upstream net.Addr) (Policy, error)
 // In case an error is returned the connection is denied.
 type ConnPolicyFunc func(connPolicyOptions ConnPolicyOptions) (Policy, error)
 
+// ConnPolicyOverridesFunc is like ConnPolicyFunc, but also returns settings
+// overriding the Listener's ones for the connection, e.g. to give trusted
+// internal proxies lenient limits while unknown sources get strict ones.
+//
+// In case an error is returned the connection is denied.
+type ConnPolicyOverridesFunc func(connPolicyOptions ConnPolicyOptions) (Policy, ConnOverrides, error)
+
+// ConnOverrides contains per-connection settings returned by a
+// ConnPolicyOverridesFunc. Zero values keep the Listener's settings.
+type ConnOverrides struct {
+	// ReadHeaderTimeout overrides Listener.ReadHeaderTimeout, a negative
+	// value disabling the timeout.
+	ReadHeaderTimeout time.Duration
+	// MaxHeaderSize overrides Listener.MaxHeaderSize, a negative value
+	// disabling the limit.
+	MaxHeaderSize int
+	// ValidateHeader overrides Listener.ValidateHeader.
+	ValidateHeader Validator
+}
+
 // ConnPolicyOptions contains the remote and local addresses of a connection.
 type ConnPolicyOptions struct {
 	Upstream   net.Addr
 	Downstream net.Addr
+	// ListenerAddr is the address of the listener the connection was
+	// accepted on, e.g. 0.0.0.0:443 where Downstream is 192.0.2.1:443.
+	// It is nil if the connection was not accepted by a Listener.
+	ListenerAddr net.Addr
 }
 
 // Policy defines how a connection with a PROXY header address is treated.
@@ -38,14 +67,14 @@ const (
 	// IGNORE address from PROXY header, but accept connection
 	IGNORE
 	// REJECT connection when PROXY header is sent
-	// Note: even though the first read on the connection returns an error if
-	// a PROXY header is present, subsequent reads do not. It is the task of
-	// the code using the connection to handle that case properly.
+	// Note: reads on the connection return an error if a PROXY header is
+	// present, but writes do not unless WithStickyHeaderError is used. It is
+	// the task of the code using the connection to handle that case properly.
 	REJECT
 	// REQUIRE connection to send PROXY header, reject if not present
-	// Note: even though the first read on the connection returns an error if
-	// a PROXY header is not present, subsequent reads do not. It is the task
-	// of the code using the connection to handle that case properly.
+	// Note: reads on the connection return an error if a PROXY header is not
+	// present, but writes do not unless WithStickyHeaderError is used. It is
+	// the task of the code using the connection to handle that case properly.
 	REQUIRE
 	// SKIP accepts a connection without requiring the PROXY header
 	// Note: an example usage can be found in the SkipProxyHeaderForCIDR
@@ -53,6 +82,23 @@ const (
 	SKIP
 )
 
+// String returns the name of the policy, e.g. "USE".
+func (p Policy) String() string {
+	switch p {
+	case USE:
+		return "USE"
+	case IGNORE:
+		return "IGNORE"
+	case REJECT:
+		return "REJECT"
+	case REQUIRE:
+		return "REQUIRE"
+	case SKIP:
+		return "SKIP"
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
 // SkipProxyHeaderForCIDR returns a PolicyFunc which can be used to accept a
 // connection from a skipHeaderCIDR without requiring a PROXY header, e.g.
 // Kubernetes pods local traffic. The def is a policy to use when an upstream
@@ -106,11 +152,12 @@ func MustLaxWhiteListPolicy(allowed []string) PolicyFunc {
 
 // StrictWhiteListPolicy returns a PolicyFunc which decides whether the
 // upstream ip is allowed to send a proxy header based on a list of allowed
-// IP addresses and IP ranges. In case upstream IP is not in list reading on
-// the connection will be refused on the first read. Please note: subsequent
-// reads do not error. It is the task of the code using the connection to
-// handle that case properly. If one of the provided IP addresses or IP
-// ranges is invalid it will return an error instead of a PolicyFunc.
+// IP addresses and IP ranges. In case upstream IP is not in list and it sends
+// a PROXY header, reading on the connection will be refused. Please note:
+// writes do not error unless WithStickyHeaderError is used. It is the task of
+// the code using the connection to handle that case properly. If one of the
+// provided IP addresses or IP ranges is invalid it will return an error
+// instead of a PolicyFunc.
 func StrictWhiteListPolicy(allowed []string) (PolicyFunc, error) {
 	allowFrom, err := parse(allowed)
 	if err != nil {
@@ -131,6 +178,278 @@ func MustStrictWhiteListPolicy(allowed []string) PolicyFunc {
 	return pfunc
 }
 
+// LaxPrefixWhiteListPolicy acts as LaxWhiteListPolicy but stores the allowed
+// IP addresses and IP ranges in a prefix tree, so that the cost of a lookup
+// depends on the length of the address rather than on the number of entries.
+// Prefer it over LaxWhiteListPolicy for lists of hundreds or thousands of
+// entries, e.g. all the address ranges of a cloud provider's load balancers.
+func LaxPrefixWhiteListPolicy(allowed []string) (PolicyFunc, error) {
+	trie, err := parsePrefixTrie(allowed)
+	if err != nil {
+		return nil, err
+	}
+
+	return whitelistPolicy([]func(net.IP) bool{trie.contains}, IGNORE), nil
+}
+
+// MustLaxPrefixWhiteListPolicy returns a LaxPrefixWhiteListPolicy but will
+// panic if one of the provided IP addresses or IP ranges is invalid.
+func MustLaxPrefixWhiteListPolicy(allowed []string) PolicyFunc {
+	pfunc, err := LaxPrefixWhiteListPolicy(allowed)
+	if err != nil {
+		panic(err)
+	}
+
+	return pfunc
+}
+
+// StrictPrefixWhiteListPolicy acts as StrictWhiteListPolicy but stores the
+// allowed IP addresses and IP ranges in a prefix tree, see
+// LaxPrefixWhiteListPolicy.
+func StrictPrefixWhiteListPolicy(allowed []string) (PolicyFunc, error) {
+	trie, err := parsePrefixTrie(allowed)
+	if err != nil {
+		return nil, err
+	}
+
+	return whitelistPolicy([]func(net.IP) bool{trie.contains}, REJECT), nil
+}
+
+// MustStrictPrefixWhiteListPolicy returns a StrictPrefixWhiteListPolicy but
+// will panic if one of the provided IP addresses or IP ranges is invalid.
+func MustStrictPrefixWhiteListPolicy(allowed []string) PolicyFunc {
+	pfunc, err := StrictPrefixWhiteListPolicy(allowed)
+	if err != nil {
+		panic(err)
+	}
+
+	return pfunc
+}
+
+// DynamicWhiteListPolicy decides whether the upstream ip is allowed to send
+// a proxy header based on a list of allowed IP addresses and IP ranges which
+// can be replaced or modified at runtime, e.g. when the source ranges of a
+// cloud load balancer change, without restarting the listener.
+//
+// Its Policy method can be used as a PolicyFunc. It is safe for concurrent
+// use: connections being accepted always see either the previous or the new
+// list of allowed addresses, never a partially updated one.
+type DynamicWhiteListPolicy struct {
+	def     Policy
+	mu      sync.Mutex   // serializes updates
+	allowed atomic.Value // *dynamicWhiteList
+}
+
+type dynamicWhiteList struct {
+	entries  []string
+	matchers []func(net.IP) bool
+}
+
+// NewDynamicWhiteListPolicy returns a DynamicWhiteListPolicy allowing the
+// given IP addresses and IP ranges. The def is a policy to use when an
+// upstream IP is not in the list, e.g. IGNORE as LaxWhiteListPolicy does or
+// REJECT as StrictWhiteListPolicy does. If one of the provided IP addresses
+// or IP ranges is invalid it will return an error.
+func NewDynamicWhiteListPolicy(allowed []string, def Policy) (*DynamicWhiteListPolicy, error) {
+	p := &DynamicWhiteListPolicy{def: def}
+	if err := p.Replace(allowed); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Policy decides the policy for the upstream address, see PolicyFunc.
+func (p *DynamicWhiteListPolicy) Policy(upstream net.Addr) (Policy, error) {
+	upstreamIP, err := ipFromAddr(upstream)
+	if err != nil {
+		// something is wrong with the source IP, better reject the connection
+		return REJECT, err
+	}
+
+	list := p.allowed.Load().(*dynamicWhiteList)
+	if matchIP(list.matchers, upstreamIP) {
+		return USE, nil
+	}
+
+	return p.def, nil
+}
+
+// Allowed returns a copy of the IP addresses and IP ranges currently allowed.
+func (p *DynamicWhiteListPolicy) Allowed() []string {
+	list := p.allowed.Load().(*dynamicWhiteList)
+	return append([]string(nil), list.entries...)
+}
+
+// Replace atomically replaces the list of allowed IP addresses and IP
+// ranges. If one of them is invalid, an error is returned and the current
+// list is left untouched.
+func (p *DynamicWhiteListPolicy) Replace(allowed []string) error {
+	matchers, err := parse(allowed)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.allowed.Store(&dynamicWhiteList{
+		entries:  append([]string(nil), allowed...),
+		matchers: matchers,
+	})
+	return nil
+}
+
+// Add allows the given IP addresses and IP ranges in addition to the current
+// ones. If one of them is invalid, an error is returned and the current list
+// is left untouched.
+func (p *DynamicWhiteListPolicy) Add(allowed ...string) error {
+	matchers, err := parse(allowed)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	list := p.allowed.Load().(*dynamicWhiteList)
+	p.allowed.Store(&dynamicWhiteList{
+		entries:  append(append([]string(nil), list.entries...), allowed...),
+		matchers: append(append([]func(net.IP) bool(nil), list.matchers...), matchers...),
+	})
+	return nil
+}
+
+// Remove stops allowing the given IP addresses and IP ranges. They must be
+// given exactly as they were added; unknown entries are ignored.
+func (p *DynamicWhiteListPolicy) Remove(allowed ...string) {
+	remove := make(map[string]bool, len(allowed))
+	for _, a := range allowed {
+		remove[a] = true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	list := p.allowed.Load().(*dynamicWhiteList)
+	updated := &dynamicWhiteList{}
+	for i, entry := range list.entries {
+		if remove[entry] {
+			continue
+		}
+		updated.entries = append(updated.entries, entry)
+		updated.matchers = append(updated.matchers, list.matchers[i])
+	}
+	p.allowed.Store(updated)
+}
+
+// HostnameWhiteListPolicy decides whether the upstream ip is allowed to send
+// a proxy header based on the addresses the given hostnames resolve to. The
+// hostnames are resolved again periodically, so that dynamically-addressed
+// proxies, e.g. load balancer nodes or Kubernetes services, stay trusted
+// without maintaining a list of IP addresses by hand.
+//
+// Its Policy method can be used as a PolicyFunc. Close must be called to
+// stop resolving the hostnames once the policy is not used anymore.
+type HostnameWhiteListPolicy struct {
+	hosts     []string
+	allowed   *DynamicWhiteListPolicy
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewHostnameWhiteListPolicy returns a HostnameWhiteListPolicy allowing the
+// addresses the given hostnames resolve to. IP addresses are accepted as
+// well and used verbatim. The def is a policy to use when an upstream IP is
+// not in the list.
+//
+// The hostnames are resolved again every interval. If interval is zero or
+// negative, they are only resolved again when Refresh is called. If one of
+// the hostnames cannot be resolved initially, an error is returned.
+func NewHostnameWhiteListPolicy(hosts []string, interval time.Duration, def Policy) (*HostnameWhiteListPolicy, error) {
+	allowed, err := NewDynamicWhiteListPolicy(nil, def)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &HostnameWhiteListPolicy{
+		hosts:   append([]string(nil), hosts...),
+		allowed: allowed,
+		done:    make(chan struct{}),
+	}
+	if err := p.Refresh(context.Background()); err != nil {
+		return nil, err
+	}
+
+	if interval > 0 {
+		go p.refreshEvery(interval)
+	}
+
+	return p, nil
+}
+
+// Policy decides the policy for the upstream address, see PolicyFunc.
+func (p *HostnameWhiteListPolicy) Policy(upstream net.Addr) (Policy, error) {
+	return p.allowed.Policy(upstream)
+}
+
+// Allowed returns the IP addresses the hostnames resolved to the last time.
+func (p *HostnameWhiteListPolicy) Allowed() []string {
+	return p.allowed.Allowed()
+}
+
+// Refresh resolves the hostnames again and replaces the allowed addresses.
+// If one of the hostnames cannot be resolved, an error is returned and the
+// previously resolved addresses are kept, so that a transient DNS failure
+// doesn't distrust all upstream proxies.
+func (p *HostnameWhiteListPolicy) Refresh(ctx context.Context) error {
+	var allowed []string
+	for _, host := range p.hosts {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return fmt.Errorf("proxyproto: can't resolve %q: %w", host, err)
+		}
+		for _, addr := range addrs {
+			allowed = append(allowed, addr.IP.String())
+		}
+	}
+
+	return p.allowed.Replace(allowed)
+}
+
+// Close stops resolving the hostnames periodically. The policy can still be
+// used afterwards, using the last resolved addresses.
+func (p *HostnameWhiteListPolicy) Close() {
+	p.closeOnce.Do(func() { close(p.done) })
+}
+
+func (p *HostnameWhiteListPolicy) refreshEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			// Errors keep the previous addresses, see Refresh.
+			_ = p.Refresh(ctx)
+			cancel()
+		}
+	}
+}
+
+func matchIP(allowed []func(net.IP) bool, ip net.IP) bool {
+	for _, allowFrom := range allowed {
+		if allowFrom(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func whitelistPolicy(allowed []func(net.IP) bool, def Policy) PolicyFunc {
 	return func(upstream net.Addr) (Policy, error) {
 		upstreamIP, err := ipFromAddr(upstream)
@@ -139,10 +458,8 @@ func whitelistPolicy(allowed []func(net.IP) bool, def Policy) PolicyFunc {
 			return REJECT, err
 		}
 
-		for _, allowFrom := range allowed {
-			if allowFrom(upstreamIP) {
-				return USE, nil
-			}
+		if matchIP(allowed, upstreamIP) {
+			return USE, nil
 		}
 
 		return def, nil
@@ -186,6 +503,115 @@ func ipFromAddr(upstream net.Addr) (net.IP, error) {
 	return upstreamIP, nil
 }
 
+// PolicyForLocalPort returns a ConnPolicyFunc which decides the policy based
+// on the local port the connection was accepted on, so that a single server
+// listening on multiple ports can e.g. require PROXY headers on one port and
+// reject them on another. The def is a policy to use when the local port is
+// not in ports.
+func PolicyForLocalPort(ports map[int]Policy, def Policy) ConnPolicyFunc {
+	return func(connOpts ConnPolicyOptions) (Policy, error) {
+		if connOpts.Downstream == nil {
+			return REJECT, fmt.Errorf("proxyproto: invalid local address")
+		}
+		_, portString, err := net.SplitHostPort(connOpts.Downstream.String())
+		if err != nil {
+			return REJECT, err
+		}
+		port, err := strconv.Atoi(portString)
+		if err != nil {
+			return REJECT, fmt.Errorf("proxyproto: invalid port number %q", portString)
+		}
+
+		if policy, ok := ports[port]; ok {
+			return policy, nil
+		}
+
+		return def, nil
+	}
+}
+
+// LocalAddrPolicy is the policy applied to connections accepted on a local
+// address, along with settings overriding the Listener's ones, see
+// PolicyForLocalAddr.
+type LocalAddrPolicy struct {
+	Policy Policy
+	ConnOverrides
+}
+
+// PolicyForLocalAddr returns a ConnPolicyOverridesFunc which decides the
+// policy and settings, e.g. timeouts and validators, based on the local
+// address the connection was accepted on, so that a single Listener, e.g.
+// created from a dual-stack or multi-address socket, can treat each address
+// differently. The keys of addrs are "ip:port", "ip" for any port or ":port"
+// for any IP, looked up in this order, IPv4-mapped IPv6 addresses matching
+// their IPv4 form. IPv6 addresses without a port may be bracketed, e.g.
+// "[::1]". The def is used when the local address matches no key, including
+// when it isn't an IP address, e.g. of a Unix socket. An error is returned if
+// a key is invalid.
+func PolicyForLocalAddr(addrs map[string]LocalAddrPolicy, def LocalAddrPolicy) (ConnPolicyOverridesFunc, error) {
+	policies := make(map[string]LocalAddrPolicy, len(addrs))
+	for key, policy := range addrs {
+		canonical, err := canonicalLocalAddr(key)
+		if err != nil {
+			return nil, err
+		}
+		policies[canonical] = policy
+	}
+
+	return func(connOpts ConnPolicyOptions) (Policy, ConnOverrides, error) {
+		if connOpts.Downstream == nil {
+			return REJECT, ConnOverrides{}, fmt.Errorf("proxyproto: invalid local address")
+		}
+		// Local addresses which aren't an IP and a port, e.g. of Unix
+		// sockets or zoned IPv6 addresses, can't match any key.
+		host, port, err := net.SplitHostPort(connOpts.Downstream.String())
+		if err != nil {
+			return def.Policy, def.ConnOverrides, nil
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return def.Policy, def.ConnOverrides, nil
+		}
+
+		for _, key := range []string{net.JoinHostPort(ip.String(), port), ip.String(), ":" + port} {
+			if policy, ok := policies[key]; ok {
+				return policy.Policy, policy.ConnOverrides, nil
+			}
+		}
+		return def.Policy, def.ConnOverrides, nil
+	}, nil
+}
+
+// canonicalLocalAddr returns the key of a PolicyForLocalAddr local address as
+// looked up for connections.
+func canonicalLocalAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
+	}
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 0 || n > 65535 {
+			return "", fmt.Errorf("proxyproto: invalid port number %q", port)
+		}
+		port = strconv.Itoa(n)
+	}
+
+	ip := net.ParseIP(host)
+	switch {
+	case host == "" && port != "":
+		return ":" + port, nil
+	case ip == nil:
+		return "", fmt.Errorf("proxyproto: invalid local address %q", addr)
+	case port == "":
+		return ip.String(), nil
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
 // IgnoreProxyHeaderNotOnInterface retuns a ConnPolicyFunc which can be used to
 // decide whether to use or ignore PROXY headers depending on the connection
 // being made on a specific interface. This policy can be used when the server
@@ -204,3 +630,96 @@ func IgnoreProxyHeaderNotOnInterface(allowedIP net.IP) ConnPolicyFunc {
 		return IGNORE, nil
 	}
 }
+
+// policyPrecedence ranks policies from the least (SKIP) to the most (REJECT)
+// restrictive, used to combine the results of several policy functions.
+func policyPrecedence(p Policy) int {
+	switch p {
+	case REJECT:
+		return 4
+	case REQUIRE:
+		return 3
+	case USE:
+		return 2
+	case IGNORE:
+		return 1
+	default: // SKIP
+		return 0
+	}
+}
+
+// PolicyAll returns a PolicyFunc which evaluates all given policy functions
+// and returns the most restrictive result, using the precedence
+// REJECT > REQUIRE > USE > IGNORE > SKIP. Evaluation stops at the first
+// REJECT or error. If no policy function is given, USE is returned.
+func PolicyAll(fns ...PolicyFunc) PolicyFunc {
+	return func(upstream net.Addr) (Policy, error) {
+		result, decided := USE, false
+		for _, fn := range fns {
+			policy, err := fn(upstream)
+			if err != nil {
+				return REJECT, err
+			}
+			if !decided || policyPrecedence(policy) > policyPrecedence(result) {
+				result, decided = policy, true
+			}
+			if result == REJECT {
+				break
+			}
+		}
+		return result, nil
+	}
+}
+
+// PolicyAny returns a PolicyFunc which evaluates all given policy functions
+// and returns the least restrictive result, using the precedence
+// REJECT > REQUIRE > USE > IGNORE > SKIP. An error returned by any of the
+// policy functions denies the connection. If no policy function is given,
+// USE is returned.
+func PolicyAny(fns ...PolicyFunc) PolicyFunc {
+	return func(upstream net.Addr) (Policy, error) {
+		result, decided := USE, false
+		for _, fn := range fns {
+			policy, err := fn(upstream)
+			if err != nil {
+				return REJECT, err
+			}
+			if !decided || policyPrecedence(policy) < policyPrecedence(result) {
+				result, decided = policy, true
+			}
+		}
+		return result, nil
+	}
+}
+
+// ChainPolicies returns a ConnPolicyFunc which evaluates the given connection
+// policy functions in order and returns the most restrictive result, using
+// the same precedence as PolicyAll. Evaluation stops at the first REJECT or
+// error. Use ConnPolicyFromPolicy to chain a PolicyFunc, e.g. an allowlist,
+// with connection policies such as IgnoreProxyHeaderNotOnInterface.
+func ChainPolicies(fns ...ConnPolicyFunc) ConnPolicyFunc {
+	return func(connOpts ConnPolicyOptions) (Policy, error) {
+		result, decided := USE, false
+		for _, fn := range fns {
+			policy, err := fn(connOpts)
+			if err != nil {
+				return REJECT, err
+			}
+			if !decided || policyPrecedence(policy) > policyPrecedence(result) {
+				result, decided = policy, true
+			}
+			if result == REJECT {
+				break
+			}
+		}
+		return result, nil
+	}
+}
+
+// ConnPolicyFromPolicy adapts a PolicyFunc to a ConnPolicyFunc by passing
+// the upstream address of the connection to it.
+func ConnPolicyFromPolicy(fn PolicyFunc) ConnPolicyFunc {
+	return func(connOpts ConnPolicyOptions) (Policy, error) {
+		return fn(connOpts.Upstream)
+	}
+}
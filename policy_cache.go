@@ -0,0 +1,109 @@
+package proxyproto
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+// CachedPolicy returns a PolicyFunc which caches the decisions of fn per
+// upstream IP address, so that an expensive policy, e.g. one querying DNS or
+// an external authorizer, is not evaluated for every accepted connection.
+//
+// At most size decisions are cached, the least recently used ones being
+// evicted first, and each decision is reused for at most ttl. A ttl of zero
+// or less caches decisions until they are evicted. Errors returned by fn are
+// not cached.
+func CachedPolicy(fn PolicyFunc, size int, ttl time.Duration) PolicyFunc {
+	if size <= 0 {
+		return fn
+	}
+
+	c := &policyCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element, size),
+		lru:     list.New(),
+	}
+
+	return func(upstream net.Addr) (Policy, error) {
+		ip, err := ipFromAddr(upstream)
+		if err != nil {
+			return fn(upstream)
+		}
+		key := ip.String()
+
+		if policy, ok := c.get(key); ok {
+			return policy, nil
+		}
+
+		policy, err := fn(upstream)
+		if err != nil {
+			return policy, err
+		}
+		c.put(key, policy)
+
+		return policy, nil
+	}
+}
+
+type policyCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // of *policyCacheEntry, most recently used first
+}
+
+type policyCacheEntry struct {
+	key     string
+	policy  Policy
+	expires time.Time
+}
+
+func (c *policyCache) get(key string) (Policy, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return USE, false
+	}
+	entry := elem.Value.(*policyCacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return USE, false
+	}
+	c.lru.MoveToFront(elem)
+
+	return entry.policy, true
+}
+
+func (c *policyCache) put(key string, policy Policy) {
+	entry := &policyCacheEntry{
+		key:    key,
+		policy: policy,
+	}
+	if c.ttl > 0 {
+		entry.expires = time.Now().Add(c.ttl)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*policyCacheEntry).key)
+	}
+}
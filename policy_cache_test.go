@@ -0,0 +1,99 @@
+package proxyproto
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func countingPolicy(policy Policy, calls *int) PolicyFunc {
+	return func(upstream net.Addr) (Policy, error) {
+		*calls++
+		return policy, nil
+	}
+}
+
+func TestCachedPolicy(t *testing.T) {
+	var calls int
+	p := CachedPolicy(countingPolicy(REQUIRE, &calls), 2, 0)
+
+	addrs := []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000},
+		&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2000}, // same IP, different port
+		&net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1000},
+	}
+	for _, addr := range addrs {
+		policy, err := p(addr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if policy != REQUIRE {
+			t.Fatalf("Expected policy REQUIRE, got %v", policy)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("Expected 2 calls to the policy, got %d", calls)
+	}
+
+	// Evict 10.0.0.1, the least recently used address.
+	if _, err := p(&net.TCPAddr{IP: net.ParseIP("10.0.0.3"), Port: 1000}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := p(addrs[2]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("Expected 3 calls to the policy, got %d", calls)
+	}
+	if _, err := p(addrs[0]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if calls != 4 {
+		t.Fatalf("Expected 4 calls to the policy, got %d", calls)
+	}
+}
+
+func TestCachedPolicyExpires(t *testing.T) {
+	var calls int
+	p := CachedPolicy(countingPolicy(USE, &calls), 10, 20*time.Millisecond)
+	upstream := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+
+	for i := 0; i < 2; i++ {
+		if _, err := p(upstream); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("Expected 1 call to the policy, got %d", calls)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, err := p(upstream); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("Expected 2 calls to the policy, got %d", calls)
+	}
+}
+
+func TestCachedPolicyDoesNotCacheErrors(t *testing.T) {
+	var calls int
+	p := CachedPolicy(func(upstream net.Addr) (Policy, error) {
+		calls++
+		return REJECT, ErrInvalidUpstream
+	}, 10, 0)
+	upstream := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+
+	for i := 0; i < 2; i++ {
+		if _, err := p(upstream); err != ErrInvalidUpstream {
+			t.Fatalf("Expected error %v, got %v", ErrInvalidUpstream, err)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("Expected 2 calls to the policy, got %d", calls)
+	}
+
+	if _, err := p(failingAddr{}); err != ErrInvalidUpstream {
+		t.Fatalf("Expected error %v, got %v", ErrInvalidUpstream, err)
+	}
+}
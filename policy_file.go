@@ -0,0 +1,266 @@
+package proxyproto
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrUnsupportedVersion is returned by FilePolicy.Validate when the header
+// version is not allowed by the configuration.
+var ErrUnsupportedVersion = errors.New("proxyproto: proxy protocol version not allowed")
+
+// PolicyConfig is the configuration loaded by FilePolicy, encoded as JSON,
+// e.g.:
+//
+//	{
+//	  "default": "REJECT",
+//	  "versions": [2],
+//	  "rules": [
+//	    {"cidrs": ["10.0.0.0/8"], "ports": [443], "policy": "REQUIRE"},
+//	    {"ports": [80], "policy": "SKIP"}
+//	  ]
+//	}
+type PolicyConfig struct {
+	// Default is the policy used when no rule matches. Defaults to USE.
+	Default string `json:"default"`
+	// Versions lists the allowed header versions. All are allowed if empty.
+	Versions []int `json:"versions"`
+	// Rules are evaluated in order, the first matching one wins.
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyRule decides the policy for connections matching both its upstream
+// IP addresses or IP ranges and its local ports.
+type PolicyRule struct {
+	// CIDRs lists upstream IP addresses and IP ranges. Matches any upstream
+	// if empty.
+	CIDRs []string `json:"cidrs"`
+	// Ports lists local ports. Matches any local port if empty.
+	Ports []int `json:"ports"`
+	// Policy is one of USE, IGNORE, REJECT, REQUIRE or SKIP.
+	Policy string `json:"policy"`
+}
+
+// FilePolicy is a connection policy loaded from a configuration file, see
+// PolicyConfig, which is reloaded whenever the file changes so that rules can
+// be updated without restarting the listener.
+//
+// Its ConnPolicy method can be used as a ConnPolicyFunc and its Validate
+// method as a Validator. Close must be called to stop watching the file once
+// the policy is not used anymore.
+type FilePolicy struct {
+	path   string
+	config atomic.Value // *filePolicyConfig
+
+	mu      sync.Mutex // protects modTime and size
+	modTime time.Time
+	size    int64
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type filePolicyConfig struct {
+	def      Policy
+	versions map[byte]bool
+	rules    []filePolicyRule
+}
+
+type filePolicyRule struct {
+	allowed []func(net.IP) bool
+	ports   map[int]bool
+	policy  Policy
+}
+
+// NewFilePolicy loads the policy configuration from the file at path and
+// checks it for changes every interval. If interval is zero or negative, the
+// file is only loaded again when Reload is called. An error is returned if
+// the file cannot be loaded initially.
+func NewFilePolicy(path string, interval time.Duration) (*FilePolicy, error) {
+	p := &FilePolicy{
+		path: path,
+		done: make(chan struct{}),
+	}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+
+	if interval > 0 {
+		go p.watch(interval)
+	}
+
+	return p, nil
+}
+
+// ConnPolicy decides the policy for the connection, see ConnPolicyFunc.
+func (p *FilePolicy) ConnPolicy(connOpts ConnPolicyOptions) (Policy, error) {
+	config := p.config.Load().(*filePolicyConfig)
+	if len(config.rules) == 0 {
+		return config.def, nil
+	}
+
+	upstreamIP, err := ipFromAddr(connOpts.Upstream)
+	if err != nil {
+		// something is wrong with the source IP, better reject the connection
+		return REJECT, err
+	}
+	port := -1
+	if connOpts.Downstream != nil {
+		if _, portString, err := net.SplitHostPort(connOpts.Downstream.String()); err == nil {
+			if p, err := strconv.Atoi(portString); err == nil {
+				port = p
+			}
+		}
+	}
+
+	for _, rule := range config.rules {
+		if len(rule.ports) > 0 && !rule.ports[port] {
+			continue
+		}
+		if len(rule.allowed) > 0 && !matchIP(rule.allowed, upstreamIP) {
+			continue
+		}
+		return rule.policy, nil
+	}
+
+	return config.def, nil
+}
+
+// Validate checks that the header version is allowed, see Validator.
+func (p *FilePolicy) Validate(header *Header) error {
+	config := p.config.Load().(*filePolicyConfig)
+	if len(config.versions) > 0 && !config.versions[header.Version] {
+		return ErrUnsupportedVersion
+	}
+
+	return nil
+}
+
+// Reload loads the configuration file again. If it cannot be loaded, an
+// error is returned and the current configuration is kept.
+func (p *FilePolicy) Reload() error {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+
+	var raw PolicyConfig
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("proxyproto: invalid policy configuration %q: %w", p.path, err)
+	}
+	config, err := compilePolicyConfig(raw)
+	if err != nil {
+		return fmt.Errorf("proxyproto: invalid policy configuration %q: %w", p.path, err)
+	}
+
+	p.mu.Lock()
+	p.modTime, p.size = info.ModTime(), info.Size()
+	p.mu.Unlock()
+	p.config.Store(config)
+
+	return nil
+}
+
+// Close stops watching the configuration file. The policy can still be used
+// afterwards, using the last loaded configuration.
+func (p *FilePolicy) Close() {
+	p.closeOnce.Do(func() { close(p.done) })
+}
+
+func (p *FilePolicy) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			info, err := os.Stat(p.path)
+			if err != nil {
+				continue
+			}
+			p.mu.Lock()
+			changed := !info.ModTime().Equal(p.modTime) || info.Size() != p.size
+			p.mu.Unlock()
+			if changed {
+				// Errors keep the current configuration, see Reload.
+				_ = p.Reload()
+			}
+		}
+	}
+}
+
+func compilePolicyConfig(raw PolicyConfig) (*filePolicyConfig, error) {
+	config := &filePolicyConfig{def: USE}
+	if raw.Default != "" {
+		def, err := parsePolicyName(raw.Default)
+		if err != nil {
+			return nil, err
+		}
+		config.def = def
+	}
+
+	if len(raw.Versions) > 0 {
+		config.versions = make(map[byte]bool, len(raw.Versions))
+		for _, v := range raw.Versions {
+			if v != 1 && v != 2 {
+				return nil, fmt.Errorf("unknown version %d", v)
+			}
+			config.versions[byte(v)] = true
+		}
+	}
+
+	for _, r := range raw.Rules {
+		policy, err := parsePolicyName(r.Policy)
+		if err != nil {
+			return nil, err
+		}
+		allowed, err := parse(r.CIDRs)
+		if err != nil {
+			return nil, err
+		}
+		rule := filePolicyRule{
+			allowed: allowed,
+			policy:  policy,
+		}
+		if len(r.Ports) > 0 {
+			rule.ports = make(map[int]bool, len(r.Ports))
+			for _, port := range r.Ports {
+				rule.ports[port] = true
+			}
+		}
+		config.rules = append(config.rules, rule)
+	}
+
+	return config, nil
+}
+
+func parsePolicyName(name string) (Policy, error) {
+	switch strings.ToUpper(name) {
+	case "USE":
+		return USE, nil
+	case "IGNORE":
+		return IGNORE, nil
+	case "REJECT":
+		return REJECT, nil
+	case "REQUIRE":
+		return REQUIRE, nil
+	case "SKIP":
+		return SKIP, nil
+	}
+
+	return USE, fmt.Errorf("unknown policy %q", name)
+}
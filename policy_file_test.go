@@ -0,0 +1,130 @@
+package proxyproto
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePolicyFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestFilePolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	writePolicyFile(t, path, `{
+		"default": "REJECT",
+		"versions": [2],
+		"rules": [
+			{"cidrs": ["10.0.0.0/8"], "ports": [443], "policy": "REQUIRE"},
+			{"ports": [80], "policy": "skip"}
+		]
+	}`)
+
+	p, err := NewFilePolicy(path, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer p.Close()
+
+	var cases = []struct {
+		name       string
+		upstream   string
+		downstream string
+		expected   Policy
+	}{
+		{"matching upstream and port", "10.1.2.3:1000", "192.0.2.1:443", REQUIRE},
+		{"matching port only", "192.0.2.7:1000", "192.0.2.1:443", REJECT},
+		{"any upstream", "192.0.2.7:1000", "192.0.2.1:80", SKIP},
+		{"default", "10.1.2.3:1000", "192.0.2.1:8080", REJECT},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream, _ := net.ResolveTCPAddr("tcp", tc.upstream)
+			downstream, _ := net.ResolveTCPAddr("tcp", tc.downstream)
+			policy, err := p.ConnPolicy(ConnPolicyOptions{Upstream: upstream, Downstream: downstream})
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if policy != tc.expected {
+				t.Fatalf("Expected policy %v, got %v", tc.expected, policy)
+			}
+		})
+	}
+
+	if err := p.Validate(&Header{Version: 1}); err != ErrUnsupportedVersion {
+		t.Fatalf("Expected error %v, got %v", ErrUnsupportedVersion, err)
+	}
+	if err := p.Validate(&Header{Version: 2}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := p.ConnPolicy(ConnPolicyOptions{Upstream: failingAddr{}}); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+}
+
+func TestFilePolicyReloadsOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	writePolicyFile(t, path, `{"default": "IGNORE"}`)
+
+	p, err := NewFilePolicy(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer p.Close()
+
+	upstream := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	if policy, _ := p.ConnPolicy(ConnPolicyOptions{Upstream: upstream}); policy != IGNORE {
+		t.Fatalf("Expected policy IGNORE, got %v", policy)
+	}
+
+	// An invalid configuration keeps the current one.
+	if err := os.WriteFile(path, []byte(`{"default": "MAYBE"}`), 0o600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := p.Reload(); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+	if policy, _ := p.ConnPolicy(ConnPolicyOptions{Upstream: upstream}); policy != IGNORE {
+		t.Fatalf("Expected policy IGNORE, got %v", policy)
+	}
+
+	writePolicyFile(t, path, `{"default": "REQUIRE", "rules": []}`)
+	deadline := time.Now().Add(time.Second)
+	for {
+		policy, _ := p.ConnPolicy(ConnPolicyOptions{Upstream: upstream})
+		if policy == REQUIRE {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected policy REQUIRE after reload, got %v", policy)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFilePolicyWithInvalidConfigurationReturnsError(t *testing.T) {
+	for _, content := range []string{
+		`not json`,
+		`{"default": "MAYBE"}`,
+		`{"versions": [3]}`,
+		`{"rules": [{"cidrs": ["20/80"], "policy": "USE"}]}`,
+		`{"rules": [{"policy": ""}]}`,
+	} {
+		path := filepath.Join(t.TempDir(), "policy.json")
+		writePolicyFile(t, path, content)
+		if _, err := NewFilePolicy(path, 0); err == nil {
+			t.Errorf("Expected error for %s, got none", content)
+		}
+	}
+
+	if _, err := NewFilePolicy(filepath.Join(t.TempDir(), "missing.json"), 0); err == nil {
+		t.Error("Expected error, got none")
+	}
+}
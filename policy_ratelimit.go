@@ -0,0 +1,104 @@
+package proxyproto
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultRateLimitMaxUpstreams is the number of upstreams whose buckets are
+// kept by RateLimitPolicy if maxUpstreams is zero or negative.
+const DefaultRateLimitMaxUpstreams = 10000
+
+// RateLimitPolicy returns a PolicyFunc which applies a token-bucket rate
+// limit per upstream IP address in front of fn. Each upstream may open
+// burst connections at once, refilled at rate connections per second. When
+// an upstream exceeds its limit, exceeded is returned without calling fn,
+// e.g. REJECT to refuse its PROXY headers or IGNORE to distrust them.
+//
+// To bound memory usage, the buckets of at most maxUpstreams upstreams are
+// kept, the least recently seen ones being forgotten first. If maxUpstreams is
+// zero or negative, DefaultRateLimitMaxUpstreams is used: the number of
+// buckets is always bounded, as abusive clients may come from many addresses.
+// A nil fn is equivalent to a policy always returning USE.
+func RateLimitPolicy(fn PolicyFunc, rate float64, burst int, maxUpstreams int, exceeded Policy) PolicyFunc {
+	if fn == nil {
+		fn = func(upstream net.Addr) (Policy, error) { return USE, nil }
+	}
+
+	l := newRateLimiter(rate, burst, maxUpstreams)
+
+	return func(upstream net.Addr) (Policy, error) {
+		ip, err := ipFromAddr(upstream)
+		if err != nil {
+			return fn(upstream)
+		}
+
+		if !l.allow(ip.String(), time.Now()) {
+			return exceeded, nil
+		}
+
+		return fn(upstream)
+	}
+}
+
+func newRateLimiter(rate float64, burst int, maxUpstreams int) *rateLimiter {
+	if maxUpstreams <= 0 {
+		maxUpstreams = DefaultRateLimitMaxUpstreams
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		max:     maxUpstreams,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+type rateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+	max   int
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List // of *tokenBucket, most recently seen first
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var bucket *tokenBucket
+	if elem, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(elem)
+		bucket = elem.Value.(*tokenBucket)
+		bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+		if bucket.tokens > l.burst {
+			bucket.tokens = l.burst
+		}
+		bucket.last = now
+	} else {
+		bucket = &tokenBucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.lru.PushFront(bucket)
+		if l.lru.Len() > l.max {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*tokenBucket).key)
+		}
+	}
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+
+	return true
+}
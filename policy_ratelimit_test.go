@@ -0,0 +1,76 @@
+package proxyproto
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimitPolicy(t *testing.T) {
+	p := RateLimitPolicy(staticPolicy(REQUIRE), 1, 2, 10, REJECT)
+	upstream := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	other := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1000}
+
+	expected := []Policy{REQUIRE, REQUIRE, REJECT}
+	for i, e := range expected {
+		policy, err := p(upstream)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if policy != e {
+			t.Fatalf("Connection %d: expected policy %v, got %v", i, e, policy)
+		}
+	}
+
+	// Other upstreams have their own bucket.
+	if policy, err := p(other); err != nil || policy != REQUIRE {
+		t.Fatalf("Expected policy REQUIRE, got %v (err: %v)", policy, err)
+	}
+
+	if _, err := p(failingAddr{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	l := newRateLimiter(10, 1, 1)
+	now := time.Now()
+
+	if !l.allow("a", now) {
+		t.Fatal("Expected first connection to be allowed")
+	}
+	if l.allow("a", now.Add(50*time.Millisecond)) {
+		t.Fatal("Expected second connection to be limited")
+	}
+	if !l.allow("a", now.Add(150*time.Millisecond)) {
+		t.Fatal("Expected connection to be allowed after refill")
+	}
+
+	// "a" is forgotten, so it gets a full bucket again.
+	if !l.allow("b", now.Add(150*time.Millisecond)) {
+		t.Fatal("Expected first connection to be allowed")
+	}
+	if !l.allow("a", now.Add(150*time.Millisecond)) {
+		t.Fatal("Expected forgotten upstream to be allowed")
+	}
+	if len(l.buckets) != 1 {
+		t.Fatalf("Expected 1 bucket, got %d", len(l.buckets))
+	}
+}
+
+func TestRateLimiterDefaultMaxUpstreams(t *testing.T) {
+	for _, max := range []int{0, -1} {
+		if l := newRateLimiter(1, 1, max); l.max != DefaultRateLimitMaxUpstreams {
+			t.Fatalf("Expected %d upstreams for %d, got %d", DefaultRateLimitMaxUpstreams, max, l.max)
+		}
+	}
+
+	l := newRateLimiter(1, 1, 0)
+	now := time.Now()
+	for i := 0; i < DefaultRateLimitMaxUpstreams+10; i++ {
+		l.allow(net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).String(), now)
+	}
+	if len(l.buckets) != DefaultRateLimitMaxUpstreams {
+		t.Fatalf("Expected %d buckets, got %d", DefaultRateLimitMaxUpstreams, len(l.buckets))
+	}
+}
@@ -3,6 +3,7 @@ package proxyproto
 import (
 	"net"
 	"testing"
+	"time"
 )
 
 type failingAddr struct{}
@@ -249,3 +250,339 @@ func TestIgnoreProxyHeaderNotOnInterface(t *testing.T) {
 	}
 
 }
+
+func staticPolicy(p Policy) PolicyFunc {
+	return func(upstream net.Addr) (Policy, error) { return p, nil }
+}
+
+func TestPolicyAll(t *testing.T) {
+	errPolicy := func(upstream net.Addr) (Policy, error) { return USE, ErrInvalidUpstream }
+
+	var cases = []struct {
+		name           string
+		policy         PolicyFunc
+		expectedPolicy Policy
+		expectError    bool
+	}{
+		{"no policies", PolicyAll(), USE, false},
+		{"single policy", PolicyAll(staticPolicy(SKIP)), SKIP, false},
+		{"reject wins", PolicyAll(staticPolicy(USE), staticPolicy(REJECT), staticPolicy(REQUIRE)), REJECT, false},
+		{"require over use", PolicyAll(staticPolicy(USE), staticPolicy(REQUIRE)), REQUIRE, false},
+		{"use over ignore", PolicyAll(staticPolicy(IGNORE), staticPolicy(USE)), USE, false},
+		{"ignore over skip", PolicyAll(staticPolicy(SKIP), staticPolicy(IGNORE)), IGNORE, false},
+		{"error denies", PolicyAll(staticPolicy(USE), errPolicy), REJECT, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := tc.policy(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000})
+			if !tc.expectError && err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if tc.expectError && err == nil {
+				t.Fatal("Expected error, got none")
+			}
+			if policy != tc.expectedPolicy {
+				t.Fatalf("Expected policy %v, got %v", tc.expectedPolicy, policy)
+			}
+		})
+	}
+}
+
+func TestPolicyAny(t *testing.T) {
+	errPolicy := func(upstream net.Addr) (Policy, error) { return USE, ErrInvalidUpstream }
+
+	var cases = []struct {
+		name           string
+		policy         PolicyFunc
+		expectedPolicy Policy
+		expectError    bool
+	}{
+		{"no policies", PolicyAny(), USE, false},
+		{"single policy", PolicyAny(staticPolicy(REJECT)), REJECT, false},
+		{"skip wins", PolicyAny(staticPolicy(REJECT), staticPolicy(SKIP), staticPolicy(USE)), SKIP, false},
+		{"use over require", PolicyAny(staticPolicy(REQUIRE), staticPolicy(USE)), USE, false},
+		{"require over reject", PolicyAny(staticPolicy(REJECT), staticPolicy(REQUIRE)), REQUIRE, false},
+		{"error denies", PolicyAny(staticPolicy(USE), errPolicy), REJECT, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := tc.policy(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000})
+			if !tc.expectError && err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if tc.expectError && err == nil {
+				t.Fatal("Expected error, got none")
+			}
+			if policy != tc.expectedPolicy {
+				t.Fatalf("Expected policy %v, got %v", tc.expectedPolicy, policy)
+			}
+		})
+	}
+}
+
+func TestChainPolicies(t *testing.T) {
+	upstream, err := net.ResolveTCPAddr("tcp", "10.0.0.3:45738")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	downstream, err := net.ResolveTCPAddr("tcp", "192.0.2.1:443")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	allowlist := ConnPolicyFromPolicy(MustStrictWhiteListPolicy([]string{"10.0.0.0/24"}))
+
+	var cases = []struct {
+		name           string
+		policy         ConnPolicyFunc
+		upstream       net.Addr
+		expectedPolicy Policy
+		expectError    bool
+	}{
+		{"allowed on interface", ChainPolicies(allowlist, IgnoreProxyHeaderNotOnInterface(net.ParseIP("192.0.2.1"))), upstream, USE, false},
+		{"allowed not on interface", ChainPolicies(allowlist, IgnoreProxyHeaderNotOnInterface(net.ParseIP("192.0.2.2"))), upstream, USE, false},
+		{"not allowed", ChainPolicies(allowlist, IgnoreProxyHeaderNotOnInterface(net.ParseIP("192.0.2.1"))), &net.TCPAddr{IP: net.ParseIP("10.0.1.3"), Port: 1000}, REJECT, false},
+		{"invalid upstream", ChainPolicies(allowlist), failingAddr{}, REJECT, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := tc.policy(ConnPolicyOptions{
+				Upstream:   tc.upstream,
+				Downstream: downstream,
+			})
+			if !tc.expectError && err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if tc.expectError && err == nil {
+				t.Fatal("Expected error, got none")
+			}
+			if policy != tc.expectedPolicy {
+				t.Fatalf("Expected policy %v, got %v", tc.expectedPolicy, policy)
+			}
+		})
+	}
+}
+
+func TestDynamicWhiteListPolicy(t *testing.T) {
+	p, err := NewDynamicWhiteListPolicy([]string{"10.0.0.2", "10.0.1.0/24"}, REJECT)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	check := func(addr string, expected Policy) {
+		t.Helper()
+		upstream, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		policy, err := p.Policy(upstream)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if policy != expected {
+			t.Fatalf("Expected policy %v for %s, got %v", expected, addr, policy)
+		}
+	}
+
+	check("10.0.0.2:1000", USE)
+	check("10.0.1.7:1000", USE)
+	check("10.0.2.7:1000", REJECT)
+
+	if err := p.Add("10.0.2.0/24"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	check("10.0.2.7:1000", USE)
+
+	p.Remove("10.0.1.0/24", "192.0.2.1")
+	check("10.0.1.7:1000", REJECT)
+	check("10.0.2.7:1000", USE)
+
+	if err := p.Replace([]string{"192.0.2.0/24"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	check("10.0.0.2:1000", REJECT)
+	check("192.0.2.1:1000", USE)
+
+	if err := p.Replace([]string{"20/80"}); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+	if err := p.Add("855.222.233.11"); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+	if allowed := p.Allowed(); len(allowed) != 1 || allowed[0] != "192.0.2.0/24" {
+		t.Fatalf("Expected allowed list to be left untouched, got %v", allowed)
+	}
+
+	if _, err := p.Policy(failingAddr{}); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+}
+
+func TestDynamicWhiteListPolicyWithInvalidIpAddressReturnsError(t *testing.T) {
+	_, err := NewDynamicWhiteListPolicy([]string{"855.222.233.11"}, IGNORE)
+	if err == nil {
+		t.Error("Expected error, got none")
+	}
+}
+
+func TestHostnameWhiteListPolicy(t *testing.T) {
+	p, err := NewHostnameWhiteListPolicy([]string{"localhost", "192.0.2.1"}, 10*time.Millisecond, REJECT)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer p.Close()
+
+	var cases = []struct {
+		upstream string
+		expected Policy
+	}{
+		{"127.0.0.1:45738", USE},
+		{"192.0.2.1:45738", USE},
+		{"192.0.2.2:45738", REJECT},
+	}
+
+	// Run twice, making sure periodic refreshes keep the same addresses.
+	for i := 0; i < 2; i++ {
+		for _, tc := range cases {
+			upstream, err := net.ResolveTCPAddr("tcp", tc.upstream)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			policy, err := p.Policy(upstream)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if policy != tc.expected {
+				t.Fatalf("Expected policy %v for %s, got %v", tc.expected, tc.upstream, policy)
+			}
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+}
+
+func TestHostnameWhiteListPolicyWithUnresolvableHostReturnsError(t *testing.T) {
+	_, err := NewHostnameWhiteListPolicy([]string{"host.invalid"}, 0, REJECT)
+	if err == nil {
+		t.Error("Expected error, got none")
+	}
+}
+
+func TestPolicyForLocalPort(t *testing.T) {
+	p := PolicyForLocalPort(map[int]Policy{
+		443:  REQUIRE,
+		8443: REJECT,
+	}, IGNORE)
+
+	var cases = []struct {
+		name           string
+		downstream     net.Addr
+		expectedPolicy Policy
+		expectError    bool
+	}{
+		{"require on 443", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}, REQUIRE, false},
+		{"reject on 8443", &net.TCPAddr{IP: net.ParseIP("fde7::1"), Port: 8443}, REJECT, false},
+		{"default on other ports", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80}, IGNORE, false},
+		{"invalid address", failingAddr{}, REJECT, true},
+		{"missing address", nil, REJECT, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := p(ConnPolicyOptions{Downstream: tc.downstream})
+			if !tc.expectError && err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if tc.expectError && err == nil {
+				t.Fatal("Expected error, got none")
+			}
+			if policy != tc.expectedPolicy {
+				t.Fatalf("Expected policy %v, got %v", tc.expectedPolicy, policy)
+			}
+		})
+	}
+}
+
+func TestPolicyForLocalAddr(t *testing.T) {
+	validator := func(*Header) error { return nil }
+	p, err := PolicyForLocalAddr(map[string]LocalAddrPolicy{
+		"192.0.2.1:443":     {Policy: REQUIRE, ConnOverrides: ConnOverrides{ReadHeaderTimeout: time.Second}},
+		"192.0.2.1":         {Policy: USE},
+		"[2001:db8::1]:443": {Policy: REQUIRE, ConnOverrides: ConnOverrides{ValidateHeader: validator}},
+		"[2001:db8::3]":     {Policy: USE},
+		":8443":             {Policy: REJECT},
+	}, LocalAddrPolicy{Policy: IGNORE, ConnOverrides: ConnOverrides{MaxHeaderSize: 100}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var cases = []struct {
+		name           string
+		downstream     net.Addr
+		expectedPolicy Policy
+		expectError    bool
+	}{
+		{"address and port", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}, REQUIRE, false},
+		{"IPv4-mapped address and port", &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 443}, REQUIRE, false},
+		{"IPv6 address and port", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, REQUIRE, false},
+		{"address on other port", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80}, USE, false},
+		{"bracketed IPv6 address", &net.TCPAddr{IP: net.ParseIP("2001:db8::3"), Port: 80}, USE, false},
+		{"port on other address", &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 8443}, REJECT, false},
+		{"address wins over port", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 8443}, USE, false},
+		{"default", &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443}, IGNORE, false},
+		{"invalid address", failingAddr{}, IGNORE, false},
+		{"unix address", &net.UnixAddr{Net: "unix", Name: "/run/proxy.sock"}, IGNORE, false},
+		{"zoned address", &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 443, Zone: "eth0"}, IGNORE, false},
+		{"missing address", nil, REJECT, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, _, err := p(ConnPolicyOptions{Downstream: tc.downstream})
+			if !tc.expectError && err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if tc.expectError && err == nil {
+				t.Fatal("Expected error, got none")
+			}
+			if policy != tc.expectedPolicy {
+				t.Fatalf("Expected policy %v, got %v", tc.expectedPolicy, policy)
+			}
+		})
+	}
+
+	_, overrides, _ := p(ConnPolicyOptions{Downstream: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}})
+	if overrides.ReadHeaderTimeout != time.Second {
+		t.Fatalf("Expected read header timeout %v, got %v", time.Second, overrides.ReadHeaderTimeout)
+	}
+	_, overrides, _ = p(ConnPolicyOptions{Downstream: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}})
+	if overrides.ValidateHeader == nil {
+		t.Fatalf("Expected a validator")
+	}
+	_, overrides, _ = p(ConnPolicyOptions{Downstream: &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443}})
+	if overrides.MaxHeaderSize != 100 {
+		t.Fatalf("Expected max header size 100, got %d", overrides.MaxHeaderSize)
+	}
+
+	for _, key := range []string{"", ":", "example.org:443", "192.0.2.1:http", "192.0.2.1:70000", "[2001:db8::1", "[]", "[example.org]"} {
+		if _, err := PolicyForLocalAddr(map[string]LocalAddrPolicy{key: {}}, LocalAddrPolicy{}); err == nil {
+			t.Fatalf("Expected error for %q, got none", key)
+		}
+	}
+}
+
+func TestPolicyString(t *testing.T) {
+	for policy, expected := range map[Policy]string{
+		USE:        "USE",
+		IGNORE:     "IGNORE",
+		REJECT:     "REJECT",
+		REQUIRE:    "REQUIRE",
+		SKIP:       "SKIP",
+		Policy(42): "Policy(42)",
+	} {
+		if s := policy.String(); s != expected {
+			t.Fatalf("expected %q, got %q", expected, s)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package proxyproto
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultMaxIdlePerKey is the number of idle connections a Pool keeps per
+// backend and header, if Pool.MaxIdlePerKey is not set.
+const DefaultMaxIdlePerKey = 2
+
+// ErrPoolHeaderRequired is returned by Pool.Get when no header is given, as
+// pooled connections are keyed by their header.
+var ErrPoolHeaderRequired = errors.New("proxyproto: pooled connections require a header")
+
+// Pool keeps outbound proxied connections open for reuse. As the proxy
+// protocol header is written once per connection, when it's dialed, pooled
+// connections are keyed by backend and header: a connection is only reused
+// for the same backend and the exact same header, so that it's never shared
+// across different clients claimed by their headers.
+//
+// The zero value is a usable pool dialing with the zero value of Dialer.
+type Pool struct {
+	// Dialer dials the pooled connections, with its Header, HeaderFunc and
+	// Local fields ignored in favor of the header given to Get. If nil, the
+	// zero value of Dialer is used.
+	Dialer *Dialer
+	// MaxIdlePerKey is the number of idle connections kept per backend and
+	// header. If zero, DefaultMaxIdlePerKey is used.
+	MaxIdlePerKey int
+	// IdleTimeout is how long a connection may stay idle before being
+	// closed instead of reused. If zero, idle connections don't expire.
+	IdleTimeout time.Duration
+	// Heartbeat, if not nil, sends heartbeats on idle connections, which
+	// are closed instead of reused when one fails. Its LOCAL headers, see
+	// Heartbeat.SendLocalHeaders, are only accepted by receivers reading a
+	// header before each message, not by Listener: prefer Heartbeat.Ping.
+	Heartbeat *Heartbeat
+
+	mu     sync.Mutex
+	idle   map[poolKey][]*idleConn
+	closed bool
+}
+
+type poolKey struct {
+	network string
+	address string
+	header  string // formatted header
+}
+
+type idleConn struct {
+	conn          *ClientConn
+	since         time.Time
+	stopHeartbeat func() error // nil without Pool.Heartbeat
+}
+
+// Get returns an idle connection to the address on the named network on which
+// the header was written, or dials a new one and writes the header on it.
+// Closing the returned connection puts it back into the pool, unless reading
+// from or writing to it failed. The header is required, ErrPoolHeaderRequired
+// is returned if it's nil.
+func (p *Pool) Get(ctx context.Context, network, address string, header *Header) (*PoolConn, error) {
+	if header == nil {
+		return nil, ErrPoolHeaderRequired
+	}
+	formatted, err := header.Format()
+	if err != nil {
+		return nil, err
+	}
+	key := poolKey{network: network, address: address, header: string(formatted)}
+
+	if conn := p.getIdle(key); conn != nil {
+		return &PoolConn{ClientConn: conn, pool: p, key: key}, nil
+	}
+
+	var d Dialer
+	if p.Dialer != nil {
+		d.Dialer = p.Dialer.Dialer
+	}
+	d.Header = header
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &PoolConn{ClientConn: conn.(*ClientConn), pool: p, key: key}, nil
+}
+
+func (p *Pool) getIdle(key poolKey) *ClientConn {
+	for {
+		ic := p.popIdle(key)
+		if ic == nil {
+			return nil
+		}
+		// The heartbeats are stopped out of the lock, as a failing one
+		// removes its connection from the pool.
+		if ic.stopHeartbeat != nil && ic.stopHeartbeat() != nil {
+			// The failed heartbeat closed the connection.
+			continue
+		}
+		if p.IdleTimeout > 0 && time.Since(ic.since) > p.IdleTimeout {
+			ic.conn.Close()
+			continue
+		}
+		return ic.conn
+	}
+}
+
+// popIdle removes the most recently used idle connection for key from the
+// pool and returns it, or nil if there is none.
+func (p *Pool) popIdle(key poolKey) *idleConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := p.idle[key]
+	if len(conns) == 0 {
+		return nil
+	}
+	ic := conns[len(conns)-1]
+	p.setIdle(key, conns[:len(conns)-1])
+	return ic
+}
+
+// removeIdle removes ic from the idle connections for key, if it's still
+// there.
+func (p *Pool) removeIdle(key poolKey, ic *idleConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := p.idle[key]
+	for i, c := range conns {
+		if c == ic {
+			p.setIdle(key, append(conns[:i:i], conns[i+1:]...))
+			return
+		}
+	}
+}
+
+func (p *Pool) setIdle(key poolKey, conns []*idleConn) {
+	if len(conns) == 0 {
+		delete(p.idle, key)
+	} else {
+		p.idle[key] = conns
+	}
+}
+
+// put puts the connection back into the pool, or closes it if the pool is
+// closed or full.
+func (p *Pool) put(key poolKey, conn *ClientConn) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	maxIdle := p.MaxIdlePerKey
+	if maxIdle == 0 {
+		maxIdle = DefaultMaxIdlePerKey
+	}
+	if p.closed || len(p.idle[key]) >= maxIdle {
+		return conn.Close()
+	}
+	if p.idle == nil {
+		p.idle = make(map[poolKey][]*idleConn)
+	}
+	ic := &idleConn{conn: conn, since: time.Now()}
+	if p.Heartbeat != nil {
+		ic.stopHeartbeat = p.Heartbeat.start(conn, func(error) {
+			p.removeIdle(key, ic)
+		})
+	}
+	p.idle[key] = append(p.idle[key], ic)
+	return nil
+}
+
+// Idle returns the number of idle connections in the pool.
+func (p *Pool) Idle() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var n int
+	for _, conns := range p.idle {
+		n += len(conns)
+	}
+	return n
+}
+
+// Close closes the idle connections of the pool. Connections in use are
+// closed instead of being put back into the pool.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	var err error
+	for _, conns := range idle {
+		for _, ic := range conns {
+			if ic.stopHeartbeat != nil && ic.stopHeartbeat() != nil {
+				continue
+			}
+			if cerr := ic.conn.Close(); cerr != nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+// PoolConn is a connection obtained from a Pool.
+type PoolConn struct {
+	*ClientConn
+
+	pool   *Pool
+	key    poolKey
+	mu     sync.Mutex
+	broken bool
+	done   bool
+}
+
+// Read wraps the original ClientConn.Read, marking the connection as not
+// reusable on error.
+func (c *PoolConn) Read(b []byte) (int, error) {
+	n, err := c.ClientConn.Read(b)
+	if err != nil {
+		c.MarkBroken()
+	}
+	return n, err
+}
+
+// Write wraps the original ClientConn.Write, marking the connection as not
+// reusable on error.
+func (c *PoolConn) Write(b []byte) (int, error) {
+	n, err := c.ClientConn.Write(b)
+	if err != nil {
+		c.MarkBroken()
+	}
+	return n, err
+}
+
+// MarkBroken prevents the connection from being put back into the pool when
+// closed, e.g. when the application protocol left it in an unusable state.
+func (c *PoolConn) MarkBroken() {
+	c.mu.Lock()
+	c.broken = true
+	c.mu.Unlock()
+}
+
+// Close puts the connection back into its pool, or closes it if it's broken,
+// see MarkBroken. Subsequent calls return net.ErrClosed.
+func (c *PoolConn) Close() error {
+	c.mu.Lock()
+	done, broken := c.done, c.broken
+	c.done = true
+	c.mu.Unlock()
+
+	if done {
+		return net.ErrClosed
+	}
+	if broken {
+		return c.ClientConn.Close()
+	}
+	// Deadlines set by the previous user mustn't affect the next one.
+	if err := c.ClientConn.SetDeadline(time.Time{}); err != nil {
+		return c.ClientConn.Close()
+	}
+	return c.pool.put(c.key, c.ClientConn)
+}
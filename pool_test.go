@@ -0,0 +1,280 @@
+package proxyproto
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	// The server records the header of each connection.
+	headers := make(chan *Header, 8)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				header, err := Read(reader)
+				if err != nil {
+					return
+				}
+				headers <- header
+				_, _ = reader.WriteTo(conn)
+			}()
+		}
+	}()
+
+	alice := HeaderProxyFromAddrs(2, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}, l.Addr())
+	bob := HeaderProxyFromAddrs(2, &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1000}, l.Addr())
+	pool := &Pool{MaxIdlePerKey: 1}
+	defer pool.Close()
+
+	get := func(header *Header) *PoolConn {
+		conn, err := pool.Get(context.Background(), "tcp", l.Addr().String(), header)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return conn
+	}
+	echo := func(conn *PoolConn) {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		buf := make([]byte, 4)
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	expectHeader := func(expected *Header) {
+		select {
+		case header := <-headers:
+			if !header.EqualsTo(expected) {
+				t.Fatalf("expected header %#v, got %#v", expected, header)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for header")
+		}
+	}
+
+	first := get(alice)
+	echo(first)
+	expectHeader(alice)
+	if err := first.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := first.Close(); err != net.ErrClosed {
+		t.Fatalf("expected %v, got %v", net.ErrClosed, err)
+	}
+	if pool.Idle() != 1 {
+		t.Fatalf("expected 1 idle connection, got %d", pool.Idle())
+	}
+
+	// The same client reuses the connection, without a new header.
+	second := get(alice)
+	if second.ClientConn != first.ClientConn {
+		t.Fatal("expected the idle connection to be reused")
+	}
+	echo(second)
+
+	// Another client, or the same one concurrently, gets a new connection.
+	other := get(bob)
+	echo(other)
+	expectHeader(bob)
+	concurrent := get(alice)
+	echo(concurrent)
+	expectHeader(alice)
+	if concurrent.ClientConn == second.ClientConn {
+		t.Fatal("expected a new connection while the idle one is in use")
+	}
+
+	// The pool keeps at most one idle connection per key.
+	second.Close()
+	concurrent.Close()
+	other.Close()
+	if pool.Idle() != 2 {
+		t.Fatalf("expected 2 idle connections, got %d", pool.Idle())
+	}
+
+	// Broken connections aren't put back.
+	broken := get(bob)
+	broken.MarkBroken()
+	broken.Close()
+	if pool.Idle() != 1 {
+		t.Fatalf("expected 1 idle connection, got %d", pool.Idle())
+	}
+
+	if err := pool.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if pool.Idle() != 0 {
+		t.Fatalf("expected no idle connection, got %d", pool.Idle())
+	}
+
+	select {
+	case header := <-headers:
+		t.Fatalf("unexpected header %#v", header)
+	default:
+	}
+}
+
+func TestPoolNilHeader(t *testing.T) {
+	pool := &Pool{}
+	defer pool.Close()
+
+	if _, err := pool.Get(context.Background(), "tcp", "127.0.0.1:0", nil); err != ErrPoolHeaderRequired {
+		t.Fatalf("expected error %v, got %v", ErrPoolHeaderRequired, err)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	pool := &Pool{IdleTimeout: time.Millisecond}
+	defer pool.Close()
+	header := NewLocalHeader()
+
+	first, err := pool.Get(context.Background(), "tcp", l.Addr().String(), header)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	first.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	second, err := pool.Get(context.Background(), "tcp", l.Addr().String(), header)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer second.Close()
+	if second.ClientConn == first.ClientConn {
+		t.Fatal("expected the expired idle connection not to be reused")
+	}
+}
+
+func TestPoolHeartbeat(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	// The server reads headers only: the PROXY header, then heartbeats.
+	headers := make(chan *Header, 8)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					header, err := Read(reader)
+					if err != nil {
+						return
+					}
+					headers <- header
+				}
+			}()
+		}
+	}()
+	expectHeader := func(expected *Header) {
+		select {
+		case header := <-headers:
+			if !header.EqualsTo(expected) {
+				t.Fatalf("expected header %#v, got %#v", expected, header)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for header")
+		}
+	}
+
+	header := HeaderProxyFromAddrs(2, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}, l.Addr())
+	pool := &Pool{Heartbeat: &Heartbeat{Interval: 10 * time.Millisecond, SendLocalHeaders: true}}
+	defer pool.Close()
+
+	first, err := pool.Get(context.Background(), "tcp", l.Addr().String(), header)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expectHeader(header)
+	first.Close()
+
+	// Idle connections get heartbeats.
+	expectHeader(NewLocalHeader())
+	expectHeader(NewLocalHeader())
+
+	// Reused connections don't.
+	second, err := pool.Get(context.Background(), "tcp", l.Addr().String(), header)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if second.ClientConn != first.ClientConn {
+		t.Fatal("expected the idle connection to be reused")
+	}
+	// Heartbeats sent before Get are read before a marker written after it.
+	marker := HeaderProxyFromAddrs(2, &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2000}, l.Addr())
+	if _, err := marker.WriteTo(second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for received := false; !received; {
+		select {
+		case h := <-headers:
+			received = h.EqualsTo(marker)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for marker")
+		}
+	}
+	select {
+	case h := <-headers:
+		t.Fatalf("expected no heartbeat on a connection in use, got %#v", h)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Connections whose heartbeat fails are dropped.
+	pool.Heartbeat = &Heartbeat{
+		Interval: time.Millisecond,
+		Ping: func(*ClientConn) error {
+			return errReadIntentionallyBroken
+		},
+	}
+	second.Close()
+	for deadline := time.Now().Add(5 * time.Second); pool.Idle() != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no idle connection, got %d", pool.Idle())
+		}
+	}
+	third, err := pool.Get(context.Background(), "tcp", l.Addr().String(), header)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer third.Close()
+	if third.ClientConn == first.ClientConn {
+		t.Fatal("expected the connection whose heartbeat failed not to be reused")
+	}
+}
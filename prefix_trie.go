@@ -0,0 +1,87 @@
+package proxyproto
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// prefixTrie is a binary trie of IP prefixes. IPv4 prefixes are stored as
+// IPv4-mapped IPv6 prefixes, so lookups take at most 128 steps regardless of
+// the number of prefixes stored.
+type prefixTrie struct {
+	root prefixTrieNode
+}
+
+type prefixTrieNode struct {
+	children [2]*prefixTrieNode
+	terminal bool
+}
+
+func (t *prefixTrie) insert(prefix netip.Prefix) {
+	addr := prefix.Addr().As16()
+	bits := prefix.Bits()
+	if prefix.Addr().Is4() {
+		bits += 96
+	}
+
+	node := &t.root
+	for i := 0; i < bits; i++ {
+		if node.terminal {
+			// A shorter prefix already covers this one.
+			return
+		}
+		bit := addr[i/8] >> (7 - uint(i%8)) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = new(prefixTrieNode)
+		}
+		node = node.children[bit]
+	}
+	node.terminal = true
+	// Longer prefixes are covered by this one.
+	node.children = [2]*prefixTrieNode{}
+}
+
+func (t *prefixTrie) contains(ip net.IP) bool {
+	a, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr := a.As16()
+
+	node := &t.root
+	for i := 0; i < 128; i++ {
+		if node.terminal {
+			return true
+		}
+		node = node.children[addr[i/8]>>(7-uint(i%8))&1]
+		if node == nil {
+			return false
+		}
+	}
+	return node.terminal
+}
+
+func parsePrefixTrie(allowed []string) (*prefixTrie, error) {
+	t := new(prefixTrie)
+	for _, allowFrom := range allowed {
+		if strings.LastIndex(allowFrom, "/") > 0 {
+			prefix, err := netip.ParsePrefix(allowFrom)
+			if err != nil {
+				return nil, fmt.Errorf("proxyproto: given string %q is not a valid IP range: %v", allowFrom, err)
+			}
+
+			t.insert(prefix.Masked())
+		} else {
+			addr, err := netip.ParseAddr(allowFrom)
+			if err != nil {
+				return nil, fmt.Errorf("proxyproto: given string %q is not a valid IP address", allowFrom)
+			}
+
+			t.insert(netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+
+	return t, nil
+}
@@ -0,0 +1,139 @@
+package proxyproto
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestPrefixTrie(t *testing.T) {
+	trie, err := parsePrefixTrie([]string{
+		"10.0.0.2",
+		"10.1.0.0/16",
+		"10.1.2.0/24", // covered by 10.1.0.0/16
+		"192.0.2.77/24",
+		"2001:db8::/32",
+		"fde7::1",
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var cases = []struct {
+		ip       string
+		expected bool
+	}{
+		{"10.0.0.2", true},
+		{"10.0.0.3", false},
+		{"10.1.255.1", true},
+		{"10.1.2.3", true},
+		{"10.2.0.1", false},
+		{"192.0.2.1", true},
+		{"192.0.3.1", false},
+		{"::ffff:10.0.0.2", true},
+		{"2001:db8:1::1", true},
+		{"2001:db9::1", false},
+		{"fde7::1", true},
+		{"fde7::2", false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.ip, func(t *testing.T) {
+			if actual := trie.contains(net.ParseIP(tc.ip)); actual != tc.expected {
+				t.Fatalf("Expected %t, got %t", tc.expected, actual)
+			}
+		})
+	}
+
+	if trie.contains(nil) {
+		t.Fatal("Expected nil IP not to be contained")
+	}
+}
+
+func TestPrefixTrieMatchAll(t *testing.T) {
+	v4, err := parsePrefixTrie([]string{"0.0.0.0/0"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !v4.contains(net.ParseIP("203.0.113.1")) {
+		t.Fatal("Expected IPv4 address to be contained in 0.0.0.0/0")
+	}
+	if v4.contains(net.ParseIP("2001:db8::1")) {
+		t.Fatal("Expected IPv6 address not to be contained in 0.0.0.0/0")
+	}
+
+	v6, err := parsePrefixTrie([]string{"::/0"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !v6.contains(net.ParseIP("2001:db8::1")) {
+		t.Fatal("Expected IPv6 address to be contained in ::/0")
+	}
+}
+
+func TestPrefixWhiteListPolicy(t *testing.T) {
+	var cases = []struct {
+		name     string
+		policy   PolicyFunc
+		upstream string
+		expected Policy
+	}{
+		{"strict in list", MustStrictPrefixWhiteListPolicy([]string{"10.0.0.0/30"}), "10.0.0.3:45738", USE},
+		{"strict not in list", MustStrictPrefixWhiteListPolicy([]string{"10.0.0.0/30"}), "10.0.0.5:45738", REJECT},
+		{"lax in list", MustLaxPrefixWhiteListPolicy([]string{"10.0.0.3"}), "10.0.0.3:45738", USE},
+		{"lax not in list", MustLaxPrefixWhiteListPolicy([]string{"10.0.0.3"}), "10.0.0.5:45738", IGNORE},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream, err := net.ResolveTCPAddr("tcp", tc.upstream)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+
+			policy, err := tc.policy(upstream)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if policy != tc.expected {
+				t.Fatalf("Expected policy %v, got %v", tc.expected, policy)
+			}
+		})
+	}
+
+	if _, err := MustStrictPrefixWhiteListPolicy([]string{"10.0.0.0/30"})(failingAddr{}); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+}
+
+func TestPrefixWhiteListPolicyWithInvalidEntriesReturnsError(t *testing.T) {
+	for _, allowed := range []string{"20/80", "855.222.233.11"} {
+		if _, err := StrictPrefixWhiteListPolicy([]string{allowed}); err == nil {
+			t.Errorf("Expected error for %q, got none", allowed)
+		}
+		if _, err := LaxPrefixWhiteListPolicy([]string{allowed}); err == nil {
+			t.Errorf("Expected error for %q, got none", allowed)
+		}
+	}
+}
+
+func BenchmarkPrefixWhiteListPolicy(b *testing.B) {
+	allowed := make([]string, 0, 4096)
+	for i := 0; i < cap(allowed); i++ {
+		allowed = append(allowed, fmt.Sprintf("10.%d.%d.0/24", i/256, i%256))
+	}
+	upstream := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+
+	b.Run("linear", func(b *testing.B) {
+		policy := MustStrictWhiteListPolicy(allowed)
+		for i := 0; i < b.N; i++ {
+			_, _ = policy(upstream)
+		}
+	})
+	b.Run("prefix tree", func(b *testing.B) {
+		policy := MustStrictPrefixWhiteListPolicy(allowed)
+		for i := 0; i < b.N; i++ {
+			_, _ = policy(upstream)
+		}
+	})
+}
@@ -2,6 +2,9 @@ package proxyproto
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -9,6 +12,8 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/pires/go-proxyproto/core"
 )
 
 var (
@@ -21,8 +26,51 @@ var (
 	// ErrInvalidUpstream should be returned when an upstream connection address
 	// is not trusted, and therefore is invalid.
 	ErrInvalidUpstream = fmt.Errorf("proxyproto: upstream connection address not trusted for PROXY information")
+
+	// ErrNotTCPConn is returned when setting TCP socket options on a
+	// connection whose underlying connection isn't a TCP one.
+	ErrNotTCPConn = errors.New("proxyproto: underlying connection is not a TCP connection")
+
+	// ErrAddresslessHeader is returned when a proxy protocol header carries
+	// no client address while it's required, see WithRejectAddressless.
+	ErrAddresslessHeader = errors.New("proxyproto: header carries no client address")
+
+	// ErrHeaderTooLarge is returned when a proxy protocol header is larger
+	// than the maximum size, see WithMaxHeaderSize.
+	ErrHeaderTooLarge = errors.New("proxyproto: header exceeds the maximum size")
+
+	// ErrReadHeaderTimeout is returned with the REQUIRE policy when the
+	// header couldn't be read before the read header timeout, e.g. because
+	// of a slow proxy, as opposed to ErrNoProxyProtocol when the connection
+	// doesn't start with a header. It implements net.Error, with Timeout
+	// returning true. Other policies proceed as if there was no header.
+	ErrReadHeaderTimeout error = &timeoutError{msg: "proxyproto: timeout while reading PROXY header"}
+
+	// ErrHeaderAlreadyProcessed is returned by Conn.SetProxyHeader when the
+	// header has already been processed and isn't a LOCAL one.
+	ErrHeaderAlreadyProcessed = errors.New("proxyproto: header already processed")
+
+	// ErrHeaderNotRecorded is returned by Conn.WriteRawHeaderTo when the
+	// header isn't recorded, see WithRecordHeader.
+	ErrHeaderNotRecorded = errors.New("proxyproto: header not recorded")
+
+	// ErrTooManyPendingHeaders is returned by Accept, wrapped in a temporary
+	// AcceptError, when a connection is closed because too many others are
+	// reading their header, see Listener.MaxPendingHeaders.
+	ErrTooManyPendingHeaders = errors.New("proxyproto: too many connections reading their PROXY header")
+
+	errHeaderPanic = errors.New("proxyproto: panic while processing PROXY header")
 )
 
+// timeoutError is a net.Error reporting a timeout.
+type timeoutError struct {
+	msg string
+}
+
+func (e *timeoutError) Error() string   { return e.msg }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
 // Listener is used to wrap an underlying listener,
 // whose connections may be using the HAProxy Proxy Protocol.
 // If the connection is using the protocol, the RemoteAddr() will return
@@ -31,15 +79,156 @@ var (
 // is set, a default of 200ms will be used. This can be disabled by setting the
 // timeout to < 0.
 //
-// Only one of Policy or ConnPolicy should be provided. If both are provided then
-// a panic would occur during accept.
+// Only one of Policy, ConnPolicy or ConnPolicyOverrides should be provided.
+// If more than one are provided then a panic would occur during accept.
 type Listener struct {
 	Listener net.Listener
 	// Deprecated: use ConnPolicyFunc instead. This will be removed in future release.
-	Policy            PolicyFunc
-	ConnPolicy        ConnPolicyFunc
-	ValidateHeader    Validator
+	Policy     PolicyFunc
+	ConnPolicy ConnPolicyFunc
+	// ConnPolicyOverrides decides the policy like ConnPolicy, and may also
+	// override ReadHeaderTimeout, MaxHeaderSize and ValidateHeader for each
+	// connection, e.g. per local address with PolicyForLocalAddr.
+	ConnPolicyOverrides ConnPolicyOverridesFunc
+	ValidateHeader      Validator
+	// OnHeaderParsed is called on accepted connections once their header has
+	// been parsed and validated, see the OnHeaderParsed option.
+	OnHeaderParsed func(*Header, net.Conn) error
+	// Sniff is passed the first SniffLen bytes of accepted connections
+	// before their header is processed, see WithSniffer.
+	Sniff             SniffFunc
+	SniffLen          int
 	ReadHeaderTimeout time.Duration
+	// MaxHeaderSize limits the size in bytes of the headers read on accepted
+	// connections, see WithMaxHeaderSize. Zero or a negative value means no
+	// limit besides the protocol's own.
+	MaxHeaderSize int
+	// ReadOptions customize how headers are read on accepted connections,
+	// see WithReadOptions.
+	ReadOptions []ReadOption
+	// RecordHeader makes accepted connections record the bytes of their
+	// header, see WithRecordHeader.
+	RecordHeader bool
+	// StickyHeaderError makes header errors sticky on accepted connections,
+	// see WithStickyHeaderError.
+	StickyHeaderError bool
+	// ProxiedAddrs makes accepted connections return *ProxiedAddr addresses,
+	// see WithProxiedAddrs.
+	ProxiedAddrs bool
+	// SocketAddrs makes accepted connections return the addresses of the
+	// underlying connections, see WithSocketAddrs.
+	SocketAddrs bool
+	// RejectAddressless makes accepted connections reject headers carrying
+	// no client address, see WithRejectAddressless.
+	RejectAddressless bool
+	// CRC32cAction is applied to the headers of accepted connections whose
+	// checksum doesn't match, see WithCRC32cCheck. By default checksums
+	// aren't verified.
+	CRC32cAction CRC32cAction
+	// OnCRC32cMismatch is called when the checksum of a header doesn't
+	// match, see WithCRC32cCheck.
+	OnCRC32cMismatch func(*Header, net.Conn)
+	// MaxPendingHeaders limits how many accepted connections may be between
+	// Accept and the end of their header processing at once, so that clients
+	// stalling after connecting, e.g. in a SYN-then-stall attack, can't pin
+	// unbounded resources. When the limit is reached, Accept waits for a
+	// connection to be done with its header for PendingHeadersTimeout, then
+	// closes the new connection and returns ErrTooManyPendingHeaders. Zero or
+	// a negative value means no limit. Connections with the SKIP policy
+	// aren't counted.
+	MaxPendingHeaders int
+	// PendingHeadersTimeout is how long Accept waits when MaxPendingHeaders
+	// is reached. Zero means waiting until a connection is done with its
+	// header or the listener is closed, a negative value not waiting.
+	PendingHeadersTimeout time.Duration
+	// Hooks are called on connection events, e.g. to export metrics.
+	Hooks ListenerHooks
+	// ConnWrappers are applied in order to each accepted connection, the
+	// first one wrapping the connection returned by this package and the last
+	// one returning the connection returned by Accept. They allow stacking
+	// e.g. rate limiting, metrics or tracing wrappers without writing a
+	// custom Accept loop. A wrapper returning nil drops the connection.
+	ConnWrappers []func(net.Conn) net.Conn
+
+	// The following fields track accepted connections for Shutdown and the
+	// paused state, and are protected by the mutex.
+	mu     sync.Mutex
+	conns  map[*Conn]struct{}
+	idle   chan struct{} // closed once no connection is left after Shutdown
+	paused chan struct{} // non-nil while paused, closed by Resume
+	closed chan struct{} // closed by Close
+	stats  ListenerStats // Open is computed from conns
+	// headerSlots holds a value per connection processing its header, see
+	// MaxPendingHeaders.
+	headerSlots chan struct{}
+}
+
+// ListenerStats is a snapshot of a Listener's connection counters, see
+// Listener.Stats.
+type ListenerStats struct {
+	// Open is the number of accepted connections not closed yet. As for
+	// Shutdown, connections accepted with the SKIP policy aren't included.
+	Open int
+	// Accepted is the total number of accepted connections.
+	Accepted uint64
+	// Rejected is the total number of connections closed by Accept because
+	// the policy returned an error, or because too many connections were
+	// reading their header, see MaxPendingHeaders.
+	Rejected uint64
+	// HeadersV1 and HeadersV2 are the total number of valid headers read on
+	// accepted connections, by version.
+	HeadersV1 uint64
+	HeadersV2 uint64
+}
+
+// AcceptError is returned by Listener.Accept when accepting a connection
+// fails, wrapping the cause. It implements net.Error so that serve loops such
+// as http.Server's know whether to retry: the error is temporary if it only
+// concerns a single connection, e.g. the policy returned an error for it, or
+// if the underlying listener's error is temporary or a timeout. The listener
+// keeps serving in that case, and Accept should be called again. Otherwise,
+// e.g. once the listener is closed, the error is fatal.
+type AcceptError struct {
+	Err error
+	// RemoteAddr is the address of the connection which was rejected, or nil
+	// if the error doesn't concern a single connection.
+	RemoteAddr net.Addr
+	temporary  bool
+	timeout    bool
+}
+
+// newAcceptError classifies an error returned by the underlying listener.
+func newAcceptError(err error) *AcceptError {
+	acceptErr := &AcceptError{Err: err}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		acceptErr.timeout = netErr.Timeout()
+		acceptErr.temporary = netErr.Timeout() || netErr.Temporary()
+	}
+	return acceptErr
+}
+
+func (e *AcceptError) Error() string {
+	if e.RemoteAddr != nil {
+		return fmt.Sprintf("proxyproto: rejected connection from %v: %v", e.RemoteAddr, e.Err)
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the cause of the error.
+func (e *AcceptError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the underlying listener timed out.
+func (e *AcceptError) Timeout() bool {
+	return e.timeout
+}
+
+// Temporary reports whether the error only concerns a single connection or
+// is temporary, in which case Accept should be called again.
+func (e *AcceptError) Temporary() bool {
+	return e.temporary
 }
 
 // Conn is used to wrap and underlying connection which
@@ -47,16 +236,72 @@ type Listener struct {
 // return the address of the client instead of the proxy address. Each connection
 // will have its own readHeaderTimeout and readDeadline set by the Accept() call.
 type Conn struct {
-	readDeadline      atomic.Value // time.Time
-	once              sync.Once
+	// bytesIn and bytesOut count the application bytes read and written
+	// when countBytes is set, see ConnInfo. They're accessed atomically and
+	// come first to be 64-bit aligned.
+	bytesIn  uint64
+	bytesOut uint64
+	// deadlineMu makes storing the user's read deadline and applying it to
+	// the underlying connection atomic, so that restoring it after reading
+	// the header can't race with SetReadDeadline.
+	deadlineMu   sync.Mutex
+	readDeadline atomic.Value // time.Time
+	// headerMu serializes header processing, headerRead is set atomically
+	// once it's done, after which header and readErr are never written to
+	// again and can be read without holding headerMu.
+	headerMu          sync.Mutex
+	headerRead        uint32
 	readErr           error
 	conn              net.Conn
 	bufReader         *bufio.Reader
-	reader            io.Reader
 	header            *Header
 	ProxyHeaderPolicy Policy
 	Validate          Validator
+	onHeaderParsed    func(*Header, net.Conn) error
+	sniff             SniffFunc
+	sniffLen          int
+	readOptions       []ReadOption
 	readHeaderTimeout time.Duration
+	maxHeaderSize     int
+	stickyHeaderError bool
+	proxiedAddrs      bool
+	socketAddrs       bool
+	rejectAddressless bool
+	crc32cAction      CRC32cAction
+	onCRC32cMismatch  func(*Header, net.Conn)
+	closeOnce         sync.Once
+	onClose           func() // called once when the connection is closed
+	onHeaderStart     func() // called once before the header is processed
+	onHeaderRead      func() // called once the header has been processed
+	// rawReader counts the bytes read from conn into bufReader, in order to
+	// compute headerSize.
+	rawReader      *countingReader
+	headerSize     int
+	headerDuration time.Duration
+	countBytes     bool
+	acceptedAt     time.Time
+	// tee records the bytes of the header when WithRecordHeader is used.
+	tee       *HeaderTee
+	rawHeader []byte
+	// headerModified is set when the header was modified once read, so that
+	// rawHeader no longer matches it, e.g. by CRC32cStrip.
+	headerModified bool
+	// noHeaderErr describes the first bytes when there was no header.
+	noHeaderErr *NoProxyProtocolError
+}
+
+// ProxiedAddr is an address taken from a proxy protocol header, returned by
+// Conn.LocalAddr and Conn.RemoteAddr when WithProxiedAddrs is used. It acts
+// as the address claimed by the header, while also carrying the address of
+// the underlying socket and the header itself.
+type ProxiedAddr struct {
+	// Addr is the address claimed by the header.
+	net.Addr
+	// SocketAddr is the address of the underlying socket, i.e. of the proxy
+	// for a remote address.
+	SocketAddr net.Addr
+	// Header is the header the address was taken from.
+	Header *Header
 }
 
 // Validator receives a header and decides whether it is a valid one
@@ -72,6 +317,26 @@ func ValidateHeader(v Validator) func(*Conn) {
 	}
 }
 
+// WithReadOptions customizes how the proxy protocol header is read when
+// passed as option to NewConn(), like ReadWith, e.g. with WithV1MaxLen.
+func WithReadOptions(opts ...ReadOption) func(*Conn) {
+	return func(c *Conn) {
+		c.readOptions = opts
+	}
+}
+
+// OnHeaderParsed sets a callback for proxy protocol headers on a connection
+// when passed as option to NewConn(). It's called once the header has been
+// parsed and validated, before any application data is read, with the header
+// and the underlying connection, e.g. to log, enrich or veto connections
+// depending on both. Returning an error rejects the header like a Validator.
+// The callback must not use the *Conn being processed, which would deadlock.
+func OnHeaderParsed(fn func(*Header, net.Conn) error) func(*Conn) {
+	return func(c *Conn) {
+		c.onHeaderParsed = fn
+	}
+}
+
 // SetReadHeaderTimeout sets the readHeaderTimeout for a connection when passed as option to NewConn()
 func SetReadHeaderTimeout(t time.Duration) func(*Conn) {
 	return func(c *Conn) {
@@ -81,68 +346,588 @@ func SetReadHeaderTimeout(t time.Duration) func(*Conn) {
 	}
 }
 
+// WithMaxHeaderSize limits the size in bytes of the proxy protocol header to
+// n when passed as option to NewConn(). Larger headers are rejected with
+// ErrHeaderTooLarge, v2 ones as soon as their length is known so that their
+// payload isn't read. Zero or a negative n means no limit besides the
+// protocol's own.
+func WithMaxHeaderSize(n int) func(*Conn) {
+	return func(c *Conn) {
+		c.maxHeaderSize = n
+	}
+}
+
+// WithReadDeadline tells a connection, when passed as option to NewConn(),
+// about the read deadline t already set on the underlying connection, which
+// can't be queried. It is restored once the header is read, instead of being
+// cleared, and it bounds the time spent reading the header if it's earlier
+// than the readHeaderTimeout. Deadlines set after wrapping the connection with
+// SetDeadline or SetReadDeadline are tracked without this option.
+func WithReadDeadline(t time.Time) func(*Conn) {
+	return func(c *Conn) {
+		c.readDeadline.Store(t)
+	}
+}
+
+// WithRecordHeader makes a connection record the exact bytes of its proxy
+// protocol header when passed as option to NewConn(), see Conn.RawHeader,
+// e.g. for compliance logging or to capture test vectors. Recording stops
+// once the header has been read.
+func WithRecordHeader(record bool) func(*Conn) {
+	return func(c *Conn) {
+		if record {
+			c.tee = TeeHeader(c.conn)
+			c.rawReader.r = c.tee
+		}
+	}
+}
+
+// WithStickyHeaderError makes the error raised while processing the header,
+// e.g. a missing header with REQUIRE or a malformed one, sticky when passed as
+// option to NewConn(): once the header has been processed, every Read and
+// Write returns that error until the connection is closed. Otherwise only
+// reads return it and writes proceed.
+func WithStickyHeaderError(sticky bool) func(*Conn) {
+	return func(c *Conn) {
+		c.stickyHeaderError = sticky
+	}
+}
+
+// WithRejectAddressless makes headers carrying no client address, i.e. v1
+// UNKNOWN headers and v2 LOCAL or UNSPEC ones, policy violations when passed
+// as option to NewConn(): reading the header fails with ErrAddresslessHeader
+// instead of falling back to the addresses of the underlying connection. This
+// suits deployments where every connection must carry a real client address,
+// e.g. when proxies don't send health checks. It applies to the USE and
+// REQUIRE policies.
+func WithRejectAddressless(reject bool) func(*Conn) {
+	return func(c *Conn) {
+		c.rejectAddressless = reject
+	}
+}
+
+// WithCRC32cCheck verifies the checksum carried by the PP2_TYPE_CRC32C TLV of
+// proxy protocol headers when passed as option to NewConn(), applying action
+// to headers whose checksum doesn't match: rejecting them, stripping the TLV
+// or only reporting the mismatch, like HAProxy allows. onMismatch, if not nil,
+// is called on each mismatch, or when the checksum can't be verified because
+// the TLVs are malformed, with the header as received and the underlying
+// connection, e.g. to log it. Headers whose TLVs are malformed are rejected
+// unless action is CRC32cLogOnly. Headers without checksum are accepted, see
+// RequireCRC32c to require one. It applies to the USE and REQUIRE policies.
+// The checksum is computed over the bytes received if the header is recorded,
+// see WithRecordHeader, and over the header formatted again otherwise.
+func WithCRC32cCheck(action CRC32cAction, onMismatch func(*Header, net.Conn)) func(*Conn) {
+	return func(c *Conn) {
+		c.crc32cAction = action
+		c.onCRC32cMismatch = onMismatch
+	}
+}
+
+// WithProxiedAddrs makes LocalAddr and RemoteAddr return *ProxiedAddr values
+// when the address comes from the proxy protocol header, when passed as
+// option to NewConn(). This allows logging and auditing code to access both
+// the header and socket addresses without casting the connection to *Conn.
+func WithProxiedAddrs(enabled bool) func(*Conn) {
+	return func(c *Conn) {
+		c.proxiedAddrs = enabled
+	}
+}
+
+// WithSocketAddrs makes LocalAddr and RemoteAddr always return the addresses
+// of the underlying connection when passed as option to NewConn(), without
+// reading the header, while the addresses claimed by the header are returned
+// by ProxyLocalAddr and ProxyRemoteAddr. This suits applications which need
+// both, e.g. to log them, and don't want the addresses to be overridden. It
+// takes precedence over WithProxiedAddrs.
+func WithSocketAddrs(enabled bool) func(*Conn) {
+	return func(c *Conn) {
+		c.socketAddrs = enabled
+	}
+}
+
+// WithHeader attaches a header which has already been read, e.g. by another
+// component handing the connection over, when passed as option to NewConn().
+// The connection is considered processed: nothing is read from the underlying
+// connection before application data, the header isn't validated and no hook
+// is called. A nil header means the connection carries none. This allows
+// building proxied connections, e.g. in tests, without writing wire bytes.
+func WithHeader(header *Header) func(*Conn) {
+	return func(c *Conn) {
+		c.header = header
+		c.readErr = nil
+		c.finishHeader()
+	}
+}
+
 // Accept waits for and returns the next valid connection to the listener.
+// Errors are *AcceptError values telling whether Accept should be called
+// again, see AcceptError.
 func (p *Listener) Accept() (net.Conn, error) {
 	for {
+		conn, err := p.accept()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, wrap := range p.ConnWrappers {
+			if conn = wrap(conn); conn == nil {
+				break
+			}
+		}
+		if conn == nil {
+			// the connection was dropped by a wrapper, which is responsible
+			// for closing it
+			continue
+		}
+
+		return conn, nil
+	}
+}
+
+// AcceptProxy is like Accept, but returns the connection as a *Conn, giving
+// access to its methods without a type assertion. ConnWrappers aren't
+// applied, as they may return other types. Connections accepted with the SKIP
+// policy, which Accept returns as is, are wrapped into a *Conn with that
+// policy, which passes all the bytes through without processing any header.
+func (p *Listener) AcceptProxy() (*Conn, error) {
+	conn, err := p.accept()
+	if err != nil {
+		return nil, err
+	}
+	if proxyConn, ok := conn.(*Conn); ok {
+		return proxyConn, nil
+	}
+	return NewConn(conn, WithPolicy(SKIP)), nil
+}
+
+// accept waits for and returns the next valid connection to the listener,
+// before applying ConnWrappers.
+func (p *Listener) accept() (net.Conn, error) {
+	for {
+		if err := p.waitResumed(); err != nil {
+			return nil, newAcceptError(err)
+		}
+
 		// Get the underlying connection
 		conn, err := p.Listener.Accept()
 		if err != nil {
-			return nil, err
+			return nil, newAcceptError(err)
+		}
+
+		// The listener may have been paused while waiting for the connection
+		if err := p.waitResumed(); err != nil {
+			conn.Close()
+			return nil, newAcceptError(err)
 		}
 
 		proxyHeaderPolicy := USE
-		if p.Policy != nil && p.ConnPolicy != nil {
-			panic("only one of policy or connpolicy must be provided.")
+		var overrides ConnOverrides
+		if countPolicies(p.Policy != nil, p.ConnPolicy != nil, p.ConnPolicyOverrides != nil) > 1 {
+			panic("only one of policy, connpolicy or connpolicyoverrides must be provided.")
 		}
-		if p.Policy != nil || p.ConnPolicy != nil {
-			if p.Policy != nil {
+		if p.Policy != nil || p.ConnPolicy != nil || p.ConnPolicyOverrides != nil {
+			connOpts := ConnPolicyOptions{
+				Upstream:     conn.RemoteAddr(),
+				Downstream:   conn.LocalAddr(),
+				ListenerAddr: p.Listener.Addr(),
+			}
+			switch {
+			case p.Policy != nil:
 				proxyHeaderPolicy, err = p.Policy(conn.RemoteAddr())
-			} else {
-				proxyHeaderPolicy, err = p.ConnPolicy(ConnPolicyOptions{
-					Upstream:   conn.RemoteAddr(),
-					Downstream: conn.LocalAddr(),
-				})
+			case p.ConnPolicy != nil:
+				proxyHeaderPolicy, err = p.ConnPolicy(connOpts)
+			default:
+				proxyHeaderPolicy, overrides, err = p.ConnPolicyOverrides(connOpts)
 			}
-			if err != nil {
-				// can't decide the policy, we can't accept the connection
-				conn.Close()
-
-				if errors.Is(err, ErrInvalidUpstream) {
-					// keep listening for other connections
-					continue
-				}
+		}
+		p.Hooks.policyDecided(conn.RemoteAddr(), proxyHeaderPolicy, err)
+		if err != nil {
+			// can't decide the policy, we can't accept the connection
+			conn.Close()
+			p.mu.Lock()
+			p.stats.Rejected++
+			p.mu.Unlock()
 
-				return nil, err
+			if errors.Is(err, ErrInvalidUpstream) {
+				// keep listening for other connections
+				continue
 			}
-			// Handle a connection as a regular one
-			if proxyHeaderPolicy == SKIP {
-				return conn, nil
+
+			// only this connection is concerned, the listener keeps
+			// serving the next ones
+			return nil, &AcceptError{Err: err, RemoteAddr: conn.RemoteAddr(), temporary: true}
+		}
+		// Handle a connection as a regular one
+		if proxyHeaderPolicy == SKIP {
+			p.mu.Lock()
+			p.stats.Accepted++
+			p.mu.Unlock()
+			return conn, nil
+		}
+
+		releaseHeaderSlot, err := p.acquireHeaderSlot()
+		if err != nil {
+			conn.Close()
+			p.mu.Lock()
+			p.stats.Rejected++
+			p.mu.Unlock()
+
+			if err != ErrTooManyPendingHeaders {
+				return nil, newAcceptError(err)
 			}
+			return nil, &AcceptError{Err: err, RemoteAddr: conn.RemoteAddr(), temporary: true}
 		}
 
 		newConn := NewConn(
 			conn,
 			WithPolicy(proxyHeaderPolicy),
 			ValidateHeader(p.ValidateHeader),
+			OnHeaderParsed(p.OnHeaderParsed),
+			WithSniffer(p.SniffLen, p.Sniff),
+			WithReadOptions(p.ReadOptions...),
+			WithRecordHeader(p.RecordHeader),
+			WithStickyHeaderError(p.StickyHeaderError),
+			WithProxiedAddrs(p.ProxiedAddrs),
+			WithSocketAddrs(p.SocketAddrs),
+			WithRejectAddressless(p.RejectAddressless),
+			WithCRC32cCheck(p.CRC32cAction, p.OnCRC32cMismatch),
 		)
 
-		// If the ReadHeaderTimeout for the listener is unset, use the default timeout.
-		if p.ReadHeaderTimeout == 0 {
-			p.ReadHeaderTimeout = DefaultReadHeaderTimeout
+		maxHeaderSize := p.MaxHeaderSize
+		if overrides.MaxHeaderSize != 0 {
+			maxHeaderSize = overrides.MaxHeaderSize
+		}
+		newConn.maxHeaderSize = maxHeaderSize
+		if overrides.ValidateHeader != nil {
+			newConn.Validate = overrides.ValidateHeader
+		}
+
+		// If the ReadHeaderTimeout for the listener is unset, use the default
+		// timeout. The listener itself is left untouched since Accept may be
+		// called concurrently.
+		readHeaderTimeout := p.ReadHeaderTimeout
+		if overrides.ReadHeaderTimeout != 0 {
+			readHeaderTimeout = overrides.ReadHeaderTimeout
+		}
+		if readHeaderTimeout == 0 {
+			readHeaderTimeout = DefaultReadHeaderTimeout
 		}
 
 		// Set the readHeaderTimeout of the new conn to the value of the listener
-		newConn.readHeaderTimeout = p.ReadHeaderTimeout
+		newConn.readHeaderTimeout = readHeaderTimeout
+
+		p.track(newConn, releaseHeaderSlot)
 
 		return newConn, nil
 	}
 }
 
+// countPolicies returns how many of the policy callbacks are set.
+func countPolicies(set ...bool) int {
+	n := 0
+	for _, ok := range set {
+		if ok {
+			n++
+		}
+	}
+	return n
+}
+
 // Close closes the underlying listener.
 func (p *Listener) Close() error {
+	p.mu.Lock()
+	closed := p.closedChan()
+	select {
+	case <-closed:
+	default:
+		close(closed)
+	}
+	p.mu.Unlock()
+
 	return p.Listener.Close()
 }
 
+// Pause makes Accept stop accepting connections until Resume is called,
+// without closing the underlying listener. Incoming connections are left
+// in the kernel's backlog in the meantime. Closing the listener unblocks a
+// paused Accept.
+func (p *Listener) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.paused == nil {
+		p.paused = make(chan struct{})
+	}
+}
+
+// Resume makes Accept accept connections again after Pause.
+func (p *Listener) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.paused != nil {
+		close(p.paused)
+		p.paused = nil
+	}
+}
+
+// Paused reports whether the listener is paused.
+func (p *Listener) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.paused != nil
+}
+
+// waitResumed blocks while the listener is paused. It returns net.ErrClosed
+// if the listener is closed in the meantime.
+func (p *Listener) waitResumed() error {
+	p.mu.Lock()
+	paused, closed := p.paused, p.closedChan()
+	p.mu.Unlock()
+
+	if paused == nil {
+		return nil
+	}
+	select {
+	case <-paused:
+		return nil
+	case <-closed:
+		return net.ErrClosed
+	}
+}
+
+// closedChan returns the channel closed by Close, the mutex must be held.
+func (p *Listener) closedChan() chan struct{} {
+	if p.closed == nil {
+		p.closed = make(chan struct{})
+	}
+	return p.closed
+}
+
+// Shutdown gracefully shuts down the listener: it closes the underlying
+// listener, so that Accept stops accepting connections, then waits for the
+// connections it accepted to be closed. If ctx expires first, the remaining
+// connections are forcibly closed and the context's error is returned.
+//
+// Connections accepted with the SKIP policy are returned as is and are
+// therefore not tracked.
+func (p *Listener) Shutdown(ctx context.Context) error {
+	err := p.Close()
+
+	p.mu.Lock()
+	if p.idle == nil {
+		p.idle = make(chan struct{})
+		if len(p.conns) == 0 {
+			close(p.idle)
+		}
+	}
+	idle := p.idle
+	p.mu.Unlock()
+
+	select {
+	case <-idle:
+		return err
+	case <-ctx.Done():
+	}
+
+	p.mu.Lock()
+	conns := make([]*Conn, 0, len(p.conns))
+	for conn := range p.conns {
+		conns = append(conns, conn)
+	}
+	p.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	return ctx.Err()
+}
+
+// track registers conn as active until it's closed, see Shutdown.
+func (p *Listener) track(conn *Conn, releaseHeaderSlot func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conns == nil {
+		p.conns = make(map[*Conn]struct{})
+	}
+	p.conns[conn] = struct{}{}
+	p.stats.Accepted++
+
+	connectionClosed := p.Hooks.ConnectionClosed
+	if connectionClosed != nil {
+		conn.countBytes = true
+		conn.acceptedAt = time.Now()
+	}
+
+	// The header slot is released once the header is processed, or when the
+	// connection is closed before.
+	var releaseOnce sync.Once
+	release := func() {
+		if releaseHeaderSlot != nil {
+			releaseOnce.Do(releaseHeaderSlot)
+		}
+	}
+
+	var headerDone func(*Header, time.Duration, error)
+	conn.onHeaderStart = func() {
+		headerDone = p.Hooks.headerReadStarted(conn.conn, conn.ProxyHeaderPolicy)
+	}
+	conn.onHeaderRead = func() {
+		release()
+		if headerDone != nil {
+			headerDone(conn.header, conn.headerDuration, conn.readErr)
+		}
+		p.Hooks.headerRead(conn.header, conn.headerDuration, conn.readErr)
+		if conn.header == nil {
+			return
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		switch conn.header.Version {
+		case 1:
+			p.stats.HeadersV1++
+		case 2:
+			p.stats.HeadersV2++
+		}
+	}
+	conn.onClose = func() {
+		release()
+		p.untrack(conn)
+		if connectionClosed != nil {
+			connectionClosed(conn.info())
+		}
+	}
+}
+
+// acquireHeaderSlot acquires a slot for a connection about to process its
+// header, waiting for one to be released if MaxPendingHeaders is reached, see
+// PendingHeadersTimeout. It returns the function releasing the slot, which is
+// nil if there's no limit, ErrTooManyPendingHeaders if no slot was released in
+// time, or net.ErrClosed if the listener was closed in the meantime.
+func (p *Listener) acquireHeaderSlot() (func(), error) {
+	if p.MaxPendingHeaders <= 0 {
+		return nil, nil
+	}
+
+	p.mu.Lock()
+	if p.headerSlots == nil {
+		p.headerSlots = make(chan struct{}, p.MaxPendingHeaders)
+	}
+	slots, closed := p.headerSlots, p.closedChan()
+	p.mu.Unlock()
+
+	release := func() { <-slots }
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if p.PendingHeadersTimeout < 0 {
+		return nil, ErrTooManyPendingHeaders
+	}
+
+	var timeout <-chan time.Time
+	if p.PendingHeadersTimeout > 0 {
+		timer := time.NewTimer(p.PendingHeadersTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	case <-timeout:
+		return nil, ErrTooManyPendingHeaders
+	case <-closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// untrack unregisters conn once it's closed.
+func (p *Listener) untrack(conn *Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.conns, conn)
+	if p.idle != nil && len(p.conns) == 0 {
+		select {
+		case <-p.idle:
+		default:
+			close(p.idle)
+		}
+	}
+}
+
+// ConnInfo describes a connection accepted by a Listener once it's closed,
+// see ListenerHooks.ConnectionClosed, e.g. to write access logs.
+type ConnInfo struct {
+	// RemoteAddr and LocalAddr are the addresses claimed by the header, or
+	// those of the underlying connection if there was no usable header.
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	// SocketRemoteAddr and SocketLocalAddr are the addresses of the
+	// underlying connection, i.e. of the proxy for the remote address.
+	SocketRemoteAddr net.Addr
+	SocketLocalAddr  net.Addr
+	// Policy is the policy applied to the connection.
+	Policy Policy
+	// Header is the header read on the connection, nil if there was none,
+	// it wasn't used or it wasn't read before the connection was closed.
+	Header *Header
+	// HeaderErr is the error raised while processing the header, if any.
+	HeaderErr error
+	// HeaderSize and HeaderReadDuration are the size of the header and how
+	// long reading it took, see Conn.HeaderSize and Conn.HeaderReadDuration.
+	HeaderSize         int
+	HeaderReadDuration time.Duration
+	// BytesIn and BytesOut are the numbers of application bytes read from
+	// and written to the connection, excluding the header.
+	BytesIn  uint64
+	BytesOut uint64
+	// Duration is how long the connection was open, from Accept to Close.
+	Duration time.Duration
+}
+
+// info returns the information about the connection for the
+// ConnectionClosed hook. It doesn't read the header if it wasn't read yet.
+func (p *Conn) info() ConnInfo {
+	info := ConnInfo{
+		RemoteAddr:       p.conn.RemoteAddr(),
+		LocalAddr:        p.conn.LocalAddr(),
+		SocketRemoteAddr: p.conn.RemoteAddr(),
+		SocketLocalAddr:  p.conn.LocalAddr(),
+		Policy:           p.ProxyHeaderPolicy,
+		BytesIn:          atomic.LoadUint64(&p.bytesIn),
+		BytesOut:         atomic.LoadUint64(&p.bytesOut),
+		Duration:         time.Since(p.acceptedAt),
+	}
+	if atomic.LoadUint32(&p.headerRead) == 0 {
+		return info
+	}
+	info.Header = p.header
+	info.HeaderErr = p.readErr
+	info.HeaderSize = p.headerSize
+	info.HeaderReadDuration = p.headerDuration
+	if p.readErr == nil && p.header != nil && !p.header.Command.IsLocal() {
+		info.RemoteAddr = p.header.SourceAddr
+		info.LocalAddr = p.header.DestinationAddr
+	}
+	return info
+}
+
+// Stats returns a snapshot of the listener's connection counters.
+func (p *Listener) Stats() ListenerStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.stats
+	stats.Open = len(p.conns)
+	return stats
+}
+
 // Addr returns the underlying listener's network address.
 func (p *Listener) Addr() net.Addr {
 	return p.Listener.Addr()
@@ -151,15 +936,8 @@ func (p *Listener) Addr() net.Addr {
 // NewConn is used to wrap a net.Conn that may be speaking
 // the proxy protocol into a proxyproto.Conn
 func NewConn(conn net.Conn, opts ...func(*Conn)) *Conn {
-	// For v1 the header length is at most 108 bytes.
-	// For v2 the header length is at most 52 bytes plus the length of the TLVs.
-	// We use 256 bytes to be safe.
-	const bufSize = 256
-	br := bufio.NewReaderSize(conn, bufSize)
-
 	pConn := &Conn{
-		bufReader: br,
-		reader:    io.MultiReader(br, conn),
+		rawReader: &countingReader{r: conn},
 		conn:      conn,
 	}
 
@@ -174,33 +952,253 @@ func NewConn(conn net.Conn, opts ...func(*Conn)) *Conn {
 // the initial scan. If there is an error parsing the header,
 // it is returned and the socket is closed.
 func (p *Conn) Read(b []byte) (int, error) {
-	p.once.Do(func() {
-		p.readErr = p.readHeader()
-	})
-	if p.readErr != nil {
-		return 0, p.readErr
+	if err := p.ensureHeader(); err != nil {
+		return 0, err
+	}
+
+	// Once the bytes buffered while reading the header are drained, release
+	// the buffer and read from the underlying connection directly, saving a
+	// copy for the rest of the connection's lifetime.
+	var n int
+	var err error
+	if p.bufReader != nil && p.bufReader.Buffered() > 0 {
+		n, err = p.bufReader.Read(b)
+		p.releaseBufReader()
+	} else {
+		n, err = p.conn.Read(b)
 	}
+	if p.countBytes {
+		atomic.AddUint64(&p.bytesIn, uint64(n))
+	}
+	return n, err
+}
+
+// readBufferSize is the size of the buffer used to read headers. It fits v1
+// headers, which are at most 107 bytes and must be buffered at once, and the
+// fixed-size part of v2 headers, whose rest is read directly into a buffer of
+// the length they advertise.
+const readBufferSize = 256
+
+// bufReaderPool recycles the buffers used to read headers: connections only
+// hold one until the application bytes read along with the header are
+// drained, so that idle connections don't.
+var bufReaderPool sync.Pool
+
+// acquireBufReader returns the buffered reader of the connection, taking one
+// from the pool if it has none.
+func (p *Conn) acquireBufReader() *bufio.Reader {
+	if p.bufReader == nil {
+		br, _ := bufReaderPool.Get().(*bufio.Reader)
+		if br == nil {
+			br = bufio.NewReaderSize(p.rawReader, readBufferSize)
+		} else {
+			br.Reset(p.rawReader)
+		}
+		p.bufReader = br
+	}
+	return p.bufReader
+}
 
-	return p.reader.Read(b)
+// releaseBufReader returns the buffered reader of the connection to the pool
+// if it's drained.
+func (p *Conn) releaseBufReader() {
+	if p.bufReader != nil && p.bufReader.Buffered() == 0 {
+		p.bufReader.Reset(nil)
+		bufReaderPool.Put(p.bufReader)
+		p.bufReader = nil
+	}
 }
 
-// Write wraps original conn.Write
+// Write wraps original conn.Write. If header errors are sticky, see
+// WithStickyHeaderError, and processing the header failed, the error is
+// returned instead.
 func (p *Conn) Write(b []byte) (int, error) {
-	return p.conn.Write(b)
+	if err := p.stickyErr(); err != nil {
+		return 0, err
+	}
+	n, err := p.conn.Write(b)
+	if p.countBytes {
+		atomic.AddUint64(&p.bytesOut, uint64(n))
+	}
+	return n, err
 }
 
 // Close wraps original conn.Close
 func (p *Conn) Close() error {
+	if p.onClose != nil {
+		p.closeOnce.Do(p.onClose)
+	}
 	return p.conn.Close()
 }
 
 // ProxyHeader returns the proxy protocol header, if any. If an error occurs
 // while reading the proxy header, nil is returned.
 func (p *Conn) ProxyHeader() *Header {
-	p.once.Do(func() { p.readErr = p.readHeader() })
+	_ = p.ensureHeader()
 	return p.header
 }
 
+// SetProxyHeader sets the proxy protocol header of the connection, e.g. for
+// sidecars and frameworks which learned the identity of the client out of
+// band and hand the connection over, like WithHeader. It is only valid before
+// the header has been processed, in which case nothing is read from the
+// underlying connection before application data, or if the processed header
+// is a LOCAL one, and returns ErrHeaderAlreadyProcessed otherwise. It must not
+// be called concurrently with other methods of the connection.
+func (p *Conn) SetProxyHeader(header *Header) error {
+	p.headerMu.Lock()
+	defer p.headerMu.Unlock()
+
+	if p.headerRead == 1 && (p.readErr != nil || p.header == nil || !p.header.Command.IsLocal()) {
+		return ErrHeaderAlreadyProcessed
+	}
+	p.header = header
+	p.readErr = nil
+	if p.headerRead == 0 {
+		p.finishHeader()
+	}
+	return nil
+}
+
+// HeaderConn is implemented by connections carrying a proxy protocol header,
+// such as *Conn. It allows retrieving the header, e.g. from http.Server
+// ConnState or ConnContext hooks, without depending on the concrete type.
+type HeaderConn interface {
+	ProxyHeader() *Header
+}
+
+// HeaderFromConn returns the proxy protocol header of conn, if it's a
+// HeaderConn, or wraps one and exposes it with a NetConn() net.Conn method like
+// *tls.Conn does. The returned bool is false if no such connection was found,
+// or if it had no header.
+func HeaderFromConn(conn net.Conn) (*Header, bool) {
+	for conn != nil {
+		switch c := conn.(type) {
+		case HeaderConn:
+			header := c.ProxyHeader()
+			return header, header != nil
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// Buffered returns the number of application bytes, i.e. following the proxy
+// protocol header, that have already been read from the underlying connection
+// and can be read without blocking. The header is read first if needed.
+func (p *Conn) Buffered() int {
+	if err := p.ensureHeader(); err != nil || p.bufReader == nil {
+		return 0
+	}
+	return p.bufReader.Buffered()
+}
+
+// Peek returns the next n application bytes, i.e. following the proxy
+// protocol header, without consuming them, reading the header first if
+// needed. It blocks until n bytes are available, and returns a shorter slice
+// along with an error explaining why if it can't, e.g. bufio.ErrBufferFull if
+// n is larger than the internal buffer. The returned bytes are only valid
+// until the next read.
+func (p *Conn) Peek(n int) ([]byte, error) {
+	if err := p.ensureHeader(); err != nil {
+		return nil, err
+	}
+	return p.acquireBufReader().Peek(n)
+}
+
+// HeaderReadDuration returns how long reading the proxy protocol header took,
+// reading the header first if needed. It is zero if the header was not read,
+// e.g. because of the SKIP policy.
+func (p *Conn) HeaderReadDuration() time.Duration {
+	_ = p.ensureHeader()
+	return p.headerDuration
+}
+
+// HeaderSize returns the size in bytes of the proxy protocol header read from
+// the connection, reading the header first if needed. It is zero if no header
+// was present.
+func (p *Conn) HeaderSize() int {
+	_ = p.ensureHeader()
+	return p.headerSize
+}
+
+// RawHeader returns the exact bytes of the proxy protocol header read from
+// the connection, reading the header first if needed, when WithRecordHeader
+// is used. If processing the header failed, they are the bytes consumed
+// before the error was raised, and they are returned as well for headers
+// which were read but not used, e.g. with the IGNORE policy: they are meant
+// for logging, use WriteRawHeaderTo to relay the header. It is empty if no
+// header was present, and nil if the header wasn't recorded. The returned
+// bytes must not be modified.
+func (p *Conn) RawHeader() []byte {
+	_ = p.ensureHeader()
+	return p.rawHeader
+}
+
+// WriteRawHeaderTo writes the exact bytes of the proxy protocol header read
+// from the connection to w, reading the header first if needed, e.g. to relay
+// it to an upstream verbatim, with its padding, TLV order and unknown TLVs,
+// instead of formatting the parsed header again. It requires WithRecordHeader
+// and fails with ErrHeaderNotRecorded otherwise, or with the error raised
+// while processing the header. Nothing is written if no header was present or
+// if it wasn't used, e.g. with the IGNORE policy, so that a client's claimed
+// identity is never relayed when it shouldn't be trusted. If the header was
+// modified once read, e.g. by CRC32cStrip, it's formatted again instead.
+// Like with Header.WriteTo, a header is written at most once on a ClientConn.
+func (p *Conn) WriteRawHeaderTo(w io.Writer) (int64, error) {
+	if err := p.ensureHeader(); err != nil {
+		return 0, err
+	}
+	if p.tee == nil {
+		return 0, ErrHeaderNotRecorded
+	}
+	if p.header == nil || len(p.rawHeader) == 0 {
+		return 0, nil
+	}
+	if p.headerModified {
+		return p.header.WriteTo(w)
+	}
+
+	if conn, ok := w.(*ClientConn); ok {
+		return conn.writeHeader(p.rawHeader)
+	}
+	n, err := w.Write(p.rawHeader)
+	return int64(n), err
+}
+
+// NoProxyProtocolError describes the first bytes of the connection, reading
+// the header first if needed, if it didn't start with a proxy protocol header,
+// e.g. to log why reading failed with ErrNoProxyProtocol with the REQUIRE
+// policy. It is nil otherwise, including when the header wasn't received in
+// time, see ErrReadHeaderTimeout.
+func (p *Conn) NoProxyProtocolError() *NoProxyProtocolError {
+	_ = p.ensureHeader()
+	return p.noHeaderErr
+}
+
+// HeaderError returns the error raised while processing the proxy protocol
+// header, if any, reading the header first if needed. Together with
+// ProxyHeader, it allows to distinguish a connection without header, for
+// which both are nil, from one with an invalid header or not complying with
+// the policy, for which an error is returned.
+func (p *Conn) HeaderError() error {
+	return p.ensureHeader()
+}
+
+// IsLocal returns true if the proxy protocol header carried the LOCAL command
+// in v2 or the UNKNOWN transport in v1, reading the header first if needed.
+// Proxies typically send such headers on health-check connections, which
+// aren't relaying client traffic. It is false if there was no valid header.
+func (p *Conn) IsLocal() bool {
+	if err := p.ensureHeader(); err != nil || p.header == nil {
+		return false
+	}
+	return p.header.Command.IsLocal()
+}
+
 // LocalAddr returns the address of the server if the proxy
 // protocol is being used, otherwise just returns the address of
 // the socket server. In case an error happens on reading the
@@ -208,11 +1206,20 @@ func (p *Conn) ProxyHeader() *Header {
 // from the proxy header even if the proxy header itself is
 // syntactically correct.
 func (p *Conn) LocalAddr() net.Addr {
-	p.once.Do(func() { p.readErr = p.readHeader() })
-	if p.header == nil || p.header.Command.IsLocal() || p.readErr != nil {
+	if p.socketAddrs {
+		return p.conn.LocalAddr()
+	}
+	if err := p.ensureHeader(); err != nil || p.header == nil || p.header.Command.IsLocal() {
 		return p.conn.LocalAddr()
 	}
 
+	if p.proxiedAddrs {
+		return &ProxiedAddr{
+			Addr:       p.header.DestinationAddr,
+			SocketAddr: p.conn.LocalAddr(),
+			Header:     p.header,
+		}
+	}
 	return p.header.DestinationAddr
 }
 
@@ -223,11 +1230,43 @@ func (p *Conn) LocalAddr() net.Addr {
 // from the proxy header even if the proxy header itself is
 // syntactically correct.
 func (p *Conn) RemoteAddr() net.Addr {
-	p.once.Do(func() { p.readErr = p.readHeader() })
-	if p.header == nil || p.header.Command.IsLocal() || p.readErr != nil {
+	if p.socketAddrs {
 		return p.conn.RemoteAddr()
 	}
+	if err := p.ensureHeader(); err != nil || p.header == nil || p.header.Command.IsLocal() {
+		return p.conn.RemoteAddr()
+	}
+
+	if p.proxiedAddrs {
+		return &ProxiedAddr{
+			Addr:       p.header.SourceAddr,
+			SocketAddr: p.conn.RemoteAddr(),
+			Header:     p.header,
+		}
+	}
+	return p.header.SourceAddr
+}
+
+// ProxyLocalAddr returns the destination address claimed by the proxy
+// protocol header, reading the header first if needed, whatever LocalAddr
+// returns. It is nil if there was no usable header, e.g. because of an error
+// or of the IGNORE policy, or if the header carries no address, e.g. for
+// LOCAL commands.
+func (p *Conn) ProxyLocalAddr() net.Addr {
+	if err := p.ensureHeader(); err != nil || p.header == nil || p.header.Command.IsLocal() {
+		return nil
+	}
+	return p.header.DestinationAddr
+}
 
+// ProxyRemoteAddr returns the source address claimed by the proxy protocol
+// header, i.e. the address of the client, reading the header first if
+// needed, whatever RemoteAddr returns. It is nil if there was no usable
+// header, see ProxyLocalAddr.
+func (p *Conn) ProxyRemoteAddr() net.Addr {
+	if err := p.ensureHeader(); err != nil || p.header == nil || p.header.Command.IsLocal() {
+		return nil
+	}
 	return p.header.SourceAddr
 }
 
@@ -266,8 +1305,55 @@ func (p *Conn) UDPConn() (conn *net.UDPConn, ok bool) {
 	return
 }
 
+// SetKeepAlive sets whether the operating system should send keep-alive
+// messages on the underlying TCP connection, see net.TCPConn.SetKeepAlive.
+// ErrNotTCPConn is returned if it isn't a TCP connection.
+func (p *Conn) SetKeepAlive(keepalive bool) error {
+	conn, ok := p.TCPConn()
+	if !ok {
+		return ErrNotTCPConn
+	}
+	return conn.SetKeepAlive(keepalive)
+}
+
+// SetKeepAlivePeriod sets the period between keep-alives of the underlying TCP
+// connection, see net.TCPConn.SetKeepAlivePeriod. ErrNotTCPConn is returned
+// if it isn't a TCP connection.
+func (p *Conn) SetKeepAlivePeriod(d time.Duration) error {
+	conn, ok := p.TCPConn()
+	if !ok {
+		return ErrNotTCPConn
+	}
+	return conn.SetKeepAlivePeriod(d)
+}
+
+// SetNoDelay controls whether the operating system should delay packet
+// transmission on the underlying TCP connection, see net.TCPConn.SetNoDelay.
+// ErrNotTCPConn is returned if it isn't a TCP connection.
+func (p *Conn) SetNoDelay(noDelay bool) error {
+	conn, ok := p.TCPConn()
+	if !ok {
+		return ErrNotTCPConn
+	}
+	return conn.SetNoDelay(noDelay)
+}
+
+// SetLinger sets the behavior of Close on the underlying TCP connection, see
+// net.TCPConn.SetLinger. ErrNotTCPConn is returned if it isn't a TCP
+// connection.
+func (p *Conn) SetLinger(sec int) error {
+	conn, ok := p.TCPConn()
+	if !ok {
+		return ErrNotTCPConn
+	}
+	return conn.SetLinger(sec)
+}
+
 // SetDeadline wraps original conn.SetDeadline
 func (p *Conn) SetDeadline(t time.Time) error {
+	p.deadlineMu.Lock()
+	defer p.deadlineMu.Unlock()
+
 	p.readDeadline.Store(t)
 	return p.conn.SetDeadline(t)
 }
@@ -277,49 +1363,157 @@ func (p *Conn) SetReadDeadline(t time.Time) error {
 	// Set a local var that tells us the desired deadline. This is
 	// needed in order to reset the read deadline to the one that is
 	// desired by the user, rather than an empty deadline.
+	p.deadlineMu.Lock()
+	defer p.deadlineMu.Unlock()
+
 	p.readDeadline.Store(t)
 	return p.conn.SetReadDeadline(t)
 }
 
+// ReadDeadline returns the read deadline set by the user with SetDeadline,
+// SetReadDeadline or the WithReadDeadline option, or the zero time if none
+// was. The deadline used while reading the header, see SetReadHeaderTimeout,
+// is never reported, and the user's one is restored once the header is read.
+func (p *Conn) ReadDeadline() time.Time {
+	t, _ := p.readDeadline.Load().(time.Time)
+	return t
+}
+
 // SetWriteDeadline wraps original conn.SetWriteDeadline
 func (p *Conn) SetWriteDeadline(t time.Time) error {
 	return p.conn.SetWriteDeadline(t)
 }
 
+// ensureHeader processes the header exactly once, no matter how many
+// goroutines concurrently call it, and returns the result of processing.
+// Callers block until the header has been processed.
+func (p *Conn) ensureHeader() error {
+	if atomic.LoadUint32(&p.headerRead) == 1 {
+		return p.readErr
+	}
+
+	p.headerMu.Lock()
+	defer p.headerMu.Unlock()
+
+	if p.headerRead == 0 {
+		// Even if readHeader panics, e.g. in a user-provided Validator,
+		// the header must be considered read so that the next calls don't
+		// proceed as if it was valid.
+		p.readErr = errHeaderPanic
+		defer p.finishHeader()
+		if p.onHeaderStart != nil {
+			p.onHeaderStart()
+		}
+		p.readErr = p.readHeader()
+		if p.readErr == nil {
+			p.releaseBufReader()
+		}
+	}
+
+	return p.readErr
+}
+
+// finishHeader marks the header as processed and calls onHeaderRead, e.g.
+// to release the listener's header slot and update its counters. Every
+// transition of headerRead goes through it, with headerMu held unless the
+// connection isn't shared yet.
+func (p *Conn) finishHeader() {
+	atomic.StoreUint32(&p.headerRead, 1)
+	if p.onHeaderRead != nil {
+		p.onHeaderRead()
+	}
+}
+
+// stickyErr returns the error raised while processing the header if header
+// errors are sticky and the header has already been processed. It never
+// triggers reading the header, so that servers speaking first don't block.
+func (p *Conn) stickyErr() error {
+	if !p.stickyHeaderError || atomic.LoadUint32(&p.headerRead) == 0 {
+		return nil
+	}
+	return p.readErr
+}
+
 func (p *Conn) readHeader() error {
+	// Connections with the SKIP policy carry no header to process.
+	if p.ProxyHeaderPolicy == SKIP {
+		if p.tee != nil {
+			p.tee.stopped = true
+			p.rawHeader = []byte{}
+		}
+		return nil
+	}
+
 	// If the connection's readHeaderTimeout is more than 0,
 	// push our deadline back to now plus the timeout. This should only
 	// run on the connection, as we don't want to override the previous
 	// read deadline the user may have used.
+	// The user's deadline is kept if it's earlier, so that it's honored no
+	// matter whether the header has been read already.
 	if p.readHeaderTimeout > 0 {
-		if err := p.conn.SetReadDeadline(time.Now().Add(p.readHeaderTimeout)); err != nil {
+		p.deadlineMu.Lock()
+		deadline := time.Now().Add(p.readHeaderTimeout)
+		if t := p.ReadDeadline(); !t.IsZero() && t.Before(deadline) {
+			deadline = t
+		}
+		err := p.conn.SetReadDeadline(deadline)
+		p.deadlineMu.Unlock()
+		if err != nil {
 			return err
 		}
 	}
 
-	header, err := Read(p.bufReader)
+	start := time.Now()
+	p.acquireBufReader()
+	var header *Header
+	skip, err := p.sniffHeader()
+	if err == nil && !skip {
+		err = p.checkHeaderSize()
+		if err == nil {
+			header, err = ReadWith(p.bufReader, p.readOptions...)
+		}
+	}
+	p.headerDuration = time.Since(start)
+	p.headerSize = int(p.rawReader.n) - p.bufReader.Buffered()
+	if p.tee != nil {
+		p.rawHeader = p.tee.Header(p.bufReader)
+	}
+	if err == nil && p.maxHeaderSize > 0 && p.headerSize > p.maxHeaderSize {
+		header, err = nil, ErrHeaderTooLarge
+	}
 
 	// If the connection's readHeaderTimeout is more than 0, undo the change to the
 	// deadline that we made above. Because we retain the readDeadline as part of our
 	// SetReadDeadline override, we know the user's desired deadline so we use that.
 	// Therefore, we check whether the error is a net.Timeout and if it is, we decide
-	// the proxy proto does not exist and set the error accordingly.
+	// the proxy proto was not received in time and set the error accordingly.
+	// Timeouts after part of the header was consumed keep their error, which
+	// reports a timeout as well, since the connection can't proceed as if there
+	// was no header.
 	if p.readHeaderTimeout > 0 {
-		t := p.readDeadline.Load()
-		if t == nil {
-			t = time.Time{}
+		p.deadlineMu.Lock()
+		setErr := p.conn.SetReadDeadline(p.ReadDeadline())
+		p.deadlineMu.Unlock()
+		if setErr != nil {
+			return setErr
 		}
-		if err := p.conn.SetReadDeadline(t.(time.Time)); err != nil {
-			return err
-		}
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			err = ErrNoProxyProtocol
+		if isTimeout(err) && p.headerSize == 0 {
+			err = ErrReadHeaderTimeout
 		}
 	}
 
 	// For the purpose of this wrapper shamefully stolen from armon/go-proxyproto
-	// let's act as if there was no error when PROXY protocol is not present.
-	if err == ErrNoProxyProtocol {
+	// let's act as if there was no error when PROXY protocol is not present,
+	// or not received in time.
+	if err == ErrNoProxyProtocol || err == ErrReadHeaderTimeout {
+		// The bytes read so far are still buffered, describe them. They
+		// aren't described after a timeout, as they may be the beginning
+		// of a header sent by a slow proxy.
+		if err == ErrNoProxyProtocol {
+			peeked, _ := p.bufReader.Peek(p.bufReader.Buffered())
+			p.noHeaderErr = DiagnoseNoProxyProtocol(peeked)
+		}
+
 		// but not if it is required that the connection has one
 		if p.ProxyHeaderPolicy == REQUIRE {
 			return err
@@ -335,12 +1529,24 @@ func (p *Conn) readHeader() error {
 			// this connection is not allowed to send one
 			return ErrSuperfluousProxyHeader
 		case USE, REQUIRE:
+			if p.rejectAddressless && (header.Command.IsLocal() || header.TransportProtocol.IsUnspec()) {
+				return ErrAddresslessHeader
+			}
+			if err := p.checkCRC32c(header); err != nil {
+				return err
+			}
 			if p.Validate != nil {
 				err = p.Validate(header)
 				if err != nil {
 					return err
 				}
 			}
+			if p.onHeaderParsed != nil {
+				err = p.onHeaderParsed(header, p.conn)
+				if err != nil {
+					return err
+				}
+			}
 
 			p.header = header
 		}
@@ -349,27 +1555,93 @@ func (p *Conn) readHeader() error {
 	return err
 }
 
+// checkCRC32c verifies the checksum of the header, if any, and applies the
+// CRC32c action on mismatch, see WithCRC32cCheck.
+func (p *Conn) checkCRC32c(header *Header) error {
+	if p.crc32cAction == CRC32cIgnore {
+		return nil
+	}
+	_, err := header.verifyCRC32c(p.rawHeader)
+	if err == nil {
+		return nil
+	}
+	if p.onCRC32cMismatch != nil {
+		p.onCRC32cMismatch(header, p.conn)
+	}
+	mismatch := err == ErrInvalidCRC32c || err == ErrMalformedTLV
+	switch {
+	case p.crc32cAction == CRC32cLogOnly:
+		return nil
+	case p.crc32cAction == CRC32cStrip && mismatch:
+		p.headerModified = true
+		return header.stripTLVs(PP2_TYPE_CRC32C)
+	default:
+		return err
+	}
+}
+
+// checkHeaderSize rejects a v2 header longer than maxHeaderSize as soon as its
+// length is known, without reading its payload. Errors peeking at the header
+// are left to Read to report, and v1 headers, which are short anyway, are
+// checked once read.
+func (p *Conn) checkHeaderSize() error {
+	if p.maxHeaderSize <= 0 {
+		return nil
+	}
+	// Peek at the signature progressively like Read does, in order not to
+	// block on short non-PROXYed packets.
+	for _, n := range []int{1, 5, len(SIGV2)} {
+		b, err := p.bufReader.Peek(n)
+		if err != nil || !bytes.Equal(b, SIGV2[:n]) {
+			return nil
+		}
+	}
+	b, err := p.bufReader.Peek(core.V2PreambleLen)
+	if err != nil {
+		return nil
+	}
+	if core.V2PreambleLen+int(binary.BigEndian.Uint16(b[core.V2PreambleLen-2:])) > p.maxHeaderSize {
+		return ErrHeaderTooLarge
+	}
+	return nil
+}
+
 // ReadFrom implements the io.ReaderFrom ReadFrom method
 func (p *Conn) ReadFrom(r io.Reader) (int64, error) {
+	if err := p.stickyErr(); err != nil {
+		return 0, err
+	}
+	var n int64
+	var err error
 	if rf, ok := p.conn.(io.ReaderFrom); ok {
-		return rf.ReadFrom(r)
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(p.conn, r)
+	}
+	if p.countBytes {
+		atomic.AddUint64(&p.bytesOut, uint64(n))
 	}
-	return io.Copy(p.conn, r)
+	return n, err
 }
 
 // WriteTo implements io.WriterTo
-func (p *Conn) WriteTo(w io.Writer) (int64, error) {
-	p.once.Do(func() { p.readErr = p.readHeader() })
-	if p.readErr != nil {
-		return 0, p.readErr
+func (p *Conn) WriteTo(w io.Writer) (n int64, err error) {
+	if err := p.ensureHeader(); err != nil {
+		return 0, err
+	}
+	if p.countBytes {
+		defer func() { atomic.AddUint64(&p.bytesIn, uint64(n)) }()
 	}
 
-	b := make([]byte, p.bufReader.Buffered())
-	if _, err := p.bufReader.Read(b); err != nil {
-		return 0, err // this should never as we read buffered data
+	var b []byte
+	if p.bufReader != nil {
+		b = make([]byte, p.bufReader.Buffered())
+		if _, err := p.bufReader.Read(b); err != nil {
+			return 0, err // this should never as we read buffered data
+		}
+		p.releaseBufReader()
 	}
 
-	var n int64
 	{
 		nn, err := w.Write(b)
 		n += int64(nn)
@@ -387,3 +1659,15 @@ func (p *Conn) WriteTo(w io.Writer) (int64, error) {
 
 	return n, nil
 }
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -6,13 +6,17 @@ package proxyproto
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"net"
 	"net/http"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -118,7 +122,7 @@ func TestRequiredWithReadHeaderTimeout(t *testing.T) {
 			recv := make([]byte, 4)
 			_, err = conn.Read(recv)
 
-			if err != nil && !errors.Is(err, ErrNoProxyProtocol) && time.Since(start)-pl.ReadHeaderTimeout > 10*time.Millisecond {
+			if err != nil && !errors.Is(err, ErrReadHeaderTimeout) && time.Since(start)-pl.ReadHeaderTimeout > 10*time.Millisecond {
 				t.Fatal("proxy proto should not be found and time should be close to read timeout")
 			}
 			err = <-cliResult
@@ -129,6 +133,46 @@ func TestRequiredWithReadHeaderTimeout(t *testing.T) {
 	}
 }
 
+func TestReadHeaderTimeoutError(t *testing.T) {
+	var cases = []struct {
+		name        string
+		policy      Policy
+		data        string
+		expectedErr error
+	}{
+		{"required", REQUIRE, "", ErrReadHeaderTimeout},
+		{"used", USE, "", nil},
+		{"partial v2", USE, string(SIGV2) + "\x21\x11\x00\x0c\x7f\x00", ErrInvalidLength},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			go func() {
+				_, _ = client.Write([]byte(tc.data))
+			}()
+
+			conn := NewConn(server, WithPolicy(tc.policy), SetReadHeaderTimeout(50*time.Millisecond))
+			err := conn.HeaderError()
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+			if err == nil {
+				return
+			}
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				t.Fatalf("Expected a timeout net.Error, got %v", err)
+			}
+			if errors.Is(err, ErrNoProxyProtocol) {
+				t.Fatalf("Expected error %v to be told apart from %v", err, ErrNoProxyProtocol)
+			}
+		})
+	}
+}
+
 // TestUseWithReadHeaderTimeout will iterate through 3 different timeouts to see
 // whether using a USE policy for a listener would not cause an error if the timeout
 // is triggerred without a proxy protocol header being defined.
@@ -661,9 +705,12 @@ func TestAcceptReturnsErrorWhenPolicyFuncErrors(t *testing.T) {
 	}()
 
 	conn, err := pl.Accept()
-	if err != expectedErr {
+	if !errors.Is(err, expectedErr) {
 		t.Fatalf("Expected error %v, got %v", expectedErr, err)
 	}
+	if netErr, ok := err.(net.Error); !ok || !netErr.Temporary() {
+		t.Fatalf("Expected a temporary error, got %v", err)
+	}
 
 	if conn != nil {
 		t.Fatalf("Expected no connection, got %v", conn)
@@ -737,9 +784,12 @@ func TestAcceptReturnsErrorWhenConnPolicyFuncErrors(t *testing.T) {
 	}()
 
 	conn, err := pl.Accept()
-	if err != expectedErr {
+	if !errors.Is(err, expectedErr) {
 		t.Fatalf("Expected error %v, got %v", expectedErr, err)
 	}
+	if netErr, ok := err.(net.Error); !ok || !netErr.Temporary() {
+		t.Fatalf("Expected a temporary error, got %v", err)
+	}
 
 	if conn != nil {
 		t.Fatalf("Expected no connection, got %v", conn)
@@ -750,6 +800,50 @@ func TestAcceptReturnsErrorWhenConnPolicyFuncErrors(t *testing.T) {
 	}
 }
 
+func TestConnPolicyReceivesListenerAddr(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var connOpts ConnPolicyOptions
+	connPolicyFunc := func(opts ConnPolicyOptions) (Policy, error) {
+		connOpts = opts
+		return SKIP, nil
+	}
+
+	pl := &Listener{Listener: l, ConnPolicy: connPolicyFunc}
+
+	cliResult := make(chan error)
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			cliResult <- err
+			return
+		}
+		defer conn.Close()
+
+		close(cliResult)
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	if connOpts.ListenerAddr == nil || connOpts.ListenerAddr.String() != l.Addr().String() {
+		t.Fatalf("Expected listener address %v, got %v", l.Addr(), connOpts.ListenerAddr)
+	}
+	if connOpts.Downstream == nil || connOpts.Downstream.String() != conn.LocalAddr().String() {
+		t.Fatalf("Expected downstream address %v, got %v", conn.LocalAddr(), connOpts.Downstream)
+	}
+	err = <-cliResult
+	if err != nil {
+		t.Fatalf("client error: %v", err)
+	}
+}
+
 func TestReadingIsRefusedWhenProxyHeaderRequiredButMissing(t *testing.T) {
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -1219,6 +1313,56 @@ func Test_ConnectionCasts(t *testing.T) {
 	}
 }
 
+func Test_ConnectionSocketOptions(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	cliConn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer cliConn.Close()
+
+	rawConn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn := NewConn(rawConn)
+	defer conn.Close()
+
+	if err := conn.SetKeepAlive(true); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := conn.SetKeepAlivePeriod(time.Minute); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := conn.SetNoDelay(false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := conn.SetLinger(0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pipeConn, _ := net.Pipe()
+	notTCP := NewConn(pipeConn)
+	defer notTCP.Close()
+	if err := notTCP.SetKeepAlive(true); err != ErrNotTCPConn {
+		t.Fatalf("expected %v, got %v", ErrNotTCPConn, err)
+	}
+	if err := notTCP.SetKeepAlivePeriod(time.Minute); err != ErrNotTCPConn {
+		t.Fatalf("expected %v, got %v", ErrNotTCPConn, err)
+	}
+	if err := notTCP.SetNoDelay(true); err != ErrNotTCPConn {
+		t.Fatalf("expected %v, got %v", ErrNotTCPConn, err)
+	}
+	if err := notTCP.SetLinger(0); err != ErrNotTCPConn {
+		t.Fatalf("expected %v, got %v", ErrNotTCPConn, err)
+	}
+}
+
 func Test_ConnectionErrorsWhenHeaderValidationFails(t *testing.T) {
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -1328,7 +1472,7 @@ func Test_ConnectionHandlesInvalidUpstreamError(t *testing.T) {
 		if err == nil {
 			t.Fatalf("errors other than invalid upstream should error")
 		}
-		if !errors.Is(ErrNoProxyProtocol, err) {
+		if !errors.Is(err, ErrNoProxyProtocol) {
 			t.Fatalf("unexpected error type: %v", err)
 		}
 	case <-time.After(2 * time.Second):
@@ -1771,3 +1915,1583 @@ y2ptGsuSmgUtWj3NM9xuwYPm+Z/F84K6+ARYiZ6PYj013sovGKUFfYAqVXVlxtIX
 qyUBnu3X9ps8ZfjLZO7BAkEAlT4R5Yl6cGhaJQYZHOde3JEMhNRcVFMO8dJDaFeo
 f9Oeos0UUothgiDktdQHxdNEwLjQf7lJJBzV+5OtwswCWA==
 -----END RSA PRIVATE KEY-----`)
+
+func TestConcurrentHeaderAccess(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l}
+
+	header := &Header{
+		Version:           2,
+		Command:           PROXY,
+		TransportProtocol: TCPv4,
+		SourceAddr: &net.TCPAddr{
+			IP:   net.ParseIP("10.1.1.1"),
+			Port: 1000,
+		},
+		DestinationAddr: &net.TCPAddr{
+			IP:   net.ParseIP("20.2.2.2"),
+			Port: 2000,
+		},
+	}
+
+	const conns = 10
+	cliResult := make(chan error, conns)
+	for i := 0; i < conns; i++ {
+		go func() {
+			conn, err := net.Dial("tcp", pl.Addr().String())
+			if err != nil {
+				cliResult <- err
+				return
+			}
+			defer conn.Close()
+
+			if _, err := header.WriteTo(conn); err != nil {
+				cliResult <- err
+				return
+			}
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				cliResult <- err
+				return
+			}
+			cliResult <- nil
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, err := pl.Accept()
+			if err != nil {
+				t.Errorf("err: %v", err)
+				return
+			}
+			defer conn.Close()
+
+			var connWg sync.WaitGroup
+			for j := 0; j < 4; j++ {
+				connWg.Add(1)
+				go func(j int) {
+					defer connWg.Done()
+					switch j {
+					case 0:
+						recv := make([]byte, 4)
+						if _, err := io.ReadFull(conn, recv); err != nil {
+							t.Errorf("err: %v", err)
+						}
+					case 1:
+						if addr := conn.RemoteAddr().String(); addr != "10.1.1.1:1000" {
+							t.Errorf("bad remote address: %v", addr)
+						}
+					case 2:
+						if addr := conn.LocalAddr().String(); addr != "20.2.2.2:2000" {
+							t.Errorf("bad local address: %v", addr)
+						}
+					case 3:
+						_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+					}
+				}(j)
+			}
+			connWg.Wait()
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < conns; i++ {
+		if err := <-cliResult; err != nil {
+			t.Fatalf("client error: %v", err)
+		}
+	}
+}
+
+func TestHeaderIsConsideredReadAfterValidatorPanics(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	conn := NewConn(server, ValidateHeader(func(*Header) error { panic("boom") }))
+
+	go func() {
+		_, _ = client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"))
+	}()
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("Expected a panic, but got none")
+			}
+		}()
+		_ = conn.RemoteAddr()
+	}()
+
+	recv := make([]byte, 4)
+	if _, err := conn.Read(recv); err != errHeaderPanic {
+		t.Fatalf("Expected error %v, got %v", errHeaderPanic, err)
+	}
+}
+
+func TestStickyHeaderError(t *testing.T) {
+	for _, sticky := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sticky=%t", sticky), func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			go func() {
+				_, _ = client.Write([]byte("ping"))
+				_, _ = io.Copy(io.Discard, client)
+			}()
+
+			conn := NewConn(server, WithPolicy(REQUIRE), WithStickyHeaderError(sticky))
+
+			recv := make([]byte, 4)
+			for i := 0; i < 2; i++ {
+				if _, err := conn.Read(recv); err != ErrNoProxyProtocol {
+					t.Fatalf("Read %d: expected error %v, got %v", i, ErrNoProxyProtocol, err)
+				}
+			}
+
+			_, err := conn.Write([]byte("pong"))
+			if sticky && err != ErrNoProxyProtocol {
+				t.Fatalf("Expected error %v, got %v", ErrNoProxyProtocol, err)
+			}
+			if !sticky && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			_, err = conn.ReadFrom(bytes.NewReader([]byte("pong")))
+			if sticky && err != ErrNoProxyProtocol {
+				t.Fatalf("Expected error %v, got %v", ErrNoProxyProtocol, err)
+			}
+			if !sticky && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestHeaderError(t *testing.T) {
+	var cases = []struct {
+		name        string
+		policy      Policy
+		data        string
+		expectedErr error
+		expectProxy bool
+	}{
+		{"no header", USE, "ping", nil, false},
+		{"valid header", USE, "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping", nil, true},
+		{"invalid header", USE, "PROXY TCP4 10.1.1.1 20.2.2.2 1000 99999\r\nping", ErrInvalidPortNumber, false},
+		{"missing required header", REQUIRE, "ping", ErrNoProxyProtocol, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			go func() {
+				_, _ = client.Write([]byte(tc.data))
+			}()
+
+			conn := NewConn(server, WithPolicy(tc.policy))
+			if err := conn.HeaderError(); err != tc.expectedErr {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+			// The result is sticky.
+			if err := conn.HeaderError(); err != tc.expectedErr {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+			if (conn.ProxyHeader() != nil) != tc.expectProxy {
+				t.Fatalf("Unexpected header %v", conn.ProxyHeader())
+			}
+		})
+	}
+}
+
+func TestBufferedAndPeek(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		_, _ = client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nGET / HTTP/1.1\r\n"))
+	}()
+
+	conn := NewConn(server)
+	peek, err := conn.Peek(3)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(peek) != "GET" {
+		t.Fatalf("Unexpected peeked data %q", peek)
+	}
+	if n := conn.Buffered(); n != len("GET / HTTP/1.1\r\n") {
+		t.Fatalf("Unexpected number of buffered bytes %d", n)
+	}
+
+	recv := make([]byte, 3)
+	if _, err := io.ReadFull(conn, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != "GET" {
+		t.Fatalf("Unexpected data %q", recv)
+	}
+	if n := conn.Buffered(); n != len(" / HTTP/1.1\r\n") {
+		t.Fatalf("Unexpected number of buffered bytes %d", n)
+	}
+}
+
+func TestPeekReturnsHeaderError(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		_, _ = client.Write([]byte("ping"))
+	}()
+
+	conn := NewConn(server, WithPolicy(REQUIRE))
+	if _, err := conn.Peek(1); err != ErrNoProxyProtocol {
+		t.Fatalf("Expected error %v, got %v", ErrNoProxyProtocol, err)
+	}
+	if n := conn.Buffered(); n != 0 {
+		t.Fatalf("Unexpected number of buffered bytes %d", n)
+	}
+}
+
+func TestReadBypassesBufferOnceDrained(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		_, _ = client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"))
+		_, _ = client.Write([]byte("pong, and some more data"))
+	}()
+
+	conn := NewConn(server)
+	recv := make([]byte, 4)
+	if _, err := io.ReadFull(conn, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != "ping" {
+		t.Fatalf("Unexpected data %q", recv)
+	}
+
+	// The internal buffer is drained, the next read must not fill it again.
+	if _, err := io.ReadFull(conn, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != "pong" {
+		t.Fatalf("Unexpected data %q", recv)
+	}
+	if conn.bufReader != nil {
+		t.Fatalf("Expected internal buffer to be released, got %d bytes", conn.bufReader.Buffered())
+	}
+}
+
+func TestHeaderSizeAndReadDuration(t *testing.T) {
+	v2Header := &Header{
+		Version:           2,
+		Command:           PROXY,
+		TransportProtocol: TCPv4,
+		SourceAddr: &net.TCPAddr{
+			IP:   net.ParseIP("10.1.1.1"),
+			Port: 1000,
+		},
+		DestinationAddr: &net.TCPAddr{
+			IP:   net.ParseIP("20.2.2.2"),
+			Port: 2000,
+		},
+	}
+	if err := v2Header.SetTLVs([]TLV{{Type: PP2_TYPE_AUTHORITY, Value: []byte("example.org")}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	v2Bytes, err := v2Header.Format()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	v1Bytes := []byte("PROXY TCP6 0:0::1 ::1 1000 2000\r\n")
+
+	var cases = []struct {
+		name         string
+		data         []byte
+		expectedSize int
+	}{
+		{"v1", v1Bytes, len(v1Bytes)},
+		{"v2", v2Bytes, len(v2Bytes)},
+		{"no header", nil, 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			go func() {
+				_, _ = client.Write(append(append([]byte(nil), tc.data...), "ping"...))
+			}()
+
+			conn := NewConn(server)
+			recv := make([]byte, 4)
+			if _, err := io.ReadFull(conn, recv); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if string(recv) != "ping" {
+				t.Fatalf("Unexpected data %q", recv)
+			}
+			if size := conn.HeaderSize(); size != tc.expectedSize {
+				t.Fatalf("Expected header size %d, got %d", tc.expectedSize, size)
+			}
+			if conn.HeaderReadDuration() <= 0 {
+				t.Fatalf("Expected a positive header read duration, got %v", conn.HeaderReadDuration())
+			}
+		})
+	}
+}
+
+func TestProxiedAddrs(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		_, _ = client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+	}()
+
+	conn := NewConn(server, WithProxiedAddrs(true))
+
+	remote, ok := conn.RemoteAddr().(*ProxiedAddr)
+	if !ok {
+		t.Fatalf("Expected a *ProxiedAddr, got %T", conn.RemoteAddr())
+	}
+	if remote.String() != "10.1.1.1:1000" || remote.Network() != "tcp" {
+		t.Fatalf("Unexpected remote address %v", remote)
+	}
+	if remote.SocketAddr != server.RemoteAddr() {
+		t.Fatalf("Unexpected remote socket address %v", remote.SocketAddr)
+	}
+	if remote.Header != conn.ProxyHeader() {
+		t.Fatalf("Unexpected header %v", remote.Header)
+	}
+
+	local, ok := conn.LocalAddr().(*ProxiedAddr)
+	if !ok {
+		t.Fatalf("Expected a *ProxiedAddr, got %T", conn.LocalAddr())
+	}
+	if local.String() != "20.2.2.2:2000" {
+		t.Fatalf("Unexpected local address %v", local)
+	}
+	if local.SocketAddr != server.LocalAddr() {
+		t.Fatalf("Unexpected local socket address %v", local.SocketAddr)
+	}
+}
+
+func TestSocketAddrs(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		_, _ = client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+	}()
+
+	conn := NewConn(server, WithSocketAddrs(true), WithProxiedAddrs(true))
+
+	// The socket addresses are returned without reading the header.
+	if conn.RemoteAddr() != server.RemoteAddr() || conn.LocalAddr() != server.LocalAddr() {
+		t.Fatalf("Expected the socket addresses, got %v and %v", conn.RemoteAddr(), conn.LocalAddr())
+	}
+	if conn.header != nil {
+		t.Fatalf("Expected the header not to be read yet")
+	}
+
+	if remote := conn.ProxyRemoteAddr(); remote == nil || remote.String() != "10.1.1.1:1000" {
+		t.Fatalf("Unexpected proxy remote address %v", remote)
+	}
+	if local := conn.ProxyLocalAddr(); local == nil || local.String() != "20.2.2.2:2000" {
+		t.Fatalf("Unexpected proxy local address %v", local)
+	}
+	if conn.RemoteAddr() != server.RemoteAddr() || conn.LocalAddr() != server.LocalAddr() {
+		t.Fatalf("Expected the socket addresses, got %v and %v", conn.RemoteAddr(), conn.LocalAddr())
+	}
+}
+
+func TestProxyAddrsWithoutHeader(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		_, _ = client.Write([]byte("PROXY UNKNOWN\r\n"))
+	}()
+
+	conn := NewConn(server)
+	if remote := conn.ProxyRemoteAddr(); remote != nil {
+		t.Fatalf("Expected no proxy remote address, got %v", remote)
+	}
+	if local := conn.ProxyLocalAddr(); local != nil {
+		t.Fatalf("Expected no proxy local address, got %v", local)
+	}
+	if conn.RemoteAddr() != server.RemoteAddr() {
+		t.Fatalf("Expected the socket remote address, got %v", conn.RemoteAddr())
+	}
+}
+
+func TestWithHeader(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// The bytes of a header are application data once the header is known.
+	data := "PROXY TCP4 30.3.3.3 40.4.4.4 3000 4000\r\n"
+	go func() {
+		_, _ = client.Write([]byte(data))
+	}()
+
+	header := HeaderProxyFromAddrs(2,
+		&net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000},
+		&net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000})
+	conn := NewConn(server, WithPolicy(REQUIRE), WithHeader(header))
+
+	if conn.ProxyHeader() != header || conn.HeaderError() != nil {
+		t.Fatalf("Unexpected header %v with error %v", conn.ProxyHeader(), conn.HeaderError())
+	}
+	if conn.RemoteAddr().String() != "10.1.1.1:1000" || conn.LocalAddr().String() != "20.2.2.2:2000" {
+		t.Fatalf("Unexpected addresses %v and %v", conn.RemoteAddr(), conn.LocalAddr())
+	}
+	recv := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != data {
+		t.Fatalf("Expected %q, got %q", data, recv)
+	}
+
+	conn = NewConn(server, WithPolicy(REQUIRE), WithHeader(nil))
+	if conn.ProxyHeader() != nil || conn.HeaderError() != nil {
+		t.Fatalf("Unexpected header %v with error %v", conn.ProxyHeader(), conn.HeaderError())
+	}
+	if conn.RemoteAddr() != server.RemoteAddr() {
+		t.Fatalf("Expected the socket remote address, got %v", conn.RemoteAddr())
+	}
+}
+
+func TestSetProxyHeader(t *testing.T) {
+	header := HeaderProxyFromAddrs(2,
+		&net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000},
+		&net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000})
+
+	var cases = []struct {
+		name        string
+		data        string
+		read        bool
+		expectedErr error
+	}{
+		{"before reading", "PROXY TCP4 30.3.3.3 40.4.4.4 3000 4000\r\n", false, nil},
+		{"after LOCAL", "PROXY UNKNOWN\r\n", true, nil},
+		{"after PROXY", "PROXY TCP4 30.3.3.3 40.4.4.4 3000 4000\r\n", true, ErrHeaderAlreadyProcessed},
+		{"after no header", "ping", true, ErrHeaderAlreadyProcessed},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			go func() {
+				_, _ = client.Write([]byte(tc.data))
+			}()
+
+			conn := NewConn(server)
+			var before *Header
+			if tc.read {
+				before = conn.ProxyHeader()
+			}
+
+			err := conn.SetProxyHeader(header)
+			if err != tc.expectedErr {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+			if err != nil {
+				if conn.ProxyHeader() != before {
+					t.Fatalf("Expected header %v to be kept, got %v", before, conn.ProxyHeader())
+				}
+				return
+			}
+			if conn.ProxyHeader() != header || conn.RemoteAddr().String() != "10.1.1.1:1000" {
+				t.Fatalf("Unexpected header %v and remote address %v", conn.ProxyHeader(), conn.RemoteAddr())
+			}
+			if !tc.read {
+				// The header bytes are application data.
+				recv := make([]byte, len(tc.data))
+				if _, err := io.ReadFull(conn, recv); err != nil {
+					t.Fatalf("err: %v", err)
+				}
+				if string(recv) != tc.data {
+					t.Fatalf("Expected %q, got %q", tc.data, recv)
+				}
+			}
+		})
+	}
+}
+
+func TestAcceptProxy(t *testing.T) {
+	for _, policy := range []Policy{USE, SKIP} {
+		t.Run(policy.String(), func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			pl := &Listener{
+				Listener: l,
+				ConnPolicy: func(ConnPolicyOptions) (Policy, error) {
+					return policy, nil
+				},
+				ConnWrappers: []func(net.Conn) net.Conn{
+					func(c net.Conn) net.Conn {
+						t.Errorf("Unexpected wrapper call")
+						return c
+					},
+				},
+			}
+			defer pl.Close()
+
+			data := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"
+			cliResult := make(chan error)
+			go func() {
+				conn, err := net.Dial("tcp", pl.Addr().String())
+				if err != nil {
+					cliResult <- err
+					return
+				}
+				defer conn.Close()
+
+				if _, err := conn.Write([]byte(data)); err != nil {
+					cliResult <- err
+					return
+				}
+
+				close(cliResult)
+			}()
+
+			conn, err := pl.AcceptProxy()
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			defer conn.Close()
+
+			expected := "ping"
+			if policy == SKIP {
+				expected = data
+			}
+			recv := make([]byte, len(expected))
+			if _, err := io.ReadFull(conn, recv); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if string(recv) != expected {
+				t.Fatalf("Expected %q, got %q", expected, recv)
+			}
+			if (conn.ProxyHeader() != nil) != (policy == USE) {
+				t.Fatalf("Unexpected header %v", conn.ProxyHeader())
+			}
+			if conn.ProxyHeaderPolicy != policy {
+				t.Fatalf("Expected policy %v, got %v", policy, conn.ProxyHeaderPolicy)
+			}
+
+			err = <-cliResult
+			if err != nil {
+				t.Fatalf("client error: %v", err)
+			}
+		})
+	}
+}
+
+type wrappedConn struct {
+	net.Conn
+	name string
+}
+
+func TestConnWrappers(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var accepted int
+	pl := &Listener{
+		Listener: l,
+		ConnWrappers: []func(net.Conn) net.Conn{
+			func(c net.Conn) net.Conn {
+				if _, ok := c.(*Conn); !ok {
+					t.Errorf("Expected first wrapper to receive a *Conn, got %T", c)
+				}
+				return &wrappedConn{Conn: c, name: "inner"}
+			},
+			func(c net.Conn) net.Conn {
+				accepted++
+				if accepted == 1 {
+					// Drop the first connection.
+					c.Close()
+					return nil
+				}
+				return &wrappedConn{Conn: c, name: "outer"}
+			},
+		},
+	}
+
+	cliResult := make(chan error)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := net.Dial("tcp", pl.Addr().String())
+			if err != nil {
+				cliResult <- err
+				return
+			}
+			defer conn.Close()
+		}
+
+		close(cliResult)
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	outer, ok := conn.(*wrappedConn)
+	if !ok || outer.name != "outer" {
+		t.Fatalf("Expected the outer wrapper, got %#v", conn)
+	}
+	inner, ok := outer.Conn.(*wrappedConn)
+	if !ok || inner.name != "inner" {
+		t.Fatalf("Expected the inner wrapper, got %#v", outer.Conn)
+	}
+	if accepted != 2 {
+		t.Fatalf("Expected 2 accepted connections, got %d", accepted)
+	}
+
+	err = <-cliResult
+	if err != nil {
+		t.Fatalf("client error: %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l}
+
+	cliConn, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer cliConn.Close()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	shutdownResult := make(chan error)
+	go func() {
+		shutdownResult <- pl.Shutdown(context.Background())
+	}()
+
+	select {
+	case err := <-shutdownResult:
+		t.Fatalf("Expected Shutdown to wait for the connection, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err := pl.Accept(); err == nil {
+		t.Fatalf("Expected Accept to fail after Shutdown")
+	}
+
+	conn.Close()
+	if err := <-shutdownResult; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestShutdownForceClosesOnContextExpiry(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l}
+
+	cliConn, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer cliConn.Close()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := pl.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected error %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err == nil {
+		t.Fatalf("Expected the connection to be closed")
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l}
+	pl.Pause()
+	if !pl.Paused() {
+		t.Fatalf("Expected listener to be paused")
+	}
+
+	cliConn, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer cliConn.Close()
+
+	acceptResult := make(chan error)
+	go func() {
+		conn, err := pl.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		acceptResult <- err
+	}()
+
+	select {
+	case err := <-acceptResult:
+		t.Fatalf("Expected Accept to block while paused, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	pl.Resume()
+	if pl.Paused() {
+		t.Fatalf("Expected listener to be resumed")
+	}
+	if err := <-acceptResult; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestCloseUnblocksPausedAccept(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l}
+	pl.Pause()
+
+	acceptResult := make(chan error)
+	go func() {
+		_, err := pl.Accept()
+		acceptResult <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	pl.Close()
+
+	if err := <-acceptResult; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Expected error %v, got %v", net.ErrClosed, err)
+	}
+}
+
+func TestListenerStats(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var calls int32
+	pl := &Listener{
+		Listener: l,
+		Policy: func(upstream net.Addr) (Policy, error) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				return REJECT, ErrInvalidUpstream
+			}
+			return USE, nil
+		},
+	}
+
+	header := &Header{
+		Version:           2,
+		Command:           PROXY,
+		TransportProtocol: TCPv4,
+		SourceAddr: &net.TCPAddr{
+			IP:   net.ParseIP("10.1.1.1"),
+			Port: 1000,
+		},
+		DestinationAddr: &net.TCPAddr{
+			IP:   net.ParseIP("20.2.2.2"),
+			Port: 2000,
+		},
+	}
+
+	cliResult := make(chan error)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := net.Dial("tcp", pl.Addr().String())
+			if err != nil {
+				cliResult <- err
+				return
+			}
+			defer conn.Close()
+
+			if _, err := header.WriteTo(conn); err != nil {
+				cliResult <- err
+				return
+			}
+		}
+
+		close(cliResult)
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.RemoteAddr()
+
+	expected := ListenerStats{Open: 1, Accepted: 1, Rejected: 1, HeadersV2: 1}
+	if stats := pl.Stats(); stats != expected {
+		t.Fatalf("Expected stats %+v, got %+v", expected, stats)
+	}
+
+	conn.Close()
+	expected.Open = 0
+	if stats := pl.Stats(); stats != expected {
+		t.Fatalf("Expected stats %+v, got %+v", expected, stats)
+	}
+
+	err = <-cliResult
+	if err != nil {
+		t.Fatalf("client error: %v", err)
+	}
+}
+
+func TestHeaderFromConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	header := HeaderProxyFromAddrs(2, v4addr, v4addr)
+	cliResult := make(chan error)
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			cliResult <- err
+			return
+		}
+		defer conn.Close()
+
+		if _, err := header.WriteTo(conn); err != nil {
+			cliResult <- err
+			return
+		}
+
+		close(cliResult)
+	}()
+
+	rawConn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn := NewConn(rawConn)
+	defer conn.Close()
+
+	var _ HeaderConn = conn
+	for _, c := range []net.Conn{conn, tls.Server(conn, &tls.Config{})} {
+		got, ok := HeaderFromConn(c)
+		if !ok || !got.EqualsTo(header) {
+			t.Fatalf("%T: expected header %#v, got %#v", c, header, got)
+		}
+	}
+	if _, ok := HeaderFromConn(rawConn); ok {
+		t.Fatal("expected no header for a raw connection")
+	}
+
+	err = <-cliResult
+	if err != nil {
+		t.Fatalf("client error: %v", err)
+	}
+}
+
+func TestConnIsLocal(t *testing.T) {
+	var cases = []struct {
+		name     string
+		data     string
+		expected bool
+	}{
+		{"no header", "ping", false},
+		{"v1 PROXY", "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping", false},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\nping", true},
+		{"v2 LOCAL", string(append(append([]byte{}, SIGV2...), byte(LOCAL), byte(UNSPEC), 0, 0)) + "ping", true},
+		{"invalid header", "PROXY TCP4 10.1.1.1 20.2.2.2 1000 99999\r\nping", false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			go func() {
+				_, _ = client.Write([]byte(tc.data))
+			}()
+
+			conn := NewConn(server)
+			if isLocal := conn.IsLocal(); isLocal != tc.expected {
+				t.Fatalf("expected IsLocal %v, got %v", tc.expected, isLocal)
+			}
+		})
+	}
+}
+
+func TestReadDeadlineRestoredAfterHeader(t *testing.T) {
+	for _, withOption := range []bool{true, false} {
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+
+		deadline := time.Now().Add(50 * time.Millisecond)
+		opts := []func(*Conn){SetReadHeaderTimeout(time.Minute)}
+		if withOption {
+			opts = append(opts, WithReadDeadline(deadline))
+		}
+		conn := NewConn(server, opts...)
+		if !withOption {
+			if err := conn.SetReadDeadline(deadline); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		if !conn.ReadDeadline().Equal(deadline) {
+			t.Fatalf("expected read deadline %v, got %v", deadline, conn.ReadDeadline())
+		}
+
+		// The user's deadline is earlier than the header timeout, so it bounds
+		// the header read, and is restored afterwards.
+		start := time.Now()
+		_, err := conn.Read(make([]byte, 1))
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Fatalf("header read wasn't bounded by the read deadline, took %v", elapsed)
+		}
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Fatalf("expected a timeout error, got %v", err)
+		}
+		if !conn.ReadDeadline().Equal(deadline) {
+			t.Fatalf("expected read deadline %v, got %v", deadline, conn.ReadDeadline())
+		}
+	}
+}
+
+func TestMaxHeaderSize(t *testing.T) {
+	v2Header := &Header{
+		Version:           2,
+		Command:           PROXY,
+		TransportProtocol: TCPv4,
+		SourceAddr:        v4addr,
+		DestinationAddr:   v4addr,
+	}
+	if err := v2Header.SetTLVs([]TLV{{Type: PP2_TYPE_NOOP, Value: make([]byte, 100)}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	v2Bytes, err := v2Header.Format()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	v1Bytes := []byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n")
+
+	var cases = []struct {
+		name          string
+		data          []byte
+		maxHeaderSize int
+		expectedErr   error
+	}{
+		{"v2 within limit", v2Bytes, len(v2Bytes), nil},
+		{"v2 too large", v2Bytes, len(v2Bytes) - 1, ErrHeaderTooLarge},
+		{"v1 within limit", v1Bytes, len(v1Bytes), nil},
+		{"v1 too large", v1Bytes, len(v1Bytes) - 1, ErrHeaderTooLarge},
+		{"no limit", v2Bytes, 0, nil},
+		{"no header", []byte("ping"), 1, nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			go func() {
+				_, _ = client.Write(append(append([]byte{}, tc.data...), "ping"...))
+			}()
+
+			conn := NewConn(server, WithMaxHeaderSize(tc.maxHeaderSize))
+			if err := conn.HeaderError(); err != tc.expectedErr {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestConnPolicyOverrides(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	connPolicyFunc := func(connOpts ConnPolicyOptions) (Policy, ConnOverrides, error) {
+		return REQUIRE, ConnOverrides{ReadHeaderTimeout: time.Minute, MaxHeaderSize: 1}, nil
+	}
+	pl := &Listener{Listener: l, ConnPolicyOverrides: connPolicyFunc, MaxHeaderSize: 1000}
+
+	cliResult := make(chan error)
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			cliResult <- err
+			return
+		}
+		defer conn.Close()
+
+		if _, err := conn.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping")); err != nil {
+			cliResult <- err
+			return
+		}
+
+		close(cliResult)
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	pConn := conn.(*Conn)
+	if pConn.ProxyHeaderPolicy != REQUIRE {
+		t.Fatalf("Expected policy %v, got %v", REQUIRE, pConn.ProxyHeaderPolicy)
+	}
+	if pConn.readHeaderTimeout != time.Minute {
+		t.Fatalf("Expected read header timeout %v, got %v", time.Minute, pConn.readHeaderTimeout)
+	}
+	if err := pConn.HeaderError(); err != ErrHeaderTooLarge {
+		t.Fatalf("Expected error %v, got %v", ErrHeaderTooLarge, err)
+	}
+
+	err = <-cliResult
+	if err != nil {
+		t.Fatalf("client error: %v", err)
+	}
+}
+
+func TestConnPolicyOverridesValidateHeader(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	overrideErr := fmt.Errorf("rejected by the override")
+	connPolicyFunc := func(connOpts ConnPolicyOptions) (Policy, ConnOverrides, error) {
+		return USE, ConnOverrides{ValidateHeader: func(*Header) error { return overrideErr }}, nil
+	}
+	pl := &Listener{
+		Listener:            l,
+		ConnPolicyOverrides: connPolicyFunc,
+		ValidateHeader:      func(*Header) error { return nil },
+	}
+
+	cliResult := make(chan error)
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			cliResult <- err
+			return
+		}
+		defer conn.Close()
+
+		if _, err := conn.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping")); err != nil {
+			cliResult <- err
+			return
+		}
+
+		close(cliResult)
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.(*Conn).HeaderError(); err != overrideErr {
+		t.Fatalf("Expected error %v, got %v", overrideErr, err)
+	}
+
+	err = <-cliResult
+	if err != nil {
+		t.Fatalf("client error: %v", err)
+	}
+}
+
+func TestMaxPendingHeaders(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &Listener{Listener: l, MaxPendingHeaders: 1, PendingHeadersTimeout: 50 * time.Millisecond}
+	defer pl.Close()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return conn
+	}
+
+	// The first connection stalls before sending its header.
+	stalled := dial()
+	defer stalled.Close()
+	first, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer first.Close()
+
+	rejected := dial()
+	defer rejected.Close()
+	_, err = pl.Accept()
+	var acceptErr *AcceptError
+	if !errors.As(err, &acceptErr) || !acceptErr.Temporary() || !errors.Is(err, ErrTooManyPendingHeaders) {
+		t.Fatalf("Expected a temporary error %v, got %v", ErrTooManyPendingHeaders, err)
+	}
+	if stats := pl.Stats(); stats.Rejected != 1 {
+		t.Fatalf("Expected 1 rejected connection, got %d", stats.Rejected)
+	}
+
+	// Processing the header of the first connection releases its slot.
+	if _, err := stalled.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := first.(*Conn).HeaderError(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	next := dial()
+	defer next.Close()
+	second, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// So does closing a connection before its header is processed.
+	second.Close()
+	last := dial()
+	defer last.Close()
+	third, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer third.Close()
+
+	// So does setting the header out of band, which is counted as well.
+	header := HeaderProxyFromAddrs(1,
+		&net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000},
+		&net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000})
+	if err := third.(*Conn).SetProxyHeader(header); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats := pl.Stats(); stats.HeadersV1 != 2 {
+		t.Fatalf("Expected 2 v1 headers, got %d", stats.HeadersV1)
+	}
+	another := dial()
+	defer another.Close()
+	fourth, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fourth.Close()
+}
+
+func TestMaxPendingHeadersPanic(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var headersRead int32
+	pl := &Listener{
+		Listener:              l,
+		MaxPendingHeaders:     1,
+		PendingHeadersTimeout: 50 * time.Millisecond,
+		ValidateHeader:        func(*Header) error { panic("broken validator") },
+		Hooks: ListenerHooks{
+			HeaderRead: func(header *Header, duration time.Duration, err error) {
+				atomic.AddInt32(&headersRead, 1)
+			},
+		},
+	}
+	defer pl.Close()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return conn
+	}
+
+	client := dial()
+	defer client.Close()
+	if _, err := client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Expected the validator to panic")
+			}
+		}()
+		_ = conn.(*Conn).HeaderError()
+	}()
+	if atomic.LoadInt32(&headersRead) != 1 {
+		t.Fatalf("Expected the HeaderRead hook to be called once, got %d", headersRead)
+	}
+
+	// The panic released the header slot.
+	next := dial()
+	defer next.Close()
+	second, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	second.Close()
+}
+
+func TestAcceptErrorClassification(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	policyErr := fmt.Errorf("failure")
+	var calls int32
+	connPolicyFunc := func(connOpts ConnPolicyOptions) (Policy, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return USE, policyErr
+		}
+		return USE, nil
+	}
+	pl := &Listener{Listener: l, ConnPolicy: connPolicyFunc}
+
+	cliResult := make(chan error)
+	go func() {
+		defer close(cliResult)
+		for i := 0; i < 2; i++ {
+			conn, err := net.Dial("tcp", pl.Addr().String())
+			if err != nil {
+				cliResult <- err
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	// The policy error only concerns the first connection.
+	_, err = pl.Accept()
+	var acceptErr *AcceptError
+	if !errors.As(err, &acceptErr) || !acceptErr.Temporary() || acceptErr.Timeout() {
+		t.Fatalf("Expected a temporary *AcceptError, got %v", err)
+	}
+	if !errors.Is(err, policyErr) || acceptErr.RemoteAddr == nil {
+		t.Fatalf("Expected the policy error for a connection, got %v", err)
+	}
+
+	// The listener keeps serving the next ones.
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+	if err := <-cliResult; err != nil {
+		t.Fatalf("client error: %v", err)
+	}
+
+	// Closing the listener is fatal.
+	pl.Close()
+	_, err = pl.Accept()
+	if !errors.As(err, &acceptErr) || acceptErr.Temporary() {
+		t.Fatalf("Expected a fatal *AcceptError, got %v", err)
+	}
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Expected error %v, got %v", net.ErrClosed, err)
+	}
+}
+
+func TestRejectAddressless(t *testing.T) {
+	v2Local := string(append(append([]byte{}, SIGV2...), byte(LOCAL), byte(UNSPEC), 0, 0))
+
+	var cases = []struct {
+		name        string
+		policy      Policy
+		reject      bool
+		data        string
+		expectedErr error
+	}{
+		{"v1 UNKNOWN", USE, true, "PROXY UNKNOWN\r\nping", ErrAddresslessHeader},
+		{"v2 LOCAL", REQUIRE, true, v2Local + "ping", ErrAddresslessHeader},
+		{"v1 TCP4", USE, true, "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping", nil},
+		{"v1 UNKNOWN allowed", USE, false, "PROXY UNKNOWN\r\nping", nil},
+		{"v2 LOCAL ignored", IGNORE, true, v2Local + "ping", nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			go func() {
+				_, _ = client.Write([]byte(tc.data))
+			}()
+
+			conn := NewConn(server, WithPolicy(tc.policy), WithRejectAddressless(tc.reject))
+			if err := conn.HeaderError(); err != tc.expectedErr {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestOnHeaderParsed(t *testing.T) {
+	errVetoed := errors.New("vetoed")
+
+	var cases = []struct {
+		name        string
+		policy      Policy
+		data        string
+		veto        bool
+		calls       int
+		expectedErr error
+	}{
+		{"header accepted", USE, "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping", false, 1, nil},
+		{"header vetoed", USE, "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping", true, 1, errVetoed},
+		{"header ignored", IGNORE, "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping", true, 0, nil},
+		{"no header", USE, "ping", true, 0, nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			go func() {
+				_, _ = client.Write([]byte(tc.data))
+			}()
+
+			calls := 0
+			conn := NewConn(server, WithPolicy(tc.policy), OnHeaderParsed(func(header *Header, c net.Conn) error {
+				calls++
+				if c != server {
+					t.Errorf("Expected the underlying connection, got %v", c)
+				}
+				if header.SourceAddr.String() != "10.1.1.1:1000" {
+					t.Errorf("Unexpected source address %v", header.SourceAddr)
+				}
+				if tc.veto {
+					return errVetoed
+				}
+				return nil
+			}))
+			if err := conn.HeaderError(); err != tc.expectedErr {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+			if calls != tc.calls {
+				t.Fatalf("Expected %d calls, got %d", tc.calls, calls)
+			}
+		})
+	}
+}
+
+func TestReadBufferReleased(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	conn := NewConn(server)
+	if conn.bufReader != nil {
+		t.Fatalf("Expected no internal buffer before reading the header")
+	}
+
+	go func() {
+		_, _ = client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+		_, _ = client.Write([]byte("ping"))
+	}()
+
+	// net.Pipe writes are unbuffered, the header is read alone.
+	if err := conn.HeaderError(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conn.bufReader != nil {
+		t.Fatalf("Expected internal buffer to be released, got %d bytes", conn.bufReader.Buffered())
+	}
+
+	// Peeking takes a buffer again, until it's drained.
+	b, err := conn.Peek(4)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(b) != "ping" {
+		t.Fatalf("Unexpected data %q", b)
+	}
+	recv := make([]byte, 4)
+	if _, err := io.ReadFull(conn, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != "ping" {
+		t.Fatalf("Unexpected data %q", recv)
+	}
+	if conn.bufReader != nil {
+		t.Fatalf("Expected internal buffer to be released, got %d bytes", conn.bufReader.Buffered())
+	}
+}
+
+func TestCRC32cCheck(t *testing.T) {
+	corrupted := append([]byte(nil), awsVPCECapture...)
+	corrupted[len(corrupted)-1] = 0x01 // in the NOOP TLV
+	withoutCRC32c, err := HeaderProxyFromAddrs(2, v4addr, v4addr).Format()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	truncatedHeader := HeaderProxyFromAddrs(2, v4addr, v4addr)
+	truncatedHeader.rawTLVs = []byte{byte(PP2_TYPE_CRC32C), 0x00, 0x04, 0x00}
+	truncated, err := truncatedHeader.Format()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var cases = []struct {
+		name           string
+		action         CRC32cAction
+		data           []byte
+		expectedErr    error
+		expectedCRC32c bool // whether the header still carries the checksum
+		mismatches     int
+	}{
+		{"ignored", CRC32cIgnore, corrupted, nil, true, 0},
+		{"rejected", CRC32cReject, corrupted, ErrInvalidCRC32c, false, 1},
+		{"stripped", CRC32cStrip, corrupted, nil, false, 1},
+		{"logged", CRC32cLogOnly, corrupted, nil, true, 1},
+		{"valid", CRC32cReject, awsVPCECapture, nil, true, 0},
+		{"missing", CRC32cReject, withoutCRC32c, nil, false, 0},
+		{"truncated rejected", CRC32cReject, truncated, ErrTruncatedTLV, false, 1},
+		{"truncated stripped", CRC32cStrip, truncated, ErrTruncatedTLV, false, 1},
+		{"truncated logged", CRC32cLogOnly, truncated, nil, false, 1},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			go func() {
+				_, _ = client.Write(tc.data)
+			}()
+
+			mismatches := 0
+			conn := NewConn(server, WithPolicy(REQUIRE), WithCRC32cCheck(tc.action, func(header *Header, c net.Conn) {
+				if c != server {
+					t.Errorf("Unexpected mismatch report for %v on %v", header, c)
+				}
+				mismatches++
+			}))
+			if err := conn.HeaderError(); err != tc.expectedErr {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+			if mismatches != tc.mismatches {
+				t.Fatalf("Expected %d mismatches, got %d", tc.mismatches, mismatches)
+			}
+			header := conn.ProxyHeader()
+			if header == nil {
+				return
+			}
+			if _, ok := header.TLV(PP2_TYPE_CRC32C); ok != tc.expectedCRC32c {
+				t.Fatalf("Expected the checksum to be kept: %v, got %v", tc.expectedCRC32c, ok)
+			}
+			// Other TLVs are kept.
+			if len(tc.data) == len(awsVPCECapture) {
+				if _, ok := header.TLV(0xea); !ok {
+					t.Fatal("Expected the VPC endpoint TLV to be kept")
+				}
+			}
+		})
+	}
+}
+
+func TestCRC32cCheckRawHeader(t *testing.T) {
+	// A UNIX header whose source name has bytes after its NUL, which
+	// formatting the parsed header again doesn't preserve.
+	payload := make([]byte, 216, 216+7)
+	copy(payload, "/src\x00garbage")
+	copy(payload[108:], "/dst")
+	payload = append(payload, byte(PP2_TYPE_CRC32C), 0x00, 0x04, 0x00, 0x00, 0x00, 0x00)
+	raw := append(append([]byte{}, SIGV2...), byte(PROXY), byte(UnixStream), 0x00, byte(len(payload)))
+	raw = append(raw, payload...)
+	binary.BigEndian.PutUint32(raw[len(raw)-4:], crc32.Checksum(raw, crc32.MakeTable(crc32.Castagnoli)))
+
+	for _, record := range []bool{true, false} {
+		server, client := net.Pipe()
+		go func() {
+			_, _ = client.Write(raw)
+		}()
+
+		conn := NewConn(server, WithRecordHeader(record), WithCRC32cCheck(CRC32cReject, nil))
+		err := conn.HeaderError()
+		server.Close()
+		client.Close()
+
+		// Without the recorded bytes, the checksum is computed over the
+		// formatted header, which differs.
+		expectedErr := ErrInvalidCRC32c
+		if record {
+			expectedErr = nil
+		}
+		if err != expectedErr {
+			t.Fatalf("Expected error %v when recording is %v, got %v", expectedErr, record, err)
+		}
+	}
+}
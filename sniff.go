@@ -0,0 +1,107 @@
+package proxyproto
+
+// DefaultSniffLen is the number of bytes peeked at by a SniffFunc if none is
+// specified. It's enough to tell apart PROXY headers of both versions and
+// the beginning of the most common protocols, e.g. TLS, SSH or HTTP.
+const DefaultSniffLen = 16
+
+// SniffFunc can be used to fingerprint connections before their PROXY header
+// is processed. It receives the first bytes of a connection, which are
+// peeked at and thus left for the header or the application to read, and
+// the policy decided for the connection, and returns the policy to apply
+// instead, e.g. SKIP to not process the header at all and pass all the bytes
+// on to the application, which may then reroute the connection depending on
+// its protocol. Returning policy keeps it.
+//
+// It receives the bytes already received when the first ones arrive, up to
+// the number asked for, but at least one: it isn't delayed waiting for more,
+// e.g. when a short header is followed by a protocol in which the server
+// speaks first. Like the header, the beginning of protocols is expected to be
+// sent at once.
+//
+// In case an error is returned, it is returned as the header processing
+// error, like a Validator's.
+type SniffFunc func(first []byte, policy Policy) (Policy, error)
+
+// WithSniffer makes a connection, when passed as option to NewConn(), peek
+// at its first n bytes and pass them to fn before processing the header, see
+// SniffFunc. If n is zero or negative, DefaultSniffLen bytes are peeked at.
+// It's capped to the size of the internal buffer, 256 bytes.
+func WithSniffer(n int, fn SniffFunc) func(*Conn) {
+	return func(c *Conn) {
+		c.sniffLen = n
+		c.sniff = fn
+	}
+}
+
+// sniffHeader calls the SniffFunc of the connection, if any, updating its
+// policy. It returns whether processing the header must be skipped, i.e. the
+// policy is now SKIP.
+func (p *Conn) sniffHeader() (bool, error) {
+	if p.sniff == nil {
+		return false, nil
+	}
+	n := p.sniffLen
+	if n <= 0 {
+		n = DefaultSniffLen
+	}
+	if n > readBufferSize {
+		n = readBufferSize
+	}
+	// Only wait for the first bytes, then sniff those already buffered.
+	// Errors, e.g. timeouts, are left to the header processing to report.
+	if _, err := p.bufReader.Peek(1); err != nil {
+		return false, nil
+	}
+	if buffered := p.bufReader.Buffered(); n > buffered {
+		n = buffered
+	}
+	first, _ := p.bufReader.Peek(n)
+	policy, err := p.sniff(first, p.ProxyHeaderPolicy)
+	if err != nil {
+		return false, err
+	}
+	p.ProxyHeaderPolicy = policy
+	return policy == SKIP, nil
+}
+
+// TLS record header fields checked by SkipProxyHeaderForTLS.
+const (
+	tlsRecordTypeHandshake      = 0x16
+	tlsRecordMajorVersion       = 0x03
+	tlsRecordMaxMinorVersion    = 0x04
+	tlsRecordMaxLength          = 1<<14 + 2048
+	tlsHandshakeTypeClientHello = 0x01
+)
+
+// SkipProxyHeaderForTLS is a SniffFunc skipping the processing of the PROXY
+// header of connections which unmistakably start with a TLS record carrying a
+// ClientHello, e.g. on a port receiving both direct TLS traffic and proxied
+// traffic. The policy of other connections is kept. PROXY headers can't be
+// mistaken for TLS records, v1 ones starting with "P" and v2 ones with "\r".
+//
+// The record header and the handshake type take 6 bytes, which is less than
+// DefaultSniffLen.
+func SkipProxyHeaderForTLS(first []byte, policy Policy) (Policy, error) {
+	if isTLSClientHello(first) {
+		return SKIP, nil
+	}
+	return policy, nil
+}
+
+// isTLSClientHello returns whether b starts with a TLS record header of a
+// ClientHello: its content type, a supported protocol version, a length which
+// isn't too large, then the handshake type.
+func isTLSClientHello(b []byte) bool {
+	if len(b) < 6 {
+		return false
+	}
+	if b[0] != tlsRecordTypeHandshake || b[1] != tlsRecordMajorVersion || b[2] > tlsRecordMaxMinorVersion {
+		return false
+	}
+	length := int(b[3])<<8 | int(b[4])
+	if length == 0 || length > tlsRecordMaxLength {
+		return false
+	}
+	return b[5] == tlsHandshakeTypeClientHello
+}
@@ -0,0 +1,196 @@
+package proxyproto
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSniffer(t *testing.T) {
+	errSniffed := errors.New("sniffed")
+
+	var cases = []struct {
+		name           string
+		policy         Policy
+		sniffed        Policy
+		sniffErr       error
+		data           string
+		expectedPolicy Policy
+		expectedErr    error
+		expectedHeader bool
+		expectedData   string
+	}{
+		{"policy kept", USE, USE, nil, "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping", USE, nil, true, "ping"},
+		{"skipped", USE, SKIP, nil, "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping", SKIP, nil, false, "PROXY"},
+		{"required", USE, REQUIRE, nil, "ping", REQUIRE, ErrNoProxyProtocol, false, ""},
+		{"error", USE, USE, errSniffed, "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping", USE, errSniffed, false, ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			go func() {
+				_, _ = client.Write([]byte(tc.data))
+				client.Close()
+			}()
+
+			var sniffed []byte
+			conn := NewConn(server, WithPolicy(tc.policy), WithSniffer(5, func(first []byte, policy Policy) (Policy, error) {
+				sniffed = append(sniffed, first...)
+				if policy != tc.policy {
+					t.Errorf("Expected policy %v, got %v", tc.policy, policy)
+				}
+				return tc.sniffed, tc.sniffErr
+			}))
+			if err := conn.HeaderError(); err != tc.expectedErr {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+			if string(sniffed) != tc.data[:len(sniffed)] || len(sniffed) == 0 {
+				t.Fatalf("Unexpected sniffed bytes %q", sniffed)
+			}
+			if conn.ProxyHeaderPolicy != tc.expectedPolicy {
+				t.Fatalf("Expected policy %v, got %v", tc.expectedPolicy, conn.ProxyHeaderPolicy)
+			}
+			if (conn.ProxyHeader() != nil) != tc.expectedHeader {
+				t.Fatalf("Unexpected header %v", conn.ProxyHeader())
+			}
+			if tc.expectedErr != nil {
+				return
+			}
+			recv := make([]byte, len(tc.expectedData))
+			if _, err := io.ReadFull(conn, recv); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if string(recv) != tc.expectedData {
+				t.Fatalf("Expected %q, got %q", tc.expectedData, recv)
+			}
+		})
+	}
+}
+
+func TestSkipProxyHeaderForTLS(t *testing.T) {
+	var cases = []struct {
+		name     string
+		first    []byte
+		expected Policy
+	}{
+		{"TLS 1.0 record", []byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x01, 0x00}, SKIP},
+		{"TLS 1.2 record", []byte{0x16, 0x03, 0x03, 0x00, 0x30, 0x01}, SKIP},
+		{"too short", []byte{0x16, 0x03, 0x01}, REQUIRE},
+		{"not a handshake", []byte{0x17, 0x03, 0x03, 0x00, 0x30, 0x01}, REQUIRE},
+		{"unknown version", []byte{0x16, 0x03, 0x05, 0x00, 0x30, 0x01}, REQUIRE},
+		{"empty record", []byte{0x16, 0x03, 0x01, 0x00, 0x00, 0x01}, REQUIRE},
+		{"record too long", []byte{0x16, 0x03, 0x01, 0xff, 0xff, 0x01}, REQUIRE},
+		{"not a ClientHello", []byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x02}, REQUIRE},
+		{"v1 header", []byte("PROXY TCP4 "), REQUIRE},
+		{"v2 header", SIGV2, REQUIRE},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := SkipProxyHeaderForTLS(tc.first, REQUIRE)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if policy != tc.expected {
+				t.Fatalf("Expected policy %v, got %v", tc.expected, policy)
+			}
+		})
+	}
+}
+
+func TestListenerSkipProxyHeaderForTLS(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &Listener{
+		Listener: l,
+		ConnPolicy: func(ConnPolicyOptions) (Policy, error) {
+			return REQUIRE, nil
+		},
+		Sniff: SkipProxyHeaderForTLS,
+	}
+	defer pl.Close()
+
+	clientHello := []byte{0x16, 0x03, 0x01, 0x00, 0x05, 0x01, 0x00, 0x00, 0x01, 0x00}
+	cliResult := make(chan error)
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			cliResult <- err
+			return
+		}
+		defer conn.Close()
+
+		if _, err := conn.Write(clientHello); err != nil {
+			cliResult <- err
+			return
+		}
+
+		close(cliResult)
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	recv := make([]byte, len(clientHello))
+	if _, err := io.ReadFull(conn, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != string(clientHello) {
+		t.Fatalf("Expected the ClientHello to be passed on, got %v", recv)
+	}
+	if conn.RemoteAddr().String() != conn.(*Conn).Raw().RemoteAddr().String() {
+		t.Fatalf("Expected the socket address, got %v", conn.RemoteAddr())
+	}
+
+	err = <-cliResult
+	if err != nil {
+		t.Fatalf("client error: %v", err)
+	}
+}
+
+func TestSnifferShortHeader(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// A header shorter than the sniffed length, after which the client waits
+	// for the server to speak first.
+	go func() {
+		_, _ = client.Write([]byte("PROXY UNKNOWN\r\n"))
+	}()
+
+	var sniffed []byte
+	conn := NewConn(server, WithSniffer(0, func(first []byte, policy Policy) (Policy, error) {
+		sniffed = append(sniffed, first...)
+		return SkipProxyHeaderForTLS(first, policy)
+	}))
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.HeaderError()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected sniffing not to wait for more bytes")
+	}
+	if string(sniffed) != "PROXY UNKNOWN\r\n" {
+		t.Fatalf("Unexpected sniffed bytes %q", sniffed)
+	}
+	if conn.ProxyHeader() == nil {
+		t.Fatal("Expected the header to be read")
+	}
+}
@@ -0,0 +1,54 @@
+package proxyproto
+
+import (
+	"bufio"
+	"io"
+)
+
+// HeaderTee wraps a reader a header is read from and records the bytes read
+// from it, in order to expose the exact bytes of the header afterwards, e.g.
+// for compliance logging or to capture test vectors:
+//
+//	tee := proxyproto.TeeHeader(conn)
+//	reader := bufio.NewReader(tee)
+//	header, err := proxyproto.Read(reader)
+//	raw := tee.Header(reader)
+//
+// Recording stops once Header is called.
+type HeaderTee struct {
+	r       io.Reader
+	buf     []byte
+	stopped bool
+}
+
+// TeeHeader returns a HeaderTee recording the bytes read from r.
+func TeeHeader(r io.Reader) *HeaderTee {
+	return &HeaderTee{r: r}
+}
+
+// Read reads from the underlying reader, recording the bytes read until
+// Header is called.
+func (t *HeaderTee) Read(b []byte) (int, error) {
+	n, err := t.r.Read(b)
+	if !t.stopped {
+		t.buf = append(t.buf, b[:n]...)
+	}
+	return n, err
+}
+
+// Header stops recording and returns the bytes consumed from reader, which
+// must read from t, i.e. those recorded minus those still buffered by
+// reader. After a header has been read, successfully or not, they are the
+// bytes of the header, or those consumed before the error was raised. The
+// returned bytes must not be modified.
+func (t *HeaderTee) Header(reader *bufio.Reader) []byte {
+	if !t.stopped {
+		t.stopped = true
+		n := len(t.buf) - reader.Buffered()
+		if n < 0 {
+			n = 0
+		}
+		t.buf = t.buf[:n:n]
+	}
+	return t.buf
+}
@@ -0,0 +1,207 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestTeeHeader(t *testing.T) {
+	v2Header := &Header{
+		Version:           2,
+		Command:           PROXY,
+		TransportProtocol: TCPv4,
+		SourceAddr:        v4addr,
+		DestinationAddr:   v4addr,
+	}
+	if err := v2Header.SetTLVs([]TLV{{Type: PP2_TYPE_NOOP, Value: make([]byte, 1000)}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	v2Bytes, err := v2Header.Format()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var cases = []struct {
+		name        string
+		header      []byte
+		expectedErr error
+	}{
+		{"v1", []byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"), nil},
+		{"v2 larger than the buffer", v2Bytes, nil},
+		{"no header", nil, ErrNoProxyProtocol},
+		{"invalid v1", []byte("PROXY TCP4 10.1.1.1\r\n"), ErrCantReadAddressFamilyAndProtocol},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tee := TeeHeader(bytes.NewReader(append(append([]byte{}, tc.header...), "ping"...)))
+			reader := bufio.NewReaderSize(tee, 64)
+			if _, err := Read(reader); err != tc.expectedErr {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+			if raw := tee.Header(reader); !bytes.Equal(raw, tc.header) {
+				t.Fatalf("Expected header bytes %q, got %q", tc.header, raw)
+			}
+
+			// Recording stops once the header bytes are retrieved.
+			rest := make([]byte, 4)
+			if _, err := reader.Read(rest); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if raw := tee.Header(reader); !bytes.Equal(raw, tc.header) {
+				t.Fatalf("Expected header bytes %q after reading on, got %q", tc.header, raw)
+			}
+		})
+	}
+}
+
+func TestConnRawHeader(t *testing.T) {
+	header := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"
+
+	var cases = []struct {
+		name     string
+		record   bool
+		data     string
+		expected []byte
+	}{
+		{"recorded", true, header + "ping", []byte(header)},
+		{"no header", true, "ping", []byte{}},
+		{"not recorded", false, header + "ping", nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			go func() {
+				_, _ = client.Write([]byte(tc.data))
+			}()
+
+			conn := NewConn(server, WithRecordHeader(tc.record))
+			raw := conn.RawHeader()
+			if !bytes.Equal(raw, tc.expected) || (raw == nil) != (tc.expected == nil) {
+				t.Fatalf("Expected header bytes %q, got %q", tc.expected, raw)
+			}
+			recv := make([]byte, 4)
+			if _, err := conn.Read(recv); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if string(recv) != "ping" {
+				t.Fatalf("Expected ping, got %q", recv)
+			}
+		})
+	}
+}
+
+func TestConnWriteRawHeaderTo(t *testing.T) {
+	// Unknown TLVs, out of order, which a parse and format round trip
+	// wouldn't be guaranteed to preserve.
+	raw := append(append([]byte{}, SIGV2...), byte(PROXY), byte(TCPv4), 0x00, 0x16)
+	raw = append(raw, 10, 1, 1, 1, 20, 2, 2, 2, 0x03, 0xe8, 0x07, 0xd0)
+	raw = append(raw, 0xee, 0x00, 0x01, 0x01, byte(PP2_TYPE_NOOP), 0x00, 0x03, 0x00, 0x00, 0x00)
+
+	var cases = []struct {
+		name        string
+		policy      Policy
+		record      bool
+		expected    []byte
+		expectedErr error
+	}{
+		{"recorded", USE, true, raw, nil},
+		{"skipped", SKIP, true, nil, nil},
+		{"ignored", IGNORE, true, nil, nil},
+		{"not recorded", USE, false, nil, ErrHeaderNotRecorded},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			go func() {
+				_, _ = client.Write(append(append([]byte{}, raw...), "ping"...))
+			}()
+
+			conn := NewConn(server, WithPolicy(tc.policy), WithRecordHeader(tc.record))
+			var buf bytes.Buffer
+			n, err := conn.WriteRawHeaderTo(&buf)
+			if err != tc.expectedErr {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+			if !bytes.Equal(buf.Bytes(), tc.expected) || n != int64(len(tc.expected)) {
+				t.Fatalf("Expected header bytes %x, got %d bytes %x", tc.expected, n, buf.Bytes())
+			}
+			if tc.policy == SKIP && len(conn.tee.buf) != 0 {
+				t.Fatalf("Expected recording to stop, got %x", conn.tee.buf)
+			}
+		})
+	}
+}
+
+func TestConnWriteRawHeaderToClientConn(t *testing.T) {
+	header := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		_, _ = client.Write([]byte(header))
+	}()
+
+	upstream, backend := net.Pipe()
+	defer upstream.Close()
+	defer backend.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, len(header))
+		_, _ = backend.Read(buf)
+		received <- buf
+	}()
+
+	conn := NewConn(server, WithRecordHeader(true))
+	clientConn := NewClientConn(upstream)
+	if _, err := conn.WriteRawHeaderTo(clientConn); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if buf := <-received; string(buf) != header {
+		t.Fatalf("Expected %q, got %q", header, buf)
+	}
+	if _, err := conn.WriteRawHeaderTo(clientConn); err != ErrHeaderAlreadyWritten {
+		t.Fatalf("Expected error %v, got %v", ErrHeaderAlreadyWritten, err)
+	}
+}
+
+func TestConnWriteRawHeaderToStripped(t *testing.T) {
+	corrupted := append([]byte(nil), awsVPCECapture...)
+	corrupted[len(corrupted)-1] = 0x01 // in the NOOP TLV
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		_, _ = client.Write(corrupted)
+	}()
+
+	conn := NewConn(server, WithRecordHeader(true), WithCRC32cCheck(CRC32cStrip, nil))
+	var buf bytes.Buffer
+	if _, err := conn.WriteRawHeaderTo(&buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The stripped checksum isn't relayed.
+	header, err := Read(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok := header.TLV(PP2_TYPE_CRC32C); ok {
+		t.Fatal("Expected the checksum not to be relayed")
+	}
+	if !header.EqualsTo(conn.ProxyHeader()) {
+		t.Fatalf("Expected header %#v, got %#v", conn.ProxyHeader(), header)
+	}
+}
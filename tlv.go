@@ -8,6 +8,8 @@ import (
 	"errors"
 	"fmt"
 	"math"
+
+	"github.com/pires/go-proxyproto/core"
 )
 
 const (
@@ -35,7 +37,7 @@ const (
 )
 
 var (
-	ErrTruncatedTLV    = errors.New("proxyproto: truncated TLV")
+	ErrTruncatedTLV    = core.ErrTruncatedTLV
 	ErrMalformedTLV    = errors.New("proxyproto: malformed TLV Value")
 	ErrIncompatibleTLV = errors.New("proxyproto: incompatible TLV type")
 )
@@ -52,25 +54,20 @@ type TLV struct {
 // SplitTLVs splits the Type-Length-Value vector, returns the vector or an error.
 func SplitTLVs(raw []byte) ([]TLV, error) {
 	var tlvs []TLV
-	for i := 0; i < len(raw); {
+	err := core.IterateTLVs(raw, func(t byte, value []byte) bool {
 		tlv := TLV{
-			Type: PP2Type(raw[i]),
-		}
-		if len(raw)-i <= 2 {
-			return nil, ErrTruncatedTLV
-		}
-		tlvLen := int(binary.BigEndian.Uint16(raw[i+1 : i+3])) // Max length = 65K
-		i += 3
-		if i+tlvLen > len(raw) {
-			return nil, ErrTruncatedTLV
+			Type: PP2Type(t),
 		}
 		// Ignore no-op padding
 		if tlv.Type != PP2_TYPE_NOOP {
-			tlv.Value = make([]byte, tlvLen)
-			copy(tlv.Value, raw[i:i+tlvLen])
+			tlv.Value = make([]byte, len(value))
+			copy(tlv.Value, value)
 		}
-		i += tlvLen
 		tlvs = append(tlvs, tlv)
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
 	return tlvs, nil
 }
@@ -91,6 +88,31 @@ func JoinTLVs(tlvs []TLV) ([]byte, error) {
 	return raw, nil
 }
 
+// JoinTLVsPadded joins multiple Type-Length-Value records like JoinTLVs, and
+// appends a PP2_TYPE_NOOP record so that the result is exactly totalLen bytes
+// long, as some load balancers do to emit headers of a constant size. An
+// error is returned if the records are already longer than totalLen, or if
+// they're shorter by less than the 3 bytes a record takes at least.
+func JoinTLVsPadded(tlvs []TLV, totalLen int) ([]byte, error) {
+	raw, err := JoinTLVs(tlvs)
+	if err != nil {
+		return nil, err
+	}
+
+	padLen := totalLen - len(raw)
+	if padLen == 0 {
+		return raw, nil
+	}
+	if padLen < 3 {
+		return nil, fmt.Errorf("proxyproto: cannot pad TLVs of %d bytes to %d bytes", len(raw), totalLen)
+	}
+
+	return JoinTLVs(append(tlvs[:len(tlvs):len(tlvs)], TLV{
+		Type:  PP2_TYPE_NOOP,
+		Value: make([]byte, padLen-3),
+	}))
+}
+
 // Registered is true if the type is registered in the spec, see section 2.2
 func (p PP2Type) Registered() bool {
 	switch p {
@@ -148,3 +148,65 @@ func TestJoinTLVs(t *testing.T) {
 		})
 	}
 }
+
+func TestJoinTLVsPadded(t *testing.T) {
+	authority := []TLV{{
+		Type:  PP2_TYPE_AUTHORITY,
+		Value: []byte("example.org"),
+	}}
+	tests := []struct {
+		name     string
+		tlvs     []TLV
+		totalLen int
+		raw      []byte
+		err      bool
+	}{
+		{
+			name:     "exact length",
+			tlvs:     authority,
+			totalLen: 14,
+			raw:      append([]byte{byte(PP2_TYPE_AUTHORITY), 0x00, 0x0B}, []byte("example.org")...),
+		},
+		{
+			name:     "padded",
+			tlvs:     authority,
+			totalLen: 19,
+			raw: append(append([]byte{byte(PP2_TYPE_AUTHORITY), 0x00, 0x0B}, []byte("example.org")...),
+				byte(PP2_TYPE_NOOP), 0x00, 0x02, 0x00, 0x00),
+		},
+		{
+			name:     "no TLVs",
+			totalLen: 3,
+			raw:      []byte{byte(PP2_TYPE_NOOP), 0x00, 0x00},
+		},
+		{
+			name:     "too short to pad",
+			tlvs:     authority,
+			totalLen: 16,
+			err:      true,
+		},
+		{
+			name:     "too long",
+			tlvs:     authority,
+			totalLen: 10,
+			err:      true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			raw, err := JoinTLVsPadded(tc.tlvs, tc.totalLen)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %#v", raw)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(raw, tc.raw) {
+				t.Errorf("expected %#v, got %#v", tc.raw, raw)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+// ALPN TLV, see section 2.2.1 of the spec
+// https://www.haproxy.org/download/2.3/doc/proxy-protocol.txt
+
+package tlvparse
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// ErrNoApplicationProtocol is returned by NegotiateALPN when the proxied
+// application protocol isn't supported, like a TLS server rejects a handshake
+// with the no_application_protocol alert.
+var ErrNoApplicationProtocol = errors.New("proxyproto: no supported application protocol")
+
+// ErrApplicationProtocolMismatch is returned by VerifyALPN when the
+// application protocol negotiated by a TLS handshake isn't the proxied one.
+var ErrApplicationProtocolMismatch = errors.New("proxyproto: negotiated application protocol differs from the proxied one")
+
+// IsALPN is true if the TLV is type PP2_TYPE_ALPN.
+func IsALPN(tlv proxyproto.TLV) bool {
+	return tlv.Type == proxyproto.PP2_TYPE_ALPN
+}
+
+// ALPN returns the application protocol of a PP2_TYPE_ALPN TLV, e.g. "h2", or
+// errors with ErrIncompatibleTLV or ErrMalformedTLV.
+func ALPN(tlv proxyproto.TLV) (string, error) {
+	if !IsALPN(tlv) {
+		return "", proxyproto.ErrIncompatibleTLV
+	}
+	// Protocol IDs are 1 to 255 bytes long, see RFC 7301 section 3.1.
+	if len(tlv.Value) == 0 || len(tlv.Value) > 255 {
+		return "", proxyproto.ErrMalformedTLV
+	}
+	return string(tlv.Value), nil
+}
+
+// FindALPN returns the first application protocol in the TLVs if it exists and
+// is well-formed, and a bool indicating one was found.
+func FindALPN(tlvs []proxyproto.TLV) (string, bool) {
+	for _, tlv := range tlvs {
+		if proto, err := ALPN(tlv); err == nil {
+			return proto, true
+		}
+	}
+	return "", false
+}
+
+// NegotiateALPN selects the application protocol of a proxied connection among
+// the protocols supported by a server, as a TLS server does with the protocols
+// of tls.Config.NextProtos: it returns the proxied protocol if it's supported,
+// and an empty protocol if none was proxied, in which case the server should
+// fall back to its default protocol. ErrNoApplicationProtocol is wrapped in
+// the error returned if the proxied protocol isn't supported.
+func NegotiateALPN(tlvs []proxyproto.TLV, supported []string) (string, error) {
+	proto, ok := FindALPN(tlvs)
+	if !ok {
+		return "", nil
+	}
+	for _, p := range supported {
+		if p == proto {
+			return proto, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q", ErrNoApplicationProtocol, proto)
+}
+
+// proxiedALPN returns the application protocol proxied by the PROXY header of
+// conn, or of the connection it wraps, see proxyproto.HeaderFromConn.
+func proxiedALPN(conn net.Conn) (string, bool, error) {
+	header, ok := proxyproto.HeaderFromConn(conn)
+	if !ok {
+		return "", false, nil
+	}
+	tlvs, err := header.TLVs()
+	if err != nil {
+		return "", false, err
+	}
+	proto, ok := FindALPN(tlvs)
+	return proto, ok, nil
+}
+
+// ConstrainALPN returns a copy of config for TLS servers whose connections
+// carry a PROXY header, e.g. behind a proxy terminating TLS and then
+// re-encrypting, which restricts the application protocols negotiated by
+// handshakes to the one proxied by the PP2_TYPE_ALPN TLV, if any, so that
+// both match. The handshake fails with ErrNoApplicationProtocol if the
+// proxied protocol isn't one of config.NextProtos. Connections without such
+// a TLV negotiate among config.NextProtos as usual.
+//
+// The config returned by config.GetConfigForClient, if any, is constrained
+// instead of config.
+func ConstrainALPN(config *tls.Config) *tls.Config {
+	constrained := config.Clone()
+	constrained.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		base := config
+		if config.GetConfigForClient != nil {
+			c, err := config.GetConfigForClient(hello)
+			if err != nil {
+				return nil, err
+			}
+			if c != nil {
+				base = c
+			}
+		}
+
+		proto, ok, err := proxiedALPN(hello.Conn)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			if base == config {
+				return nil, nil
+			}
+			return base, nil
+		}
+		for _, p := range base.NextProtos {
+			if p == proto {
+				c := base.Clone()
+				c.GetConfigForClient = nil
+				c.NextProtos = []string{proto}
+				return c, nil
+			}
+		}
+		return nil, fmt.Errorf("%w: %q", ErrNoApplicationProtocol, proto)
+	}
+	return constrained
+}
+
+// VerifyALPN checks that the application protocol negotiated by the TLS
+// handshake of conn, which is run if it hasn't been yet, is the one proxied by
+// the PP2_TYPE_ALPN TLV of the PROXY header of the connection it wraps, if
+// any. An error wrapping ErrApplicationProtocolMismatch is returned otherwise.
+func VerifyALPN(conn *tls.Conn) error {
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	proto, ok, err := proxiedALPN(conn)
+	if err != nil || !ok {
+		return err
+	}
+	if negotiated := conn.ConnectionState().NegotiatedProtocol; negotiated != proto {
+		return fmt.Errorf("%w: negotiated %q, proxied %q", ErrApplicationProtocolMismatch, negotiated, proto)
+	}
+	return nil
+}
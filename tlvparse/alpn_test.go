@@ -0,0 +1,174 @@
+package tlvparse
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+func TestALPN(t *testing.T) {
+	if _, err := ALPN(proxyproto.TLV{Type: proxyproto.PP2_TYPE_AUTHORITY, Value: []byte("h2")}); err != proxyproto.ErrIncompatibleTLV {
+		t.Fatalf("expected %v, got %v", proxyproto.ErrIncompatibleTLV, err)
+	}
+	if _, err := ALPN(proxyproto.TLV{Type: proxyproto.PP2_TYPE_ALPN}); err != proxyproto.ErrMalformedTLV {
+		t.Fatalf("expected %v, got %v", proxyproto.ErrMalformedTLV, err)
+	}
+	if proto, err := ALPN(proxyproto.TLV{Type: proxyproto.PP2_TYPE_ALPN, Value: []byte("h2")}); err != nil || proto != "h2" {
+		t.Fatalf("expected h2, got %q, %v", proto, err)
+	}
+}
+
+func TestNegotiateALPN(t *testing.T) {
+	supported := []string{"h2", "http/1.1"}
+	alpn := func(proto string) []proxyproto.TLV {
+		return []proxyproto.TLV{
+			{Type: proxyproto.PP2_TYPE_AUTHORITY, Value: []byte("example.com")},
+			{Type: proxyproto.PP2_TYPE_ALPN, Value: []byte(proto)},
+		}
+	}
+
+	tests := []struct {
+		name  string
+		tlvs  []proxyproto.TLV
+		proto string
+		err   error
+	}{
+		{name: "supported", tlvs: alpn("http/1.1"), proto: "http/1.1"},
+		{name: "none proxied", tlvs: alpn("")[:1]},
+		{name: "unsupported", tlvs: alpn("imap"), err: ErrNoApplicationProtocol},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proto, err := NegotiateALPN(tt.tlvs, supported)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if proto != tt.proto {
+				t.Fatalf("expected protocol %q, got %q", tt.proto, proto)
+			}
+		})
+	}
+}
+
+// testCertificate returns a self-signed certificate for the given DNS names.
+func testCertificate(t *testing.T, names ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// proxiedTLSHandshake sends a PROXY header with the given TLVs then runs a TLS
+// handshake over a pipe, and returns the server side of the connection and
+// the handshake error.
+func proxiedTLSHandshake(t *testing.T, tlvs []proxyproto.TLV, server, client *tls.Config) (*tls.Conn, error) {
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() {
+		serverConn.Close()
+		clientConn.Close()
+	})
+
+	header := proxyproto.HeaderProxyFromAddrs(2,
+		&net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000},
+		&net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000})
+	if err := header.SetTLVs(tlvs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		if _, err := header.WriteTo(clientConn); err != nil {
+			return
+		}
+		conn := tls.Client(clientConn, client)
+		_ = conn.Handshake()
+		// Keep the pipe open for the server to finish its handshake.
+		_, _ = conn.Read(make([]byte, 1))
+	}()
+
+	conn := tls.Server(proxyproto.NewConn(serverConn), server)
+	return conn, conn.Handshake()
+}
+
+func TestConstrainALPN(t *testing.T) {
+	cert := testCertificate(t, "example.com")
+	alpn := func(proto string) []proxyproto.TLV {
+		return []proxyproto.TLV{{Type: proxyproto.PP2_TYPE_ALPN, Value: []byte(proto)}}
+	}
+
+	tests := []struct {
+		name       string
+		tlvs       []proxyproto.TLV
+		negotiated string
+		err        error
+	}{
+		{name: "proxied", tlvs: alpn("h2"), negotiated: "h2"},
+		{name: "none proxied", negotiated: "http/1.1"},
+		{name: "unsupported", tlvs: alpn("imap"), err: ErrNoApplicationProtocol},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				NextProtos:   []string{"http/1.1", "h2"},
+			}
+			client := &tls.Config{
+				InsecureSkipVerify: true,
+				NextProtos:         []string{"h2", "http/1.1"},
+			}
+			conn, err := proxiedTLSHandshake(t, tt.tlvs, ConstrainALPN(config), client)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if err != nil {
+				return
+			}
+			if proto := conn.ConnectionState().NegotiatedProtocol; proto != tt.negotiated {
+				t.Fatalf("expected %q, got %q", tt.negotiated, proto)
+			}
+			if err := VerifyALPN(conn); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyALPN(t *testing.T) {
+	config := &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t, "example.com")},
+		NextProtos:   []string{"http/1.1", "h2"},
+	}
+	client := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2", "http/1.1"},
+	}
+	conn, err := proxiedTLSHandshake(t, []proxyproto.TLV{{Type: proxyproto.PP2_TYPE_ALPN, Value: []byte("h2")}}, config, client)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := VerifyALPN(conn); !errors.Is(err, ErrApplicationProtocolMismatch) {
+		t.Fatalf("expected %v, got %v", ErrApplicationProtocolMismatch, err)
+	}
+}
@@ -0,0 +1,187 @@
+// Authority TLV, see section 2.2.2 of the spec
+// https://www.haproxy.org/download/2.3/doc/proxy-protocol.txt
+
+package tlvparse
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/netip"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pires/go-proxyproto"
+)
+
+const (
+	// authorityMaxLen is the maximum length of a host name, without its
+	// optional trailing dot.
+	authorityMaxLen = 253
+	// authorityLabelMaxLen is the maximum length of a host name label.
+	authorityLabelMaxLen = 63
+)
+
+// ValidateAuthority returns an error wrapping ErrMalformedTLV if host isn't a
+// valid PP2_TYPE_AUTHORITY value, i.e. a host name such as the server name
+// sent by the client in the TLS SNI extension. Host names are made of dot
+// separated labels of UTF-8 letters, digits, hyphens and underscores, not
+// starting or ending with a hyphen, and are at most 253 bytes long. IP
+// literals are also accepted.
+func ValidateAuthority(host string) error {
+	if !utf8.ValidString(host) {
+		return fmt.Errorf("%w: authority is not valid UTF-8", proxyproto.ErrMalformedTLV)
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nil
+	}
+
+	name := strings.TrimSuffix(host, ".")
+	if name == "" {
+		return fmt.Errorf("%w: authority is empty", proxyproto.ErrMalformedTLV)
+	}
+	if len(name) > authorityMaxLen {
+		return fmt.Errorf("%w: authority is %d bytes long, more than %d", proxyproto.ErrMalformedTLV, len(name), authorityMaxLen)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > authorityLabelMaxLen {
+			return fmt.Errorf("%w: authority %q has a label of invalid length", proxyproto.ErrMalformedTLV, host)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("%w: authority %q has a label starting or ending with a hyphen", proxyproto.ErrMalformedTLV, host)
+		}
+		for _, r := range label {
+			if !isHostNameRune(r) {
+				return fmt.Errorf("%w: authority %q contains invalid character %q", proxyproto.ErrMalformedTLV, host, r)
+			}
+		}
+	}
+	return nil
+}
+
+func isHostNameRune(r rune) bool {
+	switch {
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-', r == '_':
+		return true
+	}
+	// Internationalized labels may be sent as is instead of punycode, but
+	// without control nor space characters.
+	return r >= utf8.RuneSelf && r != utf8.RuneError && !unicode.IsControl(r) && !unicode.IsSpace(r)
+}
+
+// IsAuthority is true if the TLV is type PP2_TYPE_AUTHORITY.
+func IsAuthority(tlv proxyproto.TLV) bool {
+	return tlv.Type == proxyproto.PP2_TYPE_AUTHORITY
+}
+
+// Authority returns the host name of a PP2_TYPE_AUTHORITY TLV or errors with
+// ErrIncompatibleTLV, or with an error wrapping ErrMalformedTLV if it isn't
+// valid, see ValidateAuthority.
+func Authority(tlv proxyproto.TLV) (string, error) {
+	if !IsAuthority(tlv) {
+		return "", proxyproto.ErrIncompatibleTLV
+	}
+	host := string(tlv.Value)
+	if err := ValidateAuthority(host); err != nil {
+		return "", err
+	}
+	return host, nil
+}
+
+// FindAuthority returns the first host name in the TLVs if it exists and is
+// well-formed, and a bool indicating one was found.
+func FindAuthority(tlvs []proxyproto.TLV) (string, bool) {
+	for _, tlv := range tlvs {
+		if host, err := Authority(tlv); err == nil {
+			return host, true
+		}
+	}
+	return "", false
+}
+
+// AuthorityTLV returns a PP2_TYPE_AUTHORITY TLV for host, or an error wrapping
+// ErrMalformedTLV if it isn't valid, see ValidateAuthority.
+func AuthorityTLV(host string) (proxyproto.TLV, error) {
+	if err := ValidateAuthority(host); err != nil {
+		return proxyproto.TLV{}, err
+	}
+	return proxyproto.TLV{Type: proxyproto.PP2_TYPE_AUTHORITY, Value: []byte(host)}, nil
+}
+
+// SetAuthority stores host into the header as its PP2_TYPE_AUTHORITY TLV,
+// replacing any previous one and keeping the other TLVs, including padding,
+// as they are. An error wrapping ErrMalformedTLV is returned if host isn't
+// valid, see ValidateAuthority.
+func SetAuthority(header *proxyproto.Header, host string) error {
+	authority, err := AuthorityTLV(host)
+	if err != nil {
+		return err
+	}
+
+	var tlvs []proxyproto.TLV
+	if err := header.IterateTLVs(func(tlv proxyproto.TLV) bool {
+		if !IsAuthority(tlv) {
+			tlvs = append(tlvs, proxyproto.TLV{Type: tlv.Type, Value: append([]byte{}, tlv.Value...)})
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	return header.SetTLVs(append(tlvs, authority))
+}
+
+// ServerName returns the server name of a TLS handshake: the one sent by the
+// client in the SNI extension or, if there's none, the host name proxied by
+// the PP2_TYPE_AUTHORITY TLV of the PROXY header of the connection, see
+// proxyproto.HeaderFromConn. It allows TLS servers behind proxies which
+// terminate TLS and re-encrypt without SNI to select certificates or route
+// connections by the name requested to the proxy. It's empty if there's
+// neither.
+func ServerName(hello *tls.ClientHelloInfo) string {
+	if hello.ServerName != "" {
+		return hello.ServerName
+	}
+	header, ok := proxyproto.HeaderFromConn(hello.Conn)
+	if !ok {
+		return ""
+	}
+	tlvs, err := header.TLVs()
+	if err != nil {
+		return ""
+	}
+	host, _ := FindAuthority(tlvs)
+	return host
+}
+
+// withServerName returns hello with its server name set by ServerName.
+func withServerName(hello *tls.ClientHelloInfo) *tls.ClientHelloInfo {
+	if hello.ServerName != "" {
+		return hello
+	}
+	serverName := ServerName(hello)
+	if serverName == "" {
+		return hello
+	}
+	h := *hello
+	h.ServerName = serverName
+	return &h
+}
+
+// GetCertificateWithAuthority wraps a tls.Config.GetCertificate callback so
+// that it's passed ClientHelloInfo.ServerName set by ServerName, i.e. to the
+// proxied PP2_TYPE_AUTHORITY when the client sent no SNI.
+func GetCertificateWithAuthority(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return getCertificate(withServerName(hello))
+	}
+}
+
+// GetConfigForClientWithAuthority wraps a tls.Config.GetConfigForClient
+// callback so that it's passed ClientHelloInfo.ServerName set by ServerName,
+// i.e. to the proxied PP2_TYPE_AUTHORITY when the client sent no SNI, e.g. to
+// route connections.
+func GetConfigForClientWithAuthority(getConfigForClient func(*tls.ClientHelloInfo) (*tls.Config, error)) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		return getConfigForClient(withServerName(hello))
+	}
+}
@@ -0,0 +1,174 @@
+package tlvparse
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+)
+
+func TestValidateAuthority(t *testing.T) {
+	tests := []struct {
+		host  string
+		valid bool
+	}{
+		{"example.com", true},
+		{"example.com.", true},
+		{"a-b_c.example", true},
+		{"bücher.example", true},
+		{"192.0.2.1", true},
+		{"2001:db8::1", true},
+		{strings.Repeat("a", 63) + ".com", true},
+		{"", false},
+		{".", false},
+		{"example..com", false},
+		{"-example.com", false},
+		{"example-.com", false},
+		{"exa mple.com", false},
+		{"example.com:443", false},
+		{"exa\x00mple.com", false},
+		{"exa\u0085mple.com", false},
+		{"\xff.example", false},
+		{strings.Repeat("a", 64) + ".com", false},
+		{strings.Repeat("a.", 127) + "ab", false},
+	}
+
+	for _, tt := range tests {
+		err := ValidateAuthority(tt.host)
+		if tt.valid && err != nil {
+			t.Fatalf("%q: err: %v", tt.host, err)
+		}
+		if !tt.valid && !errors.Is(err, proxyproto.ErrMalformedTLV) {
+			t.Fatalf("%q: expected %v, got %v", tt.host, proxyproto.ErrMalformedTLV, err)
+		}
+	}
+}
+
+func TestAuthority(t *testing.T) {
+	if _, err := Authority(proxyproto.TLV{Type: proxyproto.PP2_TYPE_ALPN, Value: []byte("h2")}); err != proxyproto.ErrIncompatibleTLV {
+		t.Fatalf("expected %v, got %v", proxyproto.ErrIncompatibleTLV, err)
+	}
+	if _, err := Authority(proxyproto.TLV{Type: proxyproto.PP2_TYPE_AUTHORITY, Value: []byte("bad host")}); !errors.Is(err, proxyproto.ErrMalformedTLV) {
+		t.Fatalf("expected %v, got %v", proxyproto.ErrMalformedTLV, err)
+	}
+
+	tlvs := []proxyproto.TLV{
+		{Type: proxyproto.PP2_TYPE_AUTHORITY, Value: []byte("bad host")},
+		{Type: proxyproto.PP2_TYPE_AUTHORITY, Value: []byte("example.com")},
+	}
+	if host, ok := FindAuthority(tlvs); !ok || host != "example.com" {
+		t.Fatalf("expected example.com, got %q, %v", host, ok)
+	}
+	if _, ok := FindAuthority(tlvs[:1]); ok {
+		t.Fatal("expected malformed authority to be skipped")
+	}
+}
+
+func TestSetAuthority(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1000}
+	header := proxyproto.HeaderProxyFromAddrs(2, addr, addr)
+	if err := header.SetTLVs([]proxyproto.TLV{
+		{Type: proxyproto.PP2_TYPE_AUTHORITY, Value: []byte("old.example")},
+		{Type: proxyproto.PP2_TYPE_NOOP, Value: make([]byte, 4)},
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := SetAuthority(header, "bad host"); !errors.Is(err, proxyproto.ErrMalformedTLV) {
+		t.Fatalf("expected %v, got %v", proxyproto.ErrMalformedTLV, err)
+	}
+	if err := SetAuthority(header, "new.example"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	tlvs, err := header.TLVs()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(tlvs) != 2 || tlvs[0].Type != proxyproto.PP2_TYPE_NOOP || tlvs[1].Type != proxyproto.PP2_TYPE_AUTHORITY {
+		t.Fatalf("unexpected TLVs %+v", tlvs)
+	}
+	if host, ok := FindAuthority(tlvs); !ok || host != "new.example" {
+		t.Fatalf("expected new.example, got %q, %v", host, ok)
+	}
+	var padding int
+	if err := header.IterateTLVs(func(tlv proxyproto.TLV) bool {
+		if tlv.Type == proxyproto.PP2_TYPE_NOOP {
+			padding = len(tlv.Value)
+		}
+		return true
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if padding != 4 {
+		t.Fatalf("expected padding to be kept, got %d bytes", padding)
+	}
+}
+
+func TestGetCertificateWithAuthority(t *testing.T) {
+	certs := map[string]tls.Certificate{
+		"example.org": testCertificate(t, "example.org"),
+		"sni.example": testCertificate(t, "sni.example"),
+	}
+	authority := []proxyproto.TLV{{Type: proxyproto.PP2_TYPE_AUTHORITY, Value: []byte("example.org")}}
+
+	tests := []struct {
+		name       string
+		tlvs       []proxyproto.TLV
+		sni        string
+		serverName string
+	}{
+		{name: "proxied authority", tlvs: authority, serverName: "example.org"},
+		{name: "SNI", tlvs: authority, sni: "sni.example", serverName: "sni.example"},
+		{name: "neither"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var serverName string
+			config := &tls.Config{
+				GetCertificate: GetCertificateWithAuthority(func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+					serverName = hello.ServerName
+					cert, ok := certs[hello.ServerName]
+					if !ok {
+						cert = certs["example.org"]
+					}
+					return &cert, nil
+				}),
+			}
+			client := &tls.Config{InsecureSkipVerify: true, ServerName: tt.sni}
+			conn, err := proxiedTLSHandshake(t, tt.tlvs, config, client)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if serverName != tt.serverName {
+				t.Fatalf("expected server name %q, got %q", tt.serverName, serverName)
+			}
+			// The connection state keeps the SNI actually sent.
+			if state := conn.ConnectionState(); state.ServerName != tt.sni {
+				t.Fatalf("expected SNI %q, got %q", tt.sni, state.ServerName)
+			}
+		})
+	}
+}
+
+func TestGetConfigForClientWithAuthority(t *testing.T) {
+	cert := testCertificate(t, "example.org")
+	var serverName string
+	config := &tls.Config{
+		GetConfigForClient: GetConfigForClientWithAuthority(func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = ServerName(hello)
+			return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+		}),
+	}
+	authority := []proxyproto.TLV{{Type: proxyproto.PP2_TYPE_AUTHORITY, Value: []byte("example.org")}}
+	if _, err := proxiedTLSHandshake(t, authority, config, &tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if serverName != "example.org" {
+		t.Fatalf("expected server name %q, got %q", "example.org", serverName)
+	}
+}
@@ -0,0 +1,96 @@
+package tlvparse
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// vendorFormats are the known formats of vendor TLVs, with the custom type
+// each vendor uses. A value is deemed to match a format if it decodes
+// successfully, whatever the type of its TLV.
+var vendorFormats = []struct {
+	vendor string
+	typ    proxyproto.PP2Type
+	match  func(value []byte) bool
+}{
+	{"AWS", PP2_TYPE_AWS, func(value []byte) bool {
+		vpce, err := AWSVPCEndpointID(proxyproto.TLV{Type: PP2_TYPE_AWS, Value: value})
+		return err == nil && vpce != ""
+	}},
+	{"GCP", PP2_TYPE_GCP, func(value []byte) bool {
+		_, err := pscConnectionID(proxyproto.TLV{Type: PP2_TYPE_GCP, Value: value})
+		return err == nil
+	}},
+	{"Azure", PP2_TYPE_AZURE, func(value []byte) bool {
+		_, err := azurePrivateEndpointLinkID(proxyproto.TLV{Type: PP2_TYPE_AZURE, Value: value})
+		return err == nil
+	}},
+}
+
+// TLVCollision describes a custom TLV whose value can't be attributed to a
+// single vendor with confidence, see DiagnoseTLVCollisions.
+type TLVCollision struct {
+	TLV proxyproto.TLV
+	// Vendor is the vendor using the type of the TLV, empty if none does.
+	Vendor string
+	// Matches are the vendors whose format the value matches.
+	Matches []string
+}
+
+func (c TLVCollision) String() string {
+	vendor := c.Vendor
+	if vendor == "" {
+		vendor = "no known vendor"
+	}
+	return fmt.Sprintf("TLV type 0x%02x (%s) matches the format of %s", byte(c.TLV.Type), vendor, strings.Join(c.Matches, ", "))
+}
+
+// DiagnoseTLVCollisions reports the custom TLVs, i.e. with a type between
+// PP2_TYPE_MIN_CUSTOM and PP2_TYPE_MAX_CUSTOM, whose value matches the formats
+// of multiple known vendors, or the format of another vendor than the one
+// using the type. Vendors share the custom range, so e.g. a value decoded as
+// a GCP PSC connection ID may have been sent by an AWS load balancer: such
+// values shouldn't be trusted before checking which proxy sent them.
+func DiagnoseTLVCollisions(tlvs []proxyproto.TLV) []TLVCollision {
+	var collisions []TLVCollision
+	for _, tlv := range tlvs {
+		if tlv.Type < proxyproto.PP2_TYPE_MIN_CUSTOM || tlv.Type > proxyproto.PP2_TYPE_MAX_CUSTOM {
+			continue
+		}
+
+		collision := TLVCollision{TLV: tlv}
+		misattributed := false
+		for _, format := range vendorFormats {
+			if format.typ == tlv.Type {
+				collision.Vendor = format.vendor
+			}
+			if format.match(tlv.Value) {
+				collision.Matches = append(collision.Matches, format.vendor)
+				misattributed = misattributed || format.typ != tlv.Type
+			}
+		}
+		if len(collision.Matches) > 1 || misattributed {
+			collisions = append(collisions, collision)
+		}
+	}
+	return collisions
+}
+
+// ReportTLVCollisions returns a Validator which calls report with the header
+// and its TLV collisions, if any, see DiagnoseTLVCollisions. It never rejects
+// headers, diagnosing them only, e.g. to log collisions while tuning a
+// deployment.
+func ReportTLVCollisions(report func(*proxyproto.Header, []TLVCollision)) proxyproto.Validator {
+	return func(header *proxyproto.Header) error {
+		tlvs, err := header.TLVs()
+		if err != nil {
+			return nil
+		}
+		if collisions := DiagnoseTLVCollisions(tlvs); len(collisions) > 0 {
+			report(header, collisions)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,109 @@
+package tlvparse
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+)
+
+func TestDiagnoseTLVCollisions(t *testing.T) {
+	tests := []struct {
+		name        string
+		tlv         proxyproto.TLV
+		wantVendor  string
+		wantMatches []string
+	}{
+		{
+			name: "AWS VPC endpoint ID",
+			tlv:  proxyproto.TLV{Type: PP2_TYPE_AWS, Value: []byte("\x01vpce-08d2bf15fac5001c9")},
+		},
+		{
+			name: "GCP PSC connection ID",
+			tlv:  proxyproto.TLV{Type: PP2_TYPE_GCP, Value: []byte{0xff, 0xff, 0xff, 0xff, 0xc0, 0xa8, 0x64, 0x02}},
+		},
+		{
+			name: "Azure link ID",
+			tlv:  proxyproto.TLV{Type: PP2_TYPE_AZURE, Value: []byte{0x01, 0xc1, 0x45, 0x00, 0x21}},
+		},
+		{
+			name:        "GCP PSC connection ID looking like an AWS VPC endpoint ID",
+			tlv:         proxyproto.TLV{Type: PP2_TYPE_GCP, Value: []byte("\x01vpce-ab")},
+			wantVendor:  "GCP",
+			wantMatches: []string{"AWS", "GCP"},
+		},
+		{
+			name:        "Azure link ID looking like an AWS VPC endpoint ID",
+			tlv:         proxyproto.TLV{Type: PP2_TYPE_AZURE, Value: []byte("\x01abcd")},
+			wantVendor:  "Azure",
+			wantMatches: []string{"AWS", "Azure"},
+		},
+		{
+			name:        "GCP PSC connection ID in the AWS type",
+			tlv:         proxyproto.TLV{Type: PP2_TYPE_AWS, Value: []byte{0xff, 0xff, 0xff, 0xff, 0xc0, 0xa8, 0x64, 0x02}},
+			wantVendor:  "AWS",
+			wantMatches: []string{"GCP"},
+		},
+		{
+			name:        "unknown custom type",
+			tlv:         proxyproto.TLV{Type: 0xE5, Value: []byte{0xff, 0xff, 0xff, 0xff, 0xc0, 0xa8, 0x64, 0x02}},
+			wantMatches: []string{"GCP"},
+		},
+		{
+			name: "unknown custom value",
+			tlv:  proxyproto.TLV{Type: 0xE5, Value: []byte{0x02}},
+		},
+		{
+			name: "experimental type",
+			tlv:  proxyproto.TLV{Type: proxyproto.PP2_TYPE_MIN_EXPERIMENT, Value: []byte("\x01vpce-ab")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collisions := DiagnoseTLVCollisions([]proxyproto.TLV{tt.tlv})
+			if tt.wantMatches == nil {
+				if len(collisions) != 0 {
+					t.Fatalf("DiagnoseTLVCollisions() = %v, want none", collisions)
+				}
+				return
+			}
+			if len(collisions) != 1 {
+				t.Fatalf("DiagnoseTLVCollisions() = %v, want 1 collision", collisions)
+			}
+			if got := collisions[0]; got.Vendor != tt.wantVendor || !reflect.DeepEqual(got.Matches, tt.wantMatches) {
+				t.Errorf("DiagnoseTLVCollisions() = %v, want vendor %q and matches %v", got, tt.wantVendor, tt.wantMatches)
+			}
+		})
+	}
+}
+
+func TestReportTLVCollisions(t *testing.T) {
+	header := proxyproto.HeaderProxyFromAddrs(2,
+		&net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000},
+		&net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000})
+	if err := header.SetTLVs([]proxyproto.TLV{
+		{Type: PP2_TYPE_AWS, Value: []byte("\x01vpce-08d2bf15fac5001c9")},
+		{Type: PP2_TYPE_GCP, Value: []byte("\x01vpce-ab")},
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var reported []TLVCollision
+	validate := ReportTLVCollisions(func(h *proxyproto.Header, collisions []TLVCollision) {
+		if h != header {
+			t.Errorf("Expected the validated header")
+		}
+		reported = collisions
+	})
+	if err := validate(header); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reported) != 1 || reported[0].TLV.Type != PP2_TYPE_GCP {
+		t.Fatalf("Expected the GCP TLV to be reported, got %v", reported)
+	}
+	want := "TLV type 0xe0 (GCP) matches the format of AWS, GCP"
+	if got := reported[0].String(); got != want {
+		t.Fatalf("Expected %q, got %q", want, got)
+	}
+}
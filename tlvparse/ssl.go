@@ -67,8 +67,31 @@ func (s PP2SSL) SSLVersion() (string, bool) {
 
 // SSLCipher returns the US-ASCII string representation of the used TLS cipher and whether that extension exists.
 func (s PP2SSL) SSLCipher() (string, bool) {
+	return s.Cipher()
+}
+
+// Cipher returns the US-ASCII string name of the used cipher, e.g. "ECDHE-RSA-AES128-GCM-SHA256", and whether
+// that extension exists.
+func (s PP2SSL) Cipher() (string, bool) {
+	return s.subTLV(proxyproto.PP2_SUBTYPE_SSL_CIPHER)
+}
+
+// SignatureAlgorithm returns the US-ASCII string name of the algorithm used to sign the certificate presented by
+// the frontend, e.g. "SHA256", and whether that extension exists.
+func (s PP2SSL) SignatureAlgorithm() (string, bool) {
+	return s.subTLV(proxyproto.PP2_SUBTYPE_SSL_SIG_ALG)
+}
+
+// KeyAlgorithm returns the US-ASCII string name of the algorithm used to generate the key of the certificate
+// presented by the frontend, e.g. "RSA2048", and whether that extension exists.
+func (s PP2SSL) KeyAlgorithm() (string, bool) {
+	return s.subTLV(proxyproto.PP2_SUBTYPE_SSL_KEY_ALG)
+}
+
+// subTLV returns the value of the first sub-TLV of the given type as a string and whether it exists.
+func (s PP2SSL) subTLV(t proxyproto.PP2Type) (string, bool) {
 	for _, tlv := range s.TLV {
-		if tlv.Type == proxyproto.PP2_SUBTYPE_SSL_CIPHER {
+		if tlv.Type == t {
 			return string(tlv.Value), true
 		}
 	}
@@ -156,6 +179,21 @@ func SSL(t proxyproto.TLV) (PP2SSL, error) {
 			if len(tlv.Value) == 0 || !isASCII(tlv.Value) {
 				return PP2SSL{}, proxyproto.ErrMalformedTLV
 			}
+		case proxyproto.PP2_SUBTYPE_SSL_SIG_ALG, proxyproto.PP2_SUBTYPE_SSL_KEY_ALG:
+			/*
+				The second level TLV PP2_SUBTYPE_SSL_SIG_ALG provides the US-ASCII string name
+				of the algorithm used to sign the certificate presented by the frontend when
+				the incoming connection was made over an SSL/TLS transport layer, for example
+				"SHA256".
+
+				The second level TLV PP2_SUBTYPE_SSL_KEY_ALG provides the US-ASCII string name
+				of the algorithm used to generate the key of the certificate presented by the
+				frontend when the incoming connection was made over an SSL/TLS transport layer,
+				for example "RSA2048".
+			*/
+			if len(tlv.Value) == 0 || !isASCII(tlv.Value) {
+				return PP2SSL{}, proxyproto.ErrMalformedTLV
+			}
 		}
 	}
 	if !versionFound {
@@ -1,6 +1,7 @@
 package tlvparse
 
 import (
+	"errors"
 	"reflect"
 	"testing"
 
@@ -197,3 +198,68 @@ func TestPP2SSLMarshal(t *testing.T) {
 		t.Errorf("PP2SSL.Marshal() = %#v, want %#v", tlv, want)
 	}
 }
+
+func TestPP2SSLAlgorithms(t *testing.T) {
+	pp2 := PP2SSL{
+		Client: PP2_BITFIELD_CLIENT_SSL,
+		TLV: []proxyproto.TLV{
+			{Type: proxyproto.PP2_SUBTYPE_SSL_VERSION, Value: []byte("TLSv1.3")},
+			{Type: proxyproto.PP2_SUBTYPE_SSL_CIPHER, Value: []byte("TLS_AES_256_GCM_SHA384")},
+			{Type: proxyproto.PP2_SUBTYPE_SSL_SIG_ALG, Value: []byte("RSA-SHA256")},
+			{Type: proxyproto.PP2_SUBTYPE_SSL_KEY_ALG, Value: []byte("RSA2048")},
+		},
+	}
+	tlv, err := pp2.Marshal()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ssl, err := SSL(tlv)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for name, get := range map[string]func() (string, bool){
+		"TLS_AES_256_GCM_SHA384": ssl.Cipher,
+		"RSA-SHA256":             ssl.SignatureAlgorithm,
+		"RSA2048":                ssl.KeyAlgorithm,
+	} {
+		if value, ok := get(); !ok || value != name {
+			t.Fatalf("expected %q, got %q, %v", name, value, ok)
+		}
+	}
+
+	if _, ok := (PP2SSL{}).KeyAlgorithm(); ok {
+		t.Fatal("unexpected key algorithm")
+	}
+
+	pp2.TLV[3].Value = []byte("RSA\xff")
+	if tlv, err = pp2.Marshal(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := SSL(tlv); err != proxyproto.ErrMalformedTLV {
+		t.Fatalf("expected %v, got %v", proxyproto.ErrMalformedTLV, err)
+	}
+}
+
+func TestPP2SSLVerifyError(t *testing.T) {
+	if err := (PP2SSL{Verify: 0}).VerifyError(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	err := PP2SSL{Verify: 10}.VerifyError()
+	var verifyErr SSLVerifyError
+	if !errors.As(err, &verifyErr) {
+		t.Fatalf("expected an SSLVerifyError, got %v", err)
+	}
+	if verifyErr.Name() != "X509_V_ERR_CERT_HAS_EXPIRED" || verifyErr.Reason() != "certificate has expired" {
+		t.Fatalf("unexpected name %q and reason %q", verifyErr.Name(), verifyErr.Reason())
+	}
+	if want := "proxyproto: client certificate verification failed: certificate has expired (X509_V_ERR_CERT_HAS_EXPIRED)"; err.Error() != want {
+		t.Fatalf("expected %q, got %q", want, err.Error())
+	}
+
+	err = PP2SSL{Verify: 1000}.VerifyError()
+	if want := "proxyproto: client certificate verification failed with code 1000"; err.Error() != want {
+		t.Fatalf("expected %q, got %q", want, err.Error())
+	}
+}
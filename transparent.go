@@ -0,0 +1,58 @@
+package proxyproto
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// ErrTransparentUnsupported is returned by DialTransparent on platforms other
+// than Linux.
+var ErrTransparentUnsupported = errors.New("proxyproto: transparent dialing is only available on Linux")
+
+// DialTransparent connects to the address on the named network, binding the
+// connection to the source IP address claimed by the header with the
+// IP_TRANSPARENT socket option, so that the backend sees the original client
+// address without parsing a PROXY header. The source port is picked by the
+// operating system, to avoid colliding with other connections of the client.
+//
+// This requires the CAP_NET_ADMIN capability, and routing the backend replies
+// back through this host, e.g. with TPROXY rules. LOCAL headers dial without
+// spoofing. ErrInvalidAddress is returned for headers of other transport
+// protocols than TCP, and an error wrapping ErrTransparentUnsupported on
+// platforms other than Linux. A nil dialer is equivalent to the zero
+// net.Dialer.
+func DialTransparent(ctx context.Context, dialer *net.Dialer, header *Header, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	if dialer != nil {
+		d = *dialer
+	}
+
+	if header.Command.IsProxy() {
+		sourceAddr, _, ok := header.TCPAddrs()
+		if !ok {
+			return nil, ErrInvalidAddress
+		}
+		d.LocalAddr = &net.TCPAddr{IP: sourceAddr.IP, Zone: sourceAddr.Zone}
+
+		control := d.Control
+		ipv6 := sourceAddr.IP.To4() == nil
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			if control != nil {
+				if err := control(network, address, c); err != nil {
+					return err
+				}
+			}
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = setTransparent(int(fd), ipv6)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+
+	return d.DialContext(ctx, network, address)
+}
@@ -0,0 +1,18 @@
+//go:build linux
+
+package proxyproto
+
+import "syscall"
+
+// IP_TRANSPARENT from linux/in.h and IPV6_TRANSPARENT from linux/in6.h.
+const (
+	ipTransparent   = 19
+	ipv6Transparent = 75
+)
+
+func setTransparent(fd int, ipv6 bool) error {
+	if ipv6 {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, ipv6Transparent, 1)
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, ipTransparent, 1)
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package proxyproto
+
+func setTransparent(fd int, ipv6 bool) error {
+	return ErrTransparentUnsupported
+}
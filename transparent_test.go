@@ -0,0 +1,64 @@
+package proxyproto
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestDialTransparent(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn.RemoteAddr()
+			conn.Close()
+		}
+	}()
+
+	udpHeader := HeaderProxyFromAddrs(2, v4UDPAddr, v4UDPAddr)
+	if _, err := DialTransparent(context.Background(), nil, udpHeader, "tcp", l.Addr().String()); err != ErrInvalidAddress {
+		t.Fatalf("expected %v, got %v", ErrInvalidAddress, err)
+	}
+
+	conn, err := DialTransparent(context.Background(), nil, NewLocalHeader(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+	<-accepted
+
+	// Claim a loopback source address other than the one the connection
+	// would otherwise come from.
+	source := &net.TCPAddr{IP: net.ParseIP("127.0.0.2"), Port: 1000}
+	header := HeaderProxyFromAddrs(2, source, l.Addr())
+	conn, err = DialTransparent(context.Background(), nil, header, "tcp", l.Addr().String())
+	if runtime.GOOS != "linux" {
+		if !errors.Is(err, ErrTransparentUnsupported) {
+			t.Fatalf("expected %v, got %v", ErrTransparentUnsupported, err)
+		}
+		return
+	}
+	if errors.Is(err, syscall.EPERM) {
+		t.Skipf("missing CAP_NET_ADMIN: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+	if addr := (<-accepted).(*net.TCPAddr); !addr.IP.Equal(source.IP) {
+		t.Fatalf("expected connection from %s, got %s", source.IP, addr.IP)
+	}
+}
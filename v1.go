@@ -3,11 +3,10 @@ package proxyproto
 import (
 	"bufio"
 	"bytes"
-	"fmt"
 	"net"
-	"net/netip"
 	"strconv"
-	"strings"
+
+	"github.com/pires/go-proxyproto/core"
 )
 
 const (
@@ -15,15 +14,7 @@ const (
 	separator = " "
 )
 
-func initVersion1() *Header {
-	header := new(Header)
-	header.Version = 1
-	// Command doesn't exist in v1
-	header.Command = PROXY
-	return header
-}
-
-func parseVersion1(reader *bufio.Reader) (*Header, error) {
+func parseVersion1(reader *bufio.Reader, header *Header, maxLen int) error {
 	//The header cannot be more than 107 bytes long. Per spec:
 	//
 	//   (...)
@@ -66,102 +57,58 @@ func parseVersion1(reader *bufio.Reader) (*Header, error) {
 	//
 	// We are subject to such implementation constraints. So we return an error if
 	// the header cannot be fully extracted with a single read of the underlying
-	// reader.
-	buf := make([]byte, 0, 107)
+	// reader. A reader whose buffer is smaller than the header can't read it at
+	// once though, so reading goes on as long as reads fill the buffer.
+	//
+	// The line is rejected once maxLen bytes have been read without finding
+	// its end, whatever the size of the reader's buffer.
+	buf := make([]byte, 0, maxLen)
+	full := reader.Buffered() == reader.Size()
 	for {
+		refill := reader.Buffered() == 0
 		b, err := reader.ReadByte()
 		if err != nil {
-			return nil, fmt.Errorf(ErrCantReadVersion1Header.Error()+": %v", err)
+			return &readError{err: ErrCantReadVersion1Header, cause: err}
+		}
+		if refill {
+			full = reader.Buffered()+1 == reader.Size()
 		}
 		buf = append(buf, b)
 		if b == '\n' {
 			// End of header found
 			break
 		}
-		if len(buf) == 107 {
-			// No delimiter in first 107 bytes
-			return nil, ErrVersion1HeaderTooLong
+		if len(buf) == maxLen {
+			// No delimiter in first maxLen bytes
+			return ErrVersion1HeaderTooLong
 		}
-		if reader.Buffered() == 0 {
+		if reader.Buffered() == 0 && !full {
 			// Header was not buffered in a single read. Since we can't
 			// differentiate between genuine slow writers and DoS agents,
 			// we abort. On healthy networks, this should never happen.
-			return nil, ErrCantReadVersion1Header
+			return ErrCantReadVersion1Header
 		}
 	}
 
-	// Check for CR before LF.
-	if len(buf) < 2 || buf[len(buf)-2] != '\r' {
-		return nil, ErrLineMustEndWithCrlf
-	}
-
-	// Check full signature.
-	tokens := strings.Split(string(buf[:len(buf)-2]), separator)
-
-	// Expect at least 2 tokens: "PROXY" and the transport protocol.
-	if len(tokens) < 2 {
-		return nil, ErrCantReadAddressFamilyAndProtocol
-	}
-
-	// Read address family and protocol
-	var transportProtocol AddressFamilyAndProtocol
-	switch tokens[1] {
-	case "TCP4":
-		transportProtocol = TCPv4
-	case "TCP6":
-		transportProtocol = TCPv6
-	case "UNKNOWN":
-		transportProtocol = UNSPEC // doesn't exist in v1 but fits UNKNOWN
-	default:
-		return nil, ErrCantReadAddressFamilyAndProtocol
-	}
-
-	// Expect 6 tokens only when UNKNOWN is not present.
-	if transportProtocol != UNSPEC && len(tokens) < 6 {
-		return nil, ErrCantReadAddressFamilyAndProtocol
+	h, err := core.ParseV1(buf)
+	if err != nil {
+		return err
 	}
 
-	// When a signature is found, allocate a v1 header with Command set to PROXY.
-	// Command doesn't exist in v1 but set it for other parts of this library
-	// to rely on it for determining connection details.
-	header := initVersion1()
-
-	// Transport protocol has been processed already.
-	header.TransportProtocol = transportProtocol
-
-	// When UNKNOWN, set the command to LOCAL and return early
+	// Command doesn't exist in v1, but the core parser sets it to PROXY, or
+	// LOCAL for UNKNOWN, for other parts of this library to rely on it for
+	// determining connection details.
+	header.Version = 1
+	header.Command = ProtocolVersionAndCommand(h.Command)
+	header.TransportProtocol = AddressFamilyAndProtocol(h.TransportProtocol)
 	if header.TransportProtocol == UNSPEC {
-		header.Command = LOCAL
-		return header, nil
+		return nil
 	}
 
-	// Otherwise, continue to read addresses and ports
-	sourceIP, err := parseV1IPAddress(header.TransportProtocol, tokens[2])
-	if err != nil {
-		return nil, err
-	}
-	destIP, err := parseV1IPAddress(header.TransportProtocol, tokens[3])
-	if err != nil {
-		return nil, err
-	}
-	sourcePort, err := parseV1PortNumber(tokens[4])
-	if err != nil {
-		return nil, err
-	}
-	destPort, err := parseV1PortNumber(tokens[5])
-	if err != nil {
-		return nil, err
-	}
-	header.SourceAddr = &net.TCPAddr{
-		IP:   sourceIP,
-		Port: sourcePort,
-	}
-	header.DestinationAddr = &net.TCPAddr{
-		IP:   destIP,
-		Port: destPort,
-	}
+	header.SourceAddr = setIPAddr(header.SourceAddr, header.TransportProtocol, h.SourceIP.AsSlice(), int(h.SourcePort))
+	header.DestinationAddr = setIPAddr(header.DestinationAddr, header.TransportProtocol, h.DestinationIP.AsSlice(), int(h.DestinationPort))
 
-	return header, nil
+	return nil
 }
 
 func (header *Header) formatVersion1() ([]byte, error) {
@@ -214,30 +161,35 @@ func (header *Header) formatVersion1() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func parseV1PortNumber(portStr string) (int, error) {
-	port, err := strconv.Atoi(portStr)
-	if err != nil || port < 0 || port > 65535 {
-		return 0, ErrInvalidPortNumber
+// lenVersion1 returns the length of the header rendered by formatVersion1.
+func (header *Header) lenVersion1() (int, error) {
+	switch header.TransportProtocol {
+	case TCPv4, TCPv6:
+	default:
+		return len("PROXY UNKNOWN" + crlf), nil
 	}
-	return port, nil
-}
 
-func parseV1IPAddress(protocol AddressFamilyAndProtocol, addrStr string) (net.IP, error) {
-	addr, err := netip.ParseAddr(addrStr)
-	if err != nil {
-		return nil, ErrInvalidAddress
+	sourceAddr, sourceOK := header.SourceAddr.(*net.TCPAddr)
+	destAddr, destOK := header.DestinationAddr.(*net.TCPAddr)
+	if !sourceOK || !destOK {
+		return 0, ErrInvalidAddress
 	}
 
-	switch protocol {
-	case TCPv4:
-		if addr.Is4() {
-			return net.IP(addr.AsSlice()), nil
-		}
-	case TCPv6:
-		if addr.Is6() || addr.Is4In6() {
-			return net.IP(addr.AsSlice()), nil
-		}
+	sourceIP, destIP := sourceAddr.IP, destAddr.IP
+	if header.TransportProtocol == TCPv4 {
+		sourceIP = sourceIP.To4()
+		destIP = destIP.To4()
+	} else {
+		sourceIP = sourceIP.To16()
+		destIP = destIP.To16()
+	}
+	if sourceIP == nil || destIP == nil {
+		return 0, ErrInvalidAddress
 	}
 
-	return nil, ErrInvalidAddress
+	// "PROXY TCPx <src> <dst> <srcport> <dstport>\r\n"
+	return len(SIGV1) + 5*len(separator) + len("TCPx") +
+		len(sourceIP.String()) + len(destIP.String()) +
+		len(strconv.Itoa(sourceAddr.Port)) + len(strconv.Itoa(destAddr.Port)) +
+		len(crlf), nil
 }
@@ -247,12 +247,59 @@ func TestParseVersion1Overflow(t *testing.T) {
 	reader := bufio.NewReader(ds)
 	bufSize := reader.Size()
 	ds.NBytes = bufSize * 16
-	_, _ = parseVersion1(reader)
+	_ = parseVersion1(reader, new(Header), V1MaxLen)
 	if ds.NRead > bufSize {
 		t.Fatalf("read: expected max %d bytes, actual %d\n", bufSize, ds.NRead)
 	}
 }
 
+func TestReadV1MaxLen(t *testing.T) {
+	header := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"
+	// The longest header allowed per spec.
+	longest := "PROXY UNKNOWN " + strings.Repeat("f", V1MaxLen-len("PROXY UNKNOWN \r\n")) + "\r\n"
+
+	var cases = []struct {
+		name        string
+		data        string
+		bufSize     int
+		opts        []ReadOption
+		expectedErr error
+	}{
+		{"within the default limit", header, 4096, nil, nil},
+		{"longest", longest, 4096, nil, nil},
+		{"too long", longest[:V1MaxLen-2] + "f\r\n", 4096, nil, ErrVersion1HeaderTooLong},
+		{"smaller buffer", fixtureTCP6V1, 16, nil, nil},
+		{"too long with a smaller buffer", longest[:V1MaxLen-2] + "f\r\n", 16, nil, ErrVersion1HeaderTooLong},
+		{"within a lower limit", header, 4096, []ReadOption{WithV1MaxLen(len(header))}, nil},
+		{"over a lower limit", header, 4096, []ReadOption{WithV1MaxLen(len(header) - 1)}, ErrVersion1HeaderTooLong},
+		{"limit over the spec's", longest[:V1MaxLen-2] + "f\r\n", 4096, []ReadOption{WithV1MaxLen(2 * V1MaxLen)}, ErrVersion1HeaderTooLong},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			reader := bufio.NewReaderSize(strings.NewReader(tc.data), tc.bufSize)
+			if _, err := ReadWith(reader, tc.opts...); err != tc.expectedErr {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestConnV1MaxLen(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		_, _ = client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"))
+	}()
+
+	conn := NewConn(server, WithReadOptions(WithV1MaxLen(20)))
+	if err := conn.HeaderError(); err != ErrVersion1HeaderTooLong {
+		t.Fatalf("Expected error %v, got %v", ErrVersion1HeaderTooLong, err)
+	}
+}
+
 func listen(t *testing.T) *Listener {
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
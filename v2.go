@@ -7,6 +7,8 @@ import (
 	"errors"
 	"io"
 	"net"
+
+	"github.com/pires/go-proxyproto/core"
 )
 
 var (
@@ -37,130 +39,51 @@ var (
 	errUint16Overflow = errors.New("proxyproto: uint16 overflow")
 )
 
-type _ports struct {
-	SrcPort uint16
-	DstPort uint16
-}
-
-type _addr4 struct {
-	Src     [4]byte
-	Dst     [4]byte
-	SrcPort uint16
-	DstPort uint16
-}
-
-type _addr6 struct {
-	Src [16]byte
-	Dst [16]byte
-	_ports
-}
-
-type _addrUnix struct {
-	Src [108]byte
-	Dst [108]byte
-}
-
-func parseVersion2(reader *bufio.Reader) (header *Header, err error) {
-	// Skip first 12 bytes (signature)
-	for i := 0; i < 12; i++ {
-		if _, err = reader.ReadByte(); err != nil {
-			return nil, ErrCantReadProtocolVersionAndCommand
-		}
-	}
-
-	header = new(Header)
+func parseVersion2(reader *bufio.Reader, header *Header) error {
+	// Read the fixed-size preamble at once: the signature, the protocol
+	// version and command, the address family and protocol, and the length.
+	// It's peeked rather than copied out, which would allocate.
+	preamble, peekErr := reader.Peek(core.V2PreambleLen)
+	h, length, err := core.ParseV2Preamble(preamble)
+	_, _ = reader.Discard(len(preamble))
 	header.Version = 2
-
-	// Read the 13th byte, protocol version and command
-	b13, err := reader.ReadByte()
-	if err != nil {
-		return nil, ErrCantReadProtocolVersionAndCommand
-	}
-	header.Command = ProtocolVersionAndCommand(b13)
-	if _, ok := supportedCommand[header.Command]; !ok {
-		return nil, ErrUnsupportedProtocolVersionAndCommand
-	}
-
-	// Read the 14th byte, address family and protocol
-	b14, err := reader.ReadByte()
+	header.Command = ProtocolVersionAndCommand(h.Command)
+	header.TransportProtocol = AddressFamilyAndProtocol(h.TransportProtocol)
 	if err != nil {
-		return nil, ErrCantReadAddressFamilyAndProtocol
-	}
-	header.TransportProtocol = AddressFamilyAndProtocol(b14)
-	// UNSPEC is only supported when LOCAL is set.
-	if header.TransportProtocol == UNSPEC && header.Command != LOCAL {
-		return nil, ErrUnsupportedAddressFamilyAndProtocol
+		return withReadCause(err, peekErr)
 	}
 
-	// Make sure there are bytes available as specified in length
-	var length uint16
-	if err := binary.Read(io.LimitReader(reader, 2), binary.BigEndian, &length); err != nil {
-		return nil, ErrCantReadLength
-	}
-	if !header.validateLength(length) {
-		return nil, ErrInvalidLength
+	// Then read exactly the rest of the header, which the bufio.Reader may
+	// not be able to buffer at once, into the TLVs buffer. The addresses are
+	// decoded from its beginning, which is then dropped.
+	payload := growBytes(header.rawTLVs, length) // Reuse or allocate minimum size slice
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return withReadCause(ErrInvalidLength, err)
 	}
-
-	// Return early if the length is zero, which means that
-	// there's no address information and TLVs present for UNSPEC.
-	if length == 0 {
-		return header, nil
+	if err := h.ParseV2Payload(payload); err != nil {
+		return err
 	}
 
-	if _, err := reader.Peek(int(length)); err != nil {
-		return nil, ErrInvalidLength
+	// Set addresses and ports for protocols other than UNSPEC, reusing the
+	// previous ones if possible. Address information is ignored for UNSPEC.
+	switch {
+	case header.TransportProtocol.IsIPv4():
+		src, dst := h.SourceIP.As4(), h.DestinationIP.As4()
+		header.SourceAddr = setIPAddr(header.SourceAddr, header.TransportProtocol, src[:], int(h.SourcePort))
+		header.DestinationAddr = setIPAddr(header.DestinationAddr, header.TransportProtocol, dst[:], int(h.DestinationPort))
+	case header.TransportProtocol.IsIPv6():
+		src, dst := h.SourceIP.As16(), h.DestinationIP.As16()
+		header.SourceAddr = setIPAddr(header.SourceAddr, header.TransportProtocol, src[:], int(h.SourcePort))
+		header.DestinationAddr = setIPAddr(header.DestinationAddr, header.TransportProtocol, dst[:], int(h.DestinationPort))
+	case header.TransportProtocol.IsUnix():
+		header.SourceAddr = setUnixAddr(header.SourceAddr, header.TransportProtocol, h.SourceUnix)
+		header.DestinationAddr = setUnixAddr(header.DestinationAddr, header.TransportProtocol, h.DestinationUnix)
 	}
 
-	// Length-limited reader for payload section
-	payloadReader := io.LimitReader(reader, int64(length)).(*io.LimitedReader)
-
-	// Read addresses and ports for protocols other than UNSPEC.
-	// Ignore address information for UNSPEC, and skip straight to read TLVs,
-	// since the length is greater than zero.
-	if header.TransportProtocol != UNSPEC {
-		if header.TransportProtocol.IsIPv4() {
-			var addr _addr4
-			if err := binary.Read(payloadReader, binary.BigEndian, &addr); err != nil {
-				return nil, ErrInvalidAddress
-			}
-			header.SourceAddr = newIPAddr(header.TransportProtocol, addr.Src[:], addr.SrcPort)
-			header.DestinationAddr = newIPAddr(header.TransportProtocol, addr.Dst[:], addr.DstPort)
-		} else if header.TransportProtocol.IsIPv6() {
-			var addr _addr6
-			if err := binary.Read(payloadReader, binary.BigEndian, &addr); err != nil {
-				return nil, ErrInvalidAddress
-			}
-			header.SourceAddr = newIPAddr(header.TransportProtocol, addr.Src[:], addr.SrcPort)
-			header.DestinationAddr = newIPAddr(header.TransportProtocol, addr.Dst[:], addr.DstPort)
-		} else if header.TransportProtocol.IsUnix() {
-			var addr _addrUnix
-			if err := binary.Read(payloadReader, binary.BigEndian, &addr); err != nil {
-				return nil, ErrInvalidAddress
-			}
+	// Keep the bytes left for the optional Type-Length-Value vector
+	header.rawTLVs = payload[:copy(payload, h.TLVs)]
 
-			network := "unix"
-			if header.TransportProtocol.IsDatagram() {
-				network = "unixgram"
-			}
-
-			header.SourceAddr = &net.UnixAddr{
-				Net:  network,
-				Name: parseUnixName(addr.Src[:]),
-			}
-			header.DestinationAddr = &net.UnixAddr{
-				Net:  network,
-				Name: parseUnixName(addr.Dst[:]),
-			}
-		}
-	}
-
-	// Copy bytes for optional Type-Length-Value vector
-	header.rawTLVs = make([]byte, payloadReader.N) // Allocate minimum size slice
-	if _, err = io.ReadFull(payloadReader, header.rawTLVs); err != nil && err != io.EOF {
-		return nil, err
-	}
-
-	return header, nil
+	return nil
 }
 
 func (header *Header) formatVersion2() ([]byte, error) {
@@ -196,7 +119,11 @@ func (header *Header) formatVersion2() ([]byte, error) {
 			addrSrc = sourceIP.To16()
 			addrDst = destIP.To16()
 		} else if header.TransportProtocol.IsUnix() {
-			buf.Write(lengthUnixBytes)
+			hdrLen, err := addTLVLen(lengthUnixBytes, len(header.rawTLVs))
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(hdrLen)
 			sourceAddr, destAddr, ok := header.UnixAddrs()
 			if !ok {
 				return nil, ErrInvalidAddress
@@ -229,17 +156,53 @@ func (header *Header) formatVersion2() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func (header *Header) validateLength(length uint16) bool {
-	if header.TransportProtocol.IsIPv4() {
-		return length >= lengthV4
-	} else if header.TransportProtocol.IsIPv6() {
-		return length >= lengthV6
-	} else if header.TransportProtocol.IsUnix() {
-		return length >= lengthUnix
-	} else if header.TransportProtocol.IsUnspec() {
-		return length >= lengthUnspec
+// lenVersion2 returns the length of the header rendered by formatVersion2.
+func (header *Header) lenVersion2() (int, error) {
+	var length uint16
+	switch {
+	case header.TransportProtocol.IsUnspec():
+		length = lengthUnspec
+	case header.TransportProtocol.IsIPv4():
+		sourceIP, destIP, _ := header.IPs()
+		if sourceIP.To4() == nil || destIP.To4() == nil {
+			return 0, ErrInvalidAddress
+		}
+		length = lengthV4
+	case header.TransportProtocol.IsIPv6():
+		sourceIP, destIP, _ := header.IPs()
+		if sourceIP.To16() == nil || destIP.To16() == nil {
+			return 0, ErrInvalidAddress
+		}
+		length = lengthV6
+	case header.TransportProtocol.IsUnix():
+		if _, _, ok := header.UnixAddrs(); !ok {
+			return 0, ErrInvalidAddress
+		}
+		length = lengthUnix
+	default:
+		return 0, ErrInvalidAddress
+	}
+
+	payloadLen := int(length) + len(header.rawTLVs)
+	if len(header.rawTLVs) > 0 && payloadLen >= 1<<16 {
+		return 0, errUint16Overflow
+	}
+	return len(SIGV2) + 4 + payloadLen, nil
+}
+
+// addressesLenVersion2 returns the length of the addresses of version 2
+// headers with the transport protocol, which adds to the length of the TLVs.
+func addressesLenVersion2(transport AddressFamilyAndProtocol) uint16 {
+	switch {
+	case transport.IsIPv4():
+		return lengthV4
+	case transport.IsIPv6():
+		return lengthV6
+	case transport.IsUnix():
+		return lengthUnix
+	default:
+		return lengthUnspec
 	}
-	return false
 }
 
 // addTLVLen adds the length of the TLV to the header length or errors on uint16 overflow.
@@ -257,16 +220,54 @@ func addTLVLen(cur []byte, tlvLen int) ([]byte, error) {
 	return a, nil
 }
 
-func newIPAddr(transport AddressFamilyAndProtocol, ip net.IP, port uint16) net.Addr {
+// setIPAddr returns an address for the transport protocol, reusing addr if it
+// has the right type, so that headers can be read into a reused Header
+// without allocating.
+func setIPAddr(addr net.Addr, transport AddressFamilyAndProtocol, ip net.IP, port int) net.Addr {
 	if transport.IsStream() {
-		return &net.TCPAddr{IP: ip, Port: int(port)}
+		tcpAddr, ok := addr.(*net.TCPAddr)
+		if !ok {
+			tcpAddr = new(net.TCPAddr)
+		}
+		*tcpAddr = net.TCPAddr{IP: append(tcpAddr.IP[:0], ip...), Port: port}
+		return tcpAddr
 	} else if transport.IsDatagram() {
-		return &net.UDPAddr{IP: ip, Port: int(port)}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			udpAddr = new(net.UDPAddr)
+		}
+		*udpAddr = net.UDPAddr{IP: append(udpAddr.IP[:0], ip...), Port: port}
+		return udpAddr
 	} else {
 		return nil
 	}
 }
 
+func setUnixAddr(addr net.Addr, transport AddressFamilyAndProtocol, name []byte) net.Addr {
+	network := "unix"
+	if transport.IsDatagram() {
+		network = "unixgram"
+	}
+	unixAddr, ok := addr.(*net.UnixAddr)
+	if !ok {
+		unixAddr = new(net.UnixAddr)
+	}
+	unixAddr.Net = network
+	// Comparing doesn't allocate, so the name is only copied if it changed.
+	if unixAddr.Name != string(name) {
+		unixAddr.Name = string(name)
+	}
+	return unixAddr
+}
+
+// growBytes returns a slice of length n, reusing the capacity of b if possible.
+func growBytes(b []byte, n int) []byte {
+	if cap(b) < n {
+		return make([]byte, n)
+	}
+	return b[:n]
+}
+
 func parseUnixName(b []byte) string {
 	i := bytes.IndexByte(b, 0)
 	if i < 0 {
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	iorand "crypto/rand"
 	"encoding/binary"
+	"io"
 	"math/rand"
 	"reflect"
 	"testing"
@@ -108,6 +109,16 @@ var invalidParseV2Tests = []struct {
 		reader:        newBufioReader(append(SIGV2, byte(PROXY), invalidRune)),
 		expectedError: ErrCantReadLength,
 	},
+	{
+		desc:          "command proxy but unsupported inet protocol",
+		reader:        newBufioReader(append(append(SIGV2, byte(PROXY), byte(0x15)), fixtureIPv4V2...)),
+		expectedError: ErrUnsupportedAddressFamilyAndProtocol,
+	},
+	{
+		desc:          "command proxy but unsupported protocol and no length",
+		reader:        newBufioReader(append(append(SIGV2, byte(PROXY), byte(0x01)), lengthEmptyBytes...)),
+		expectedError: ErrUnsupportedAddressFamilyAndProtocol,
+	},
 	{
 		desc:          "TCPv4 but no length",
 		reader:        newBufioReader(append(SIGV2, byte(PROXY), byte(TCPv4))),
@@ -143,6 +154,11 @@ var invalidParseV2Tests = []struct {
 		reader:        newBufioReader(append(append(append(SIGV2, byte(PROXY), byte(TCPv6)), lengthV6Bytes...), fixtureIPv4Address...)),
 		expectedError: ErrInvalidLength,
 	},
+	{
+		desc:          "command local with unknown inet family and no length",
+		reader:        newBufioReader(append(append(SIGV2, byte(LOCAL), byte(0x41)), lengthEmptyBytes...)),
+		expectedError: ErrInvalidLength,
+	},
 	{
 		desc:          "unspec length greater than zero but no TLVs",
 		reader:        newBufioReader(append(append(SIGV2, byte(LOCAL), byte(UNSPEC)), fixtureUnspecTLV[:2]...)),
@@ -409,6 +425,49 @@ func TestParseV2Padded(t *testing.T) {
 	}
 }
 
+func TestParseV2LargerThanBuffer(t *testing.T) {
+	header := &Header{
+		Version:           2,
+		Command:           PROXY,
+		TransportProtocol: TCPv4,
+		SourceAddr:        v4addr,
+		DestinationAddr:   v4addr,
+	}
+	if err := header.SetTLVs([]TLV{{Type: PP2_TYPE_AUTHORITY, Value: bytes.Repeat([]byte("a"), 1000)}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	raw, err := header.Format()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The header doesn't fit in the bufio.Reader's buffer, nor is it
+	// written at once.
+	r, w := io.Pipe()
+	go func() {
+		for _, b := range [][]byte{raw[:10], raw[10:500], raw[500:], arbitraryTailBytes} {
+			_, _ = w.Write(b)
+		}
+		w.Close()
+	}()
+	reader := bufio.NewReaderSize(r, 64)
+
+	newHeader, err := Read(reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !newHeader.EqualsTo(header) {
+		t.Fatalf("expected %#v, actual %#v", header, newHeader)
+	}
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(rest, arbitraryTailBytes) {
+		t.Fatalf("expected %#v, actual %#v", arbitraryTailBytes, rest)
+	}
+}
+
 func TestV2EqualsToTLV(t *testing.T) {
 	eHdr := &Header{
 		Version:           2,
@@ -508,6 +567,93 @@ func TestV2TLVFormatTooLargeTLV(t *testing.T) {
 	}
 }
 
+// v2AllocHeaders are the headers whose parsing must not allocate when reusing
+// the header, see TestParseV2Allocs.
+var v2AllocHeaders = []struct {
+	desc   string
+	header *Header
+}{
+	{"TCPv4", &Header{Version: 2, Command: PROXY, TransportProtocol: TCPv4, SourceAddr: v4addr, DestinationAddr: v4addr}},
+	{"TCPv6", &Header{Version: 2, Command: PROXY, TransportProtocol: TCPv6, SourceAddr: v6addr, DestinationAddr: v6addr}},
+	{"UnixStream", &Header{Version: 2, Command: PROXY, TransportProtocol: UnixStream, SourceAddr: unixStreamAddr, DestinationAddr: unixStreamAddr}},
+	{"TCPv4 with TLVs", &Header{Version: 2, Command: PROXY, TransportProtocol: TCPv4, SourceAddr: v4addr, DestinationAddr: v4addr, rawTLVs: fixtureTLV}},
+	{"LOCAL", &Header{Version: 2, Command: LOCAL, TransportProtocol: UNSPEC}},
+}
+
+func TestParseV2Allocs(t *testing.T) {
+	for _, tt := range v2AllocHeaders {
+		t.Run(tt.desc, func(t *testing.T) {
+			raw, err := tt.header.Format()
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			r := bytes.NewReader(raw)
+			reader := bufio.NewReader(r)
+			var header Header
+			allocs := testing.AllocsPerRun(100, func() {
+				r.Reset(raw)
+				reader.Reset(r)
+				if err := ReadInto(reader, &header); err != nil {
+					t.Fatalf("err: %v", err)
+				}
+			})
+			if allocs > 1 {
+				t.Fatalf("expected at most 1 allocation per header, got %v", allocs)
+			}
+			if !header.EqualsTo(tt.header) {
+				t.Fatalf("expected %#v, actual %#v", tt.header, &header)
+			}
+		})
+	}
+}
+
+func BenchmarkReadV2(b *testing.B) {
+	for _, tt := range v2AllocHeaders {
+		b.Run(tt.desc, func(b *testing.B) {
+			raw, err := tt.header.Format()
+			if err != nil {
+				b.Fatalf("err: %v", err)
+			}
+			r := bytes.NewReader(raw)
+			reader := bufio.NewReader(r)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(raw)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r.Reset(raw)
+				reader.Reset(r)
+				if _, err := Read(reader); err != nil {
+					b.Fatalf("err: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReadIntoV2(b *testing.B) {
+	for _, tt := range v2AllocHeaders {
+		b.Run(tt.desc, func(b *testing.B) {
+			raw, err := tt.header.Format()
+			if err != nil {
+				b.Fatalf("err: %v", err)
+			}
+			r := bytes.NewReader(raw)
+			reader := bufio.NewReader(r)
+			var header Header
+			b.ReportAllocs()
+			b.SetBytes(int64(len(raw)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r.Reset(raw)
+				reader.Reset(r)
+				if err := ReadInto(reader, &header); err != nil {
+					b.Fatalf("err: %v", err)
+				}
+			}
+		})
+	}
+}
+
 func newBufioReader(b []byte) *bufio.Reader {
 	return bufio.NewReader(bytes.NewReader(b))
 }
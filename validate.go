@@ -0,0 +1,410 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"sync/atomic"
+
+	"github.com/pires/go-proxyproto/core"
+)
+
+var (
+	ErrNotProxyCommand         = errors.New("proxyproto: header command is not PROXY")
+	ErrUnexpectedAddressFamily = errors.New("proxyproto: unexpected address family and protocol")
+	ErrMissingTLV              = errors.New("proxyproto: required TLV is missing")
+	ErrInvalidCRC32c           = errors.New("proxyproto: CRC32c checksum mismatch")
+	ErrDuplicateTLV            = errors.New("proxyproto: duplicate TLV")
+	ErrSpoofedSourceAddress    = errors.New("proxyproto: claimed source address can't be a client's")
+	ErrDestinationMismatch     = errors.New("proxyproto: destination address doesn't match the local address")
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CRC32cAction defines what happens to headers whose PP2_TYPE_CRC32C checksum
+// doesn't match, see WithCRC32cCheck.
+type CRC32cAction int
+
+const (
+	// CRC32cIgnore doesn't verify checksums.
+	CRC32cIgnore CRC32cAction = iota
+	// CRC32cReject rejects headers with ErrInvalidCRC32c, or ErrMalformedTLV
+	// if the checksum TLV is malformed.
+	CRC32cReject
+	// CRC32cStrip removes the PP2_TYPE_CRC32C TLV from headers and accepts
+	// them.
+	CRC32cStrip
+	// CRC32cLogOnly accepts headers as is, only reporting the mismatch. It
+	// never rejects headers, not even ones whose checksum can't be verified
+	// because their TLVs are malformed.
+	CRC32cLogOnly
+)
+
+// bogonNets are the ranges which can't be the address of a client, besides
+// unspecified, loopback, multicast and link-local addresses, see
+// RejectSpoofedSource.
+var bogonNets = mustParseCIDRs(
+	"0.0.0.0/8",       // "this network"
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // documentation
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"240.0.0.0/4",     // reserved, including broadcast
+	"100::/64",        // discard-only
+	"2001:db8::/32",   // documentation
+	"::/96",           // deprecated IPv4-compatible
+)
+
+// ValidateAll returns a Validator which runs the given validators in order
+// and returns the first error, if any. Nil validators are skipped.
+func ValidateAll(validators ...Validator) Validator {
+	return func(header *Header) error {
+		for _, v := range validators {
+			if v == nil {
+				continue
+			}
+			if err := v(header); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Validate runs the given validators on this header in order and returns the
+// first error, if any, like ValidateAll. It allows validating headers read
+// with Read, outside of a Listener or Conn.
+func (header *Header) Validate(validators ...Validator) error {
+	return ValidateAll(validators...)(header)
+}
+
+// RequireProxyCommand is a Validator which rejects headers not carrying the
+// PROXY command, i.e. v2 LOCAL headers and v1 UNKNOWN headers.
+func RequireProxyCommand(header *Header) error {
+	if !header.Command.IsProxy() {
+		return ErrNotProxyCommand
+	}
+	return nil
+}
+
+// RequireAddressFamily returns a Validator which rejects headers whose address
+// family and transport protocol is not one of fams, e.g. TCPv4 and TCPv6.
+func RequireAddressFamily(fams ...AddressFamilyAndProtocol) Validator {
+	return func(header *Header) error {
+		for _, fam := range fams {
+			if header.TransportProtocol == fam {
+				return nil
+			}
+		}
+		return ErrUnexpectedAddressFamily
+	}
+}
+
+// RequireTLV returns a Validator which rejects headers not carrying a TLV of
+// the given type.
+func RequireTLV(t PP2Type) Validator {
+	return func(header *Header) error {
+		tlvs, err := header.TLVs()
+		if err != nil {
+			return err
+		}
+		for _, tlv := range tlvs {
+			if tlv.Type == t {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: type 0x%02x", ErrMissingTLV, byte(t))
+	}
+}
+
+// RequireCRC32c is a Validator which rejects headers not carrying a
+// PP2_TYPE_CRC32C TLV, or whose checksum doesn't match the header, see
+// section 2.2.3 of the spec. As validators only get the parsed header, the
+// checksum is computed over the header formatted again, see WithCRC32cCheck
+// and WithRecordHeader to verify it over the bytes received instead.
+func RequireCRC32c(header *Header) error {
+	found, err := header.verifyCRC32c(nil)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%w: type 0x%02x", ErrMissingTLV, byte(PP2_TYPE_CRC32C))
+	}
+	return nil
+}
+
+// verifyCRC32c checks the checksum carried by the PP2_TYPE_CRC32C TLV, if
+// any. It reports whether the TLV was found, and returns ErrInvalidCRC32c if
+// the checksum doesn't match. The checksum is computed over raw, the bytes of
+// the header as received, e.g. recorded by a Conn, if not nil, and over the
+// formatted header otherwise, which only matches the bytes received if the
+// header round-trips, e.g. not for UNIX addresses with bytes after their NUL.
+func (header *Header) verifyCRC32c(raw []byte) (bool, error) {
+	if header.Version != 2 {
+		return false, nil
+	}
+
+	var buf []byte
+	if raw != nil {
+		buf = append(buf, raw...)
+	} else {
+		var err error
+		if buf, err = header.Format(); err != nil {
+			return false, err
+		}
+	}
+	h, length, err := core.ParseV2Preamble(buf)
+	if err != nil {
+		return false, err
+	}
+	if len(buf) < core.V2PreambleLen+length {
+		return false, ErrInvalidLength
+	}
+	buf = buf[:core.V2PreambleLen+length]
+	if err := h.ParseV2Payload(buf[core.V2PreambleLen:]); err != nil {
+		return false, err
+	}
+
+	// Locate the TLV in the TLV block, which ends the header.
+	offset := len(buf) - len(h.TLVs)
+	found, malformed := false, false
+	if err := core.IterateTLVs(h.TLVs, func(t byte, value []byte) bool {
+		if PP2Type(t) != PP2_TYPE_CRC32C {
+			offset += 3 + len(value)
+			return true
+		}
+		found, malformed = true, len(value) != 4
+		offset += 3
+		return false
+	}); err != nil {
+		return false, err
+	}
+	if !found {
+		return false, nil
+	}
+	if malformed {
+		return true, ErrMalformedTLV
+	}
+
+	// The checksum is computed over the whole header with the checksum field
+	// set to zero.
+	expected := binary.BigEndian.Uint32(buf[offset : offset+4])
+	copy(buf[offset:offset+4], []byte{0, 0, 0, 0})
+	if crc32.Checksum(buf, crc32cTable) != expected {
+		return true, ErrInvalidCRC32c
+	}
+
+	return true, nil
+}
+
+// stripTLVs removes the TLVs of type t from the header.
+func (header *Header) stripTLVs(t PP2Type) error {
+	var rawTLVs []byte
+	if err := core.IterateTLVs(header.rawTLVs, func(typ byte, value []byte) bool {
+		if PP2Type(typ) != t {
+			rawTLVs = append(rawTLVs, typ, byte(len(value)>>8), byte(len(value)))
+			rawTLVs = append(rawTLVs, value...)
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	header.rawTLVs = rawTLVs
+	header.tlvs = atomic.Value{}
+	return nil
+}
+
+// RejectSpoofedSource returns a Validator which rejects headers claiming a
+// source address which can't be the address of a client, a common indicator
+// of spoofed headers or misconfigured proxies, with ErrSpoofedSourceAddress:
+// unspecified, loopback, multicast, link-local and reserved addresses, e.g.
+// documentation ranges, as well as own, e.g. the addresses a listener is
+// bound to. The ports of own are only compared if they're not zero, and
+// unspecified IPs in own are ignored, so listeners bound to all interfaces
+// should pass the address of each interface. Private addresses are allowed,
+// since clients behind proxies commonly have such addresses. Headers without
+// IP addresses, e.g. LOCAL ones, are accepted.
+func RejectSpoofedSource(own ...net.Addr) Validator {
+	return func(header *Header) error {
+		if !header.Command.IsProxy() {
+			return nil
+		}
+		sourceIP, _, ok := header.IPs()
+		if !ok {
+			return nil
+		}
+		if reason := bogonReason(sourceIP); reason != "" {
+			return fmt.Errorf("%w: %s address %s", ErrSpoofedSourceAddress, reason, sourceIP)
+		}
+		sourcePort, _, _ := header.Ports()
+		for _, addr := range own {
+			ip, port := addrIPPort(addr)
+			if ip == nil || ip.IsUnspecified() || !ip.Equal(sourceIP) || (port != 0 && port != sourcePort) {
+				continue
+			}
+			return fmt.Errorf("%w: own address %s", ErrSpoofedSourceAddress, addr)
+		}
+		return nil
+	}
+}
+
+// CheckDestination returns a callback for OnHeaderParsed, or the
+// Listener.OnHeaderParsed field, which compares the destination address and
+// port claimed by headers with the local address of the connection, catching
+// proxies forwarding traffic to the wrong backend or rewriting destinations
+// incorrectly. On mismatch, an error wrapping ErrDestinationMismatch is
+// passed to onMismatch, along with the header and the connection, and what it
+// returns is returned, so that mismatches can e.g. be logged and accepted by
+// returning nil. If onMismatch is nil, the error is returned and the header is
+// rejected. Headers without IP addresses, e.g. LOCAL ones, and connections
+// whose local address isn't an IP one are accepted. This only suits proxies
+// preserving the destination, unlike e.g. load balancers claiming their own
+// address as destination.
+func CheckDestination(onMismatch func(err error, header *Header, conn net.Conn) error) func(*Header, net.Conn) error {
+	return func(header *Header, conn net.Conn) error {
+		if !header.Command.IsProxy() {
+			return nil
+		}
+		_, destIP, ok := header.IPs()
+		if !ok {
+			return nil
+		}
+		_, destPort, _ := header.Ports()
+		localIP, localPort := addrIPPort(conn.LocalAddr())
+		if localIP == nil || (localIP.Equal(destIP) && localPort == destPort) {
+			return nil
+		}
+
+		err := fmt.Errorf("%w: %s, local address %s", ErrDestinationMismatch, header.DestinationAddr, conn.LocalAddr())
+		if onMismatch == nil {
+			return err
+		}
+		return onMismatch(err, header, conn)
+	}
+}
+
+// bogonReason describes why ip can't be the address of a client, or returns
+// an empty string if it can.
+func bogonReason(ip net.IP) string {
+	switch {
+	case ip.IsUnspecified():
+		return "unspecified"
+	case ip.IsLoopback():
+		return "loopback"
+	case ip.IsMulticast():
+		return "multicast"
+	case ip.IsLinkLocalUnicast():
+		return "link-local"
+	}
+	for _, n := range bogonNets {
+		if n.Contains(ip) {
+			return "reserved"
+		}
+	}
+	return ""
+}
+
+// addrIPPort returns the IP and port of addr, or a nil IP if it has none.
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP, addr.Port
+	case *net.UDPAddr:
+		return addr.IP, addr.Port
+	case *net.IPAddr:
+		return addr.IP, 0
+	}
+	return nil, 0
+}
+
+// mustParseCIDRs parses the given CIDRs, panicking if one is invalid.
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// RequireWellFormedTLVs is a Validator which rejects headers whose TLVs are
+// ambiguous or malformed per the spec:
+//   - ErrTruncatedTLV is returned if a TLV or a PP2_TYPE_SSL sub-TLV is
+//     truncated;
+//   - ErrDuplicateTLV if a registered type other than PP2_TYPE_NOOP appears
+//     more than once, at the top level or within a PP2_TYPE_SSL TLV;
+//   - ErrMalformedTLV if a PP2_TYPE_SSL TLV is too short, if an SSL subtype
+//     appears at the top level, or if a registered type other than an SSL
+//     subtype or PP2_TYPE_NOOP appears within a PP2_TYPE_SSL TLV.
+//
+// Unregistered types, e.g. application specific ones, may appear more than
+// once.
+func RequireWellFormedTLVs(header *Header) error {
+	var seen [256]bool
+	var tlvErr error
+	err := header.IterateTLVs(func(tlv TLV) bool {
+		if isSSLSubtype(tlv.Type) {
+			tlvErr = fmt.Errorf("%w: SSL subtype 0x%02x outside of an SSL TLV", ErrMalformedTLV, byte(tlv.Type))
+			return false
+		}
+		if tlvErr = checkDuplicateTLV(&seen, tlv.Type); tlvErr != nil {
+			return false
+		}
+		if tlv.Type == PP2_TYPE_SSL {
+			tlvErr = checkSSLSubTLVs(tlv.Value)
+		}
+		return tlvErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return tlvErr
+}
+
+// checkDuplicateTLV returns ErrDuplicateTLV if t is a registered type other
+// than PP2_TYPE_NOOP which has already been seen, and records it otherwise.
+func checkDuplicateTLV(seen *[256]bool, t PP2Type) error {
+	if !t.Registered() || t == PP2_TYPE_NOOP {
+		return nil
+	}
+	if seen[t] {
+		return fmt.Errorf("%w: type 0x%02x", ErrDuplicateTLV, byte(t))
+	}
+	seen[t] = true
+	return nil
+}
+
+// checkSSLSubTLVs checks the sub-TLVs of the value of a PP2_TYPE_SSL TLV,
+// which follow its client and verify fields, see section 2.2.5 of the spec.
+func checkSSLSubTLVs(value []byte) error {
+	// client (1 byte) and verify (4 bytes)
+	if len(value) < 5 {
+		return fmt.Errorf("%w: SSL TLV of %d bytes", ErrMalformedTLV, len(value))
+	}
+	var seen [256]bool
+	var subErr error
+	err := core.IterateTLVs(value[5:], func(b byte, _ []byte) bool {
+		t := PP2Type(b)
+		if t.Registered() && !isSSLSubtype(t) && t != PP2_TYPE_NOOP {
+			subErr = fmt.Errorf("%w: type 0x%02x within an SSL TLV", ErrMalformedTLV, b)
+			return false
+		}
+		subErr = checkDuplicateTLV(&seen, t)
+		return subErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return subErr
+}
+
+// isSSLSubtype returns whether t is a sub-type of PP2_TYPE_SSL.
+func isSSLSubtype(t PP2Type) bool {
+	return t >= PP2_SUBTYPE_SSL_VERSION && t <= PP2_SUBTYPE_SSL_KEY_ALG
+}
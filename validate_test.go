@@ -0,0 +1,276 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"net"
+	"testing"
+)
+
+// awsVPCECapture is a header captured from an AWS Network Load Balancer
+// behind a VPC endpoint, carrying a valid CRC32c checksum.
+var awsVPCECapture = []byte{
+	0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51,
+	0x55, 0x49, 0x54, 0x0a, 0x21, 0x11, 0x00, 0x54,
+	0xc0, 0xa8, 0x2c, 0x0a, 0xc0, 0xa8, 0x2c, 0x07,
+	0xcc, 0x3e, 0x24, 0x1b, 0x03, 0x00, 0x04, 0xb9,
+	0x28, 0x6f, 0xa6, 0xea, 0x00, 0x17, 0x01, 0x76,
+	0x70, 0x63, 0x65, 0x2d, 0x30, 0x30, 0x65, 0x61,
+	0x66, 0x63, 0x34, 0x35, 0x38, 0x65, 0x63, 0x39,
+	0x37, 0x62, 0x38, 0x33, 0x33, 0x04, 0x00, 0x24,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+}
+
+func TestValidatorPresets(t *testing.T) {
+	proxyHeader := &Header{
+		Version:           2,
+		Command:           PROXY,
+		TransportProtocol: TCPv4,
+		SourceAddr:        v4addr,
+		DestinationAddr:   v4addr,
+	}
+	if err := proxyHeader.SetTLVs([]TLV{{Type: PP2_TYPE_AUTHORITY, Value: []byte("example.org")}}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	localHeader := &Header{
+		Version:           2,
+		Command:           LOCAL,
+		TransportProtocol: UNSPEC,
+	}
+
+	tests := []struct {
+		name      string
+		validator Validator
+		header    *Header
+		expected  error
+	}{
+		{"proxy command", RequireProxyCommand, proxyHeader, nil},
+		{"local command", RequireProxyCommand, localHeader, ErrNotProxyCommand},
+		{"address family", RequireAddressFamily(TCPv6, TCPv4), proxyHeader, nil},
+		{"unexpected address family", RequireAddressFamily(TCPv6), proxyHeader, ErrUnexpectedAddressFamily},
+		{"TLV", RequireTLV(PP2_TYPE_AUTHORITY), proxyHeader, nil},
+		{"missing TLV", RequireTLV(PP2_TYPE_ALPN), proxyHeader, ErrMissingTLV},
+		{"missing CRC32c", RequireCRC32c, proxyHeader, ErrMissingTLV},
+		{"all", ValidateAll(RequireProxyCommand, nil, RequireTLV(PP2_TYPE_AUTHORITY)), proxyHeader, nil},
+		{"all failing", ValidateAll(RequireProxyCommand, RequireTLV(PP2_TYPE_AUTHORITY)), localHeader, ErrNotProxyCommand},
+		{"none", ValidateAll(), localHeader, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.validator(tt.header); !errors.Is(err, tt.expected) {
+				t.Fatalf("expected %v, actual %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestRequireCRC32c(t *testing.T) {
+	header, err := Read(bufio.NewReader(bytes.NewReader(awsVPCECapture)))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := RequireCRC32c(header); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	corrupted := append([]byte(nil), awsVPCECapture...)
+	corrupted[len(corrupted)-1] = 0x01 // in the NOOP TLV
+	header, err = Read(bufio.NewReader(bytes.NewReader(corrupted)))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := RequireCRC32c(header); err != ErrInvalidCRC32c {
+		t.Fatalf("expected %v, actual %v", ErrInvalidCRC32c, err)
+	}
+
+	header = &Header{
+		Version:           2,
+		Command:           LOCAL,
+		TransportProtocol: UNSPEC,
+	}
+	if err := header.SetTLVs([]TLV{{Type: PP2_TYPE_CRC32C, Value: []byte{0, 0}}}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := RequireCRC32c(header); err != ErrMalformedTLV {
+		t.Fatalf("expected %v, actual %v", ErrMalformedTLV, err)
+	}
+}
+
+func TestRequireCRC32cRoundTrip(t *testing.T) {
+	header := &Header{
+		Version:           2,
+		Command:           PROXY,
+		TransportProtocol: TCPv6,
+		SourceAddr:        v6addr,
+		DestinationAddr:   v6addr,
+	}
+	if err := header.SetTLVs([]TLV{{Type: PP2_TYPE_CRC32C, Value: make([]byte, 4)}}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	buf, err := header.Format()
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	sum := crc32.Checksum(buf, crc32.MakeTable(crc32.Castagnoli))
+	checksum := []byte{byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)}
+	if err := header.SetTLVs([]TLV{{Type: PP2_TYPE_CRC32C, Value: checksum}}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := RequireCRC32c(header); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+}
+
+func TestRequireWellFormedTLVs(t *testing.T) {
+	ssl := func(subTLVs ...TLV) TLV {
+		raw, err := JoinTLVs(subTLVs)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return TLV{Type: PP2_TYPE_SSL, Value: append([]byte{0x01, 0, 0, 0, 0}, raw...)}
+	}
+	version := TLV{Type: PP2_SUBTYPE_SSL_VERSION, Value: []byte("TLSv1.3")}
+	authority := TLV{Type: PP2_TYPE_AUTHORITY, Value: []byte("example.org")}
+	noop := TLV{Type: PP2_TYPE_NOOP, Value: []byte{0}}
+	custom := TLV{Type: PP2_TYPE_MIN_CUSTOM, Value: []byte("custom")}
+
+	tests := []struct {
+		name     string
+		tlvs     []TLV
+		expected error
+	}{
+		{"none", nil, nil},
+		{"unique", []TLV{authority, ssl(version), noop}, nil},
+		{"repeated unregistered and no-op", []TLV{custom, noop, custom, noop}, nil},
+		{"duplicate", []TLV{authority, noop, authority}, ErrDuplicateTLV},
+		{"duplicate SSL", []TLV{ssl(version), ssl(version)}, ErrDuplicateTLV},
+		{"duplicate SSL subtype", []TLV{ssl(version, version)}, ErrDuplicateTLV},
+		{"SSL subtype outside of SSL", []TLV{version}, ErrMalformedTLV},
+		{"registered type within SSL", []TLV{ssl(version, authority)}, ErrMalformedTLV},
+		{"short SSL", []TLV{{Type: PP2_TYPE_SSL, Value: []byte{0x01}}}, ErrMalformedTLV},
+		{"truncated SSL subtype", []TLV{{Type: PP2_TYPE_SSL, Value: []byte{0x01, 0, 0, 0, 0, 0x21, 0, 5}}}, ErrTruncatedTLV},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := HeaderProxyFromAddrs(2, v4addr, v4addr)
+			if err := header.SetTLVs(tt.tlvs); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if err := header.Validate(RequireWellFormedTLVs); !errors.Is(err, tt.expected) {
+				t.Fatalf("expected %v, actual %v", tt.expected, err)
+			}
+		})
+	}
+
+	// Truncated TLVs
+	header := HeaderProxyFromAddrs(2, v4addr, v4addr)
+	header.rawTLVs = []byte{byte(PP2_TYPE_AUTHORITY), 0, 5}
+	if err := RequireWellFormedTLVs(header); !errors.Is(err, ErrTruncatedTLV) {
+		t.Fatalf("expected %v, actual %v", ErrTruncatedTLV, err)
+	}
+}
+
+func TestRejectSpoofedSource(t *testing.T) {
+	own := []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("198.100.1.1"), Port: 443},
+		&net.TCPAddr{IP: net.ParseIP("2a00::1")},
+		&net.TCPAddr{IP: net.IPv4zero, Port: 80},
+	}
+	validator := RejectSpoofedSource(own...)
+	fromSource := func(source string, port int) *Header {
+		return HeaderProxyFromAddrs(2,
+			&net.TCPAddr{IP: net.ParseIP(source), Port: port},
+			&net.TCPAddr{IP: net.ParseIP("198.100.1.1"), Port: 443})
+	}
+
+	var cases = []struct {
+		name        string
+		header      *Header
+		expectedErr error
+	}{
+		{"public IPv4", fromSource("198.100.2.2", 1000), nil},
+		{"public IPv6", fromSource("2a00::2", 1000), nil},
+		{"private IPv4", fromSource("10.1.1.1", 1000), nil},
+		{"unique local IPv6", fromSource("fd00::1", 1000), nil},
+		{"own IP on other port", fromSource("198.100.1.1", 1000), nil},
+		{"unspecified own IP", fromSource("198.100.3.3", 80), nil},
+		{"LOCAL", NewLocalHeader(), nil},
+		{"loopback", fromSource("127.0.0.1", 1000), ErrSpoofedSourceAddress},
+		{"IPv4-mapped loopback", fromSource("::ffff:127.0.0.1", 1000), ErrSpoofedSourceAddress},
+		{"IPv6 loopback", fromSource("::1", 1000), ErrSpoofedSourceAddress},
+		{"unspecified", fromSource("0.0.0.0", 1000), ErrSpoofedSourceAddress},
+		{"this network", fromSource("0.1.2.3", 1000), ErrSpoofedSourceAddress},
+		{"multicast", fromSource("224.0.0.1", 1000), ErrSpoofedSourceAddress},
+		{"IPv6 multicast", fromSource("ff02::1", 1000), ErrSpoofedSourceAddress},
+		{"link-local", fromSource("169.254.1.1", 1000), ErrSpoofedSourceAddress},
+		{"IPv6 link-local", fromSource("fe80::1", 1000), ErrSpoofedSourceAddress},
+		{"documentation", fromSource("192.0.2.1", 1000), ErrSpoofedSourceAddress},
+		{"IPv6 documentation", fromSource("2001:db8::1", 1000), ErrSpoofedSourceAddress},
+		{"broadcast", fromSource("255.255.255.255", 1000), ErrSpoofedSourceAddress},
+		{"own address", fromSource("198.100.1.1", 443), ErrSpoofedSourceAddress},
+		{"own IP without port", fromSource("2a00::1", 1000), ErrSpoofedSourceAddress},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := validator(tc.header); !errors.Is(err, tc.expectedErr) || (err == nil) != (tc.expectedErr == nil) {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestCheckDestination(t *testing.T) {
+	local := &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000}
+	toDest := func(dest string, port int) *Header {
+		return HeaderProxyFromAddrs(2,
+			&net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000},
+			&net.TCPAddr{IP: net.ParseIP(dest), Port: port})
+	}
+
+	var cases = []struct {
+		name        string
+		header      *Header
+		local       net.Addr
+		expectedErr error
+	}{
+		{"matching", toDest("20.2.2.2", 2000), local, nil},
+		{"IPv4-mapped", toDest("::ffff:20.2.2.2", 2000), local, nil},
+		{"other IP", toDest("30.3.3.3", 2000), local, ErrDestinationMismatch},
+		{"other port", toDest("20.2.2.2", 3000), local, ErrDestinationMismatch},
+		{"LOCAL", NewLocalHeader(), local, nil},
+		{"non-IP local address", toDest("30.3.3.3", 2000), &net.UnixAddr{Net: "unix", Name: "sock"}, nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := addrConn{local: tc.local}
+			if err := CheckDestination(nil)(tc.header, conn); !errors.Is(err, tc.expectedErr) || (err == nil) != (tc.expectedErr == nil) {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+
+			var logged error
+			err := CheckDestination(func(err error, header *Header, c net.Conn) error {
+				if header != tc.header || c != conn {
+					t.Fatalf("Unexpected header %v and connection %v", header, c)
+				}
+				logged = err
+				return nil
+			})(tc.header, conn)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if !errors.Is(logged, tc.expectedErr) || (logged == nil) != (tc.expectedErr == nil) {
+				t.Fatalf("Expected logged error %v, got %v", tc.expectedErr, logged)
+			}
+		})
+	}
+}
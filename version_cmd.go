@@ -1,5 +1,7 @@
 package proxyproto
 
+import "fmt"
+
 // ProtocolVersionAndCommand represents the command in proxy protocol v2.
 // Command doesn't exist in v1 but it should be set since other parts of
 // this library may rely on it for determining connection details.
@@ -14,9 +16,35 @@ const (
 	PROXY ProtocolVersionAndCommand = '\x21'
 )
 
-var supportedCommand = map[ProtocolVersionAndCommand]bool{
-	LOCAL: true,
-	PROXY: true,
+// supportedCommands are the commands supported by this library.
+var supportedCommands = []ProtocolVersionAndCommand{LOCAL, PROXY}
+
+// SupportedCommands returns the commands supported by this library, LOCAL and
+// PROXY. The returned slice is a copy and may be modified.
+func SupportedCommands() []ProtocolVersionAndCommand {
+	return append([]ProtocolVersionAndCommand{}, supportedCommands...)
+}
+
+// IsSupported returns true if the command is supported by this library, see
+// SupportedCommands, false otherwise.
+func (pvc ProtocolVersionAndCommand) IsSupported() bool {
+	for _, supported := range supportedCommands {
+		if pvc == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the name of the command, "LOCAL" or "PROXY".
+func (pvc ProtocolVersionAndCommand) String() string {
+	switch pvc {
+	case LOCAL:
+		return "LOCAL"
+	case PROXY:
+		return "PROXY"
+	}
+	return fmt.Sprintf("ProtocolVersionAndCommand(%#02x)", byte(pvc))
 }
 
 // IsLocal returns true if the command in v2 is LOCAL or the transport in v1 is UNKNOWN,
@@ -41,3 +41,34 @@ func TestInvalidProtocolVersion(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestProtocolVersionAndCommandString(t *testing.T) {
+	for pvc, expected := range map[ProtocolVersionAndCommand]string{
+		LOCAL: "LOCAL",
+		PROXY: "PROXY",
+		0x22:  "ProtocolVersionAndCommand(0x22)",
+	} {
+		if s := pvc.String(); s != expected {
+			t.Fatalf("expected %q, got %q", expected, s)
+		}
+	}
+}
+
+func TestProtocolVersionAndCommandIsSupported(t *testing.T) {
+	for _, pvc := range SupportedCommands() {
+		if !pvc.IsSupported() {
+			t.Fatalf("expected %v to be supported", pvc)
+		}
+	}
+	for _, pvc := range []ProtocolVersionAndCommand{0x00, 0x11, 0x22} {
+		if pvc.IsSupported() {
+			t.Fatalf("expected %v to be unsupported", pvc)
+		}
+	}
+
+	commands := SupportedCommands()
+	commands[0] = 0x22
+	if !LOCAL.IsSupported() {
+		t.Fatalf("modifying SupportedCommands shouldn't change the supported commands")
+	}
+}